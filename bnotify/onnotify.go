@@ -4,9 +4,12 @@
 package bnotify
 
 import (
+	"Service/config"
 	"Service/db"
+	"Service/health"
 	"Service/log"
 	"fmt"
+	"os"
 	"runtime/debug"
 	"strconv"
 	"strings"
@@ -61,16 +64,21 @@ const (
 	ActionEnable  = "enable"
 	ActionDisable = "disable"
 	ActionSet     = "set"
+	ActionReload  = "reload"
 )
 
 const (
 	EntityPprof    = "pprof"
 	EntityExpvar   = "expvar"
 	EntityLogLevel = "loglevel"
+	EntityDrain    = "drain"
+	EntityConfig   = "config"
 )
 
 // 执行后台系统命令
 // command:action.entity[.value]
+// reload.config重新加载配置文件
+// enable.drain让所有订阅的进程drain，enable.drain.pid只让这个pid的进程drain
 func doAction(command string) (err error) {
 	s := strings.Split(command, ".")
 	var action, entity string
@@ -95,6 +103,10 @@ func doAction(command string) (err error) {
 		switch entity {
 		case EntityPprof:
 			pprof.Activate()
+		case EntityDrain:
+			if value == 0 || value == int64(os.Getpid()) {
+				health.Drain("bnotify " + command)
+			}
 		default:
 			return fmt.Errorf("command(%s).entity is invalid", command)
 		}
@@ -112,6 +124,13 @@ func doAction(command string) (err error) {
 		default:
 			return fmt.Errorf("command(%s).entity is invalid", command)
 		}
+	case ActionReload:
+		switch entity {
+		case EntityConfig:
+			config.ReloadConfig()
+		default:
+			return fmt.Errorf("command(%s).entity is invalid", command)
+		}
 	default:
 		return fmt.Errorf("command(%s).action is invalid", command)
 	}
@@ -0,0 +1,183 @@
+// Package clickstore click缓存、postback去重、cap计数等key-value数据的存储
+//
+// 按用途分为几个role，每个role可以在[CLICKSTORE]里面单独配置后端:
+//
+//	local  = redis  本机的click缓存，postback去重，访问频次等，默认LOCALREQCACHE
+//	remote = mysql  所有机器共享的click缓存，默认REMOTEREQCACHE
+//	shared = redis  所有机器共享的计数，如cap，默认MSGQUEUE
+//
+// 后端可以是redis/mysql/disk/memory，remote还可以是none。
+// 单机部署可以全部用disk，不需要redis和MySQL；测试的时候用Set换成memory。
+package clickstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"Service/config"
+	"Service/log"
+)
+
+// ErrNotFound key不存在或者已经过期
+var ErrNotFound = errors.New("clickstore: key not found")
+
+const (
+	Local  = "local"
+	Remote = "remote"
+	Shared = "shared"
+)
+
+const (
+	KindRedis  = "redis"
+	KindMySQL  = "mysql"
+	KindDisk   = "disk"
+	KindMemory = "memory"
+	KindNone   = "none"
+)
+
+// ClickStore key-value存储
+type ClickStore interface {
+	// Get key不存在或者已经过期时返回ErrNotFound
+	Get(key string) (string, error)
+	// GetWithTTL 同时返回剩余的过期时间，ttl<=0表示不过期或者后端不记录过期时间
+	GetWithTTL(key string) (value string, ttl time.Duration, err error)
+	// MGet 不存在的key对应的值为""
+	MGet(keys ...string) ([]string, error)
+	// Set ttl<=0表示不过期
+	Set(key, value string, ttl time.Duration) error
+	// SetMulti 批量Set，后端支持的话一次写入
+	SetMulti(items []Item) error
+	// SetNX key不存在时才设置，返回是否设置成功
+	SetNX(key, value string, ttl time.Duration) (bool, error)
+	// IncrByFloat 计数，返回计数之后的值，key第一次创建的时候设置ttl
+	IncrByFloat(key string, delta float64, ttl time.Duration) (float64, error)
+	// IncrMulti 批量IncrByFloat，不返回计数之后的值，后端支持的话一次写入
+	IncrMulti(items []Incr) error
+	Del(key string) error
+	Close() error
+}
+
+// Item SetMulti的一条数据
+type Item struct {
+	Key   string
+	Value string
+	TTL   time.Duration
+}
+
+// Incr IncrMulti的一条计数
+type Incr struct {
+	Key   string
+	Delta float64
+	TTL   time.Duration
+}
+
+var defaults = map[string]struct {
+	kind  string
+	title string // redis/mysql用的配置section
+}{
+	Local:  {KindRedis, "LOCALREQCACHE"},
+	Remote: {KindMySQL, "REMOTEREQCACHE"},
+	Shared: {KindRedis, "MSGQUEUE"},
+}
+
+var mu sync.Mutex // protects the following
+var stores = make(map[string]ClickStore)
+
+// Kind role配置的后端
+func Kind(role string) string {
+	if k := config.String("CLICKSTORE", role); k != "" {
+		return k
+	}
+	return defaults[role].kind
+}
+
+// Get 返回role对应的存储，没有配置(none)或者创建失败时返回nil，失败的下次调用会重试
+func Get(role string) ClickStore {
+	mu.Lock()
+	defer mu.Unlock()
+	if s, ok := stores[role]; ok {
+		return s
+	}
+	s, err := open(role, Kind(role))
+	if err != nil {
+		log.Errorf("[clickstore][Get]open %s store failed:%v\n", role, err)
+		return nil
+	}
+	if s != nil {
+		stores[role] = s
+	}
+	return s
+}
+
+// Set 替换role对应的存储，主要给测试使用
+func Set(role string, s ClickStore) {
+	mu.Lock()
+	defer mu.Unlock()
+	if s == nil {
+		delete(stores, role)
+		return
+	}
+	stores[role] = s
+}
+
+// CloseAll 关闭所有已经打开的存储，disk的会把数据刷到磁盘
+func CloseAll() {
+	mu.Lock()
+	defer mu.Unlock()
+	for role, s := range stores {
+		if err := s.Close(); err != nil {
+			log.Errorf("[clickstore][CloseAll]close %s store failed:%v\n", role, err)
+		}
+		delete(stores, role)
+	}
+}
+
+const pingKey = "__clickstore_ping__"
+
+// Ping 检查role对应的存储是否可用，没有配置(none)的返回nil
+func Ping(role string) error {
+	if Kind(role) == KindNone {
+		return nil
+	}
+	s := Get(role)
+	if s == nil {
+		return fmt.Errorf("%s %s store is not available", role, Kind(role))
+	}
+	if _, err := s.Get(pingKey); err != nil && err != ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+func open(role, kind string) (ClickStore, error) {
+	d, ok := defaults[role]
+	if !ok {
+		return nil, fmt.Errorf("unknown role %s", role)
+	}
+	switch kind {
+	case KindRedis:
+		return NewRedisStore(d.title)
+	case KindMySQL:
+		return NewMySQLStore(d.title)
+	case KindDisk:
+		dir := config.String("CLICKSTORE", "dir")
+		if dir == "" {
+			dir = "clickstore"
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		return OpenDiskStore(filepath.Join(dir, role+".db"))
+	case KindMemory:
+		return NewMemoryStore(), nil
+	case KindNone:
+		if role == Remote {
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported %s store kind %s", role, kind)
+}
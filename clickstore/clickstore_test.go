@@ -0,0 +1,219 @@
+package clickstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testStore(t *testing.T, s ClickStore) {
+	if _, err := s.Get("a"); err != ErrNotFound {
+		t.Errorf("Get missing key err = %v, want ErrNotFound", err)
+	}
+
+	if err := s.Set("a", "1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.Get("a"); err != nil || v != "1" {
+		t.Errorf("Get a = %q,%v", v, err)
+	}
+
+	if ok, _ := s.SetNX("a", "2", 0); ok {
+		t.Error("SetNX on existing key should fail")
+	}
+	if ok, _ := s.SetNX("b", "2", time.Hour); !ok {
+		t.Error("SetNX on new key should succeed")
+	}
+
+	vs, err := s.MGet("a", "x", "b")
+	if err != nil || len(vs) != 3 || vs[0] != "1" || vs[1] != "" || vs[2] != "2" {
+		t.Errorf("MGet = %v,%v", vs, err)
+	}
+
+	for i, want := range []float64{1.5, 3, 4.5} {
+		v, err := s.IncrByFloat("c", 1.5, time.Hour)
+		if err != nil || v != want {
+			t.Errorf("IncrByFloat #%d = %v,%v want %v", i, v, err, want)
+		}
+	}
+
+	if err := s.IncrMulti([]Incr{{"f", 1.5, time.Hour}, {"g", 2, 0}, {"g", 2, 0}}); err != nil {
+		t.Fatal(err)
+	}
+	if vs, _ := s.MGet("f", "g"); len(vs) != 2 || vs[0] != "1.5" || vs[1] != "4" {
+		t.Errorf("after IncrMulti = %v", vs)
+	}
+
+	if err := s.Del("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("a"); err != ErrNotFound {
+		t.Errorf("Get deleted key err = %v", err)
+	}
+
+	s.Set("e", "x", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, err := s.Get("e"); err != ErrNotFound {
+		t.Errorf("Get expired key err = %v", err)
+	}
+	if ok, _ := s.SetNX("e", "y", 0); !ok {
+		t.Error("SetNX on expired key should succeed")
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestDiskStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "local.db")
+
+	s, err := OpenDiskStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+	s.Set("short", "x", time.Millisecond)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// 重新打开之后数据还在，删除和过期的key没有了
+	s, err = OpenDiskStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	vs, _ := s.MGet("a", "b", "c", "e", "short")
+	want := []string{"", "2", "4.5", "y", ""}
+	for i := range want {
+		if vs[i] != want[i] {
+			t.Errorf("after reopen MGet = %q, want %q", vs, want)
+			break
+		}
+	}
+}
+
+func TestDiskStoreTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "local.db")
+
+	s, _ := OpenDiskStore(path)
+	s.Set("a", "1", 0)
+	s.Set("b", "2", 0)
+	s.Close()
+
+	// 模拟最后一条记录只写了一半
+	fi, _ := os.Stat(path)
+	os.Truncate(path, fi.Size()-1)
+
+	s, err = OpenDiskStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, _ := s.Get("a"); v != "1" {
+		t.Errorf("Get a = %q after truncation", v)
+	}
+}
+
+func TestDiskStoreCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "local.db")
+
+	old := compactMin
+	compactMin = 10
+	defer func() { compactMin = old }()
+
+	s, err := OpenDiskStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 反复改同一批key，日志会在后台重写很多次，同时还有并发的读写
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			s.Get(fmt.Sprintf("k%d", i%5))
+		}
+	}()
+	for i := 0; i < 2000; i++ {
+		s.Set(fmt.Sprintf("k%d", i%5), strconv.Itoa(i), 0)
+		if i%7 == 0 {
+			s.Del("gone")
+			s.Set("gone", "x", 0)
+		}
+	}
+	s.Del("gone")
+	<-done
+
+	// 等正在进行的重写完成，它会带上重写期间的所有修改；再写一次触发新的重写，
+	// 这次期间没有别的修改，日志里面只剩下快照
+	ds := s.(*diskStore)
+	ds.compactWG.Wait()
+	s.Set("k4", "1999", 0)
+	ds.compactWG.Wait()
+	ds.mu.Lock()
+	records, keys := ds.records, len(ds.m)
+	ds.mu.Unlock()
+	if records > 2*keys+compactMin {
+		t.Errorf("log should be compacted, %d records for %d keys", records, keys)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("second Close = %v", err)
+	}
+
+	s, err = OpenDiskStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	vs, _ := s.MGet("k0", "k1", "k2", "k3", "k4", "gone")
+	want := []string{"1995", "1996", "1997", "1998", "1999", ""}
+	for i := range want {
+		if vs[i] != want[i] {
+			t.Errorf("after compact MGet = %q, want %q", vs, want)
+			break
+		}
+	}
+}
+
+func TestExpireAtSec(t *testing.T) {
+	now := time.Unix(1000, 500)
+	cases := []struct {
+		ttl  time.Duration
+		want int64
+	}{
+		{0, 0},
+		{-time.Second, 0},
+		{time.Millisecond, 1001},
+		{time.Second, 1002},
+		{time.Hour, 4601},
+	}
+	for _, c := range cases {
+		if got := expireAtSec(now, c.ttl); got != c.want {
+			t.Errorf("expireAtSec(%v) = %d, want %d", c.ttl, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package clickstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"Service/log"
+)
+
+const (
+	opSet byte = 'S'
+	opDel byte = 'D'
+
+	flushInterval = time.Second
+)
+
+// compactMin 日志里面的记录数超过 2*有效key数+compactMin 的时候重写日志，测试的时候改小
+var compactMin = 100000
+
+var errBadRecord = errors.New("clickstore: bad disk record")
+
+// diskStore 数据在内存中，所有修改追加写到日志文件，打开的时候重放日志
+// 日志每秒刷一次盘，进程崩溃最多丢失1秒的修改
+// 所有没有过期的key都在内存里面，只适合单机部署，key的数量由ttl限制；数据量大的用redis/mysql
+// 日志太长的时候在后台从快照重写，重写期间的修改照常追加到原来的日志，同时记在pending里面，
+// 重写完之后追加到新文件再替换，任何时候崩溃原来的日志或者新文件都是完整的
+type diskStore struct {
+	*memoryStore
+	path     string
+	f        *os.File
+	w        *bufio.Writer
+	records  int // 日志里面的记录数
+	buf      []byte
+	stop     chan struct{}
+	done     chan struct{}
+	writeErr error
+
+	compacting bool     // 后台正在重写日志
+	pending    [][]byte // 重写开始之后的记录
+	compactWG  sync.WaitGroup
+	closed     bool
+	closeOnce  sync.Once
+	closeErr   error
+}
+
+// OpenDiskStore 打开path的存储，文件不存在时创建
+func OpenDiskStore(path string) (ClickStore, error) {
+	s := &diskStore{
+		memoryStore: newMemoryStore(),
+		path:        path,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	// 还没有开始使用，直接重写
+	f, w, n, err := writeSnapshot(s.path+".tmp", s.m)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.install(f, w, n, nil); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	s.onSet = s.appendSet
+	s.onDel = s.appendDel
+	go s.flushing()
+	return s, nil
+}
+
+// load 重放日志，最后一条记录不完整(写到一半崩溃)时忽略
+func (s *diskStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := time.Now().UnixNano()
+	r := bufio.NewReader(f)
+	for {
+		op, key, e, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			log.Errorf("[clickstore][load]%s is truncated after %d records:%v\n", s.path, s.records, err)
+			return nil
+		}
+		s.records++
+		switch op {
+		case opSet:
+			if e.expired(now) {
+				delete(s.m, key)
+			} else {
+				s.m[key] = e
+			}
+		case opDel:
+			delete(s.m, key)
+		}
+	}
+}
+
+func readRecord(r *bufio.Reader) (op byte, key string, e entry, err error) {
+	if op, err = r.ReadByte(); err != nil {
+		return
+	}
+	if op != opSet && op != opDel {
+		err = errBadRecord
+		return
+	}
+	if key, err = readString(r); err != nil {
+		return
+	}
+	if op == opDel {
+		return
+	}
+	if e.expireAt, err = binary.ReadVarint(r); err != nil {
+		return
+	}
+	e.value, err = readString(r)
+	return
+}
+
+func readString(r *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (s *diskStore) record(op byte, key string, e entry) []byte {
+	s.buf = appendRecord(s.buf[:0], op, key, e)
+	return s.buf
+}
+
+func appendRecord(b []byte, op byte, key string, e entry) []byte {
+	b = append(b, op)
+	b = appendUvarint(b, uint64(len(key)))
+	b = append(b, key...)
+	if op == opSet {
+		var tmp [binary.MaxVarintLen64]byte
+		n := binary.PutVarint(tmp[:], e.expireAt)
+		b = append(b, tmp[:n]...)
+		b = appendUvarint(b, uint64(len(e.value)))
+		b = append(b, e.value...)
+	}
+	return b
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(b, tmp[:n]...)
+}
+
+func (s *diskStore) append(b []byte) {
+	if _, err := s.w.Write(b); err != nil {
+		if s.writeErr == nil {
+			log.Errorf("[clickstore][append]write %s failed:%v\n", s.path, err)
+		}
+		s.writeErr = err
+		return
+	}
+	s.records++
+	if s.compacting {
+		s.pending = append(s.pending, append([]byte(nil), b...))
+	} else if !s.closed && s.records > 2*len(s.m)+compactMin {
+		s.startCompact()
+	}
+}
+
+func (s *diskStore) appendSet(key string, e entry) {
+	s.append(s.record(opSet, key, e))
+}
+
+func (s *diskStore) appendDel(key string) {
+	s.append(s.record(opDel, key, entry{}))
+}
+
+// startCompact 复制一份快照在后台重写日志；调用时需要持有锁
+// 复制map比写文件和fsync快得多，不会长时间挡住其它的读写
+func (s *diskStore) startCompact() {
+	now := time.Now().UnixNano()
+	snap := make(map[string]entry, len(s.m))
+	for k, e := range s.m {
+		if !e.expired(now) {
+			snap[k] = e
+		}
+	}
+	s.compacting = true
+	s.compactWG.Add(1)
+	go s.compactBackground(snap)
+}
+
+func (s *diskStore) compactBackground(snap map[string]entry) {
+	defer s.compactWG.Done()
+	f, w, n, err := writeSnapshot(s.path+".tmp", snap)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.pending
+	s.pending = nil
+	s.compacting = false
+	if err == nil && s.closed {
+		// 修改都已经在原来的日志里面了，下次打开的时候再重写
+		err = errors.New("store closed")
+	}
+	if err == nil {
+		err = s.install(f, w, n, pending)
+	}
+	if err != nil {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+		log.Errorf("[clickstore][compact]compact %s failed:%v\n", s.path, err)
+	}
+}
+
+// writeSnapshot 把snap中没有过期的数据写到tmp，返回还没有sync的文件
+func writeSnapshot(tmp string, snap map[string]entry) (f *os.File, w *bufio.Writer, n int, err error) {
+	if f, err = os.Create(tmp); err != nil {
+		return nil, nil, 0, err
+	}
+	w = bufio.NewWriter(f)
+	now := time.Now().UnixNano()
+	var b []byte
+	for k, e := range snap {
+		if e.expired(now) {
+			continue
+		}
+		b = appendRecord(b[:0], opSet, k, e)
+		if _, err = w.Write(b); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return nil, nil, 0, err
+		}
+		n++
+	}
+	return f, w, n, nil
+}
+
+// install 把快照之后的tail追加到f，fsync之后替换掉原来的日志，后面的修改写到新文件
+// 调用时需要持有锁(或者还没有开始使用)；失败时f由调用方清理
+func (s *diskStore) install(f *os.File, w *bufio.Writer, n int, tail [][]byte) (err error) {
+	for _, b := range tail {
+		if _, err = w.Write(b); err != nil {
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), s.path); err != nil {
+		return err
+	}
+	if s.f != nil {
+		// 原来的日志已经被替换掉了，缓冲里面的修改都在tail里面
+		s.f.Close()
+	}
+	s.f, s.w = f, w
+	s.records = n + len(tail)
+	s.writeErr = nil
+	return nil
+}
+
+func (s *diskStore) flushing() {
+	defer close(s.done)
+	t := time.NewTicker(flushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.mu.Lock()
+			if err := s.w.Flush(); err != nil {
+				log.Errorf("[clickstore][flushing]flush %s failed:%v\n", s.path, err)
+			}
+			s.mu.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Close 可以调用多次，后面的调用返回第一次的结果
+func (s *diskStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+		s.mu.Lock()
+		s.closed = true
+		s.mu.Unlock()
+		s.compactWG.Wait()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		err := s.w.Flush()
+		if err == nil {
+			err = s.f.Sync()
+		}
+		if cerr := s.f.Close(); err == nil {
+			err = cerr
+		}
+		s.closeErr = err
+	})
+	return s.closeErr
+}
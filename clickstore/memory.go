@@ -0,0 +1,199 @@
+package clickstore
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 每隔多少次写操作清理一次过期的key
+const sweepEvery = 10000
+
+type entry struct {
+	value    string
+	expireAt int64 // UnixNano，0表示不过期
+}
+
+func (e entry) expired(now int64) bool {
+	return e.expireAt != 0 && e.expireAt <= now
+}
+
+func expireAt(now int64, ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return now + int64(ttl)
+}
+
+// memoryStore 进程内的存储，重启之后数据丢失
+type memoryStore struct {
+	mu     sync.Mutex
+	m      map[string]entry
+	writes int
+
+	// onSet/onDel 在持有锁的时候调用，disk用来写日志
+	onSet func(key string, e entry)
+	onDel func(key string)
+}
+
+// NewMemoryStore 进程内的存储，单机测试用
+func NewMemoryStore() ClickStore {
+	return newMemoryStore()
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{m: make(map[string]entry)}
+}
+
+func (s *memoryStore) get(key string, now int64) (entry, bool) {
+	e, ok := s.m[key]
+	if !ok {
+		return e, false
+	}
+	if e.expired(now) {
+		s.del(key)
+		return e, false
+	}
+	return e, true
+}
+
+func (s *memoryStore) set(key string, e entry) {
+	s.m[key] = e
+	if s.onSet != nil {
+		s.onSet(key, e)
+	}
+	s.writes++
+	if s.writes%sweepEvery == 0 {
+		s.sweep(time.Now().UnixNano())
+	}
+}
+
+func (s *memoryStore) del(key string) {
+	if _, ok := s.m[key]; !ok {
+		return
+	}
+	delete(s.m, key)
+	if s.onDel != nil {
+		s.onDel(key)
+	}
+}
+
+func (s *memoryStore) sweep(now int64) {
+	for k, e := range s.m {
+		if e.expired(now) {
+			s.del(k)
+		}
+	}
+}
+
+func (s *memoryStore) Get(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.get(key, time.Now().UnixNano())
+	if !ok {
+		return "", ErrNotFound
+	}
+	return e.value, nil
+}
+
+func (s *memoryStore) GetWithTTL(key string) (string, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UnixNano()
+	e, ok := s.get(key, now)
+	if !ok {
+		return "", 0, ErrNotFound
+	}
+	var ttl time.Duration
+	if e.expireAt != 0 {
+		ttl = time.Duration(e.expireAt - now)
+	}
+	return e.value, ttl, nil
+}
+
+func (s *memoryStore) MGet(keys ...string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UnixNano()
+	values := make([]string, len(keys))
+	for i, k := range keys {
+		e, _ := s.get(k, now)
+		values[i] = e.value
+	}
+	return values, nil
+}
+
+func (s *memoryStore) Set(key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(key, entry{value, expireAt(time.Now().UnixNano(), ttl)})
+	return nil
+}
+
+func (s *memoryStore) SetMulti(items []Item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UnixNano()
+	for _, it := range items {
+		s.set(it.Key, entry{it.Value, expireAt(now, it.TTL)})
+	}
+	return nil
+}
+
+func (s *memoryStore) SetNX(key, value string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UnixNano()
+	if _, ok := s.get(key, now); ok {
+		return false, nil
+	}
+	s.set(key, entry{value, expireAt(now, ttl)})
+	return true, nil
+}
+
+func (s *memoryStore) IncrByFloat(key string, delta float64, ttl time.Duration) (float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.incr(key, delta, ttl, time.Now().UnixNano())
+}
+
+func (s *memoryStore) IncrMulti(items []Incr) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UnixNano()
+	for _, it := range items {
+		if _, err := s.incr(it.Key, it.Delta, it.TTL, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// incr 调用时需要持有锁
+func (s *memoryStore) incr(key string, delta float64, ttl time.Duration, now int64) (float64, error) {
+	e, ok := s.get(key, now)
+	var v float64
+	if ok {
+		var err error
+		if v, err = strconv.ParseFloat(e.value, 64); err != nil {
+			return 0, err
+		}
+	} else {
+		e.expireAt = expireAt(now, ttl)
+	}
+	v += delta
+	e.value = strconv.FormatFloat(v, 'f', -1, 64)
+	s.set(key, e)
+	return v, nil
+}
+
+func (s *memoryStore) Del(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.del(key)
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,258 @@
+package clickstore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"Service/db"
+	"Service/log"
+)
+
+const (
+	maxBatchRows = 500
+
+	// 每隔sweepInterval删除一次过期的行，每条DELETE最多删sweepRows行，避免长时间锁表
+	sweepInterval = 10 * time.Minute
+	sweepRows     = 1000
+)
+
+// mysqlStore 使用Cache.ReqCache表，expireAt为过期的unix时间戳(秒)，0为不过期
+// 读的时候过滤掉过期的行，后台定时删除
+type mysqlStore struct {
+	db     *sql.DB
+	setStm *sql.Stmt
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewMySQLStore 使用title配置的MySQL
+func NewMySQLStore(title string) (ClickStore, error) {
+	d := db.GetDB(title)
+	if d == nil {
+		return nil, fmt.Errorf("%s DB does not exist", title)
+	}
+	stmt, err := d.Prepare("INSERT INTO Cache.ReqCache(clickId,value,expireAt) VALUES(?,?,?) ON DUPLICATE KEY UPDATE value=VALUES(value),expireAt=VALUES(expireAt)")
+	if err != nil {
+		return nil, err
+	}
+	s := &mysqlStore{db: d, setStm: stmt, stop: make(chan struct{}), done: make(chan struct{})}
+	go s.sweeping()
+	return s, nil
+}
+
+// expireAtSec ttl<=0不过期，不足一秒的按一秒算
+func expireAtSec(now time.Time, ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return now.Add(ttl + time.Second - 1).Unix()
+}
+
+func (s *mysqlStore) get(key string, now int64) (v string, expireAt int64, err error) {
+	err = s.db.QueryRow("SELECT value,expireAt FROM Cache.ReqCache WHERE clickId=? AND (expireAt=0 OR expireAt>?)", key, now).Scan(&v, &expireAt)
+	if err == sql.ErrNoRows {
+		return "", 0, ErrNotFound
+	}
+	return v, expireAt, err
+}
+
+func (s *mysqlStore) Get(key string) (string, error) {
+	v, _, err := s.get(key, time.Now().Unix())
+	return v, err
+}
+
+func (s *mysqlStore) GetWithTTL(key string) (string, time.Duration, error) {
+	now := time.Now()
+	v, expireAt, err := s.get(key, now.Unix())
+	if err != nil || expireAt == 0 {
+		return v, 0, err
+	}
+	return v, time.Unix(expireAt, 0).Sub(now), nil
+}
+
+func (s *mysqlStore) MGet(keys ...string) ([]string, error) {
+	values := make([]string, len(keys))
+	for i, k := range keys {
+		v, err := s.Get(k)
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+func (s *mysqlStore) Set(key, value string, ttl time.Duration) error {
+	_, err := s.setStm.Exec(key, value, expireAtSec(time.Now(), ttl))
+	return err
+}
+
+// SetMulti 拼成一条多行的INSERT，单条语句最多maxBatchRows行
+func (s *mysqlStore) SetMulti(items []Item) error {
+	now := time.Now()
+	for len(items) > 0 {
+		n := len(items)
+		if n > maxBatchRows {
+			n = maxBatchRows
+		}
+		var b bytes.Buffer
+		args := make([]interface{}, 0, 3*n)
+		b.WriteString("INSERT INTO Cache.ReqCache(clickId,value,expireAt) VALUES")
+		for i, it := range items[:n] {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString("(?,?,?)")
+			args = append(args, it.Key, it.Value, expireAtSec(now, it.TTL))
+		}
+		b.WriteString(" ON DUPLICATE KEY UPDATE value=VALUES(value),expireAt=VALUES(expireAt)")
+		if _, err := s.db.Exec(b.String(), args...); err != nil {
+			return err
+		}
+		items = items[n:]
+	}
+	return nil
+}
+
+// SetNX 已经过期(还没有被删除)的行当作不存在，直接覆盖
+// ON DUPLICATE KEY UPDATE按顺序赋值，value的IF里面用的还是原来的expireAt
+// 插入时RowsAffected为1，覆盖时为2，没有改变时为0
+func (s *mysqlStore) SetNX(key, value string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	r, err := s.db.Exec("INSERT INTO Cache.ReqCache(clickId,value,expireAt) VALUES(?,?,?) ON DUPLICATE KEY UPDATE "+
+		"value=IF(expireAt<>0 AND expireAt<=?,VALUES(value),value),expireAt=IF(expireAt<>0 AND expireAt<=?,VALUES(expireAt),expireAt)",
+		key, value, expireAtSec(now, ttl), now.Unix(), now.Unix())
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	return n == 1 || n == 2, err
+}
+
+// IncrByFloat 一条INSERT ... ON DUPLICATE KEY UPDATE完成计数，不用事务锁行
+// 已经过期(还没有被删除)的行和SetNX一样当作不存在，从delta重新计数
+// 更新的时候计数之后的值赋给会话变量@v，同一个连接上读回来；插入时RowsAffected为1，值就是delta
+func (s *mysqlStore) IncrByFloat(key string, delta float64, ttl time.Duration) (float64, error) {
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	now := time.Now()
+	r, err := conn.ExecContext(ctx, "INSERT INTO Cache.ReqCache(clickId,value,expireAt) VALUES(?,?,?) ON DUPLICATE KEY UPDATE "+
+		"value=(@v:=IF(expireAt<>0 AND expireAt<=?,VALUES(value),value+?)),expireAt=IF(expireAt<>0 AND expireAt<=?,VALUES(expireAt),expireAt)",
+		key, strconv.FormatFloat(delta, 'f', -1, 64), expireAtSec(now, ttl), now.Unix(), delta, now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 1 {
+		return delta, nil
+	}
+	var v string
+	if err := conn.QueryRowContext(ctx, "SELECT @v").Scan(&v); err != nil {
+		return 0, err
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("value of %s is not a number:%v", key, err)
+	}
+	return f, nil
+}
+
+// IncrMulti 和SetMulti一样拼成多行的INSERT，过期的行从delta重新计数，其它的加上delta
+func (s *mysqlStore) IncrMulti(items []Incr) error {
+	now := time.Now()
+	for len(items) > 0 {
+		n := len(items)
+		if n > maxBatchRows {
+			n = maxBatchRows
+		}
+		var b bytes.Buffer
+		args := make([]interface{}, 0, 3*n+2)
+		b.WriteString("INSERT INTO Cache.ReqCache(clickId,value,expireAt) VALUES")
+		for i, it := range items[:n] {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString("(?,?,?)")
+			args = append(args, it.Key, strconv.FormatFloat(it.Delta, 'f', -1, 64), expireAtSec(now, it.TTL))
+		}
+		b.WriteString(" ON DUPLICATE KEY UPDATE value=IF(expireAt<>0 AND expireAt<=?,VALUES(value),value+VALUES(value))," +
+			"expireAt=IF(expireAt<>0 AND expireAt<=?,VALUES(expireAt),expireAt)")
+		args = append(args, now.Unix(), now.Unix())
+		if _, err := s.db.Exec(b.String(), args...); err != nil {
+			return err
+		}
+		items = items[n:]
+	}
+	return nil
+}
+
+func (s *mysqlStore) Del(key string) error {
+	_, err := s.db.Exec("DELETE FROM Cache.ReqCache WHERE clickId=?", key)
+	return err
+}
+
+// sweep 删除所有过期的行，返回删除的行数
+func (s *mysqlStore) sweep(now int64) (deleted int64, err error) {
+	for {
+		r, err := s.db.Exec("DELETE FROM Cache.ReqCache WHERE expireAt<>0 AND expireAt<=? LIMIT ?", now, sweepRows)
+		if err != nil {
+			return deleted, err
+		}
+		n, err := r.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+		if n < sweepRows {
+			return deleted, nil
+		}
+		select {
+		case <-s.stop:
+			return deleted, nil
+		default:
+		}
+	}
+}
+
+func (s *mysqlStore) sweeping() {
+	defer close(s.done)
+	t := time.NewTicker(sweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			n, err := s.sweep(time.Now().Unix())
+			if err != nil {
+				log.Errorf("[clickstore][sweeping]delete expired rows failed after %d:%v\n", n, err)
+			} else if n > 0 {
+				log.Infof("[clickstore][sweeping]%d expired rows deleted\n", n)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Close 可以调用多次，后面的调用返回第一次的结果
+func (s *mysqlStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+		s.closeErr = s.setStm.Close()
+	})
+	return s.closeErr
+}
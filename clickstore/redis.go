@@ -0,0 +1,141 @@
+package clickstore
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"Service/db"
+
+	"github.com/go-redis/redis"
+)
+
+type redisStore struct {
+	cli *redis.Client
+}
+
+// NewRedisStore 使用title配置的redis
+func NewRedisStore(title string) (ClickStore, error) {
+	cli := db.GetRedisClient(title)
+	if cli == nil {
+		return nil, fmt.Errorf("%s redis does not exist", title)
+	}
+	return &redisStore{cli: cli}, nil
+}
+
+func (s *redisStore) Get(key string) (string, error) {
+	v, err := s.cli.Get(key).Result()
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+	return v, err
+}
+
+func (s *redisStore) GetWithTTL(key string) (string, time.Duration, error) {
+	v, err := s.Get(key)
+	if err != nil {
+		return "", 0, err
+	}
+	// 没有过期时间时PTTL返回负数
+	ttl, err := s.cli.PTTL(key).Result()
+	if err != nil || ttl < 0 {
+		ttl = 0
+	}
+	return v, ttl, nil
+}
+
+func (s *redisStore) MGet(keys ...string) ([]string, error) {
+	vs, err := s.cli.MGet(keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, len(keys))
+	for i, v := range vs {
+		if i < len(values) {
+			values[i], _ = v.(string)
+		}
+	}
+	return values, nil
+}
+
+func (s *redisStore) Set(key, value string, ttl time.Duration) error {
+	if ttl < 0 {
+		ttl = 0
+	}
+	return s.cli.Set(key, value, ttl).Err()
+}
+
+// SetMulti 用pipeline一次发出去，只有一次往返
+func (s *redisStore) SetMulti(items []Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	_, err := s.cli.Pipelined(func(p redis.Pipeliner) error {
+		for _, it := range items {
+			ttl := it.TTL
+			if ttl < 0 {
+				ttl = 0
+			}
+			p.Set(it.Key, it.Value, ttl)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) SetNX(key, value string, ttl time.Duration) (bool, error) {
+	if ttl < 0 {
+		ttl = 0
+	}
+	return s.cli.SetNX(key, value, ttl).Result()
+}
+
+// incrByFloatScript INCRBYFLOAT之后还没有过期时间(第一次计数)的设置过期时间，
+// 在一个脚本里面，不会出现计数了但是没有过期时间的key
+const incrByFloatScript = `
+local v = redis.call("INCRBYFLOAT", KEYS[1], ARGV[1])
+if tonumber(ARGV[2]) > 0 and redis.call("PTTL", KEYS[1]) == -1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return v
+`
+
+var incrByFloat = redis.NewScript(incrByFloatScript)
+
+func incrArgs(delta float64, ttl time.Duration) []interface{} {
+	if ttl < 0 {
+		ttl = 0
+	}
+	return []interface{}{strconv.FormatFloat(delta, 'f', -1, 64), int64(ttl / time.Millisecond)}
+}
+
+func (s *redisStore) IncrByFloat(key string, delta float64, ttl time.Duration) (float64, error) {
+	v, err := incrByFloat.Run(s.cli, []string{key}, incrArgs(delta, ttl)...).String()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(v, 64)
+}
+
+// IncrMulti 用pipeline一次发出去，只有一次往返
+func (s *redisStore) IncrMulti(items []Incr) error {
+	if len(items) == 0 {
+		return nil
+	}
+	_, err := s.cli.Pipelined(func(p redis.Pipeliner) error {
+		for _, it := range items {
+			p.Eval(incrByFloatScript, []string{it.Key}, incrArgs(it.Delta, it.TTL)...)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) Del(key string) error {
+	return s.cli.Del(key).Err()
+}
+
+// Close redis client是db包共享的，这里不关闭
+func (s *redisStore) Close() error {
+	return nil
+}
@@ -10,6 +10,7 @@ const (
 	UrlTokenClickId       = "cid"
 	UrlTokenPayout        = "payout"
 	UrlTokenTransactionId = "txid"
+	UrlTokenCost          = "cost"
 )
 
 //http header
@@ -6,6 +6,7 @@ import (
 	//"path/filepath"
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/robfig/config"
 
@@ -20,8 +21,16 @@ var configfile = "development"
 
 var configPath string
 
+var printConfig bool
+
 func init() {
 	flag.StringVar(&configPath, "config", "..\\config\\development.ini", "specify the configuration file")
+	flag.BoolVar(&printConfig, "print-config", false, "print the effective configuration (secrets redacted) and exit")
+}
+
+// PrintConfigRequested 是否指定了-print-config，是的话main应该Print之后退出
+func PrintConfigRequested() bool {
+	return printConfig
 }
 
 func LoadConfig(isFirstTime bool) (err error) {
@@ -99,20 +108,16 @@ func isExist(filePath string) bool {
 	return true
 }
 
+// ReloadConfig 重新加载配置，见Reload
 func ReloadConfig() {
-	LoadConfig(false)
+	if _, err := Reload(); err != nil {
+		log.Errorf("[config][ReloadConfig] reload failed:%v\n", err)
+	}
 }
 
-//String get config string value
+//String get config string value，可以被环境变量或者文件覆盖，见override.go
 func String(section, key string) string {
-	if instance == nil {
-		LoadConfig(false)
-	}
-	configLock.RLock()
-	defer configLock.RUnlock()
-
-	v, err := instance.String(section, key)
-
+	v, err := get(section, key)
 	if err != nil {
 		log.Errorf("Read config string value for section:%v key:%v error:%v\n", section, key, err)
 	}
@@ -122,13 +127,11 @@ func String(section, key string) string {
 
 //Bool  get config bool value
 func Bool(section, key string) bool {
-	if instance == nil {
-		LoadConfig(false)
+	s, err := get(section, key)
+	var v bool
+	if err == nil {
+		v, err = parseBool(s)
 	}
-	configLock.RLock()
-	defer configLock.RUnlock()
-
-	v, err := instance.Bool(section, key)
 	if err != nil {
 		log.Errorf("Read config bool value for section:%v key:%v error:%v", section, key, err)
 	}
@@ -138,13 +141,11 @@ func Bool(section, key string) bool {
 
 //Int get config int value
 func Int(section, key string) int {
-	if instance == nil {
-		LoadConfig(false)
+	s, err := get(section, key)
+	var v int
+	if err == nil {
+		v, err = parseInt(s)
 	}
-	configLock.RLock()
-	defer configLock.RUnlock()
-
-	v, err := instance.Int(section, key)
 	if err != nil {
 		log.Errorf("Read config int value for section:%v, key:%v error:%v\n", section, key, err)
 	}
@@ -153,13 +154,11 @@ func Int(section, key string) int {
 
 //Float  get config float value
 func Float(section, key string) float64 {
-	if instance == nil {
-		LoadConfig(false)
+	s, err := get(section, key)
+	var v float64
+	if err == nil {
+		v, err = parseFloat(s)
 	}
-	configLock.RLock()
-	defer configLock.RUnlock()
-
-	v, err := instance.Float(section, key)
 	if err != nil {
 		log.Errorf("Read config float value for section:%v key:%v error:%v\n", section, key, err)
 	}
@@ -167,6 +166,20 @@ func Float(section, key string) float64 {
 	return v
 }
 
+// LogSettings [LOG]的配置，adapter默认console，jsonconfig默认{"level":7}
+func LogSettings() (adapter, jsonconfig string, async bool) {
+	adapter = String("LOG", "adapter")
+	jsonconfig = String("LOG", "jsonconfig")
+	async = Bool("LOG", "async")
+	if adapter == "" {
+		adapter = "console"
+	}
+	if jsonconfig == "" {
+		jsonconfig = `{"level":7}`
+	}
+	return
+}
+
 func GetEnginePort() string {
 	return String("DEFAULT", "engineport")
 }
@@ -180,9 +193,18 @@ func GetSvrUniqueStr() string {
 }
 
 // InitVars 初始化vars.go里面的变量
+// 没有配置的时候使用默认值，Reload之后删掉的配置也会恢复成默认值
 func InitVars() {
-	reqcachetime := Int("[DEFAULT", "reqcachetime")
+	reqcachetime := Int("DEFAULT", "reqcachetime")
 	if reqcachetime > 0 {
-		ReqCacheTime = time.Duration(reqcachetime) * time.Second
+		atomic.StoreInt64(&reqCacheTime, int64(time.Duration(reqcachetime)*time.Second))
+	} else {
+		atomic.StoreInt64(&reqCacheTime, int64(defaultReqCacheTime))
+	}
+	clickcachetime := Int("DEFAULT", "clickcachetime")
+	if clickcachetime > 0 {
+		atomic.StoreInt64(&clickCacheTime, int64(time.Duration(clickcachetime)*time.Second))
+	} else {
+		atomic.StoreInt64(&clickCacheTime, int64(defaultClickCacheTime))
 	}
 }
@@ -0,0 +1,241 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/robfig/config"
+)
+
+// 配置的覆盖，按顺序查找：
+//
+//	1. 环境变量SERVICE_<SECTION>_<KEY>，如[DB] pass对应SERVICE_DB_PASS
+//	2. 环境变量SERVICE_<SECTION>_<KEY>_FILE，值为文件路径，读取文件的内容
+//	3. INI里面的<key>_file，如pass_file = /run/secrets/db_pass
+//	4. INI里面的<key>
+//
+// 这样密码之类的可以放在环境变量或者挂载的文件里面，不用写在INI里
+
+// EnvPrefix 覆盖配置的环境变量的前缀
+const EnvPrefix = "SERVICE_"
+
+const fileSuffix = "_file"
+
+var envReplacer = strings.NewReplacer("-", "_", ".", "_", " ", "_")
+
+// EnvName section/key对应的环境变量名
+func EnvName(section, key string) string {
+	return EnvPrefix + strings.ToUpper(envReplacer.Replace(section+"_"+key))
+}
+
+var secrets = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// readSecret 读取文件的内容，去掉末尾的换行；cached时缓存起来，Reload之后清空
+func readSecret(path string, cached bool) (string, error) {
+	if cached {
+		secrets.Lock()
+		v, ok := secrets.m[path]
+		secrets.Unlock()
+		if ok {
+			return v, nil
+		}
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read secret file failed:%v", err)
+	}
+	v := strings.TrimRight(string(b), "\r\n")
+	if cached {
+		secrets.Lock()
+		secrets.m[path] = v
+		secrets.Unlock()
+	}
+	return v, nil
+}
+
+func clearSecrets() {
+	secrets.Lock()
+	secrets.m = make(map[string]string)
+	secrets.Unlock()
+}
+
+// lookup 返回section/key生效的值，from说明来源，来自INI的<key>时为空
+func lookup(c *config.Config, section, key string, cached bool) (v, from string, err error) {
+	name := EnvName(section, key)
+	if v, ok := os.LookupEnv(name); ok {
+		return v, "env " + name, nil
+	}
+	if path, ok := os.LookupEnv(name + "_FILE"); ok {
+		v, err = readSecret(path, cached)
+		return v, "env " + name + "_FILE", err
+	}
+	if c == nil {
+		return "", "", errors.New("config not loaded")
+	}
+	if c.HasOption(section, key+fileSuffix) {
+		path, err := c.String(section, key+fileSuffix)
+		if err != nil {
+			return "", "", err
+		}
+		v, err = readSecret(path, cached)
+		return v, key + fileSuffix, err
+	}
+	v, err = c.String(section, key)
+	return v, "", err
+}
+
+func get(section, key string) (string, error) {
+	if instance == nil {
+		LoadConfig(false)
+	}
+	configLock.RLock()
+	defer configLock.RUnlock()
+	v, _, err := lookup(instance, section, key, true)
+	return v, err
+}
+
+// 和robfig/config的Bool一样
+var boolValues = map[string]bool{
+	"1": true, "t": true, "true": true, "y": true, "yes": true, "on": true,
+	"0": false, "f": false, "false": false, "n": false, "no": false, "off": false,
+}
+
+func parseBool(s string) (bool, error) {
+	v, ok := boolValues[strings.ToLower(s)]
+	if !ok {
+		return false, fmt.Errorf("could not parse bool value: %s", s)
+	}
+	return v, nil
+}
+
+func parseInt(s string) (int, error) {
+	return strconv.Atoi(s)
+}
+
+func parseFloat(s string) (float64, error) {
+	return strconv.ParseFloat(s, 64)
+}
+
+// keys section自己的key(不包括DEFAULT带过来的)，<key>_file同时带上<key>
+func keys(c *config.Config, section string) []string {
+	options, err := c.Options(section)
+	if err != nil {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, key := range options {
+		if section != config.DEFAULT_SECTION && c.HasOption(config.DEFAULT_SECTION, key) {
+			continue
+		}
+		set[key] = true
+		if strings.HasSuffix(key, fileSuffix) {
+			set[strings.TrimSuffix(key, fileSuffix)] = true
+		}
+	}
+	ks := make([]string, 0, len(set))
+	for k := range set {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
+
+// sections DEFAULT在最前面，其它的按名字排序
+func sections(c *config.Config) []string {
+	ss := c.Sections()
+	sort.Slice(ss, func(i, j int) bool {
+		if ss[i] == config.DEFAULT_SECTION || ss[j] == config.DEFAULT_SECTION {
+			return ss[i] == config.DEFAULT_SECTION && ss[j] != config.DEFAULT_SECTION
+		}
+		return ss[i] < ss[j]
+	})
+	return ss
+}
+
+var secretWords = []string{"pass", "secret", "token", "credential"}
+
+// isSecret 密码之类的key
+func isSecret(key string) bool {
+	k := strings.ToLower(strings.TrimSuffix(key, fileSuffix))
+	for _, w := range secretWords {
+		if strings.Contains(k, w) {
+			return true
+		}
+	}
+	return strings.HasSuffix(k, "key")
+}
+
+var urlPassword = regexp.MustCompile(`(://[^:/@\s]+:)[^@/\s]+@`)
+
+const redacted = "******"
+
+// redact 隐藏密码，以及URL里面的密码
+func redact(key, v string) string {
+	if strings.HasSuffix(key, fileSuffix) {
+		return v // 文件路径不是密码
+	}
+	if isSecret(key) && v != "" {
+		return redacted
+	}
+	return urlPassword.ReplaceAllString(v, "${1}"+redacted+"@")
+}
+
+// Print 输出当前生效的配置(INI格式)，密码用******代替
+// 来自环境变量或者文件的，前面加一行注释说明来源
+func Print(w io.Writer) error {
+	if instance == nil {
+		LoadConfig(false)
+	}
+	configLock.RLock()
+	defer configLock.RUnlock()
+	if instance == nil {
+		return errors.New("config not loaded")
+	}
+
+	used := make(map[string]bool)
+	for i, section := range sections(instance) {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "[%s]\n", section)
+		for _, key := range keys(instance, section) {
+			name := EnvName(section, key)
+			used[name], used[name+"_FILE"] = true, true
+			v, from, err := lookup(instance, section, key, true)
+			if err != nil {
+				fmt.Fprintf(w, "# %s: %v\n", key, err)
+			} else if from != "" {
+				fmt.Fprintf(w, "# %s from %s\n", key, from)
+			}
+			fmt.Fprintf(w, "%s = %s\n", key, redact(key, v))
+		}
+	}
+
+	// 不对应任何INI里面的key的环境变量，只输出名字
+	var unused []string
+	for _, kv := range os.Environ() {
+		name := kv[:strings.IndexByte(kv+"=", '=')]
+		if strings.HasPrefix(name, EnvPrefix) && !used[name] {
+			unused = append(unused, name)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		fmt.Fprintf(w, "\n# %s* variables without a matching key in the INI file:\n", EnvPrefix)
+		for _, name := range unused {
+			fmt.Fprintf(w, "# %s\n", name)
+		}
+	}
+	return nil
+}
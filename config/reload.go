@@ -0,0 +1,188 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/robfig/config"
+
+	"Service/log"
+)
+
+// 配置的在线重新加载
+// 能够在线生效的配置由各自的包用OnReload注册，key的格式为"SECTION:key"；
+// 其它有变化的配置只有重启之后才会生效，Reload会把它们列出来
+
+type watcher struct {
+	keys  []string
+	apply func() error
+}
+
+var (
+	reloadLock sync.Mutex // 同一时间只能有一个Reload
+	watchers   []watcher
+	watchLock  sync.Mutex
+)
+
+// OnReload 注册可以在线生效的配置，Reload之后keys里面有任何一个变化时调用一次apply
+// apply返回error表示没有生效(继续使用旧的值)
+func OnReload(apply func() error, keys ...string) {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	watchers = append(watchers, watcher{keys, apply})
+}
+
+// ReloadReport Reload的结果
+type ReloadReport struct {
+	Applied []string          // 已经在线生效的key
+	Failed  map[string]string // 在线生效失败的key和原因
+	Restart []string          // 需要重启才能生效的key
+}
+
+func (r ReloadReport) String() string {
+	if len(r.Applied)+len(r.Failed)+len(r.Restart) == 0 {
+		return "nothing changed"
+	}
+	var failed []string
+	for k, e := range r.Failed {
+		failed = append(failed, k+"("+e+")")
+	}
+	sort.Strings(failed)
+	return fmt.Sprintf("applied:[%s] failed:[%s] restart required:[%s]",
+		strings.Join(r.Applied, " "), strings.Join(failed, " "), strings.Join(r.Restart, " "))
+}
+
+// Reload 重新读取配置文件，检查通过之后替换当前的配置，并应用可以在线生效的部分
+// 文件读取或者检查失败时返回error，当前配置保持不变
+func Reload() (report ReloadReport, err error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	next, err := config.ReadDefault(configfile)
+	if err != nil {
+		return report, fmt.Errorf("read %s failed:%v", configfile, err)
+	}
+
+	configLock.RLock()
+	prev := snapshot(instance, true)
+	configLock.RUnlock()
+	cur := snapshot(next, false)
+
+	changed := diff(prev, cur)
+	if err = validate(prev, cur, changed); err != nil {
+		return report, err
+	}
+
+	configLock.Lock()
+	instance = next
+	configLock.Unlock()
+	clearSecrets()
+	InitVars()
+
+	report = apply(changed)
+	log.Infof("[config][Reload] %s reloaded, %s\n", configfile, report)
+	if len(report.Restart) > 0 {
+		log.Warnf("[config][Reload] restart required for:%s\n", strings.Join(report.Restart, " "))
+	}
+	return report, nil
+}
+
+// snapshot 所有的"SECTION:key"和生效的值(包括环境变量和文件的覆盖)
+// cached为false时重新读取文件，这样更换了的密码文件也能发现
+func snapshot(c *config.Config, cached bool) map[string]string {
+	m := make(map[string]string)
+	if c == nil {
+		return m
+	}
+	for _, section := range c.Sections() {
+		for _, key := range keys(c, section) {
+			v, _, _ := lookup(c, section, key, cached)
+			m[section+":"+key] = v
+		}
+	}
+	return m
+}
+
+func diff(prev, cur map[string]string) []string {
+	var changed []string
+	for k, v := range cur {
+		if old, ok := prev[k]; !ok || old != v {
+			changed = append(changed, k)
+		}
+	}
+	for k := range prev {
+		if _, ok := cur[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// validate 原来是整数/布尔值的配置，新的值也必须是整数/布尔值
+func validate(prev, cur map[string]string, changed []string) error {
+	var errs []string
+	for _, k := range changed {
+		old, v := strings.TrimSpace(prev[k]), strings.TrimSpace(cur[k])
+		if old == "" || v == "" {
+			continue
+		}
+		if _, err := parseInt(old); err == nil {
+			if _, err := parseInt(v); err != nil {
+				errs = append(errs, fmt.Sprintf("%s=%q is not an integer", k, v))
+			}
+			continue
+		}
+		if _, err := parseBool(old); err == nil {
+			if _, err := parseBool(v); err != nil {
+				errs = append(errs, fmt.Sprintf("%s=%q is not a boolean", k, v))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func apply(changed []string) (report ReloadReport) {
+	watchLock.Lock()
+	ws := append([]watcher(nil), watchers...)
+	watchLock.Unlock()
+
+	isChanged := make(map[string]bool, len(changed))
+	for _, k := range changed {
+		isChanged[k] = true
+	}
+	live := make(map[string]bool)
+	report.Failed = make(map[string]string)
+	for _, w := range ws {
+		var hit []string
+		for _, k := range w.keys {
+			if isChanged[k] {
+				hit = append(hit, k)
+			}
+		}
+		if len(hit) == 0 {
+			continue
+		}
+		err := w.apply()
+		for _, k := range hit {
+			live[k] = true
+			if err != nil {
+				report.Failed[k] = err.Error()
+			}
+		}
+	}
+	for _, k := range changed {
+		switch {
+		case !live[k]:
+			report.Restart = append(report.Restart, k)
+		case report.Failed[k] == "":
+			report.Applied = append(report.Applied, k)
+		}
+	}
+	return
+}
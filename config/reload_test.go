@@ -0,0 +1,52 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReloadDiffAndValidate(t *testing.T) {
+	prev := map[string]string{"A:port": "80", "A:async": "true", "A:name": "x", "B:gone": "1"}
+	cur := map[string]string{"A:port": "8080", "A:async": "true", "A:name": "y", "C:new": "1"}
+
+	changed := diff(prev, cur)
+	if want := []string{"A:name", "A:port", "B:gone", "C:new"}; !reflect.DeepEqual(changed, want) {
+		t.Fatalf("diff = %v, want %v", changed, want)
+	}
+	if err := validate(prev, cur, changed); err != nil {
+		t.Errorf("validate: %v", err)
+	}
+
+	cur["A:port"] = "80a"
+	cur["A:async"] = "maybe"
+	err := validate(prev, cur, diff(prev, cur))
+	if err == nil || !strings.Contains(err.Error(), "A:port") || !strings.Contains(err.Error(), "A:async") {
+		t.Errorf("validate = %v, want errors for A:port and A:async", err)
+	}
+}
+
+func TestReloadApply(t *testing.T) {
+	defer func(ws []watcher) { watchers = ws }(watchers)
+	watchers = nil
+
+	calls := 0
+	OnReload(func() error { calls++; return nil }, "LOG:adapter", "LOG:jsonconfig")
+	OnReload(func() error { return errors.New("bad path") }, "BLACKLIST:path")
+	OnReload(func() error { t.Error("unchanged keys should not be applied"); return nil }, "DB:max_open_conns")
+
+	report := apply([]string{"BLACKLIST:path", "DB:host", "LOG:adapter", "LOG:jsonconfig"})
+	if calls != 1 {
+		t.Errorf("apply called %d times, want once for both LOG keys", calls)
+	}
+	if want := []string{"LOG:adapter", "LOG:jsonconfig"}; !reflect.DeepEqual(report.Applied, want) {
+		t.Errorf("Applied = %v, want %v", report.Applied, want)
+	}
+	if want := []string{"DB:host"}; !reflect.DeepEqual(report.Restart, want) {
+		t.Errorf("Restart = %v, want %v", report.Restart, want)
+	}
+	if report.Failed["BLACKLIST:path"] != "bad path" {
+		t.Errorf("Failed = %v", report.Failed)
+	}
+}
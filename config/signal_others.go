@@ -0,0 +1,20 @@
+//go:build !windows
+
+package config
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// WatchReloadSignal 收到SIGHUP的时候重新加载配置
+func WatchReloadSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			ReloadConfig()
+		}
+	}()
+}
@@ -0,0 +1,5 @@
+package config
+
+// WatchReloadSignal windows下没有SIGHUP，只能用bnotify的reload.config
+func WatchReloadSignal() {
+}
@@ -1,10 +1,32 @@
 package config
 
 import (
+	"sync/atomic"
 	"time"
 )
 
+const (
+	defaultReqCacheTime   = 24 * time.Hour
+	defaultClickCacheTime = time.Hour * 24 * 31
+)
+
+// Reload的时候InitVars会改，处理请求的时候在读，所以用atomic
+var (
+	reqCacheTime   = int64(defaultReqCacheTime)
+	clickCacheTime = int64(defaultClickCacheTime)
+)
+
 // ReqCacheTime reqcache持续时间
-var ReqCacheTime = 24 * time.Hour
+func ReqCacheTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&reqCacheTime))
+}
+
+// ClickCacheTime click之后remote缓存持续的时间
+func ClickCacheTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&clickCacheTime))
+}
 
-var ClickCacheTime = time.Hour * 24 * 31
+func init() {
+	// InitVars在Reload里面总是会调用，这里只是标记这两个可以在线生效
+	OnReload(func() error { return nil }, "DEFAULT:reqcachetime", "DEFAULT:clickcachetime")
+}
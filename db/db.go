@@ -49,6 +49,11 @@ func GetDB(title string) (db *sql.DB) {
 	}
 
 	dbSingletonMap[title] = db
+	// 连接池的大小可以在线修改
+	config.OnReload(func() error {
+		setPoolSize(db, config.Int(title, "max_open_conns"), config.Int(title, "max_idle_conns"))
+		return nil
+	}, title+":max_open_conns", title+":max_idle_conns")
 	return
 }
 
@@ -64,14 +69,7 @@ func connect(dbname string, host string, port int, user, pass string, maxopen, m
 		return nil
 	}
 
-	if maxopen <= 0 {
-		maxopen = defaultMaxOpenConns
-	}
-	db.SetMaxOpenConns(maxopen)
-	if maxidle <= 0 {
-		maxidle = defaultMaxIdleConns
-	}
-	db.SetMaxIdleConns(maxidle)
+	setPoolSize(db, maxopen, maxidle)
 
 	if err = db.Ping(); err != nil {
 		log.Errorf("mysql(%s) ping error:%s\n", dbname, err.Error())
@@ -82,3 +80,14 @@ func connect(dbname string, host string, port int, user, pass string, maxopen, m
 	return db
 
 }
+
+func setPoolSize(db *sql.DB, maxopen, maxidle int) {
+	if maxopen <= 0 {
+		maxopen = defaultMaxOpenConns
+	}
+	db.SetMaxOpenConns(maxopen)
+	if maxidle <= 0 {
+		maxidle = defaultMaxIdleConns
+	}
+	db.SetMaxIdleConns(maxidle)
+}
@@ -0,0 +1,145 @@
+// Package health /healthz、/readyz和drain模式
+//
+// /healthz 检查注册的依赖(DB, Redis, IP库等)是否可用
+// /readyz  在/healthz的基础上，drain之后一直返回503，让负载均衡把流量切走
+//
+// drain可以由信号(SIGUSR1)或者bnotify的enable.drain触发，只会触发一次
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"Service/log"
+)
+
+// CheckTimeout 单个检查的超时时间
+var CheckTimeout = 2 * time.Second
+
+// Check 检查一个依赖，不可用时返回error
+type Check func() error
+
+var (
+	mu     sync.Mutex
+	checks = make(map[string]Check)
+
+	draining  int32
+	drainOnce sync.Once
+	drained   = make(chan struct{})
+)
+
+// Register 注册一个检查，同名的会被替换
+func Register(name string, c Check) {
+	mu.Lock()
+	defer mu.Unlock()
+	checks[name] = c
+}
+
+// Run 并发执行所有检查，返回失败的检查和原因
+func Run() map[string]error {
+	mu.Lock()
+	all := make(map[string]Check, len(checks))
+	for name, c := range checks {
+		all[name] = c
+	}
+	mu.Unlock()
+
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(all))
+	for name, c := range all {
+		go func(name string, c Check) {
+			defer func() {
+				if x := recover(); x != nil {
+					results <- result{name, fmt.Errorf("panic:%v", x)}
+				}
+			}()
+			results <- result{name, c()}
+		}(name, c)
+	}
+
+	failed := make(map[string]error)
+	timeout := time.After(CheckTimeout)
+	for n := len(all); n > 0; n-- {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				failed[r.name] = r.err
+			}
+			delete(all, r.name)
+		case <-timeout:
+			for name := range all {
+				failed[name] = fmt.Errorf("timeout after %v", CheckTimeout)
+			}
+			return failed
+		}
+	}
+	return failed
+}
+
+// Drain 进入drain模式，只有第一次调用有效
+func Drain(reason string) {
+	drainOnce.Do(func() {
+		log.Warnf("[health][Drain] draining because of %s", reason)
+		atomic.StoreInt32(&draining, 1)
+		close(drained)
+	})
+}
+
+// Draining 是否已经进入drain模式
+func Draining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// Drained 进入drain模式的时候关闭
+func Drained() <-chan struct{} {
+	return drained
+}
+
+// Healthz 所有检查都通过时返回200
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	respond(w, Run(), false)
+}
+
+// Readyz drain之后，或者有检查失败时返回503
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	if Draining() {
+		respond(w, nil, true)
+		return
+	}
+	respond(w, Run(), false)
+}
+
+func respond(w http.ResponseWriter, failed map[string]error, draining bool) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if draining {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "draining")
+		return
+	}
+	if len(failed) == 0 {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+
+	names := make([]string, 0, len(failed))
+	for name := range failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s: %v", name, failed[name]))
+	}
+	log.Warnf("[health] checks failed: %s", strings.Join(lines, "; "))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintln(w, strings.Join(lines, "\n"))
+}
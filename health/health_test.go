@@ -0,0 +1,63 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func get(h http.HandlerFunc) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/", nil))
+	return w
+}
+
+func TestChecks(t *testing.T) {
+	defer func(d time.Duration) { CheckTimeout = d }(CheckTimeout)
+	CheckTimeout = 50 * time.Millisecond
+
+	Register("ok", func() error { return nil })
+	if w := get(Healthz); w.Code != http.StatusOK {
+		t.Fatalf("healthz = %d %s", w.Code, w.Body)
+	}
+
+	Register("db", func() error { return errors.New("down") })
+	Register("slow", func() error { time.Sleep(time.Second); return nil })
+	Register("panic", func() error { panic("boom") })
+	failed := Run()
+	if len(failed) != 3 || failed["ok"] != nil {
+		t.Fatalf("failed = %v", failed)
+	}
+	w := get(Readyz)
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "db: down") {
+		t.Errorf("readyz = %d %s", w.Code, w.Body)
+	}
+
+	mu.Lock()
+	delete(checks, "db")
+	delete(checks, "slow")
+	delete(checks, "panic")
+	mu.Unlock()
+}
+
+func TestDrain(t *testing.T) {
+	if Draining() {
+		t.Fatal("draining before Drain")
+	}
+	Drain("test")
+	Drain("again")
+	select {
+	case <-Drained():
+	default:
+		t.Fatal("Drained not closed")
+	}
+	if w := get(Readyz); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz while draining = %d", w.Code)
+	}
+	if w := get(Healthz); w.Code != http.StatusOK {
+		t.Errorf("healthz while draining = %d %s, should stay healthy", w.Code, w.Body)
+	}
+}
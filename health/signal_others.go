@@ -0,0 +1,21 @@
+//go:build !windows
+
+package health
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// WatchSignal 收到SIGUSR1的时候进入drain模式
+// SIGINT/SIGTERM/SIGUSR2已经被gracehttp用来停止和重启
+func WatchSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		<-c
+		signal.Stop(c)
+		Drain("SIGUSR1")
+	}()
+}
@@ -0,0 +1,5 @@
+package health
+
+// WatchSignal windows下没有SIGUSR1，只能用bnotify触发drain
+func WatchSignal() {
+}
@@ -5,6 +5,7 @@ import (
 	"flag"
 	"os"
 	"runtime"
+	"sync"
 
 	_ "Service/log/glog"
 	"Service/log/logs"
@@ -34,6 +35,10 @@ var (
 	//DefaultGlogLogger *Logger
 	DefaultMsgCount int64 = 10000
 	DefalutLogLevel       = logs.LevelDebug
+
+	// lock 保护DefaultLogger，写日志的时候拿读锁，Reload替换的时候拿写锁，
+	// 拿到写锁时原来的logger已经没有人在用，可以放心关闭
+	lock sync.RWMutex
 )
 
 func newLog(logger, jsonconfig string, bufsize int64) (l *Logger, err error) {
@@ -46,7 +51,7 @@ func newLog(logger, jsonconfig string, bufsize int64) (l *Logger, err error) {
 		return nil, err
 	}
 	var config struct {
-		Level int `json:level`
+		Level int `json:"level"`
 	}
 	err = json.Unmarshal([]byte(jsonconfig), &config)
 	if err != nil {
@@ -58,13 +63,16 @@ func newLog(logger, jsonconfig string, bufsize int64) (l *Logger, err error) {
 }
 
 func Init(logger, jsonconfig string, async bool) (err error) {
-	DefaultLogger, err = newLog(logger, jsonconfig, DefaultMsgCount)
+	l, err := newLog(logger, jsonconfig, DefaultMsgCount)
 	if err != nil {
 		return
 	}
 	if async {
-		DefaultLogger.l.Async()
+		l.l.Async()
 	}
+	lock.Lock()
+	DefaultLogger = l
+	lock.Unlock()
 
 	if logger == "glog" {
 		flag.Parse() // necessory for glog
@@ -72,17 +80,43 @@ func Init(logger, jsonconfig string, async bool) (err error) {
 	return
 }
 
+// Reload 按新的配置创建DefaultLogger，创建失败时继续使用原来的
+// 等正在写的日志写完之后替换，原来的把异步队列里的日志写完之后关闭
+func Reload(logger, jsonconfig string, async bool) error {
+	l, err := newLog(logger, jsonconfig, DefaultMsgCount)
+	if err != nil {
+		return err
+	}
+	if async {
+		l.l.Async()
+	}
+	lock.Lock()
+	old := DefaultLogger
+	DefaultLogger = l
+	lock.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
 func SetLevel(level int) {
+	lock.RLock()
+	defer lock.RUnlock()
 	DefaultLogger.SetLevel(level)
 }
 
 type Verbose bool
 
 func V(level int) Verbose {
+	lock.RLock()
+	defer lock.RUnlock()
 	return DefaultLogger.GetLevel() >= level
 }
 
 func Emergency(msg ...interface{}) {
+	lock.RLock()
+	defer lock.RUnlock()
 	if DefaultLogger == nil {
 		return
 	}
@@ -90,6 +124,8 @@ func Emergency(msg ...interface{}) {
 }
 
 func Emergencyf(format string, msg ...interface{}) {
+	lock.RLock()
+	defer lock.RUnlock()
 	if DefaultLogger == nil {
 		return
 	}
@@ -97,6 +133,8 @@ func Emergencyf(format string, msg ...interface{}) {
 }
 
 func Alert(msg ...interface{}) {
+	lock.RLock()
+	defer lock.RUnlock()
 	if DefaultLogger == nil {
 		return
 	}
@@ -104,6 +142,8 @@ func Alert(msg ...interface{}) {
 }
 
 func Alertf(format string, msg ...interface{}) {
+	lock.RLock()
+	defer lock.RUnlock()
 	if DefaultLogger == nil {
 		return
 	}
@@ -111,6 +151,8 @@ func Alertf(format string, msg ...interface{}) {
 }
 
 func Critical(msg ...interface{}) {
+	lock.RLock()
+	defer lock.RUnlock()
 	if DefaultLogger == nil {
 		return
 	}
@@ -118,6 +160,8 @@ func Critical(msg ...interface{}) {
 }
 
 func Criticalf(format string, msg ...interface{}) {
+	lock.RLock()
+	defer lock.RUnlock()
 	if DefaultLogger == nil {
 		return
 	}
@@ -125,6 +169,8 @@ func Criticalf(format string, msg ...interface{}) {
 }
 
 func Error(msg ...interface{}) {
+	lock.RLock()
+	defer lock.RUnlock()
 	if DefaultLogger == nil {
 		return
 	}
@@ -132,6 +178,8 @@ func Error(msg ...interface{}) {
 }
 
 func Errorf(format string, msg ...interface{}) {
+	lock.RLock()
+	defer lock.RUnlock()
 	if DefaultLogger == nil {
 		return
 	}
@@ -139,6 +187,8 @@ func Errorf(format string, msg ...interface{}) {
 }
 
 func Warn(msg ...interface{}) {
+	lock.RLock()
+	defer lock.RUnlock()
 	if DefaultLogger == nil {
 		return
 	}
@@ -146,6 +196,8 @@ func Warn(msg ...interface{}) {
 }
 
 func Warnf(format string, msg ...interface{}) {
+	lock.RLock()
+	defer lock.RUnlock()
 	if DefaultLogger == nil {
 		return
 	}
@@ -153,6 +205,8 @@ func Warnf(format string, msg ...interface{}) {
 }
 
 func Notice(msg ...interface{}) {
+	lock.RLock()
+	defer lock.RUnlock()
 	if DefaultLogger == nil {
 		return
 	}
@@ -160,6 +214,8 @@ func Notice(msg ...interface{}) {
 }
 
 func Noticef(format string, msg ...interface{}) {
+	lock.RLock()
+	defer lock.RUnlock()
 	if DefaultLogger == nil {
 		return
 	}
@@ -167,6 +223,8 @@ func Noticef(format string, msg ...interface{}) {
 }
 
 func Info(msg ...interface{}) {
+	lock.RLock()
+	defer lock.RUnlock()
 	if DefaultLogger == nil {
 		return
 	}
@@ -174,6 +232,8 @@ func Info(msg ...interface{}) {
 }
 
 func Infof(format string, msg ...interface{}) {
+	lock.RLock()
+	defer lock.RUnlock()
 	if DefaultLogger == nil {
 		return
 	}
@@ -181,6 +241,8 @@ func Infof(format string, msg ...interface{}) {
 }
 
 func Debug(msg ...interface{}) {
+	lock.RLock()
+	defer lock.RUnlock()
 	if DefaultLogger == nil {
 		return
 	}
@@ -188,6 +250,8 @@ func Debug(msg ...interface{}) {
 }
 
 func Debugf(format string, msg ...interface{}) {
+	lock.RLock()
+	defer lock.RUnlock()
 	if DefaultLogger == nil {
 		return
 	}
@@ -195,6 +259,8 @@ func Debugf(format string, msg ...interface{}) {
 }
 
 func Detail(msg ...interface{}) {
+	lock.RLock()
+	defer lock.RUnlock()
 	if DefaultLogger == nil {
 		return
 	}
@@ -202,6 +268,8 @@ func Detail(msg ...interface{}) {
 }
 
 func Detailf(format string, msg ...interface{}) {
+	lock.RLock()
+	defer lock.RUnlock()
 	if DefaultLogger == nil {
 		return
 	}
@@ -209,6 +277,8 @@ func Detailf(format string, msg ...interface{}) {
 }
 
 func Flush() {
+	lock.RLock()
+	defer lock.RUnlock()
 	if DefaultLogger == nil {
 		return
 	}
@@ -216,6 +286,8 @@ func Flush() {
 }
 
 func Close() {
+	lock.RLock()
+	defer lock.RUnlock()
 	if DefaultLogger == nil {
 		return
 	}
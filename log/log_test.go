@@ -0,0 +1,69 @@
+package log
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestReloadConcurrent 一边并发写日志一边Reload，用-race跑，日志不能丢也不能写到已经关闭的logger
+func TestReloadConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logreload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := func(i int) string {
+		return fmt.Sprintf(`{"filename":%q,"level":7,"daily":false}`, filepath.Join(dir, fmt.Sprintf("r%d.log", i)))
+	}
+	if err := Init("file", config(0), true); err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, count, reloads = 8, 500, 20
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				Infof("reload-test %d %d\n", w, i)
+			}
+		}(w)
+	}
+	for i := 1; i <= reloads; i++ {
+		if err := Reload("file", config(i), i%2 == 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := 0
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			if strings.Contains(s.Text(), "reload-test") {
+				lines++
+			}
+		}
+		f.Close()
+	}
+	if lines != writers*count {
+		t.Errorf("got %d lines, want %d", lines, writers*count)
+	}
+}
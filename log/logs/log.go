@@ -96,6 +96,8 @@ type BeeLogger struct {
 	asynchronous        bool
 	msg                 chan *logMsg
 	outputs             map[string]LoggerInterface
+	closing             chan struct{} // Close通知startLogger把队列写完后退出
+	done                chan struct{} // startLogger已经退出
 }
 
 type logMsg struct {
@@ -117,6 +119,8 @@ func NewLogger(channellen int64) *BeeLogger {
 
 func (bl *BeeLogger) Async() *BeeLogger {
 	bl.asynchronous = true
+	bl.closing = make(chan struct{})
+	bl.done = make(chan struct{})
 	go bl.startLogger()
 	return bl
 }
@@ -212,19 +216,33 @@ func (bl *BeeLogger) EnableFuncCallDepth(b bool) {
 // start logger chan reading.
 // when chan is not empty, write logs.
 func (bl *BeeLogger) startLogger() {
+	defer close(bl.done)
 	for {
 		select {
 		case bm := <-bl.msg:
-			for _, l := range bl.outputs {
-				err := l.WriteMsg(bm.msg, bm.level)
-				if err != nil {
-					fmt.Println("ERROR, unable to WriteMsg:", err)
+			bl.writeOutputs(bm)
+		case <-bl.closing:
+			for {
+				select {
+				case bm := <-bl.msg:
+					bl.writeOutputs(bm)
+				default:
+					return
 				}
 			}
 		}
 	}
 }
 
+func (bl *BeeLogger) writeOutputs(bm *logMsg) {
+	for _, l := range bl.outputs {
+		err := l.WriteMsg(bm.msg, bm.level)
+		if err != nil {
+			fmt.Println("ERROR, unable to WriteMsg:", err)
+		}
+	}
+}
+
 // Log EMERGENCY level message.
 func (bl *BeeLogger) Emergency(format string, v ...interface{}) {
 	if LevelEmergency > bl.level {
@@ -344,7 +362,12 @@ func (bl *BeeLogger) Flush() {
 }
 
 // close logger, flush all chan data and destroy all adapters in BeeLogger.
+// 异步的时候由startLogger写完队列，不能和它同时写outputs
 func (bl *BeeLogger) Close() {
+	if bl.asynchronous {
+		close(bl.closing)
+		<-bl.done
+	}
 	for {
 		if len(bl.msg) > 0 {
 			bm := <-bl.msg
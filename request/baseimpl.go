@@ -35,6 +35,9 @@ type reqbase struct {
 	payout     float64
 	txid       string
 
+	trackedCost float64 // 已经记到统计里面的cost
+	costTs      int64   // 第一次记cost的统计时间点，TS后来更新cost时记到这个时间点
+
 	trafficSourceId   int64
 	trafficSourceName string
 
@@ -55,6 +58,7 @@ type reqbase struct {
 	landerName        string
 	offerId           int64
 	optOfferId        int64
+	slot              int64
 	offerName         string
 
 	affiliateId       int64
@@ -95,6 +99,10 @@ type reqbase struct {
 
 	urlParam map[string]string
 
+	// 当前http请求带过来的url参数和cookie，不保存到cache
+	query     url.Values
+	reqCookie map[string]string
+
 	// Traffic Source的一些配置
 	//	tsExternalId *common.TrafficSourceParams // 暂时不需要，去掉
 	//	tsCost       *common.TrafficSourceParams // 暂时不需要，去掉
@@ -158,6 +166,7 @@ func newReqBase(id, t string, r *http.Request) (req *reqbase) {
 		cookie:         make(map[string]string),
 		urlParam:       make(map[string]string),
 	}
+	req.setHttpRequest(r)
 
 	// parse traffic source externalId/cost/vars
 	switch t {
@@ -241,6 +250,17 @@ func (r *reqbase) Cost() float64 {
 	return r.cost
 }
 
+func (r *reqbase) TrackedCost() (cost float64, timestamp int64) {
+	return r.trackedCost, r.costTs
+}
+
+func (r *reqbase) AddTrackedCost(cost float64, timestamp int64) {
+	r.trackedCost += cost
+	if r.costTs == 0 {
+		r.costTs = timestamp
+	}
+}
+
 func (r *reqbase) Vars(n uint) string { // n:0~VarsMaxNum-1
 	if n < 0 || n >= VarsMaxNum {
 		return ""
@@ -248,6 +268,23 @@ func (r *reqbase) Vars(n uint) string { // n:0~VarsMaxNum-1
 	return r.vars[n]
 }
 
+// setHttpRequest 保存当前http请求的url参数和cookie，供rule的get.xx和cookie.xx使用
+func (r *reqbase) setHttpRequest(hr *http.Request) {
+	r.query = hr.URL.Query()
+	r.reqCookie = make(map[string]string)
+	for _, c := range hr.Cookies() {
+		r.reqCookie[c.Name] = c.Value
+	}
+}
+
+func (r *reqbase) QueryParam(key string) string {
+	return r.query.Get(key)
+}
+
+func (r *reqbase) CookieValue(key string) string {
+	return r.reqCookie[key]
+}
+
 func (r *reqbase) ParseTSParams(
 	externalId common.TrafficSourceParams,
 	cost common.TrafficSourceParams,
@@ -383,6 +420,12 @@ func (r *reqbase) OptOfferId() int64 {
 func (r *reqbase) SetOptOfferId(id int64) {
 	r.optOfferId = id
 }
+func (r *reqbase) Slot() int64 {
+	return r.slot
+}
+func (r *reqbase) SetSlot(slot int64) {
+	r.slot = slot
+}
 func (r *reqbase) OfferName() string {
 	return r.offerName
 }
@@ -676,6 +719,19 @@ func (r *reqbase) DomainKey(timestamp int64) tracking.ReferrerDomainStatisKey {
 	domain.ReferrerDomain = r.ReferrerDomain()
 	return domain
 }
+func (r *reqbase) SlotKey(timestamp int64) tracking.SlotStatisKey {
+	var slot tracking.SlotStatisKey
+	if r == nil {
+		return slot
+	}
+	slot.UserID = r.UserId()
+	slot.Timestamp = timestamp
+	slot.CampaignID = r.CampaignId()
+	slot.LanderID = r.LanderId()
+	slot.Slot = r.Slot()
+	slot.OfferID = r.OfferId()
+	return slot
+}
 func (r *reqbase) ConversionKey() tracking.Conversion {
 	var conv tracking.Conversion
 	if r == nil {
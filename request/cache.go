@@ -1,138 +1,169 @@
 package request
 
 import (
-	"database/sql"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"net/url"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"time"
 
+	"Service/clickstore"
 	"Service/common"
-	//"Service/config"
-	"Service/db"
+	"Service/config"
 	"Service/log"
-	"time"
+	"Service/util/metrics"
 )
 
 const LocalCacheSvrTitle = "LOCALREQCACHE"
-const remoteCacheSvrTitle = "REMOTEREQCACHE"
 const defaultAsyncBuffer = 100000
+const (
+	defaultBatchSize     = 100
+	defaultBatchInterval = 200 * time.Millisecond
+	defaultAsyncMaxBytes = 256 << 20
+)
 
 var remoteCacheAsync bool // 是否异步保存
-var remoteSetStmt *sql.Stmt
 
-var mu sync.RWMutex // protects the following
-var reqCache = make(map[string]string)
+var (
+	toSave          chan *cacheValue
+	pendingBytes    int64 // 已经进入toSave还没有写到remote的数据大小
+	maxPendingBytes int64
+	batchSize       int
+	batchInterval   time.Duration
+)
 
+// InitRemoteCacheStmt 初始化remote cache的异步保存，remote配置为none时不需要
+// 异步保存时按[REMOTEREQCACHE]的batchsize/batchinterval(毫秒)批量写入，
+// 排队的数据总大小不超过asyncmaxbytes，超过的丢弃
 func InitRemoteCacheStmt(async bool, buffer int) {
-	svr := db.GetDB(remoteCacheSvrTitle)
-	if svr == nil {
-		panic(fmt.Sprintf("[InitRemoteCache]%s remote cache DB does not exist", remoteCacheSvrTitle))
-	}
-	var err error
-	remoteSetStmt, err = svr.Prepare("INSERT INTO Cache.ReqCache(clickId,value) VALUES(?,?) ON DUPLICATE KEY UPDATE value=?")
-	if err != nil {
-		panic(err.Error())
+	if clickstore.Kind(clickstore.Remote) != clickstore.KindNone && clickstore.Get(clickstore.Remote) == nil {
+		panic(fmt.Sprintf("[InitRemoteCache]%s remote cache store does not exist", clickstore.Kind(clickstore.Remote)))
 	}
 	remoteCacheAsync = async
 	if buffer <= 0 {
 		buffer = defaultAsyncBuffer
 	}
 	toSave = make(chan *cacheValue, buffer)
-}
 
-func CloseRemoteCacheStmt() {
-	if remoteSetStmt != nil {
-		remoteSetStmt.Close()
+	batchSize = config.Int("REMOTEREQCACHE", "batchsize")
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
 	}
-}
-
-func get(token string) (caStr string) {
-	if token == "" {
-		return ""
+	batchInterval = time.Duration(config.Int("REMOTEREQCACHE", "batchinterval")) * time.Millisecond
+	if batchInterval <= 0 {
+		batchInterval = defaultBatchInterval
 	}
-	mu.RLock()
-	defer mu.RUnlock()
-	caStr, _ = reqCache[token]
-	return
-}
-func del(token string) {
-	if token == "" {
-		return
+	maxPendingBytes = int64(config.Int("REMOTEREQCACHE", "asyncmaxbytes"))
+	if maxPendingBytes <= 0 {
+		maxPendingBytes = defaultAsyncMaxBytes
 	}
-	mu.Lock()
-	defer mu.Unlock()
-	delete(reqCache, token)
 }
-func set(token, caStr string) error {
-	if token == "" {
-		return errors.New("token is empty")
-	}
-	mu.Lock()
-	defer mu.Unlock()
-	reqCache[token] = caStr
-	return nil
+
+// CloseRemoteCacheStmt 关闭所有的click store
+func CloseRemoteCacheStmt() {
+	clickstore.CloseAll()
 }
 
 type cacheValue struct {
 	key   string
 	value string
+	ttl   time.Duration
 }
 
-var toSave chan *cacheValue
+func (v *cacheValue) size() int64 {
+	return int64(len(v.key) + len(v.value))
+}
 
+// AsyncingRemoteCache 从toSave收集数据，攒够batchSize条或者每隔batchInterval写一次remote
 func AsyncingRemoteCache(stop chan struct{}) {
+	batch := make([]*cacheValue, 0, batchSize)
+	t := time.NewTicker(batchInterval)
+	defer t.Stop()
 	for {
 		select {
 		case m := <-toSave:
-			if m == nil {
-				log.Error("saveRemoteCache failed:m is nil")
-				continue
-			}
-			err := saveRemoteCache(false, m.key, m.value)
-			if err != nil {
-				log.Errorf("saveRemoteCache failed:%v", err)
+			batch = append(batch, m)
+			if len(batch) >= batchSize {
+				batch = flushRemoteCache(batch)
 			}
+		case <-t.C:
+			batch = flushRemoteCache(batch)
 		case <-stop:
 			// 收所有的数据，防止的未写入数据库的
 			for {
 				select {
 				case m := <-toSave:
-					if m == nil {
-						log.Error("saveRemoteCache failed:m is nil")
-						continue
-					}
-					err := saveRemoteCache(false, m.key, m.value)
-					if err != nil {
-						log.Errorf("saveRemoteCache failed:%v", err)
+					batch = append(batch, m)
+					if len(batch) >= batchSize {
+						batch = flushRemoteCache(batch)
 					}
 				default:
-					goto allreceived
+					flushRemoteCache(batch)
+					return
 				}
 			}
-		allreceived:
-			return
 		}
 	}
 }
 
-func saveRemoteCache(async bool, reqId, value string) (err error) {
+// flushRemoteCache 同一个key只写最后一次的值，返回清空之后的batch
+func flushRemoteCache(batch []*cacheValue) []*cacheValue {
+	if len(batch) == 0 {
+		return batch
+	}
+	var size int64
+	index := make(map[string]int, len(batch))
+	items := make([]clickstore.Item, 0, len(batch))
+	for _, m := range batch {
+		size += m.size()
+		if i, ok := index[m.key]; ok {
+			items[i].Value, items[i].TTL = m.value, m.ttl
+			continue
+		}
+		index[m.key] = len(items)
+		items = append(items, clickstore.Item{Key: m.key, Value: m.value, TTL: m.ttl})
+	}
+	defer atomic.AddInt64(&pendingBytes, -size)
+
+	s := clickstore.Get(clickstore.Remote)
+	if s == nil {
+		return batch[:0]
+	}
+	if err := s.SetMulti(items); err != nil {
+		log.Errorf("[flushRemoteCache]save %d clicks failed:%v\n", len(items), err)
+	}
+	return batch[:0]
+}
+
+func saveRemoteCache(async bool, reqId, value string, ttl time.Duration) (err error) {
 	if !async { // 同步保存RemoteCache
-		//TODO 远程的cache暂时用MySQL来做，没有用上expire;上线一个月之后必须修改
-		_, err = remoteSetStmt.Exec(reqId, value, value)
-	} else {
-		// save remote async
-		select {
-		case toSave <- &cacheValue{
-			key:   reqId,
-			value: value,
-		}:
-		default:
-			log.Errorf("[saveRemoteCache]toSave is full, cacheValue lost,%s:%s\n", reqId, value)
+		s := clickstore.Get(clickstore.Remote)
+		if s == nil {
+			return nil
 		}
+		return s.Set(reqId, value, ttl)
+	}
+
+	// save remote async
+	m := &cacheValue{
+		key:   reqId,
+		value: value,
+		ttl:   ttl,
+	}
+	size := m.size()
+	if atomic.AddInt64(&pendingBytes, size) > maxPendingBytes {
+		atomic.AddInt64(&pendingBytes, -size)
+		log.Errorf("[saveRemoteCache]pending bytes exceed %d, cacheValue lost,%s:%s\n", maxPendingBytes, reqId, value)
+		return
+	}
+	select {
+	case toSave <- m:
+	default:
+		atomic.AddInt64(&pendingBytes, -size)
+		log.Errorf("[saveRemoteCache]toSave is full, cacheValue lost,%s:%s\n", reqId, value)
 	}
 	return
 }
@@ -145,133 +176,152 @@ func setReqCache(req *reqbase, localExpire, remoteExpire time.Duration) (err err
 		return errors.New("req.Id() is empty for setReqCache")
 	}
 
-	strategy := 1
-	switch strategy {
-	case 1: //方案1：使用中心Cache服务器。
-		v := Req2cacheStr(req)
-		log.Infof("[request][setReqCache]key:%s value:%s\n", req.Id(), v)
-		{ // local cache
-			if localExpire >= 0 {
-				svr := db.GetRedisClient(LocalCacheSvrTitle)
-				if svr == nil {
-					return fmt.Errorf("[setReqCache]%s local cache DB does not exist", LocalCacheSvrTitle)
-				}
-				err = svr.Set(req.Id(), v, localExpire).Err()
-				log.Infof("[request][setReqCache]local key:%s err:%v\n", req.Id(), err)
-			}
-		}
-		{ // remote cache
-			if remoteExpire >= 0 {
-				err = saveRemoteCache(remoteCacheAsync, req.Id(), v)
-				log.Infof("[request][setReqCache]remote key:%s err:%v\n", req.Id(), err)
-			}
-		}
-	case 2: //方案2：使用程序内部的Cache。外部通过userIdText做分流。
-		{
-			err = set(req.Id(), Req2cacheStr(req))
+	local, remote := encodeCache(req)
+	log.Infof("[request][setReqCache]key:%s value:%s\n", req.Id(), remote)
+	if localExpire >= 0 {
+		s := clickstore.Get(clickstore.Local)
+		if s == nil {
+			return fmt.Errorf("[setReqCache]%s local cache store does not exist", clickstore.Kind(clickstore.Local))
 		}
+		err = s.Set(req.Id(), local, localExpire)
+		log.Infof("[request][setReqCache]local key:%s err:%v\n", req.Id(), err)
+	}
+	if remoteExpire >= 0 {
+		err = saveRemoteCache(remoteCacheAsync, req.Id(), remote, remoteExpire)
+		log.Infof("[request][setReqCache]remote key:%s err:%v\n", req.Id(), err)
 	}
 	return
 }
 
-func getClickValue(dataSourceName, reqId string) (string, error) {
-	var value string
-	var err error
-
-	svr := db.GetDB(dataSourceName)
-	if svr == nil {
-		err = fmt.Errorf("[getClickValue]%s remote cache DB does not exist", dataSourceName)
-		return "", err
+func getReqCache(reqId string, onlyLocal bool) (req *reqbase, err error) {
+	s := clickstore.Get(clickstore.Local)
+	if s == nil {
+		return nil, fmt.Errorf("[getReqCache]%s local cache store does not exist", clickstore.Kind(clickstore.Local))
 	}
-	err = svr.QueryRow("SELECT value FROM Cache.ReqCache WHERE clickId=?", reqId).Scan(&value)
-	if err == nil {
-		return value, nil
-	} else {
-		err = fmt.Errorf("[getClickValue]remote %s get %v failed:%v", dataSourceName, reqId, err)
-		return "", err
+	value, err := s.Get(reqId)
+	countLookup(clickstore.Local, err)
+	if err != nil { // 在Local没有找到时
+		err = fmt.Errorf("[getReqCache]local get %v failed:%v", reqId, err)
+		log.Error(err.Error())
+		// 不能直接return，还有可能要尝试Remote部分
+	} else if value != "" {
+		req = CacheStr2Req(value)
 	}
-	return "", nil
-}
 
-func getReqCache(reqId string, onlyLocal bool) (req *reqbase, err error) {
-	strategy := 1
-	switch strategy {
-	case 1: //方案1：使用中心Cache服务器。
-		svr := db.GetRedisClient(LocalCacheSvrTitle)
-		if svr == nil {
-			return nil, fmt.Errorf("[getReqCache]%s local cache DB does not exist", LocalCacheSvrTitle)
+	if req == nil && !onlyLocal { // 当local cache没有找到时，尝试从remote cache查找
+		//TODO 在线上所有的clickId，都转化为aes clickId之前，先屏蔽这个检查 2017/3/21
+		/*if !common.IndateClickId(reqId, config.ClickCacheTime()) {
+			// 检查时间，如果不在一个月内，则省去查询这一步
+			return nil, fmt.Errorf("[getReqCache]%s exceeds one month, omit searching from remote", reqId)
+		}*/
+		rs := clickstore.Get(clickstore.Remote)
+		if rs == nil {
+			return nil, err
 		}
-		cmd := svr.Get(reqId)
-
-		if cmd.Err() != nil { // 在Local没有找到时
-			err = fmt.Errorf("[getReqCache]local %s get %v failed:%v", LocalCacheSvrTitle, reqId, cmd.Err())
-			log.Error(err.Error())
-			// 不能直接return，还有可能要尝试Remote部分
-		} else if cmd.Val() != "" {
-			req = CacheStr2Req(cmd.Val())
+		value, ttl, err := rs.GetWithTTL(reqId)
+		countLookup(clickstore.Remote, err)
+		if err == nil && value != "" {
+			req = CacheStr2Req(value)
+			if req != nil {
+				backfillLocal(s, reqId, req, ttl)
+			}
+			return req, nil
 		}
+		return nil, fmt.Errorf("[getReqCache]remote get %v failed:%v", reqId, err)
+	}
+	return
+}
 
-		if req == nil && !onlyLocal { // 当local cache没有找到时，尝试从remote cache查找
-			//TODO 在线上所有的clickId，都转化为aes clickId之前，先屏蔽这个检查 2017/3/21
-			/*if !common.IndateClickId(reqId, config.ClickCacheTime) {
-				// 检查时间，如果不在一个月内，则省去查询这一步
-				return nil, fmt.Errorf("[getReqCache]%s exceeds one month, omit searching from %s", reqId, remoteCacheSvrTitle)
-			}*/
-
-			value, err := getClickValue(remoteCacheSvrTitle, reqId)
-			if err == nil && value != "" {
-				req = CacheStr2Req(value)
-				return req, nil
-			}
+var cacheLookups = metrics.NewCounterVec("reqcache_lookups_total",
+	"Request cache lookups by tier (local|remote) and result (hit|miss|error).", "tier", "result")
+
+func countLookup(tier string, err error) {
+	switch err {
+	case nil:
+		cacheLookups.Inc(tier, "hit")
+	case clickstore.ErrNotFound:
+		cacheLookups.Inc(tier, "miss")
+	default:
+		cacheLookups.Inc(tier, "error")
+	}
+}
 
-			return nil, err
-		}
-	case 2: //方案2：使用程序内部的Cache。外部通过userIdText做分流。
-		{
-			req = CacheStr2Req(get(reqId))
+// RemoteCacheQueueDepth toSave里面等待写到remote的条数
+func RemoteCacheQueueDepth() int {
+	return len(toSave)
+}
+
+// backfillLocal remote命中之后写回local，过期时间为remote剩余的时间，最长ReqCacheTime
+func backfillLocal(s clickstore.ClickStore, reqId string, req *reqbase, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = remoteTTL(req, time.Now())
+	}
+	if ttl <= 0 {
+		return
+	}
+	if ttl > config.ReqCacheTime() {
+		ttl = config.ReqCacheTime()
+	}
+	local, _ := encodeCache(req)
+	if err := s.Set(reqId, local, ttl); err != nil {
+		log.Errorf("[backfillLocal]set %s failed:%v\n", reqId, err)
+	}
+}
+
+// remoteTTL remote不记录过期时间时，按最后一次保存(最近的时间戳)加上ClickCacheTime推算
+func remoteTTL(req *reqbase, now time.Time) time.Duration {
+	last := req.impTimeStamp
+	for _, ts := range []int64{req.visitTimeStamp, req.clickTimeStamp, req.postbackTimeStamp} {
+		if ts > last {
+			last = ts
 		}
 	}
-	return
+	if last == 0 {
+		return config.ReqCacheTime()
+	}
+	saved := time.Unix(0, last*int64(time.Millisecond))
+	return saved.Add(config.ClickCacheTime()).Sub(now)
 }
 
 func delReqCache(token string, local bool) {
-	strategy := 1
-	switch strategy {
-	case 1: //方案1：使用中心Cache服务器。
-		if local {
-			svr := db.GetRedisClient(LocalCacheSvrTitle)
-			if svr == nil {
-				log.Errorf("[delReqCache]%s local cache DB does not exist\n", LocalCacheSvrTitle)
-			}
-			if err := svr.Del(token).Err(); err != nil {
-				log.Errorf("[delReqCache]local delReqCache token(%s) with err(%s)\n", token, err.Error())
-			}
-		} else {
-			svr := db.GetDB(remoteCacheSvrTitle)
-			if svr == nil {
-				log.Errorf("[delReqCache]%s remote cache DB does not exist\n", remoteCacheSvrTitle)
-			}
-			_, err := svr.Exec("DELETE FROM Cache.ReqCache WHERE clickId=?", token)
-			if err != nil {
-				log.Errorf("[delReqCache]remote delReqCache token(%s) with err(%s)\n", token, err.Error())
-			}
-		}
-	case 2: //方案2：使用程序内部的Cache。外部通过userIdText做分流。
-		{
-			del(token)
-		}
-	case 3: //方案3：有效内容包装在token中。内容太多token太长。开发简便。
-		{
-			// do nothing
-		}
+	role := clickstore.Remote
+	if local {
+		role = clickstore.Local
+	}
+	s := clickstore.Get(role)
+	if s == nil {
+		log.Errorf("[delReqCache]%s cache store does not exist\n", role)
+		return
+	}
+	if err := s.Del(token); err != nil {
+		log.Errorf("[delReqCache]%s delReqCache token(%s) with err(%s)\n", role, token, err.Error())
 	}
-	return
 }
 
+// Req2cacheStr 按照[REQCACHE]的配置编码，结果可以直接保存到MySQL
 func Req2cacheStr(req *reqbase) (caStr string) {
 	if req == nil {
 		return ""
 	}
+	_, caStr = encodeCache(req)
+	return
+}
+
+// CacheStr2Req 新老格式的记录都可以解
+func CacheStr2Req(caStr string) (req *reqbase) {
+	if caStr == "" {
+		return nil
+	}
+	req, err := decodeCache(caStr)
+	if err != nil {
+		log.Errorf("[CacheStr2Req]decode %q failed:%v", caStr, err)
+		return nil
+	}
+	return req
+}
+
+// req2QueryStr 老的格式，url query的base64
+func req2QueryStr(req *reqbase) string {
 	ku, _ := url.ParseQuery("")
 	ku.Add("id", req.id)
 	ku.Add("t", req.t)
@@ -284,6 +334,8 @@ func Req2cacheStr(req *reqbase) (caStr string) {
 	ku.Add("websiteId", req.websiteId)
 	ku.Add("vars", strings.Join(req.vars, ";"))
 	ku.Add("payout", fmt.Sprintf("%f", req.payout))
+	ku.Add("tCost", fmt.Sprintf("%f", req.trackedCost))
+	ku.Add("costTs", fmt.Sprintf("%d", req.costTs))
 	ku.Add("txId", req.txid)
 
 	ku.Add("tsId", fmt.Sprintf("%d", req.trafficSourceId))
@@ -302,6 +354,7 @@ func Req2cacheStr(req *reqbase) (caStr string) {
 	ku.Add("lName", req.landerName)
 	ku.Add("oId", fmt.Sprintf("%d", req.offerId))
 	ku.Add("oOId", fmt.Sprintf("%d", req.optOfferId))
+	ku.Add("slot", fmt.Sprintf("%d", req.slot))
 	ku.Add("oName", req.offerName)
 	ku.Add("affId", fmt.Sprintf("%d", req.affiliateId))
 	ku.Add("oAffId", fmt.Sprintf("%d", req.optAffiliateId))
@@ -349,20 +402,15 @@ func Req2cacheStr(req *reqbase) (caStr string) {
 	return base64.URLEncoding.EncodeToString([]byte(ku.Encode()))
 }
 
-func CacheStr2Req(caStr string) (req *reqbase) {
-	if caStr == "" {
-		return nil
-	}
+func queryStr2Req(caStr string) (req *reqbase, err error) {
 	bt, err := base64.URLEncoding.DecodeString(caStr)
 	if err != nil {
-		log.Errorf("DecodeString:%s failed:%v", caStr, err)
-		return
+		return nil, fmt.Errorf("DecodeString failed:%v", err)
 	}
 	//bc := xxtea.XxteaDecrypt(bt)
 	bd, err := url.ParseQuery(string(bt))
 	if err != nil {
-		log.Errorf("ParseQuery:%s failed:%v", caStr, err)
-		return
+		return nil, fmt.Errorf("ParseQuery failed:%v", err)
 	}
 
 	req = &reqbase{
@@ -412,6 +460,8 @@ func CacheStr2Req(caStr string) (req *reqbase) {
 
 	req.cost, _ = strconv.ParseFloat(bd.Get("cost"), 64)
 	req.payout, _ = strconv.ParseFloat(bd.Get("payout"), 64)
+	req.trackedCost, _ = strconv.ParseFloat(bd.Get("tCost"), 64)
+	req.costTs, _ = strconv.ParseInt(bd.Get("costTs"), 10, 64)
 	req.impTimeStamp, _ = strconv.ParseInt(bd.Get("impTs"), 10, 64)
 	req.visitTimeStamp, _ = strconv.ParseInt(bd.Get("visitTs"), 10, 64)
 	req.clickTimeStamp, _ = strconv.ParseInt(bd.Get("clickTs"), 10, 64)
@@ -425,6 +475,7 @@ func CacheStr2Req(caStr string) (req *reqbase) {
 	req.landerId, _ = strconv.ParseInt(bd.Get("lId"), 10, 64)
 	req.offerId, _ = strconv.ParseInt(bd.Get("oId"), 10, 64)
 	req.optOfferId, _ = strconv.ParseInt(bd.Get("oOId"), 10, 64)
+	req.slot, _ = strconv.ParseInt(bd.Get("slot"), 10, 64)
 	req.affiliateId, _ = strconv.ParseInt(bd.Get("affId"), 10, 64)
 	req.optAffiliateId, _ = strconv.ParseInt(bd.Get("oAffId"), 10, 64)
 	req.bot, _ = strconv.ParseBool(bd.Get("bot"))
@@ -434,5 +485,5 @@ func CacheStr2Req(caStr string) (req *reqbase) {
 	//	req.tsCost = &common.TrafficSourceParams{}
 	//	req.tsCost.Decode(bd.Get("tsCost"))
 	req.tsVars = common.DecodeParams(bd.Get("tsVars"))
-	return
+	return req, nil
 }
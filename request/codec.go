@@ -0,0 +1,434 @@
+package request
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sync"
+
+	"Service/common"
+	"Service/config"
+)
+
+// click cache记录的二进制格式
+// 第一个字节为版本号，最高位表示后面的内容是否用deflate压缩过
+// 老的记录是url query的base64，第一个字节一定是base64的字符，所以可以和新格式区分开
+// MySQL的value是text，不能直接存二进制，所以存的是cacheArmor+base64(二进制)
+// 同一个版本内新加的字段只能加在最后，老的记录解出来新字段为零值
+const (
+	cacheCodecV1     byte = 0x01
+	cacheFlagDeflate byte = 0x80
+	cacheVersionMask byte = 0x7f
+	cacheArmor            = '~'
+)
+
+var errCacheTruncated = errors.New("cache record truncated")
+
+var codecOnce sync.Once
+var binaryCodec bool   // 是否使用二进制格式，否则还是用老的格式
+var compressCodec bool // 二进制格式是否压缩
+
+// loadCodec 读取[REQCACHE]的配置
+// 所有服务都能解新格式之后才能打开codec = binary
+func loadCodec() {
+	codecOnce.Do(func() {
+		binaryCodec = config.String("REQCACHE", "codec") == "binary"
+		compressCodec = config.Bool("REQCACHE", "compress")
+	})
+}
+
+// encodeCache 按照配置编码，local为保存到redis的值，remote为保存到MySQL的值
+func encodeCache(req *reqbase) (local, remote string) {
+	loadCodec()
+	if !binaryCodec {
+		v := req2QueryStr(req)
+		return v, v
+	}
+	b := marshalReq(req, compressCodec)
+	return string(b), armorCache(b)
+}
+
+func armorCache(b []byte) string {
+	return string(cacheArmor) + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCache 可以解所有格式的记录
+func decodeCache(caStr string) (*reqbase, error) {
+	if caStr == "" {
+		return nil, errors.New("empty cache record")
+	}
+	switch {
+	case caStr[0] == cacheArmor:
+		b, err := base64.RawURLEncoding.DecodeString(caStr[1:])
+		if err != nil {
+			return nil, err
+		}
+		return unmarshalReq(b)
+	case caStr[0]&cacheVersionMask == cacheCodecV1:
+		return unmarshalReq([]byte(caStr))
+	}
+	return queryStr2Req(caStr)
+}
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+var flateReaders = sync.Pool{
+	New: func() interface{} {
+		return flate.NewReader(nil)
+	},
+}
+
+// marshalReq compress为true时，只有压缩之后更小才会使用压缩的内容
+func marshalReq(req *reqbase, compress bool) []byte {
+	var e cacheEncoder
+	e.buf = make([]byte, 1, 512)
+	e.buf[0] = cacheCodecV1
+	e.req(req)
+	if !compress {
+		return e.buf
+	}
+
+	var out bytes.Buffer
+	out.WriteByte(cacheCodecV1 | cacheFlagDeflate)
+	fw := flateWriters.Get().(*flate.Writer)
+	fw.Reset(&out)
+	fw.Write(e.buf[1:])
+	fw.Close()
+	flateWriters.Put(fw)
+	if out.Len() >= len(e.buf) {
+		return e.buf
+	}
+	return out.Bytes()
+}
+
+func unmarshalReq(b []byte) (*reqbase, error) {
+	if len(b) == 0 {
+		return nil, errCacheTruncated
+	}
+	if v := b[0] & cacheVersionMask; v != cacheCodecV1 {
+		return nil, fmt.Errorf("unsupported cache record version %d", v)
+	}
+	body := b[1:]
+	if b[0]&cacheFlagDeflate != 0 {
+		fr := flateReaders.Get().(io.ReadCloser)
+		fr.(flate.Resetter).Reset(bytes.NewReader(body), nil)
+		var err error
+		body, err = ioutil.ReadAll(fr)
+		flateReaders.Put(fr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d := cacheDecoder{buf: body}
+	req := d.req()
+	if d.err != nil {
+		return nil, d.err
+	}
+	return req, nil
+}
+
+type cacheEncoder struct {
+	buf     []byte
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (e *cacheEncoder) uvarint(v uint64) {
+	n := binary.PutUvarint(e.scratch[:], v)
+	e.buf = append(e.buf, e.scratch[:n]...)
+}
+
+func (e *cacheEncoder) int(v int64) {
+	n := binary.PutVarint(e.scratch[:], v)
+	e.buf = append(e.buf, e.scratch[:n]...)
+}
+
+// float 把字节序反过来之后按varint保存，0.5,1,100这样的值只要一两个字节
+func (e *cacheEncoder) float(v float64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(v))
+	e.uvarint(binary.LittleEndian.Uint64(b[:]))
+}
+
+func (e *cacheEncoder) bool(v bool) {
+	if v {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *cacheEncoder) str(s string) {
+	e.uvarint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *cacheEncoder) strs(ss []string) {
+	e.uvarint(uint64(len(ss)))
+	for _, s := range ss {
+		e.str(s)
+	}
+}
+
+func (e *cacheEncoder) params(ps []common.TrafficSourceParams) {
+	e.uvarint(uint64(len(ps)))
+	for _, p := range ps {
+		e.str(p.Parameter)
+		e.str(p.Placeholder)
+		e.str(p.Name)
+		e.int(p.Track)
+	}
+}
+
+// req 字段的顺序不能改，新的字段只能加在最后，cacheDecoder.req要保持一致
+func (e *cacheEncoder) req(r *reqbase) {
+	e.str(r.id)
+	e.str(r.t)
+	e.str(r.ip)
+	e.str(r.ua)
+
+	e.str(r.externalId)
+	e.float(r.cost)
+	e.str(r.tsCId)
+	e.str(r.websiteId)
+	e.strs(r.vars)
+	e.float(r.payout)
+	e.float(r.trackedCost)
+	e.int(r.costTs)
+	e.str(r.txid)
+
+	e.int(r.trafficSourceId)
+	e.str(r.trafficSourceName)
+	e.int(r.userId)
+	e.str(r.userIdText)
+	e.str(r.campaignHash)
+	e.int(r.campaignId)
+	e.str(r.campaignName)
+	e.str(r.campaignCountry)
+	e.int(r.flowId)
+	e.str(r.flowName)
+	e.int(r.ruleId)
+	e.int(r.pathId)
+	e.int(r.landerId)
+	e.str(r.landerName)
+	e.int(r.offerId)
+	e.int(r.optOfferId)
+	e.int(r.slot)
+	e.str(r.offerName)
+	e.int(r.affiliateId)
+	e.int(r.optAffiliateId)
+	e.str(r.affiliateName)
+
+	e.int(r.impTimeStamp)
+	e.int(r.visitTimeStamp)
+	e.int(r.clickTimeStamp)
+	e.int(r.postbackTimeStamp)
+
+	e.str(r.deviceType)
+	e.str(r.trackingDomain)
+	e.str(r.trackingPath)
+	e.str(r.referrer)
+	e.str(r.referrerdomain)
+	e.str(r.language)
+	e.str(r.model)
+	e.str(r.brand)
+	e.str(r.countryCode)
+	e.str(r.countryName)
+	e.str(r.region)
+	e.str(r.city)
+	e.str(r.carrier)
+	e.str(r.isp)
+	e.str(r.os)
+	e.str(r.osVersion)
+	e.str(r.browser)
+	e.str(r.browserVersion)
+	e.str(r.connectionType)
+	e.bool(r.bot)
+	e.float(r.cpaValue)
+	e.params(r.tsVars)
+}
+
+// cacheDecoder 出错之后后面的读取都返回零值，最后检查err即可
+// 记录在字段的边界上结束时不算错误，后面的字段为零值
+type cacheDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *cacheDecoder) uvarint() uint64 {
+	if d.err != nil || len(d.buf) == 0 {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errCacheTruncated
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *cacheDecoder) int() int64 {
+	if d.err != nil || len(d.buf) == 0 {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errCacheTruncated
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *cacheDecoder) float() float64 {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], d.uvarint())
+	return math.Float64frombits(binary.BigEndian.Uint64(b[:]))
+}
+
+func (d *cacheDecoder) bool() bool {
+	if d.err != nil || len(d.buf) == 0 {
+		return false
+	}
+	v := d.buf[0] != 0
+	d.buf = d.buf[1:]
+	return v
+}
+
+func (d *cacheDecoder) str() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if uint64(len(d.buf)) < n {
+		d.err = errCacheTruncated
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+func (d *cacheDecoder) strs() []string {
+	n := d.uvarint()
+	if d.err != nil || n > uint64(len(d.buf)) { // 每个string至少一个字节
+		if d.err == nil {
+			d.err = errCacheTruncated
+		}
+		return nil
+	}
+	ss := make([]string, n)
+	for i := range ss {
+		ss[i] = d.str()
+	}
+	return ss
+}
+
+func (d *cacheDecoder) params() []common.TrafficSourceParams {
+	n := d.uvarint()
+	if d.err != nil || n == 0 || n > uint64(len(d.buf)) {
+		if d.err == nil && n > 0 {
+			d.err = errCacheTruncated
+		}
+		return nil
+	}
+	ps := make([]common.TrafficSourceParams, n)
+	for i := range ps {
+		ps[i].Parameter = d.str()
+		ps[i].Placeholder = d.str()
+		ps[i].Name = d.str()
+		ps[i].Track = d.int()
+	}
+	return ps
+}
+
+func (d *cacheDecoder) req() *reqbase {
+	r := &reqbase{
+		cookie:   make(map[string]string),
+		urlParam: make(map[string]string),
+	}
+	r.id = d.str()
+	r.t = d.str()
+	r.ip = d.str()
+	r.ua = d.str()
+
+	r.externalId = d.str()
+	r.cost = d.float()
+	r.tsCId = d.str()
+	r.websiteId = d.str()
+	r.vars = d.strs()
+	r.payout = d.float()
+	r.trackedCost = d.float()
+	r.costTs = d.int()
+	r.txid = d.str()
+
+	r.trafficSourceId = d.int()
+	r.trafficSourceName = d.str()
+	r.userId = d.int()
+	r.userIdText = d.str()
+	r.campaignHash = d.str()
+	r.campaignId = d.int()
+	r.campaignName = d.str()
+	r.campaignCountry = d.str()
+	r.flowId = d.int()
+	r.flowName = d.str()
+	r.ruleId = d.int()
+	r.pathId = d.int()
+	r.landerId = d.int()
+	r.landerName = d.str()
+	r.offerId = d.int()
+	r.optOfferId = d.int()
+	r.slot = d.int()
+	r.offerName = d.str()
+	r.affiliateId = d.int()
+	r.optAffiliateId = d.int()
+	r.affiliateName = d.str()
+
+	r.impTimeStamp = d.int()
+	r.visitTimeStamp = d.int()
+	r.clickTimeStamp = d.int()
+	r.postbackTimeStamp = d.int()
+
+	r.deviceType = d.str()
+	r.trackingDomain = d.str()
+	r.trackingPath = d.str()
+	r.referrer = d.str()
+	r.referrerdomain = d.str()
+	r.language = d.str()
+	r.model = d.str()
+	r.brand = d.str()
+	r.countryCode = d.str()
+	r.countryName = d.str()
+	r.region = d.str()
+	r.city = d.str()
+	r.carrier = d.str()
+	r.isp = d.str()
+	r.os = d.str()
+	r.osVersion = d.str()
+	r.browser = d.str()
+	r.browserVersion = d.str()
+	r.connectionType = d.str()
+	r.bot = d.bool()
+	r.cpaValue = d.float()
+	r.tsVars = d.params()
+
+	if len(r.vars) < VarsMaxNum {
+		// Vars(n)直接按下标取
+		vars := make([]string, VarsMaxNum)
+		copy(vars, r.vars)
+		r.vars = vars
+	}
+	return r
+}
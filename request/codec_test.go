@@ -0,0 +1,140 @@
+package request
+
+import (
+	"reflect"
+	"testing"
+)
+
+func legacyReq(t testing.TB) *reqbase {
+	req, err := queryStr2Req(cacheStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestCacheCodecRoundTrip(t *testing.T) {
+	req := legacyReq(t)
+	req.trackedCost = 0.0015
+	req.costTs = 1490292000000
+	req.slot = 2
+
+	for _, compress := range []bool{false, true} {
+		b := marshalReq(req, compress)
+		if compress && b[0]&cacheFlagDeflate == 0 {
+			t.Error("record is not compressed")
+		}
+		for _, v := range []string{string(b), armorCache(b)} {
+			got := CacheStr2Req(v)
+			if !reflect.DeepEqual(got, req) {
+				t.Errorf("compress(%v) round trip mismatch:\n%+v\n%+v", compress, got, req)
+			}
+		}
+	}
+}
+
+func TestCacheCodecLegacy(t *testing.T) {
+	req := CacheStr2Req(cacheStr)
+	if req == nil {
+		t.Fatal("legacy record should still be decoded")
+	}
+	if req.Id() != "2e8bb5118975f10bd05bb603414281b634" || req.OfferId() != 103 || req.Payout() != 0.5 {
+		t.Errorf("legacy record decoded as %s", req.String())
+	}
+}
+
+func TestCacheCodecTruncated(t *testing.T) {
+	b := marshalReq(legacyReq(t), false)
+	if _, err := unmarshalReq(b[:len(b)/2]); err == nil {
+		t.Error("truncated record should fail")
+	}
+
+	// 在字段边界结束的老记录，后面的字段为零值
+	var e cacheEncoder
+	e.buf = []byte{cacheCodecV1}
+	e.str("abc")
+	e.str(ReqLPOffer)
+	req, err := unmarshalReq(e.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.id != "abc" || req.t != ReqLPOffer || len(req.vars) != VarsMaxNum {
+		t.Errorf("short record decoded as %+v", req)
+	}
+
+	if _, err := unmarshalReq([]byte{0x05}); err == nil {
+		t.Error("unknown version should fail")
+	}
+}
+
+func TestCacheCodecSize(t *testing.T) {
+	req := legacyReq(t)
+	legacy := req2QueryStr(req)
+	plain := marshalReq(req, false)
+	compressed := marshalReq(req, true)
+	t.Logf("query:%d binary:%d(armored %d) deflate:%d(armored %d)",
+		len(legacy), len(plain), len(armorCache(plain)), len(compressed), len(armorCache(compressed)))
+	if len(armorCache(plain)) >= len(legacy) {
+		t.Errorf("binary record(%d) is not smaller than query record(%d)", len(armorCache(plain)), len(legacy))
+	}
+}
+
+func BenchmarkEncodeQuery(b *testing.B) {
+	req := legacyReq(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.SetBytes(int64(len(req2QueryStr(req))))
+	}
+}
+
+func BenchmarkEncodeBinary(b *testing.B) {
+	req := legacyReq(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.SetBytes(int64(len(marshalReq(req, false))))
+	}
+}
+
+func BenchmarkEncodeBinaryDeflate(b *testing.B) {
+	req := legacyReq(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.SetBytes(int64(len(marshalReq(req, true))))
+	}
+}
+
+func BenchmarkDecodeQuery(b *testing.B) {
+	v := req2QueryStr(legacyReq(b))
+	b.SetBytes(int64(len(v)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		CacheStr2Req(v)
+	}
+}
+
+func BenchmarkDecodeBinary(b *testing.B) {
+	v := string(marshalReq(legacyReq(b), false))
+	b.SetBytes(int64(len(v)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		CacheStr2Req(v)
+	}
+}
+
+func BenchmarkDecodeBinaryDeflate(b *testing.B) {
+	v := string(marshalReq(legacyReq(b), true))
+	b.SetBytes(int64(len(v)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		CacheStr2Req(v)
+	}
+}
+
+func BenchmarkDecodeArmored(b *testing.B) {
+	v := armorCache(marshalReq(legacyReq(b), false))
+	b.SetBytes(int64(len(v)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		CacheStr2Req(v)
+	}
+}
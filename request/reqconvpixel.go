@@ -0,0 +1,44 @@
+package request
+
+import (
+	"net/http"
+
+	"Service/common"
+	"Service/log"
+)
+
+type ConversionPixelRequest struct {
+	reqbase
+}
+
+func CreateConversionPixelRequest(reqId string, r *http.Request) Request {
+	breq, err := getReqCache(reqId, false)
+	if err != nil || breq == nil {
+		log.Errorf("[CreateConversionPixelRequest]Failed with reqId(%s) from %s with err(%v)\n",
+			reqId, common.SchemeHostURI(r), err)
+		return nil
+	}
+
+	breq.t = ReqConversionPixel
+	breq.trackingPath = r.URL.Path
+
+	return &ConversionPixelRequest{*breq}
+}
+
+type ConversionScriptRequest struct {
+	reqbase
+}
+
+func CreateConversionScriptRequest(reqId string, r *http.Request) Request {
+	breq, err := getReqCache(reqId, false)
+	if err != nil || breq == nil {
+		log.Errorf("[CreateConversionScriptRequest]Failed with reqId(%s) from %s with err(%v)\n",
+			reqId, common.SchemeHostURI(r), err)
+		return nil
+	}
+
+	breq.t = ReqConversionScript
+	breq.trackingPath = r.URL.Path
+
+	return &ConversionScriptRequest{*breq}
+}
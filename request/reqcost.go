@@ -0,0 +1,27 @@
+package request
+
+import (
+	"net/http"
+
+	"Service/common"
+	"Service/log"
+)
+
+// CostUpdateRequest TS事后通知某个click的实际cost
+type CostUpdateRequest struct {
+	reqbase
+}
+
+func CreateCostUpdateRequest(reqId string, r *http.Request) Request {
+	breq, err := getReqCache(reqId, false)
+	if err != nil || breq == nil {
+		log.Errorf("[CreateCostUpdateRequest]Failed with reqId(%s) from %s with err(%v)\n",
+			reqId, common.SchemeHostURI(r), err)
+		return nil
+	}
+
+	breq.t = ReqCostUpdate
+	breq.trackingPath = r.URL.Path
+
+	return &CostUpdateRequest{*breq}
+}
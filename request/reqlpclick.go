@@ -21,6 +21,7 @@ func CreateLPClickRequest(reqId string, r *http.Request) Request {
 
 	breq.t = ReqLPClick
 	breq.trackingPath = r.URL.Path
+	breq.setHttpRequest(r)
 
 	return &LPClickRequest{*breq}
 }
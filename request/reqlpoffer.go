@@ -15,6 +15,7 @@ func CreateLPOfferRequest(reqId string, r *http.Request, brandNew bool) (req *LP
 		if err == nil && breq != nil {
 			breq.t = ReqLPOffer
 			breq.trackingPath = r.URL.Path
+			breq.setHttpRequest(r)
 			return &LPOfferRequest{*breq}
 		}
 	}
@@ -17,6 +17,7 @@ const (
 	ReqUploadConversions = "conversions"
 	ReqConversionPixel   = "conversionpixel"
 	ReqConversionScript  = "conversionscript"
+	ReqCostUpdate        = "costupdate"
 )
 
 const (
@@ -38,9 +39,14 @@ type Request interface {
 
 	ExternalId() string
 	Cost() float64
+	// TrackedCost 已经记到统计里面的cost，以及记cost的统计时间点
+	TrackedCost() (cost float64, timestamp int64)
+	AddTrackedCost(cost float64, timestamp int64)
 	TSCampaignId() string
 	WebsiteId() string
-	Vars(n uint) string // n:0~VarsMaxNum-1
+	Vars(n uint) string            // n:0~VarsMaxNum-1
+	QueryParam(key string) string  // 当前http请求中的url参数
+	CookieValue(key string) string // 当前http请求中的cookie
 	ParseTSParams(
 		externalId common.TrafficSourceParams,
 		cost common.TrafficSourceParams,
@@ -80,6 +86,8 @@ type Request interface {
 	SetOfferId(id int64)
 	OptOfferId() int64
 	SetOptOfferId(id int64)
+	Slot() int64 // lander上/click/N的N，/click为0
+	SetSlot(slot int64)
 	OfferName() string
 	SetOfferName(name string)
 	AffiliateId() int64
@@ -142,6 +150,7 @@ type Request interface {
 	IPKey(timestamp int64) tracking.IPStatisKey
 	ReferrerKey(timestamp int64) tracking.ReferrerStatisKey
 	DomainKey(timestamp int64) tracking.ReferrerDomainStatisKey
+	SlotKey(timestamp int64) tracking.SlotStatisKey
 	ConversionKey() tracking.Conversion
 
 	// Payout
@@ -182,9 +191,11 @@ func CreateRequest(reqId string, brandNew bool, reqType string, r *http.Request)
 	case ReqUploadConversions:
 		req = CreateUploadConversionsRequest(reqId, r)
 	case ReqConversionPixel:
-		//TODO
+		req = CreateConversionPixelRequest(reqId, r)
 	case ReqConversionScript:
-		//TODO
+		req = CreateConversionScriptRequest(reqId, r)
+	case ReqCostUpdate:
+		req = CreateCostUpdateRequest(reqId, r)
 	}
 	if req == nil {
 		return nil, fmt.Errorf("CreateRequest failed for %s;%s;%s%s", reqType, reqId, r.Host, r.RequestURI)
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// checkpoint 记录SCAN的cursor和已经同步的数量，每一批写到remote之后保存
+type checkpoint struct {
+	path    string
+	cursor  uint64
+	scanned int64
+	synced  int64
+}
+
+// load 文件不存在时从头开始
+func (c *checkpoint) load() error {
+	b, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Sscanf(string(b), "%d %d %d", &c.cursor, &c.scanned, &c.synced); err != nil {
+		return fmt.Errorf("bad checkpoint %s:%v", c.path, err)
+	}
+	return nil
+}
+
+// save 先写临时文件再rename，保存到一半崩溃不会留下损坏的checkpoint
+func (c *checkpoint) save() error {
+	tmp := c.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d %d %d\n", c.cursor, c.scanned, c.synced)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, c.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("save checkpoint %s failed:%v", c.path, err)
+	}
+	return nil
+}
+
+// remove 同步完成之后删除，下次从头开始
+func (c *checkpoint) remove() error {
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -1,20 +1,24 @@
 package main
 
 import (
-	"database/sql"
 	"flag"
+	"fmt"
 	"os"
 	"runtime/debug"
-	"sync"
-	"sync/atomic"
-	"time"
 
+	"Service/clickstore"
 	"Service/config"
 	"Service/db"
 	"Service/log"
 	"Service/request"
 
-	"gopkg.in/redis.v5"
+	"github.com/go-redis/redis"
+)
+
+var (
+	checkpointPath = flag.String("checkpoint", "sclicks.checkpoint", "checkpoint file, the sync resumes from it after a crash")
+	scanCount      = flag.Int64("count", 1000, "number of keys per SCAN")
+	restart        = flag.Bool("restart", false, "ignore the checkpoint and scan from the beginning")
 )
 
 func main() {
@@ -27,6 +31,10 @@ func main() {
 	if err := config.LoadConfig(true); err != nil {
 		panic(err.Error())
 	}
+	if config.PrintConfigRequested() {
+		config.Print(os.Stdout)
+		return
+	}
 
 	logAdapter := config.String("LOG", "adapter")
 	logConfig := config.String("LOG", "jsonconfig")
@@ -50,57 +58,91 @@ func main() {
 	}
 	log.Debugf("Connect LOCALREQCACHE redis success: localRedis:%p", localRedis)
 
-	remoteDB := db.GetDB("REMOTEREQCACHE")
-	if remoteDB == nil {
-		log.Error("Connect REMOTEREQCACHE db failed.")
+	remote := clickstore.Get(clickstore.Remote)
+	if remote == nil {
+		log.Errorf("Open %s remote click store failed.", clickstore.Kind(clickstore.Remote))
 		return
 	}
-	log.Debugf("Connect REMOTEREQCACHE redis success: remoteDB:%p", remoteDB)
-
-	request.InitRemoteCacheStmt()
-	defer request.CloseRemoteCacheStmt()
+	defer clickstore.CloseAll()
 
-	if err := SyncLocalClicksToRemote(localRedis, remoteDB); err != nil {
+	cp := &checkpoint{path: *checkpointPath}
+	if !*restart {
+		if err := cp.load(); err != nil {
+			panic(err.Error())
+		}
+	}
+	if err := SyncLocalClicksToRemote(localRedis, remote, cp); err != nil {
 		panic(err.Error())
 	}
 }
 
-func SyncLocalClicksToRemote(localRedis *redis.Client, remoteDB *sql.DB) (err error) {
-	keys, err := localRedis.Keys("*").Result()
-	if err != nil {
-		return err
+// SyncLocalClicksToRemote 用SCAN遍历local redis，每一批写到remote之后记录checkpoint，
+// 中途退出的话下次从checkpoint的cursor继续
+func SyncLocalClicksToRemote(localRedis *redis.Client, remote clickstore.ClickStore, cp *checkpoint) error {
+	if cp.cursor != 0 {
+		log.Infof("[SyncLocalClicksToRemote]resume from cursor %d, %d scanned, %d synced\n", cp.cursor, cp.scanned, cp.synced)
 	}
-	log.Infof("[SyncLocalClicksToRemote]%d clicks got!\n", len(keys))
+	cursor := cp.cursor
+	for {
+		keys, next, err := localRedis.Scan(cursor, "*", *scanCount).Result()
+		if err != nil {
+			return fmt.Errorf("scan from cursor %d failed:%v", cursor, err)
+		}
 
-	str := ""
-	i := int64(0)
-	wait := sync.WaitGroup{}
-	for _, key := range keys {
-		str, err = localRedis.Get(key).Result()
+		items, err := clicksToSync(localRedis, keys)
 		if err != nil {
-			log.Errorf("[SyncLocalClicksToRemote]localRedis.Get(%s) failed with err(%s)\n", key, err.Error())
-			continue
+			return err
+		}
+		if len(items) > 0 {
+			// 写失败时不更新checkpoint，下次重新同步这一批
+			if err := remote.SetMulti(items); err != nil {
+				return fmt.Errorf("save %d clicks from cursor %d failed:%v", len(items), cursor, err)
+			}
 		}
+
+		cp.scanned += int64(len(keys))
+		cp.synced += int64(len(items))
+		if next == 0 {
+			break
+		}
+		cp.cursor = next
+		if err := cp.save(); err != nil {
+			return err
+		}
+		cursor = next
+	}
+	log.Infof("[SyncLocalClicksToRemote]%d keys scanned, %d clicks synced!\n", cp.scanned, cp.synced)
+	return cp.remove()
+}
+
+// clicksToSync 取出keys对应的click，只同步到达offer或者直接访问campaign(没有flow)的click
+func clicksToSync(localRedis *redis.Client, keys []string) ([]clickstore.Item, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	values, err := localRedis.MGet(keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("mget %d keys failed:%v", len(keys), err)
+	}
+	items := make([]clickstore.Item, 0, len(keys))
+	for i, v := range values {
+		str, _ := v.(string)
+		if str == "" {
+			continue // 已经过期
+		}
+		// local里面还有postback去重、访问频次等其它的key，解不出来的跳过
 		req := request.CacheStr2Req(str)
 		if req == nil {
-			log.Errorf("[SyncLocalClicksToRemote]request.CacheStr2Req(%s) failed for key(%s)\n", str, key)
+			log.Debugf("[clicksToSync]key(%s) is not a click\n", keys[i])
 			continue
 		}
-
 		if req.OfferId() > 0 || (req.CampaignId() > 0 && req.FlowId() == 0) {
-			wait.Add(1)
-			go func(req request.Request) {
-				if !req.CacheSave(time.Duration(-1), config.ClickCacheTime) {
-					log.Errorf("[SyncLocalClicksToRemote]req.CacheSave failed for key(%s)\n", key)
-				} else {
-					log.Debugf("[SyncLocalClicksToRemote]req.CacheSave finished for key(%s)\n", key)
-				}
-				atomic.AddInt64(&i, 1)
-				wait.Done()
-			}(req)
+			items = append(items, clickstore.Item{
+				Key:   keys[i],
+				Value: request.Req2cacheStr(req),
+				TTL:   config.ClickCacheTime(),
+			})
 		}
 	}
-	wait.Wait()
-	log.Infof("[SyncLocalClicksToRemote]%d clicks synced!\n", i)
-	return nil
+	return items, nil
 }
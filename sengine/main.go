@@ -6,7 +6,6 @@ import (
 	"net/http"
 	"os"
 	"runtime/debug"
-	"time"
 
 	_ "Service/util/pprof"
 
@@ -19,11 +18,13 @@ import (
 	"Service/request"
 	"Service/servehttp"
 	"Service/tracking"
+	"Service/tracking/eventlog"
 	"Service/units"
 	"Service/units/blacklist"
 	"Service/units/user"
 	"Service/util/ip"
 	"Service/util/ip2location"
+	"Service/util/metrics"
 )
 
 func main() {
@@ -33,7 +34,7 @@ func main() {
 	}()
 
 	help := flag.Bool("help", false, "show help")
-	blacklistPath := flag.String("blacklist", "", "global blacklist.txt path. If it's empty, disable global blacklist. You can download blacklist here: https://myip.ms/files/blacklist/general/full_blacklist_database.zip")
+	blacklistPath := flag.String("blacklist", "", "global blacklist.txt path. If it's empty, use [BLACKLIST] path in config, and disable global blacklist if both are empty. You can download blacklist here: https://myip.ms/files/blacklist/general/full_blacklist_database.zip")
 
 	flag.Parse()
 	if *help {
@@ -44,33 +45,39 @@ func main() {
 	if err := config.LoadConfig(true); err != nil {
 		panic(err.Error())
 	}
-
-	common.Init(config.GetSvrUniqueStr(), "")
-
-	logAdapter := config.String("LOG", "adapter")
-	logConfig := config.String("LOG", "jsonconfig")
-	logAsync := config.Bool("LOG", "async")
-	if logAdapter == "" {
-		logAdapter = "console"
+	if config.PrintConfigRequested() {
+		config.Print(os.Stdout)
+		return
 	}
 
-	if logConfig == "" {
-		logConfig = `{"level":7}`
-	}
+	common.Init(config.GetSvrUniqueStr(), "")
 
-	log.Init(logAdapter, logConfig, logAsync)
+	log.Init(config.LogSettings())
+	// 日志的配置可以在线修改
+	config.OnReload(func() error {
+		return log.Reload(config.LogSettings())
+	}, "LOG:adapter", "LOG:jsonconfig", "LOG:async")
 	defer func() {
 		log.Flush()
 	}()
 
 	common.WritePidFile()
 
+	// SIGHUP重新加载配置
+	config.WatchReloadSignal()
+
 	bnotify.Start()
 
-	if len(*blacklistPath) != 0 {
-		if err := blacklist.EnableBlacklist(*blacklistPath); err != nil {
-			log.Errorf("EnableBlacklist with path:%v failed:%v", *blacklistPath, err)
-		}
+	// -blacklist优先，没有指定时使用[BLACKLIST] path，并且可以在线修改
+	path := *blacklistPath
+	if len(path) == 0 {
+		path = config.String("BLACKLIST", "path")
+		config.OnReload(func() error {
+			return useBlacklist(config.String("BLACKLIST", "path"))
+		}, "BLACKLIST:path")
+	}
+	if err := useBlacklist(path); err != nil {
+		log.Errorf("EnableBlacklist with path:%v failed:%v", path, err)
 	}
 
 	ip2location.Open(config.String("IP", "path"))
@@ -92,21 +99,10 @@ func main() {
 
 	// 启动汇总协程
 	gracequit.StartGoroutine(func(c gracequit.StopSigChan) {
-		secondsAdStatis := config.Int("TRACKING", "adstatis-interval")
-		interval := time.Duration(secondsAdStatis) * time.Second
-		if interval == 0 {
-			log.Warnf("config: TRACKING:adstatis-interval not found. Using default interval: 10 minutes")
-			interval = 10 * 60 * time.Second
-		}
-		tracking.Gathering(c, interval)
+		tracking.Gathering(c, tracking.GatherInterval("adstatis-interval"))
 	})
 
-	secondsIpReferrerDomain := config.Int("TRACKING", "ip-interval")
-	interval := time.Duration(secondsIpReferrerDomain) * time.Second
-	if interval == 0 {
-		log.Warnf("config: TRACKING:ip-interval not found. Using default interval: 10 minutes")
-		interval = 10 * 60 * time.Second
-	}
+	interval := tracking.GatherInterval("ip-interval")
 
 	// 启动AdIPStatis表的汇总协程
 	tracking.InitIPGatherSaver(&gracequit.G, db.GetDB("DB"), interval)
@@ -117,6 +113,14 @@ func main() {
 	// 启动AdReferrerDomainStatis表的汇总协程
 	tracking.InitDomainGatherSaver(&gracequit.G, db.GetDB("DB"), interval)
 
+	// 启动AdLanderSlotStatis表的汇总协程
+	tracking.InitSlotGatherSaver(&gracequit.G, db.GetDB("DB"), interval)
+
+	// 启动原始事件日志的写入，没有开启时不启动
+	if err := eventlog.Init(&gracequit.G); err != nil {
+		log.Errorf("eventlog.Init failed:%v", err)
+	}
+
 	request.InitRemoteCacheStmt(
 		config.Bool("REMOTEREQCACHE", "asyncwrite"),
 		config.Int("REMOTEREQCACHE", "asyncbuffer"))
@@ -166,19 +170,26 @@ func main() {
 	collector.Update()
 	defer collector.Close()
 
+	if err := units.InitMetrics(http.DefaultServeMux); err != nil {
+		log.Errorf("units.InitMetrics failed:%v", err)
+	}
+	units.InitHealth(http.DefaultServeMux, true)
+
 	http.Handle("/favicon.ico", http.NotFoundHandler())
 	http.HandleFunc("/robots.txt", robots)
-	http.HandleFunc("/dmr", units.OnDoubleMetaRefresh)
+	http.HandleFunc("/dmr", metrics.Instrument("OnDoubleMetaRefresh", units.OnDoubleMetaRefresh))
 	http.HandleFunc("/status", Status)
 	http.HandleFunc("/status/", Status)
-	http.HandleFunc(config.String("DEFAULT", "lpofferrequrl"), units.OnLPOfferRequest)
-	http.HandleFunc(config.String("DEFAULT", "lpclickurl"), units.OnLandingPageClick)
-	http.HandleFunc(config.String("DEFAULT", "lpclickopturl"), units.OnLandingPageClick)
-	http.HandleFunc(config.String("DEFAULT", "impressionurl"), units.OnImpression)
+	http.HandleFunc(config.String("DEFAULT", "lpofferrequrl"), metrics.Instrument("OnLPOfferRequest", units.OnLPOfferRequest))
+	http.HandleFunc(config.String("DEFAULT", "lpclickurl"), metrics.Instrument("OnLandingPageClick", units.OnLandingPageClick))
+	http.HandleFunc(config.String("DEFAULT", "lpclickopturl"), metrics.Instrument("OnLandingPageClick", units.OnLandingPageClick))
+	http.HandleFunc(config.String("DEFAULT", "impressionurl"), metrics.Instrument("OnImpression", units.OnImpression))
 
 	reqServer := &http.Server{Addr: ":" + config.GetEnginePort(), Handler: http.DefaultServeMux}
 	log.Info("Start listening request at", config.GetEnginePort())
-	log.Error(servehttp.Serve(reqServer))
+	if err := servehttp.ServeDrainable(reqServer); err != nil {
+		log.Error(err)
+	}
 	log.Infof("http server stopped. stopping other goroutines...")
 	// 只需要在HTTP服务器退出的时候，等待协程退出
 
@@ -189,6 +200,15 @@ func main() {
 	log.Infof("%d Quit main()\n", os.Getpid())
 }
 
+// useBlacklist path为空时禁用全局黑名单，加载失败时保持原来的
+func useBlacklist(path string) error {
+	if len(path) == 0 {
+		blacklist.DisableBlacklist()
+		return nil
+	}
+	return blacklist.EnableBlacklist(path)
+}
+
 func Status(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "It works!")
 }
@@ -0,0 +1,68 @@
+package servehttp
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"Service/config"
+	"Service/health"
+	"Service/log"
+)
+
+const (
+	defaultDrainDelay   = 5 * time.Second
+	defaultDrainTimeout = 30 * time.Second
+)
+
+// ServeDrainable 和Serve一样，另外在health.Drain之后：
+// 先等[HEALTH] drain-delay秒，这段时间/readyz失败，负载均衡把流量切走；
+// 然后Shutdown，最多等drain-timeout秒让正在处理的请求完成，再返回nil。
+// 调用者返回之后再gracequit.StopAll，把汇总的数据写完
+func ServeDrainable(servers ...*http.Server) error {
+	delay := time.Duration(config.Int("HEALTH", "drain-delay")) * time.Second
+	if delay <= 0 {
+		delay = defaultDrainDelay
+	}
+	timeout := time.Duration(config.Int("HEALTH", "drain-timeout")) * time.Second
+	if timeout <= 0 {
+		timeout = defaultDrainTimeout
+	}
+
+	done := make(chan struct{})
+	shutdown := make(chan struct{})
+	go func() {
+		select {
+		case <-health.Drained():
+		case <-done:
+			return
+		}
+		log.Infof("[servehttp][ServeDrainable] draining, shutdown in %v", delay)
+		time.Sleep(delay)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		var wg sync.WaitGroup
+		for _, s := range servers {
+			wg.Add(1)
+			go func(s *http.Server) {
+				defer wg.Done()
+				if err := s.Shutdown(ctx); err != nil {
+					log.Errorf("[servehttp][ServeDrainable] shutdown %s failed:%v", s.Addr, err)
+				}
+			}(s)
+		}
+		wg.Wait()
+		close(shutdown)
+	}()
+
+	err := Serve(servers...)
+	close(done)
+	if health.Draining() {
+		// Serve在listener关闭的时候就返回了，还要等正在处理的请求完成
+		<-shutdown
+		log.Infof("[servehttp][ServeDrainable] drained")
+		return nil
+	}
+	return err
+}
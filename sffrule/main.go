@@ -38,17 +38,17 @@ func main() {
 
 	// 只用监控FFRule的变化即可
 	user.SubscribeElement(user.ElementFFRule)
-	collector := new(user.CollectorCampChangedUsers)
+	// 和sengine/spostback一样，加载期间收到的变化由collector在加载完之后处理
+	collector := user.NewCollectorCampChangeUsers()
 	collector.Start()
 
 	if err := ffrule.InitAllRules(); err != nil {
 		panic(err.Error())
 	}
-	collector.Stop()
-	reloader := new(user.Reloader)
-	go reloader.Running()
 
-	log.Infof("collected users:%+v", collector.Users)
+	collector.Update()
+	defer collector.Close()
+
 	// redis 要能够连接
 	redisClient := db.GetRedisClient("MSGQUEUE")
 	if redisClient == nil {
@@ -57,12 +57,13 @@ func main() {
 	}
 	log.Debugf("Connect MSGQUEUE redis success: redisClient:%p", redisClient)
 
+	// LOCALFFCACHE连不上时consumer会自己重试
 	redisClient = db.GetRedisClient("LOCALFFCACHE")
 	if redisClient == nil {
-		log.Errorf("Connect LOCALFFCACHE redis server failed.")
-		return
+		log.Errorf("Connect LOCALFFCACHE redis server failed, will retry.")
+	} else {
+		log.Debugf("Connect LOCALFFCACHE redis success: redisClient:%p", redisClient)
 	}
-	log.Debugf("Connect LOCALFFCACHE redis success: redisClient:%p", redisClient)
 
 	if err := ffrule.Start(ffrule.ModeConsumer); err != nil {
 		panic(err.Error())
@@ -32,6 +32,10 @@ func main() {
 	if err := config.LoadConfig(true); err != nil {
 		panic(err.Error())
 	}
+	if config.PrintConfigRequested() {
+		config.Print(os.Stdout)
+		return
+	}
 
 	//log
 	var logAdapter, logConfig string
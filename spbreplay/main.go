@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"Service/config"
+	"Service/log"
+	"Service/units/tspostback"
+)
+
+// spbreplay 查看或者重发往traffic source发送失败(dead letter)的postback
+// 重发只是把记录放回TSPostbackLog队列，由运行中的spostback负责发送
+func main() {
+	clickId := flag.String("clickid", "", "only the postbacks of this click id")
+	campaignId := flag.Int64("campaign", 0, "only the postbacks of this campaign")
+	limit := flag.Int("limit", 1000, "max number of postbacks to list or replay")
+	list := flag.Bool("list", false, "list dead letters instead of replaying them")
+	status := flag.Bool("status", false, "show the delivery status of -clickid")
+	flag.Parse()
+
+	if err := config.LoadConfig(true); err != nil {
+		panic(err.Error())
+	}
+	if config.PrintConfigRequested() {
+		config.Print(os.Stdout)
+		return
+	}
+
+	logAdapter := config.String("LOG", "adapter")
+	logConfig := config.String("LOG", "jsonconfig")
+	if logAdapter == "" {
+		logAdapter = "console"
+	}
+	if logConfig == "" {
+		logConfig = `{"level":7}`
+	}
+	log.Init(logAdapter, logConfig, false)
+	defer log.Flush()
+
+	switch {
+	case *status:
+		if *clickId == "" {
+			fmt.Fprintln(os.Stderr, "-status requires -clickid")
+			os.Exit(2)
+		}
+		ds, err := tspostback.DBGetDeliveries(*clickId)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		printDeliveries(ds)
+	case *list:
+		ds, err := tspostback.DBGetDeadLetters(*clickId, *campaignId, *limit)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		printDeliveries(ds)
+	default:
+		n, err := tspostback.Replay(*clickId, *campaignId, *limit)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%d postbacks requeued\n", n)
+	}
+}
+
+func printDeliveries(ds []tspostback.Delivery) {
+	for _, d := range ds {
+		fmt.Printf("%d\t%s\tcampaign:%d\tstatus:%d\tattempts:%d\thttp:%d\tlast:%s\tdelivered:%s\t%s\t%s\n",
+			d.Id, d.ClickId, d.CampaignId, d.Status, d.Attempts, d.HttpStatus,
+			unixTime(d.LastAttemptAt), unixTime(d.DeliveredAt), d.Url, d.LastError)
+	}
+}
+
+func unixTime(t int64) string {
+	if t == 0 {
+		return "-"
+	}
+	return time.Unix(t, 0).Format(time.RFC3339)
+}
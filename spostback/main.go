@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
 
 	_ "Service/util/pprof"
 
@@ -16,11 +17,13 @@ import (
 	"Service/request"
 	"Service/servehttp"
 	"Service/tracking"
+	"Service/tracking/eventlog"
 	"Service/units"
 	_ "Service/units/blacklist"
+	"Service/units/tspostback"
 	"Service/units/user"
 	"Service/util/ip"
-	"time"
+	"Service/util/metrics"
 )
 
 func main() {
@@ -34,25 +37,27 @@ func main() {
 	if err := config.LoadConfig(true); err != nil {
 		panic(err.Error())
 	}
+	if config.PrintConfigRequested() {
+		config.Print(os.Stdout)
+		return
+	}
 
 	common.Init(config.GetSvrUniqueStr(), "")
 
-	logAdapter := config.String("LOG", "adapter")
-	logConfig := config.String("LOG", "jsonconfig")
-	logAsync := config.Bool("LOG", "async")
-	if logAdapter == "" {
-		logAdapter = "console"
-	}
-	if logConfig == "" {
-		logConfig = `{"level":7}`
-	}
-	log.Init(logAdapter, logConfig, logAsync)
+	log.Init(config.LogSettings())
+	// 日志的配置可以在线修改
+	config.OnReload(func() error {
+		return log.Reload(config.LogSettings())
+	}, "LOG:adapter", "LOG:jsonconfig", "LOG:async")
 	defer func() {
 		log.Flush()
 	}()
 
 	common.WritePidFile()
 
+	// SIGHUP重新加载配置
+	config.WatchReloadSignal()
+
 	bnotify.Start()
 
 	// 启动保存协程
@@ -65,23 +70,17 @@ func main() {
 		tracking.SavingConversions(db.GetDB("DB"), c)
 	})
 
+	// 启动往traffic source的postback发送
+	gracequit.StartGoroutine(func(c gracequit.StopSigChan) {
+		tspostback.Delivering(c)
+	})
+
 	// 启动汇总协程
 	gracequit.StartGoroutine(func(c gracequit.StopSigChan) {
-		secondsAdStatis := config.Int("TRACKING", "adstatis-interval")
-		interval := time.Duration(secondsAdStatis) * time.Second
-		if interval == 0 {
-			log.Warnf("config: TRACKING:adstatis-interval not found. Using default interval: 10 minutes")
-			interval = 10 * 60 * time.Second
-		}
-		tracking.Gathering(c, interval)
+		tracking.Gathering(c, tracking.GatherInterval("adstatis-interval"))
 	})
 
-	secondsIpReferrerDomain := config.Int("TRACKING", "ip-interval")
-	interval := time.Duration(secondsIpReferrerDomain) * time.Second
-	if interval == 0 {
-		log.Warnf("config: TRACKING:ip-interval not found. Using default interval: 10 minutes")
-		interval = 10 * 60 * time.Second
-	}
+	interval := tracking.GatherInterval("ip-interval")
 
 	// Postback不需要ip库的支持
 	//ip2location.Open(config.String("IP", "path"))
@@ -95,6 +94,14 @@ func main() {
 	// 启动AdReferrerDomainStatis表的汇总协程
 	tracking.InitDomainGatherSaver(&gracequit.G, db.GetDB("DB"), interval)
 
+	// 启动AdLanderSlotStatis表的汇总协程
+	tracking.InitSlotGatherSaver(&gracequit.G, db.GetDB("DB"), interval)
+
+	// 启动原始事件日志的写入，没有开启时不启动
+	if err := eventlog.Init(&gracequit.G); err != nil {
+		log.Errorf("eventlog.Init failed:%v", err)
+	}
+
 	request.InitRemoteCacheStmt(
 		config.Bool("REMOTEREQCACHE", "asyncwrite"),
 		config.Int("REMOTEREQCACHE", "asyncbuffer"))
@@ -142,15 +149,24 @@ func main() {
 	defer collector.Close()
 
 
+	if err := units.InitMetrics(http.DefaultServeMux); err != nil {
+		log.Errorf("units.InitMetrics failed:%v", err)
+	}
+	units.InitHealth(http.DefaultServeMux, false)
+
 	http.HandleFunc("/status", Status)
 	http.Handle("/favicon.ico", http.NotFoundHandler())
 	http.HandleFunc("/robots.txt", robots)
-	http.HandleFunc(config.String("DEFAULT", "s2spostback"), OnS2SPostback)
-	http.HandleFunc(config.String("DEFAULT", "conversionUpload"), OnUploadConversions)
-	http.HandleFunc(config.String("DEFAULT", "conversionpixelurl"), OnConversionPixel)
-	http.HandleFunc(config.String("DEFAULT", "conversionscripturl"), OnConversionScript)
-
-	log.Error(StartServe())
+	http.HandleFunc(config.String("DEFAULT", "s2spostback"), metrics.Instrument("OnS2SPostback", OnS2SPostback))
+	http.HandleFunc(config.String("DEFAULT", "conversionUpload"), metrics.Instrument("OnUploadConversions", OnUploadConversions))
+	http.HandleFunc(config.String("DEFAULT", "costUpload"), metrics.Instrument("OnUploadCosts", OnUploadCosts))
+	http.HandleFunc(config.String("DEFAULT", "conversionpixelurl"), metrics.Instrument("OnConversionPixel", OnConversionPixel))
+	http.HandleFunc(config.String("DEFAULT", "conversionscripturl"), metrics.Instrument("OnConversionScript", OnConversionScript))
+	http.HandleFunc(config.String("DEFAULT", "costupdateurl"), metrics.Instrument("OnCostUpdate", OnCostUpdate))
+
+	if err := StartServe(); err != nil {
+		log.Error(err)
+	}
 
 	log.Infof("stopping background goroutines...")
 	gracequit.StopAll()
@@ -160,7 +176,7 @@ func main() {
 func StartServe() error {
 	reqServer := &http.Server{Addr: ":" + config.GetPostbackPort(), Handler: http.DefaultServeMux}
 	log.Info("Start listening postback at", config.GetPostbackPort())
-	return servehttp.Serve(reqServer) // reqServer.ListenAndServe()
+	return servehttp.ServeDrainable(reqServer) // reqServer.ListenAndServe()
 }
 
 func Status(w http.ResponseWriter, r *http.Request) {
@@ -182,34 +198,36 @@ func OnUploadConversions(w http.ResponseWriter, r *http.Request) {
 	units.OnUploadConversions(w, r)
 }
 
-const base64GifPixel = "R0lGODlhAQABAIAAAP///wAAACwAAAAAAQABAAACAkQBADs="
+func OnUploadCosts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	units.OnUploadCosts(w, r)
+}
 
 func OnConversionPixel(w http.ResponseWriter, r *http.Request) {
-	//TODO 去除重复的clickId和transactionId的conversions
 	if r.Method != http.MethodGet {
 		http.NotFound(w, r)
 		return
 	}
-	w.WriteHeader(http.StatusNoContent)
-
 	units.OnConversionPixel(w, r)
-
-	/* 备忘
-	w.Header().Set("Content-Type", "image/gif")
-	output, _ := base64.StdEncoding.DecodeString(base64GifPixel)
-	w.Write(output)
-	*/
 }
 
 func OnConversionScript(w http.ResponseWriter, r *http.Request) {
-	//TODO 去除重复的clickId和transactionId的conversions
 	if r.Method != http.MethodGet {
 		http.NotFound(w, r)
 		return
 	}
-	w.WriteHeader(http.StatusNoContent)
 	units.OnConversionScript(w, r)
+}
 
+func OnCostUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	units.OnCostUpdate(w, r)
 }
 
 var robotsTxt = []byte(`User-agent: *
@@ -0,0 +1,191 @@
+-- [STATSSINK] sinks里面有clickhouse时使用，列名和tracking里面结构体的字段名一致
+-- 同一个key的多行由SummingMergeTree在合并时累加，查询时仍然要用sum()
+-- 重试的批次带着同一个insert_deduplication_token，non_replicated_deduplication_window让ClickHouse去掉重复的，
+-- 否则超时之后的重试会重复累加。已经建好的表(其它几个统计表一样)：
+-- ALTER TABLE AdStatis MODIFY SETTING non_replicated_deduplication_window = 1000;
+
+CREATE TABLE AdStatis (
+  `UserID` Int64,
+  `CampaignID` Int64,
+  `CampaignName` String,
+  `FlowID` Int64,
+  `FlowName` String,
+  `LanderID` Int64,
+  `LanderName` String,
+  `OfferID` Int64,
+  `OfferName` String,
+  `AffiliateNetworkID` Int64,
+  `AffiliateNetworkName` String,
+  `TrafficSourceID` Int64,
+  `TrafficSourceName` String,
+  `Language` String,
+  `Model` String,
+  `Country` String,
+  `City` String,
+  `Region` String,
+  `ISP` String,
+  `MobileCarrier` String,
+  `Domain` String,
+  `DeviceType` String,
+  `Brand` String,
+  `OS` String,
+  `OSVersion` String,
+  `Browser` String,
+  `BrowserVersion` String,
+  `ConnectionType` String,
+  `Timestamp` Int64,
+  `V1` String,
+  `V2` String,
+  `V3` String,
+  `V4` String,
+  `V5` String,
+  `V6` String,
+  `V7` String,
+  `V8` String,
+  `V9` String,
+  `V10` String,
+  `TSCampaignId` String,
+  `TSWebsiteId` String,
+  `KeysMD5` String,
+  `Visits` Int64,
+  `Clicks` Int64,
+  `Conversions` Int64,
+  `Cost` Int64 COMMENT '累计的开销(实际的值x1000000)',
+  `Revenue` Int64 COMMENT '累计的收益(实际的值x1000000)',
+  `Impressions` Int64
+) ENGINE = SummingMergeTree((Visits, Clicks, Conversions, Cost, Revenue, Impressions))
+PARTITION BY toYYYYMM(toDateTime(intDiv(Timestamp, 1000)))
+ORDER BY (UserID, Timestamp, CampaignID, KeysMD5)
+SETTINGS non_replicated_deduplication_window = 1000;
+
+
+CREATE TABLE AdIPStatis (
+  `UserID` Int64,
+  `Timestamp` Int64,
+  `CampaignID` Int64,
+  `IP` String,
+  `Visits` Int64,
+  `Clicks` Int64,
+  `Conversions` Int64,
+  `Cost` Int64 COMMENT '累计的开销(实际的值x1000000)',
+  `Revenue` Int64 COMMENT '累计的收益(实际的值x1000000)',
+  `Impressions` Int64
+) ENGINE = SummingMergeTree((Visits, Clicks, Conversions, Cost, Revenue, Impressions))
+PARTITION BY toYYYYMM(toDateTime(intDiv(Timestamp, 1000)))
+ORDER BY (UserID, Timestamp, CampaignID, IP)
+SETTINGS non_replicated_deduplication_window = 1000;
+
+
+CREATE TABLE AdReferrerStatis (
+  `UserID` Int64,
+  `Timestamp` Int64,
+  `CampaignID` Int64,
+  `Referrer` String,
+  `Visits` Int64,
+  `Clicks` Int64,
+  `Conversions` Int64,
+  `Cost` Int64 COMMENT '累计的开销(实际的值x1000000)',
+  `Revenue` Int64 COMMENT '累计的收益(实际的值x1000000)',
+  `Impressions` Int64
+) ENGINE = SummingMergeTree((Visits, Clicks, Conversions, Cost, Revenue, Impressions))
+PARTITION BY toYYYYMM(toDateTime(intDiv(Timestamp, 1000)))
+ORDER BY (UserID, Timestamp, CampaignID, Referrer)
+SETTINGS non_replicated_deduplication_window = 1000;
+
+
+CREATE TABLE AdReferrerDomainStatis (
+  `UserID` Int64,
+  `Timestamp` Int64,
+  `CampaignID` Int64,
+  `ReferrerDomain` String,
+  `Visits` Int64,
+  `Clicks` Int64,
+  `Conversions` Int64,
+  `Cost` Int64 COMMENT '累计的开销(实际的值x1000000)',
+  `Revenue` Int64 COMMENT '累计的收益(实际的值x1000000)',
+  `Impressions` Int64
+) ENGINE = SummingMergeTree((Visits, Clicks, Conversions, Cost, Revenue, Impressions))
+PARTITION BY toYYYYMM(toDateTime(intDiv(Timestamp, 1000)))
+ORDER BY (UserID, Timestamp, CampaignID, ReferrerDomain)
+SETTINGS non_replicated_deduplication_window = 1000;
+
+
+CREATE TABLE AdLanderSlotStatis (
+  `UserID` Int64,
+  `Timestamp` Int64,
+  `CampaignID` Int64,
+  `LanderID` Int64,
+  `Slot` Int64,
+  `OfferID` Int64,
+  `Visits` Int64,
+  `Clicks` Int64,
+  `Conversions` Int64,
+  `Cost` Int64 COMMENT '累计的开销(实际的值x1000000)',
+  `Revenue` Int64 COMMENT '累计的收益(实际的值x1000000)',
+  `Impressions` Int64
+) ENGINE = SummingMergeTree((Visits, Clicks, Conversions, Cost, Revenue, Impressions))
+PARTITION BY toYYYYMM(toDateTime(intDiv(Timestamp, 1000)))
+ORDER BY (UserID, Timestamp, CampaignID, LanderID, Slot, OfferID)
+SETTINGS non_replicated_deduplication_window = 1000;
+
+
+-- [EVENTLOG] output = clickhouse时使用，每一次impression/visit/click/postback一行，cost对账的调整也是一行(Event为costupdate)
+CREATE TABLE RawEvents (
+  `Event` String,
+  `Step` String,
+  `Time` Int64,
+  `RequestID` String,
+  `UserID` Int64,
+  `CampaignID` Int64,
+  `CampaignName` String,
+  `TrafficSourceID` Int64,
+  `FlowID` Int64,
+  `RuleID` Int64,
+  `PathID` Int64,
+  `LanderID` Int64,
+  `OfferID` Int64,
+  `Slot` Int64,
+  `AffiliateNetworkID` Int64,
+  `IP` String,
+  `UserAgent` String,
+  `Referrer` String,
+  `TrackingDomain` String,
+  `TrackingPath` String,
+  `Language` String,
+  `CountryCode` String,
+  `Region` String,
+  `City` String,
+  `Carrier` String,
+  `ISP` String,
+  `DeviceType` String,
+  `Brand` String,
+  `Model` String,
+  `OS` String,
+  `OSVersion` String,
+  `Browser` String,
+  `BrowserVersion` String,
+  `ConnectionType` String,
+  `Bot` UInt8,
+  `ExternalID` String,
+  `TSCampaignID` String,
+  `TSWebsiteID` String,
+  `V1` String,
+  `V2` String,
+  `V3` String,
+  `V4` String,
+  `V5` String,
+  `V6` String,
+  `V7` String,
+  `V8` String,
+  `V9` String,
+  `V10` String,
+  `Cost` Float64,
+  `Payout` Float64,
+  `TransactionID` String,
+  `ImpTimestamp` Int64,
+  `VisitTimestamp` Int64,
+  `ClickTimestamp` Int64,
+  `PostbackTimestamp` Int64
+) ENGINE = MergeTree()
+PARTITION BY toYYYYMMDD(toDateTime(intDiv(Time, 1000)))
+ORDER BY (UserID, Time, RequestID);
@@ -21,5 +21,12 @@ CREATE TABLE AdClickTool.`CampaignMap` (
 CREATE TABLE Cache.`ReqCache` (
   `clickId` varchar(250) NOT NULL,
   `value` text NOT NULL,
-  PRIMARY KEY (`clickId`)
-) ENGINE=InnoDB AUTO_INCREMENT=8 DEFAULT CHARSET=utf8;
\ No newline at end of file
+  `expireAt` bigint(20) NOT NULL DEFAULT 0 COMMENT '过期的unix时间戳(秒)，0为不过期',
+  PRIMARY KEY (`clickId`),
+  KEY `expireAt` (`expireAt`)
+) ENGINE=InnoDB AUTO_INCREMENT=8 DEFAULT CHARSET=utf8;
+
+-- 已经建好的Cache.ReqCache(没有expireAt的旧表)执行下面的升级，新建的表不用：
+-- ALTER TABLE Cache.`ReqCache`
+--   ADD COLUMN `expireAt` bigint(20) NOT NULL DEFAULT 0 COMMENT '过期的unix时间戳(秒)，0为不过期',
+--   ADD KEY `expireAt` (`expireAt`);
@@ -14,6 +14,7 @@ CREATE TABLE AdClickTool.`User` (
   `timezone` varchar(6) DEFAULT '+00:00' COMMENT '默认的时区，格式:+08:00',
   `timezoneId` int(11) DEFAULT '35' COMMENT '用户的时区Id，默认为GMT',
   `rootdomainredirect` varchar(512) NOT NULL DEFAULT '' COMMENT '当访问用户的rootdomain时的跳转页面，如果为空则显示默认的404页面',
+  `apiToken` varchar(64) NOT NULL DEFAULT '' COMMENT '调用cost上传等接口时使用的token，为空则不允许调用',
   `json` text NOT NULL COMMENT '按照既定规则生成的User信息(CompanyName,Phone,DefaultTimeZone,DefaultHomeScreen)',
   `setting` text NOT NULL DEFAULT '',
   `referralToken` varchar(128) NOT NULL COMMENT '用户推荐链接中的token，链接中其他部分现拼',
@@ -71,10 +72,11 @@ CREATE TABLE AdClickTool.`TrackingCampaign` (
   `trafficSourceId` int(11) NOT NULL,
   `trafficSourceName` varchar(256) NOT NULL DEFAULT '',
   `country` varchar(3) NOT NULL DEFAULT '' COMMENT 'ISO-ALPHA-3',
-  `costModel` int(11) NOT NULL COMMENT '0:Do-not-track-costs;1:cpc;2:cpa;3:cpm;4:auto?',
+  `costModel` int(11) NOT NULL COMMENT '0:Do-not-track-costs;1:cpc;2:cpa;3:cpm;4:auto;5:revshare',
   `cpcValue` decimal(10,5) NOT NULL DEFAULT 0,
   `cpaValue` decimal(10,5) NOT NULL DEFAULT 0,
   `cpmValue` decimal(10,5) NOT NULL DEFAULT 0,
+  `revShareValue` decimal(10,5) NOT NULL DEFAULT 0 COMMENT 'revshare时占payout的百分比',
   `postbackUrl` varchar(512) NOT NULL DEFAULT '' COMMENT 'campaign自定义的postback url，为空则使用traffic source的设置',
   `pixelRedirectUrl` varchar(512) NOT NULL DEFAULT '' COMMENT 'campaign自定义的pixel redirect url，为空则使用traffic source的设置',
   `redirectMode` int(11) NOT NULL COMMENT '0:302;1:Meta refresh;2:Double meta refresh',
@@ -110,6 +112,7 @@ CREATE TABLE AdClickTool.`Rule` (
   `json` text NOT NULL COMMENT '按照既定规则生成的rule信息，供Service使用',
   `object` text NOT NULL COMMENT '按照既定规则生成的rule信息，供前端使用',
   `status` int(11) NOT NULL COMMENT '0:停止;1:运行;用来标记该Rule本身是否有效',
+  `sticky` int(11) NOT NULL DEFAULT 0 COMMENT '0:每次随机;1:按IP+UA固定;2:按访客cookie固定',
   `createdAt` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
   `deleted` int(11) NOT NULL DEFAULT 0 COMMENT '0:未删除;1:已删除',
   PRIMARY KEY (`id`)
@@ -131,6 +134,8 @@ CREATE TABLE AdClickTool.`Path` (
   `hash` varchar(39) NOT NULL,
   `redirectMode` int(11) NOT NULL COMMENT '0:302;1:Meta refresh;2:Double meta refresh',
   `directLink` int(11) NOT NULL COMMENT '0:No;1:Yes',
+  `sticky` int(11) NOT NULL DEFAULT 0 COMMENT '0:每次随机;1:按IP+UA固定;2:按访客cookie固定',
+  `autoOptimize` int(11) NOT NULL DEFAULT 0 COMMENT '0:按配置的权重;1:按EPC优化;2:按CR优化',
   `status` int(11) NOT NULL COMMENT '0:停止;1:运行;用来标记该Path本身是否有效',
   `createdAt` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
   `deleted` int(11) NOT NULL DEFAULT 0 COMMENT '0:未删除;1:已删除',
@@ -809,6 +814,7 @@ CREATE TABLE FraudFilterRule(
   `dimension` VARCHAR(20) DEFAULT '' COMMENT 'IP',
   `timeSpan` INT(11) DEFAULT 0 COMMENT '单位：秒', 
   `condition` VARCHAR(256) DEFAULT '' COMMENT 'PV>500,UserAgent>100,Clicks>100',
+  `actions` VARCHAR(4096) NOT NULL DEFAULT '' COMMENT '命中之后的动作(json数组):blacklist/pause/safepage/nocost/email/webhook/tspostback，空的时候为blacklist',
   `status` INT(2) NOT NULL DEFAULT '0' COMMENT 'active: 1,inactive: 0',
   `deleted` int(11) NOT NULL DEFAULT '0' COMMENT '0:未删除;1:已删除',
  PRIMARY KEY (`id`)
@@ -821,9 +827,24 @@ CREATE TABLE FraudFilterLog(
   `hit` INT(2) NOT NULL DEFAULT 0 COMMENT '0:未命中,1:命中',
   `condition` VARCHAR(256) DEFAULT '' COMMENT 'PV>500,UserAgent>100,Clicks>100',
   `timeStamp` INT(10) DEFAULT NULL COMMENT 'unix时间戳',
+  `actions` TEXT COMMENT '执行的动作以及结果(json数组)',
  PRIMARY KEY (`id`)
 ) ENGINE=INNODB DEFAULT CHARSET=utf8;
 
+CREATE TABLE FFRuleSanction(
+  `id` BIGINT(20) UNSIGNED NOT NULL AUTO_INCREMENT,
+  `ruleId` INT(11) UNSIGNED NOT NULL,
+  `logId` BIGINT(20) UNSIGNED NOT NULL DEFAULT 0 COMMENT 'FraudFilterLog.id',
+  `campaignId` INT(11) UNSIGNED NOT NULL,
+  `dimension` VARCHAR(20) NOT NULL DEFAULT '' COMMENT 'IP/SUBNET/ISP/REFERRER/V1~V10',
+  `value` VARCHAR(256) NOT NULL DEFAULT '' COMMENT 'dimension的值',
+  `action` VARCHAR(20) NOT NULL DEFAULT '' COMMENT 'pause:停止campaign;safepage:跳转到url;nocost:不记cost',
+  `url` VARCHAR(2048) NOT NULL DEFAULT '' COMMENT 'safepage的url',
+  `expiresAt` INT(10) NOT NULL DEFAULT 0 COMMENT 'unix时间戳，0为永久',
+ PRIMARY KEY (`id`),
+ KEY `expiresAt` (`expiresAt`)
+) ENGINE=INNODB DEFAULT CHARSET=utf8;
+
 CREATE TABLE FraudFilterLogDetail(
   `id` BIGINT(20) UNSIGNED NOT NULL AUTO_INCREMENT,
   `logId` INT(11) UNSIGNED NOT NULL,
@@ -837,3 +858,40 @@ CREATE TABLE `ISP` (
   `name` varchar(256) NOT NULL DEFAULT '',
   PRIMARY KEY (`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE AdClickTool.`TSPostbackLog` (
+  `id` BIGINT(20) UNSIGNED NOT NULL AUTO_INCREMENT,
+  `clickId` VARCHAR(64) NOT NULL,
+  `userId` INT(11) NOT NULL DEFAULT 0,
+  `campaignId` INT(11) NOT NULL DEFAULT 0,
+  `trafficSourceId` INT(11) NOT NULL DEFAULT 0,
+  `url` TEXT NOT NULL,
+  `status` INT(2) NOT NULL DEFAULT 0 COMMENT '0:待发送,1:成功,2:等待重试,3:失败(dead letter)',
+  `attempts` INT(11) NOT NULL DEFAULT 0,
+  `httpStatus` INT(11) NOT NULL DEFAULT 0 COMMENT '最后一次发送的http status,网络错误为0',
+  `lastError` VARCHAR(512) NOT NULL DEFAULT '',
+  `createdAt` INT(10) NOT NULL DEFAULT 0 COMMENT 'unix时间戳',
+  `lastAttemptAt` INT(10) NOT NULL DEFAULT 0 COMMENT 'unix时间戳',
+  `nextAttemptAt` INT(10) NOT NULL DEFAULT 0 COMMENT 'unix时间戳',
+  `deliveredAt` INT(10) NOT NULL DEFAULT 0 COMMENT 'unix时间戳',
+  PRIMARY KEY (`id`),
+  KEY `clickId` (`clickId`),
+  KEY `status_next` (`status`, `nextAttemptAt`)
+) ENGINE=INNODB DEFAULT CHARSET=utf8;
+
+CREATE TABLE AdClickTool.`Cap` (
+  `id` INT(11) NOT NULL AUTO_INCREMENT,
+  `userId` INT(11) NOT NULL,
+  `element` VARCHAR(20) NOT NULL COMMENT 'campaign,lander,offer',
+  `elementId` INT(11) NOT NULL,
+  `metric` INT(2) NOT NULL DEFAULT 0 COMMENT '0:clicks(campaign为visits),1:conversions,2:revenue',
+  `period` INT(2) NOT NULL DEFAULT 0 COMMENT '0:daily,1:hourly,2:total',
+  `value` DECIMAL(14,5) NOT NULL DEFAULT 0,
+  `timezoneId` INT(11) NOT NULL DEFAULT 0 COMMENT 'Timezones表的id,0为UTC',
+  `action` INT(2) NOT NULL DEFAULT 0 COMMENT '0:跳转到redirectOfferId,1:下一个offer,2:跳转到fallbackUrl',
+  `redirectOfferId` INT(11) NOT NULL DEFAULT 0,
+  `fallbackUrl` VARCHAR(512) NOT NULL DEFAULT '',
+  `deleted` INT(11) NOT NULL DEFAULT 0 COMMENT '0:未删除;1:已删除',
+  PRIMARY KEY (`id`),
+  KEY `element` (`element`, `elementId`)
+) ENGINE=INNODB DEFAULT CHARSET=utf8;
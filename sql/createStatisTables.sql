@@ -147,5 +147,22 @@ CREATE TABLE `AdStatis` (
   `id` bigint(20) NOT NULL AUTO_INCREMENT,
   PRIMARY KEY (`id`),
   UNIQUE KEY `md5_unique_key` (`KeysMD5`),
-  KEY `TimeStampIndex` (`Timestamp`)
+  KEY `TimeStampIndex` (`Timestamp`),
+  KEY `UserTimestampIndex` (`UserID`,`Timestamp`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `AdLanderSlotStatis` (
+  `UserID` int(11) DEFAULT 0 COMMENT '用户ID',
+  `Timestamp` bigint(22) DEFAULT 0 COMMENT 'unix时间戳，精确到小时，补0到毫秒位，如1483869600000',
+  `CampaignID` int(11) DEFAULT 0 COMMENT 'Campaign的ID',
+  `LanderID` int(11) DEFAULT 0 COMMENT 'Lander的ID',
+  `Slot` int(11) DEFAULT 0 COMMENT 'lander上/click/N的N，/click为0',
+  `OfferID` int(11) DEFAULT 0 COMMENT 'Offer的ID',
+  `Visits` int(11) DEFAULT '0' COMMENT '累计的展示次数',
+  `Clicks` int(11) DEFAULT '0' COMMENT '累计的点击次数',
+  `Conversions` int(11) DEFAULT '0' COMMENT '累计的成功转换次数',
+  `Cost` bigint(20) DEFAULT '0' COMMENT '累计的开销(实际的值x1000000)',
+  `Revenue` bigint(20) DEFAULT '0' COMMENT '累计的收益(实际的值x1000000)',
+  `Impressions` int(11) DEFAULT '0',
+  UNIQUE KEY `unique_key` (`UserID`,`Timestamp`,`CampaignID`,`LanderID`,`Slot`,`OfferID`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -11,6 +11,7 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 )
@@ -217,6 +218,10 @@ func main() {
 	if err := config.LoadConfig(true); err != nil {
 		panic(err.Error())
 	}
+	if config.PrintConfigRequested() {
+		config.Print(os.Stdout)
+		return
+	}
 
 	//log
 	logAdapter := config.String("LOG", "adapter")
@@ -3,7 +3,9 @@ package tracking
 import (
 	"Service/log"
 	"database/sql"
+	"fmt"
 	"sync"
+	"time"
 )
 
 // Conversion 对应数据库里面的AdConversionsStatis字段
@@ -81,6 +83,10 @@ func SavingConversions(db *sql.DB, stop chan struct{}) {
 		}
 	}
 
+	// 重放在单独的goroutine里面，积压多的时候不挡住新的数据
+	stopReplay := replaying(func() { replayConversions(db) })
+	defer stopReplay()
+
 	for {
 		select {
 		case conversion := <-conversionsChan:
@@ -89,14 +95,14 @@ func SavingConversions(db *sql.DB, stop chan struct{}) {
 
 			// 把剩下的一并拿出来，统一存储
 			collect()
-			saveConversions(db, conversions)
+			storeConversions(db, conversions)
 
 			// 保存完毕，清空列表
 			conversions = conversions[0:0]
 		case <-stop:
 			// 如果仍然有新的数据，也先写一下数据库
 			collect()
-			saveConversions(db, conversions)
+			storeConversions(db, conversions)
 			// 保存完毕，清空列表
 			conversions = conversions[0:0]
 			return
@@ -104,7 +110,26 @@ func SavingConversions(db *sql.DB, stop chan struct{}) {
 	}
 }
 
-func saveConversions(db *sql.DB, conversions []*Conversion) {
+// storeConversions 写失败的落到磁盘
+func storeConversions(db *sql.DB, conversions []*Conversion) {
+	if len(conversions) == 0 {
+		return
+	}
+	start := time.Now()
+	failed, rejected, _ := saveConversions(db, conversions)
+	conversionSaveDuration.Observe(time.Since(start).Seconds())
+	if len(failed) > 0 {
+		conversionsSpilled.Add(float64(len(failed)))
+		spillConversions(failed)
+	}
+	if len(rejected) > 0 {
+		rejectConversions(rejected)
+	}
+}
+
+// saveConversions 返回没有写成功的Conversion：failed是可以重试的，rejected是数据库不接受的，
+// err是Prepare的错误或者最后一个可以重试的错误
+func saveConversions(db *sql.DB, conversions []*Conversion) (failed, rejected []*Conversion, err error) {
 	if len(conversions) == 0 {
 		return
 	}
@@ -112,10 +137,22 @@ func saveConversions(db *sql.DB, conversions []*Conversion) {
 	stmt, err := db.Prepare(insertConversionSQL)
 	if err != nil {
 		log.Errorf("[tracking][SavingConversions] Prepare[%s] failed:%v", insertConversionSQL, err)
-		return
+		return conversions, nil, err
 	}
 	defer stmt.Close()
 
+	var mu sync.Mutex
+	fail := func(c *Conversion, e error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if rowRejected(e) {
+			rejected = append(rejected, c)
+			return
+		}
+		failed = append(failed, c)
+		err = e
+	}
+
 	w := sync.WaitGroup{}
 	for _, c := range conversions {
 		w.Add(1)
@@ -124,6 +161,7 @@ func saveConversions(db *sql.DB, conversions []*Conversion) {
 				w.Done()
 				if x := recover(); x != nil {
 					log.Error("[tracking][saveConversions] insert panic:", x)
+					fail(c, fmt.Errorf("insert panic:%v", x))
 				}
 			}()
 			_, err := stmt.Exec(
@@ -173,10 +211,12 @@ func saveConversions(db *sql.DB, conversions []*Conversion) {
 
 			if err != nil {
 				log.Errorf("[tracking][SavingConversions] Insert failed:%v", err)
+				fail(c, err)
 			}
 		}(c)
 	}
 	w.Wait()
+	return
 }
 
 var insertConversionSQL = `INSERT INTO AdConversionsStatis
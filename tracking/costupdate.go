@@ -0,0 +1,238 @@
+package tracking
+
+import (
+	"database/sql"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// costFilterColumns CostReconcile.Filters允许的key和对应AdStatis的字段
+var costFilterColumns = map[string]string{
+	"v1":           "V1",
+	"v2":           "V2",
+	"v3":           "V3",
+	"v4":           "V4",
+	"v5":           "V5",
+	"v6":           "V6",
+	"v7":           "V7",
+	"v8":           "V8",
+	"v9":           "V9",
+	"v10":          "V10",
+	"tscampaignid": "tsCampaignId",
+	"tswebsiteid":  "tsWebsiteId",
+}
+
+// CostReconcile 把某个campaign在[From, To)时间段内的实际花费，
+// 按照visits的比例重新分配到AdStatis已有的行上面
+type CostReconcile struct {
+	UserId     int64
+	CampaignId int64
+	From       int64             // 毫秒，包含
+	To         int64             // 毫秒，不包含
+	Cost       float64           // 实际的总花费
+	Filters    map[string]string // 可选，v1-v10/tsCampaignId/tsWebsiteId，按zone等维度分别对账
+}
+
+// costReports 没有V1-V10等维度的报表，UNIQUE KEY为(UserID, Timestamp, CampaignID, 列)
+// 按各自的visits比例分配和AdStatis一样的总花费
+var costReports = []struct {
+	table  string
+	column string
+}{
+	{"AdIPStatis", "IP"},
+	{"AdReferrerStatis", "Referrer"},
+	{"AdReferrerDomainStatis", "ReferrerDomain"},
+}
+
+func (c CostReconcile) where() (string, []interface{}, error) {
+	conds := []string{"UserID=?", "CampaignID=?", "Timestamp>=?", "Timestamp<?"}
+	args := []interface{}{c.UserId, c.CampaignId, c.From, c.To}
+	for k, v := range c.Filters {
+		column, ok := costFilterColumns[strings.ToLower(k)]
+		if !ok {
+			return "", nil, fmt.Errorf("unsupported filter %s", k)
+		}
+		conds = append(conds, column+"=?")
+		args = append(args, v)
+	}
+	return strings.Join(conds, " AND "), args, nil
+}
+
+// ReconcileCost 在一个事务里面覆盖符合条件的行的Cost，返回更新的AdStatis的行数，以及调整的差值(调整后减调整前)
+// 没有visits的行Cost清零；对账的时间段最好是已经结束的，否则还在内存里面汇总的cost会再加上去
+// AdIPStatis/AdReferrerStatis/AdReferrerDomainStatis同时调整
+func ReconcileCost(db *sql.DB, c CostReconcile) (n int, delta float64, err error) {
+	if c.UserId <= 0 || c.CampaignId <= 0 {
+		return 0, 0, fmt.Errorf("invalid user(%d) or campaign(%d)", c.UserId, c.CampaignId)
+	}
+	if c.From >= c.To {
+		return 0, 0, fmt.Errorf("invalid time range [%d, %d)", c.From, c.To)
+	}
+	if c.Cost < 0 {
+		return 0, 0, fmt.Errorf("invalid cost %f", c.Cost)
+	}
+	where, args, err := c.where()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	query := "SELECT id, Visits, Cost FROM AdStatis WHERE " + where + " FOR UPDATE"
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Query %s failed:%v", query, err)
+	}
+	var ids, visits []int64
+	var old int64
+	for rows.Next() {
+		var id, v, cost int64
+		if err = rows.Scan(&id, &v, &cost); err != nil {
+			rows.Close()
+			return 0, 0, fmt.Errorf("Scan %s failed:%v", query, err)
+		}
+		ids = append(ids, id)
+		visits = append(visits, v)
+		old += cost
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	total := int64(c.Cost*MILLION + 0.5)
+	costs, ok := distributeCost(total, visits)
+	if !ok {
+		err = fmt.Errorf("no visits for campaign(%d) in [%d, %d)", c.CampaignId, c.From, c.To)
+		return 0, 0, err
+	}
+
+	stmt, err := tx.Prepare("UPDATE AdStatis SET Cost=? WHERE id=?")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stmt.Close()
+	for i, id := range ids {
+		if _, err = stmt.Exec(costs[i], id); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	for _, r := range costReports {
+		if err = reconcileReport(tx, r.table, r.column, c, total, old); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return len(ids), float64(total-old) / MILLION, nil
+}
+
+// reportTarget 报表调整之后的总花费
+// 报表没有V1-V10等维度，带了Filters时只能把AdStatis上的变化量加到报表上，不够减的时候为0
+func reportTarget(total, adOld, reportOld int64, filtered bool) int64 {
+	if !filtered {
+		return total
+	}
+	if t := reportOld + total - adOld; t > 0 {
+		return t
+	}
+	return 0
+}
+
+// reconcileReport 按visits把花费分配到table里面这个campaign在[From, To)的行上，没有visits的报表跳过
+func reconcileReport(tx *sql.Tx, table, column string, c CostReconcile, total, adOld int64) error {
+	query := "SELECT Timestamp, " + column + ", Visits, Cost FROM " + table +
+		" WHERE UserID=? AND CampaignID=? AND Timestamp>=? AND Timestamp<? FOR UPDATE"
+	rows, err := tx.Query(query, c.UserId, c.CampaignId, c.From, c.To)
+	if err != nil {
+		return fmt.Errorf("Query %s failed:%v", query, err)
+	}
+	var timestamps, visits []int64
+	var keys []string
+	var old int64
+	for rows.Next() {
+		var ts, v, cost int64
+		var key string
+		if err := rows.Scan(&ts, &key, &v, &cost); err != nil {
+			rows.Close()
+			return fmt.Errorf("Scan %s failed:%v", query, err)
+		}
+		timestamps = append(timestamps, ts)
+		keys = append(keys, key)
+		visits = append(visits, v)
+		old += cost
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	costs, ok := distributeCost(reportTarget(total, adOld, old, len(c.Filters) > 0), visits)
+	if !ok {
+		return nil
+	}
+	stmt, err := tx.Prepare("UPDATE " + table + " SET Cost=? WHERE UserID=? AND Timestamp=? AND CampaignID=? AND " + column + "=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i := range costs {
+		if _, err := stmt.Exec(costs[i], c.UserId, timestamps[i], c.CampaignId, keys[i]); err != nil {
+			return fmt.Errorf("Update %s failed:%v", table, err)
+		}
+	}
+	return nil
+}
+
+// distributeCost 按visits的比例把total分配下去，余数按最大余数法分配，保证总和等于total
+// 所有行都没有visits时返回false
+func distributeCost(total int64, visits []int64) ([]int64, bool) {
+	var sum int64
+	for _, v := range visits {
+		if v > 0 {
+			sum += v
+		}
+	}
+	if sum == 0 {
+		return nil, false
+	}
+
+	// total*v可能超出int64，用big.Int计算
+	bigSum := big.NewInt(sum)
+	costs := make([]int64, len(visits))
+	remainders := make([]int64, len(visits))
+	var assigned int64
+	for i, v := range visits {
+		if v <= 0 {
+			continue
+		}
+		q, r := new(big.Int).QuoRem(new(big.Int).Mul(big.NewInt(total), big.NewInt(v)), bigSum, new(big.Int))
+		costs[i], remainders[i] = q.Int64(), r.Int64()
+		assigned += costs[i]
+	}
+
+	// 剩下的不会超过行数，每次给余数最大的行加1
+	for left := total - assigned; left > 0; left-- {
+		best := -1
+		for i, v := range visits {
+			if v > 0 && (best == -1 || remainders[i] > remainders[best]) {
+				best = i
+			}
+		}
+		costs[best]++
+		remainders[best] -= sum
+	}
+	return costs, true
+}
@@ -0,0 +1,71 @@
+package tracking
+
+import (
+	"testing"
+)
+
+func TestDistributeCost(t *testing.T) {
+	cases := []struct {
+		total  int64
+		visits []int64
+		want   []int64
+	}{
+		{100, []int64{1, 1, 2}, []int64{25, 25, 50}},
+		{100, []int64{1, 1, 1}, []int64{34, 33, 33}},
+		{10, []int64{0, 3, 7}, []int64{0, 3, 7}},
+		{1, []int64{2, 0, 3}, []int64{0, 0, 1}},
+		{0, []int64{5, 5}, []int64{0, 0}},
+		{9000000000000000, []int64{3000, 6000}, []int64{3000000000000000, 6000000000000000}},
+	}
+	for _, c := range cases {
+		got, ok := distributeCost(c.total, c.visits)
+		if !ok {
+			t.Errorf("distributeCost(%d, %v) failed", c.total, c.visits)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("distributeCost(%d, %v) = %v, want %v", c.total, c.visits, got, c.want)
+				break
+			}
+		}
+	}
+
+	if _, ok := distributeCost(100, []int64{0, 0}); ok {
+		t.Error("distributeCost without visits should fail")
+	}
+}
+
+func TestCostReconcileWhere(t *testing.T) {
+	c := CostReconcile{UserId: 1, CampaignId: 2, From: 3, To: 4, Filters: map[string]string{"V3": "zone1"}}
+	where, args, err := c.where()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if where != "UserID=? AND CampaignID=? AND Timestamp>=? AND Timestamp<? AND V3=?" || len(args) != 5 {
+		t.Errorf("where = %s %v", where, args)
+	}
+
+	c.Filters = map[string]string{"Cost": "0"}
+	if _, _, err := c.where(); err == nil {
+		t.Error("unsupported filter should fail")
+	}
+}
+
+func TestReportTarget(t *testing.T) {
+	cases := []struct {
+		total, adOld, reportOld int64
+		filtered                bool
+		want                    int64
+	}{
+		{100, 80, 50, false, 100},
+		{100, 80, 50, true, 70},
+		{20, 80, 50, true, 0},
+		{80, 80, 50, true, 50},
+	}
+	for _, c := range cases {
+		if got := reportTarget(c.total, c.adOld, c.reportOld, c.filtered); got != c.want {
+			t.Errorf("reportTarget(%d, %d, %d, %v) = %d, want %d", c.total, c.adOld, c.reportOld, c.filtered, got, c.want)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package tracking
 
 import (
 	"Service/gracequit"
+	"Service/tracking/sink"
 	"database/sql"
 	"time"
 )
@@ -44,6 +45,6 @@ var Domain gatherSaver
 
 // InitDomainGatherSaver 初始化tracking.Domain
 func InitDomainGatherSaver(g *gracequit.GraceQuit, db *sql.DB, saveInterval time.Duration) {
-	Domain = newGatherSaver(g, referrerDomainStatisSQL, saveInterval)
-	Domain.Start(db)
+	Domain = newGatherSaver(g, "AdReferrerDomainStatis", statsSink("AdReferrerDomainStatis", sink.NewMySQL(db, referrerDomainStatisSQL)), saveInterval)
+	Domain.Start()
 }
@@ -0,0 +1,198 @@
+// Package eventlog 原始的事件日志，每一次impression/visit/click/postback一条记录，以及cost对账的调整
+// 用来和traffic source逐条核对有争议的点击，默认不开启([EVENTLOG] enable)
+package eventlog
+
+import (
+	"strings"
+	"time"
+
+	"Service/request"
+)
+
+// 事件类型
+const (
+	Impression = "impression"
+	Visit      = "visit"
+	Click      = "click"
+	Postback   = "postback"
+	CostUpdate = "costupdate" // cost对账的调整，Cost为调整的差值
+)
+
+// Event 一条事件，字段名就是ClickHouse的列名
+type Event struct {
+	Event     string // 事件类型
+	Step      string // request的类型，如lpoffer/lpclick/s2spostback/convpixel
+	Time      int64  // 事件发生的时间，毫秒
+	RequestID string
+	UserID    int64
+
+	// 路由的结果
+	CampaignID         int64
+	CampaignName       string
+	TrafficSourceID    int64
+	FlowID             int64
+	RuleID             int64
+	PathID             int64
+	LanderID           int64
+	OfferID            int64
+	Slot               int64
+	AffiliateNetworkID int64
+
+	// 访问者
+	IP             string
+	UserAgent      string
+	Referrer       string
+	TrackingDomain string
+	TrackingPath   string
+	Language       string
+	CountryCode    string
+	Region         string
+	City           string
+	Carrier        string
+	ISP            string
+	DeviceType     string
+	Brand          string
+	Model          string
+	OS             string
+	OSVersion      string
+	Browser        string
+	BrowserVersion string
+	ConnectionType string
+	Bot            bool
+
+	// traffic source传过来的参数
+	ExternalID   string
+	TSCampaignID string
+	TSWebsiteID  string
+	V1           string
+	V2           string
+	V3           string
+	V4           string
+	V5           string
+	V6           string
+	V7           string
+	V8           string
+	V9           string
+	V10          string
+
+	Cost          float64
+	Payout        float64
+	TransactionID string
+
+	ImpTimestamp      int64
+	VisitTimestamp    int64
+	ClickTimestamp    int64
+	PostbackTimestamp int64
+}
+
+// FromRequest 用req当前的状态生成一条事件
+func FromRequest(event string, req request.Request) Event {
+	return Event{
+		Event:     event,
+		Step:      req.Type(),
+		Time:      time.Now().UnixNano() / int64(time.Millisecond),
+		RequestID: req.Id(),
+		UserID:    req.UserId(),
+
+		CampaignID:         req.CampaignId(),
+		CampaignName:       req.CampaignName(),
+		TrafficSourceID:    req.TrafficSourceId(),
+		FlowID:             req.FlowId(),
+		RuleID:             req.RuleId(),
+		PathID:             req.PathId(),
+		LanderID:           req.LanderId(),
+		OfferID:            req.OfferId(),
+		Slot:               req.Slot(),
+		AffiliateNetworkID: req.AffiliateId(),
+
+		IP:             req.RemoteIp(),
+		UserAgent:      req.UserAgent(),
+		Referrer:       req.Referrer(),
+		TrackingDomain: req.TrackingDomain(),
+		TrackingPath:   req.TrackingPath(),
+		Language:       req.Language(),
+		CountryCode:    req.CountryCode(),
+		Region:         req.Region(),
+		City:           req.City(),
+		Carrier:        req.Carrier(),
+		ISP:            req.ISP(),
+		DeviceType:     req.DeviceType(),
+		Brand:          req.Brand(),
+		Model:          req.Model(),
+		OS:             req.OS(),
+		OSVersion:      req.OSVersion(),
+		Browser:        req.Browser(),
+		BrowserVersion: req.BrowserVersion(),
+		ConnectionType: req.ConnectionType(),
+		Bot:            req.IsBot(),
+
+		ExternalID:   req.ExternalId(),
+		TSCampaignID: req.TSCampaignId(),
+		TSWebsiteID:  req.WebsiteId(),
+		V1:           req.Vars(0),
+		V2:           req.Vars(1),
+		V3:           req.Vars(2),
+		V4:           req.Vars(3),
+		V5:           req.Vars(4),
+		V6:           req.Vars(5),
+		V7:           req.Vars(6),
+		V8:           req.Vars(7),
+		V9:           req.Vars(8),
+		V10:          req.Vars(9),
+
+		Cost:          req.Cost(),
+		Payout:        req.Payout(),
+		TransactionID: req.TransactionId(),
+
+		ImpTimestamp:      req.ImpTimeStamp(),
+		VisitTimestamp:    req.VisitTimeStamp(),
+		ClickTimestamp:    req.ClickTimeStamp(),
+		PostbackTimestamp: req.PostBackTimeStamp(),
+	}
+}
+
+// costFilter cost对账的Filters对应到Event的字段
+func (e *Event) costFilter(k, v string) {
+	switch strings.ToLower(k) {
+	case "v1":
+		e.V1 = v
+	case "v2":
+		e.V2 = v
+	case "v3":
+		e.V3 = v
+	case "v4":
+		e.V4 = v
+	case "v5":
+		e.V5 = v
+	case "v6":
+		e.V6 = v
+	case "v7":
+		e.V7 = v
+	case "v8":
+		e.V8 = v
+	case "v9":
+		e.V9 = v
+	case "v10":
+		e.V10 = v
+	case "tscampaignid":
+		e.TSCampaignID = v
+	case "tswebsiteid":
+		e.TSWebsiteID = v
+	}
+}
+
+// FromCost cost对账的事件，Time为对账时间段的开始，这样按时间汇总Cost时包含调整的部分
+func FromCost(userId, campaignId, from int64, delta float64, filters map[string]string) Event {
+	e := Event{
+		Event:      CostUpdate,
+		Step:       "reconcile",
+		Time:       from,
+		UserID:     userId,
+		CampaignID: campaignId,
+		Cost:       delta,
+	}
+	for k, v := range filters {
+		e.costFilter(k, v)
+	}
+	return e
+}
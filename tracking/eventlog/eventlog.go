@@ -0,0 +1,157 @@
+package eventlog
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"Service/config"
+	"Service/gracequit"
+	"Service/log"
+	"Service/request"
+	"Service/tracking/sink"
+)
+
+// Table 事件写到sink时的表名
+const Table = "RawEvents"
+
+const (
+	defaultBuffer    = 100000
+	defaultBatchSize = 1000
+	flushInterval    = time.Second
+)
+
+var (
+	events    chan Event // 为nil时没有开启
+	batchSize int
+	dropped   int64
+)
+
+// Init 按[EVENTLOG]的配置开启事件日志
+// output为file(默认，按小时切分的文件)、ndjson(写到path，可以是管道)或者clickhouse(用[STATSSINK]的clickhouse配置)
+func Init(g *gracequit.GraceQuit) error {
+	if !config.Bool("EVENTLOG", "enable") {
+		return nil
+	}
+	out, err := openOutput(config.String("EVENTLOG", "output"))
+	if err != nil {
+		return err
+	}
+	buffer := config.Int("EVENTLOG", "buffer")
+	if buffer <= 0 {
+		buffer = defaultBuffer
+	}
+	batchSize = config.Int("EVENTLOG", "batchsize")
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	events = make(chan Event, buffer)
+	g.StartGoroutine(func(stop gracequit.StopSigChan) {
+		Running(out, stop)
+	})
+	return nil
+}
+
+func openOutput(output string) (sink.StatsSink, error) {
+	var out sink.StatsSink
+	switch output {
+	case "", "file":
+		dir := config.String("EVENTLOG", "dir")
+		if dir == "" {
+			dir = "events"
+		}
+		f, err := NewRotatingFile(dir, int64(config.Int("EVENTLOG", "maxsize"))<<20, config.Int("EVENTLOG", "maxdays"))
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	case "ndjson":
+		s, err := sink.NewNDJSON(config.String("EVENTLOG", "path"))
+		if err != nil {
+			return nil, err
+		}
+		out = s
+	case "clickhouse":
+		out = sink.NewClickHouse(
+			config.String("STATSSINK", "clickhouse-url"),
+			config.String("STATSSINK", "clickhouse-db"),
+			config.String("STATSSINK", "clickhouse-user"),
+			config.String("STATSSINK", "clickhouse-pass"),
+			30*time.Second)
+	default:
+		return nil, fmt.Errorf("unknown eventlog output %s", output)
+	}
+	return sink.Buffered("eventlog", out, 100, 3), nil
+}
+
+// Record 记录一条事件，没有开启时什么都不做；缓冲满了的时候丢弃，不阻塞请求
+func Record(event string, req request.Request) {
+	if events == nil || req == nil {
+		return
+	}
+	record(FromRequest(event, req))
+}
+
+// RecordCost 记录一次cost对账的调整，delta为调整之后和之前的差值
+func RecordCost(userId, campaignId, from int64, delta float64, filters map[string]string) {
+	if events == nil {
+		return
+	}
+	record(FromCost(userId, campaignId, from, delta, filters))
+}
+
+func record(e Event) {
+	select {
+	case events <- e:
+	default:
+		if atomic.AddInt64(&dropped, 1)%10000 == 1 {
+			log.Errorf("[eventlog][Record]buffer is full, %d events dropped\n", atomic.LoadInt64(&dropped))
+		}
+	}
+}
+
+// Dropped 因为缓冲满了丢弃的事件数
+func Dropped() int64 {
+	return atomic.LoadInt64(&dropped)
+}
+
+// Running 攒够batchSize条或者每秒写一次
+func Running(out sink.StatsSink, stop chan struct{}) {
+	rows := make([]sink.Row, 0, batchSize)
+	write := func() {
+		if len(rows) == 0 {
+			return
+		}
+		if err := out.Write(Table, rows); err != nil {
+			log.Errorf("[eventlog][Running]write %d events failed:%v\n", len(rows), err)
+		}
+		rows = make([]sink.Row, 0, batchSize)
+	}
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-events:
+			rows = append(rows, sink.Row{Key: e, Value: struct{}{}})
+			if len(rows) >= batchSize {
+				write()
+			}
+		case <-ticker.C:
+			write()
+		case <-stop:
+			// 把已经有的收完
+			for {
+				select {
+				case e := <-events:
+					rows = append(rows, sink.Row{Key: e, Value: struct{}{}})
+				default:
+					write()
+					if err := out.Close(); err != nil {
+						log.Errorf("[eventlog][Running]close failed:%v\n", err)
+					}
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package eventlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"Service/tracking/sink"
+)
+
+type memSink struct {
+	rows   []sink.Row
+	closed bool
+}
+
+func (m *memSink) Write(table string, rows []sink.Row) error {
+	m.rows = append(m.rows, rows...)
+	return nil
+}
+
+func (m *memSink) Close() error {
+	m.closed = true
+	return nil
+}
+
+func TestRecordDrop(t *testing.T) {
+	events = make(chan Event, 2)
+	batchSize = 10
+	defer func() { events = nil }()
+
+	for i := 0; i < 3; i++ {
+		record(Event{Event: Click, RequestID: "r"})
+	}
+	if Dropped() != 1 {
+		t.Errorf("Dropped = %d, want 1", Dropped())
+	}
+
+	out := &memSink{}
+	stop := make(chan struct{})
+	close(stop)
+	Running(out, stop)
+	if len(out.rows) != 2 || !out.closed {
+		t.Errorf("%d rows written, closed %v", len(out.rows), out.closed)
+	}
+}
+
+func TestFromCost(t *testing.T) {
+	e := FromCost(1, 2, 3000, -1.5, map[string]string{"V3": "zone1", "tsWebsiteId": "site"})
+	if e.Event != CostUpdate || e.UserID != 1 || e.CampaignID != 2 || e.Time != 3000 || e.Cost != -1.5 {
+		t.Errorf("FromCost = %+v", e)
+	}
+	if e.V3 != "zone1" || e.TSWebsiteID != "site" || e.V1 != "" {
+		t.Errorf("filters not mapped: %+v", e)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 一条记录就超过maxSize，每条一个文件
+	s, err := NewRotatingFile(dir, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := []sink.Row{
+		{Key: Event{Event: Visit, RequestID: "a"}, Value: struct{}{}},
+		{Key: Event{Event: Click, RequestID: "a", OfferID: 3}, Value: struct{}{}},
+	}
+	if err := s.Write(Table, rows); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	hour := time.Now().Format("2006010215")
+	for i, name := range []string{"events-" + hour + ".log", "events-" + hour + ".1.log"} {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := bufio.NewScanner(f)
+		sc.Scan()
+		var e Event
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil || e != rows[i].Key.(Event) {
+			t.Errorf("%s: %+v,%v", name, e, err)
+		}
+		f.Close()
+	}
+}
+
+func TestRotatingFileRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewRotatingFile(dir, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	rows := []sink.Row{
+		{Key: Event{Event: Visit, RequestID: "a"}, Value: struct{}{}},
+		{Key: Event{Event: Click, RequestID: "a", OfferID: 3}, Value: struct{}{}},
+	}
+
+	// 第二个文件打不开，第一个文件已经写了的行要截断掉
+	hour := time.Now().Format("2006010215")
+	second := filepath.Join(dir, "events-"+hour+".1.log")
+	if err := os.Mkdir(second, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(Table, rows); err == nil {
+		t.Fatal("Write should fail")
+	}
+	os.Remove(second)
+	if err := s.Write(Table, rows); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重试之后每一行只写了一次
+	names, _ := filepath.Glob(filepath.Join(dir, "events-*.log"))
+	lines := 0
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines += strings.Count(string(b), "\n")
+	}
+	if lines != len(rows) {
+		t.Errorf("%d lines in %v, want %d", lines, names, len(rows))
+	}
+}
@@ -0,0 +1,183 @@
+package eventlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"Service/log"
+	"Service/tracking/sink"
+)
+
+// rotatingFile 每行一个JSON，按小时切分文件：events-2017032115.log，
+// 超过maxSize时同一个小时里面再切分：events-2017032115.1.log
+type rotatingFile struct {
+	dir     string
+	maxSize int64
+	maxDays int
+
+	hour string // 当前文件的小时
+	seq  int
+	f    *os.File
+	size int64
+}
+
+// NewRotatingFile maxSize<=0不按大小切分，maxDays<=0不删除旧文件
+func NewRotatingFile(dir string, maxSize int64, maxDays int) (sink.StatsSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &rotatingFile{dir: dir, maxSize: maxSize, maxDays: maxDays}, nil
+}
+
+func (r *rotatingFile) name() string {
+	if r.seq == 0 {
+		return filepath.Join(r.dir, fmt.Sprintf("events-%s.log", r.hour))
+	}
+	return filepath.Join(r.dir, fmt.Sprintf("events-%s.%d.log", r.hour, r.seq))
+}
+
+// rotate 需要的时候切换到新的文件
+func (r *rotatingFile) rotate(now time.Time) error {
+	hour := now.Format("2006010215")
+	switch {
+	case r.f == nil:
+	case hour != r.hour:
+		r.seq = 0
+	case r.maxSize > 0 && r.size >= r.maxSize:
+		r.seq++
+	default:
+		return nil
+	}
+	if r.f != nil {
+		if err := r.close(); err != nil {
+			return err
+		}
+		r.removeOld(now)
+	}
+	r.hour = hour
+	for {
+		f, err := os.OpenFile(r.name(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		// 重启之后接着写，已经写满的跳过
+		if r.maxSize > 0 && fi.Size() >= r.maxSize {
+			f.Close()
+			r.seq++
+			continue
+		}
+		r.f, r.size = f, fi.Size()
+		return nil
+	}
+}
+
+func (r *rotatingFile) removeOld(now time.Time) {
+	if r.maxDays <= 0 {
+		return
+	}
+	names, _ := filepath.Glob(filepath.Join(r.dir, "events-*.log"))
+	deadline := now.AddDate(0, 0, -r.maxDays).Format("2006010215")
+	for _, name := range names {
+		hour := strings.TrimPrefix(filepath.Base(name), "events-")
+		if len(hour) >= 10 && hour[:10] < deadline {
+			if err := os.Remove(name); err != nil {
+				log.Errorf("[eventlog][removeOld]remove %s failed:%v\n", name, err)
+			}
+		}
+	}
+}
+
+// segment 一批数据写到某个文件的部分，offset为写之前的大小
+type segment struct {
+	name   string
+	offset int64
+}
+
+// Write 一批数据先全部编码，每个文件的部分一次写入；出错时把这一批写过的文件都截断回写之前的大小，
+// 这样Buffered重试的时候不会重复写入前面已经写成功的行
+func (r *rotatingFile) Write(table string, rows []sink.Row) (err error) {
+	lines := make([][]byte, len(rows))
+	for i, row := range rows {
+		b, err := json.Marshal(row.Key)
+		if err != nil {
+			return err
+		}
+		lines[i] = append(b, '\n')
+	}
+
+	var done []segment
+	var buf bytes.Buffer
+	defer func() {
+		if err != nil {
+			r.rollback(done)
+		}
+	}()
+	flush := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		done = append(done, segment{r.name(), r.size - int64(buf.Len())})
+		_, err := r.f.Write(buf.Bytes())
+		buf.Reset()
+		return err
+	}
+	for _, line := range lines {
+		now := time.Now()
+		if r.full(now) {
+			if err = flush(); err != nil {
+				return err
+			}
+		}
+		if err = r.rotate(now); err != nil {
+			return err
+		}
+		buf.Write(line)
+		r.size += int64(len(line))
+	}
+	return flush()
+}
+
+// full 当前的文件需要切换
+func (r *rotatingFile) full(now time.Time) bool {
+	return r.f != nil && (now.Format("2006010215") != r.hour || r.maxSize > 0 && r.size >= r.maxSize)
+}
+
+// rollback 截断这一批写过的文件，当前的文件截断不了的时候换一个新的文件
+func (r *rotatingFile) rollback(done []segment) {
+	for _, s := range done {
+		if r.f != nil && s.name == r.name() {
+			if err := r.f.Truncate(s.offset); err != nil {
+				log.Errorf("[eventlog][rollback]truncate %s to %d failed:%v\n", s.name, s.offset, err)
+				r.close()
+				r.seq++
+				continue
+			}
+			r.size = s.offset
+		} else if err := os.Truncate(s.name, s.offset); err != nil {
+			log.Errorf("[eventlog][rollback]truncate %s to %d failed:%v\n", s.name, s.offset, err)
+		}
+	}
+}
+
+func (r *rotatingFile) close() error {
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+func (r *rotatingFile) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	return r.close()
+}
@@ -23,7 +23,8 @@ type Gather struct {
 
 	saver Saver
 
-	saveInterval time.Duration // 多长时间存储一次
+	saveInterval time.Duration      // 多长时间存储一次
+	newInterval  chan time.Duration // SetInterval通过这个通知Gathering
 }
 
 // Event 一条修改请求
@@ -49,6 +50,11 @@ func (g *Gather) Gathering(stop chan struct{}) {
 		case <-ticker.C:
 			g.flush()
 
+		case d := <-g.newInterval:
+			ticker.Stop()
+			ticker = time.NewTicker(d)
+			g.saveInterval = d
+
 		case <-stop:
 			// 把已经有的收完
 			for {
@@ -89,5 +95,16 @@ func NewGather(bufferSize int, valueNewer func() interface{}, saver Saver, inter
 		NewValue:     valueNewer,
 		saver:        saver,
 		saveInterval: interval,
+		newInterval:  make(chan time.Duration, 1),
+	}
+}
+
+// SetInterval 修改存储的间隔，从下一次存储开始生效
+// 多次调用还没有生效时只保留最后一次
+func (g *Gather) SetInterval(d time.Duration) {
+	select {
+	case <-g.newInterval:
+	default:
 	}
+	g.newInterval <- d
 }
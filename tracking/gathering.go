@@ -27,12 +27,14 @@ var userStatis map[string]*adStaticTableFields
 var toSave chan map[string]*adStaticTableFields
 var gatherChan chan events
 var flushEvent chan struct{}
+var newInterval chan time.Duration
 
 func init() {
 	gatherChan = make(chan events, 1000000)
 	userStatis = make(map[string]*adStaticTableFields)
 	toSave = make(chan map[string]*adStaticTableFields)
 	flushEvent = make(chan struct{})
+	newInterval = make(chan time.Duration, 1)
 }
 
 func getData(keyMD5 string, keyFields AdStatisKey) *adStaticTableFields {
@@ -63,6 +65,10 @@ func Gathering(stop chan struct{}, interval time.Duration) {
 		case <-ticker.C:
 			flush()
 
+		case d := <-newInterval:
+			ticker.Stop()
+			ticker = time.NewTicker(d)
+
 		case <-flushEvent:
 			flush()
 
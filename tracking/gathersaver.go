@@ -4,9 +4,10 @@ package tracking
 
 import (
 	"Service/gracequit"
+	"Service/log"
 	"Service/tracking/gather"
 	"Service/tracking/saver"
-	"database/sql"
+	"Service/tracking/sink"
 	"time"
 )
 
@@ -26,16 +27,27 @@ func valueNewer() interface{} {
 
 //
 type gatherSaver struct {
+	table  string
+	sink   sink.StatsSink
 	saver  *saver.Saver
 	gather *gather.Gather
 	g      *gracequit.GraceQuit
 }
 
-func newGatherSaver(g *gracequit.GraceQuit, insertSQL string, saveInterval time.Duration) gatherSaver {
+// newGatherSaver 汇总之后的数据写到out，table是out里面的表名
+func newGatherSaver(g *gracequit.GraceQuit, table string, out sink.StatsSink, saveInterval time.Duration) gatherSaver {
 	// saver只负责汇总之后的数据的保存
 	// 所以其chan buffer不需要太大
-	s := saver.NewSaver(2, insertSQL)
+	s := saver.NewSaver(2, func(data map[interface{}]interface{}) error {
+		rows := make([]sink.Row, 0, len(data))
+		for k, v := range data {
+			rows = append(rows, sink.Row{Key: k, Value: v})
+		}
+		return out.Write(table, rows)
+	})
 	return gatherSaver{
+		table: table,
+		sink:  out,
 		saver: s,
 		// gather负责消息的汇总
 		// 其buffer需要大一些
@@ -45,10 +57,14 @@ func newGatherSaver(g *gracequit.GraceQuit, insertSQL string, saveInterval time.
 }
 
 // StartStatis 开启
-func (gs gatherSaver) Start(db *sql.DB) {
+func (gs gatherSaver) Start() {
 	// 先启动保存协程，再启动汇总协程
 	gs.g.StartGoroutine(func(stop gracequit.StopSigChan) {
-		gs.saver.Running(db, stop)
+		gs.saver.Running(stop)
+		// 等sink缓冲的数据写完
+		if err := gs.sink.Close(); err != nil {
+			log.Errorf("[tracking][gatherSaver] close %s sink failed:%v", gs.table, err)
+		}
 	})
 
 	gs.g.StartGoroutine(func(stop gracequit.StopSigChan) {
@@ -3,6 +3,7 @@ package tracking
 import (
 	"Service/gracequit"
 	"Service/tracking/saver"
+	"Service/tracking/sink"
 	"fmt"
 	"testing"
 	"time"
@@ -24,14 +25,13 @@ var tableTests = []tableTest{
 	{
 		user: 1,
 		key: IPStatisKey{
-			UserID:      1,
-			Timestamp:   14000000000,
-			CampaignID:  2,
-			IP:          "123.123.123.123",
-			CountryName: "China",
+			UserID:     1,
+			Timestamp:  14000000000,
+			CampaignID: 2,
+			IP:         "123.123.123.123",
 		},
 		deleteSQL: "DELETE FROM AdIPStatis WHERE UserID=?",
-		selectSQL: `SELECT Visits, Clicks, Conversions, Cost, Revenue, Impressions, Clicks FROM AdIPStatis WHERE UserID=? and Timestamp=? and CampaignID=? and IP=? and CountryName=?`,
+		selectSQL: `SELECT Visits, Clicks, Conversions, Cost, Revenue, Impressions, Clicks FROM AdIPStatis WHERE UserID=? and Timestamp=? and CampaignID=? and IP=?`,
 		insertSQL: ipStatisSQL,
 		table:     "AdIPStatis",
 	},
@@ -64,6 +64,7 @@ var tableTests = []tableTest{
 }
 
 func TestAllStatis(t *testing.T) {
+	requireDB(t)
 	for _, table := range tableTests {
 		testTable(t, table)
 	}
@@ -72,8 +73,8 @@ func TestAllStatis(t *testing.T) {
 func testTable(t *testing.T, table tableTest) {
 	var g gracequit.GraceQuit
 
-	ip := newGatherSaver(&g, table.insertSQL, 10*time.Second)
-	ip.Start(db)
+	ip := newGatherSaver(&g, table.table, sink.NewMySQL(db, table.insertSQL), 10*time.Second)
+	ip.Start()
 
 	// 测试之前先清空此用户的数据
 	_, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE UserID=?", table.table), table.user)
@@ -2,6 +2,7 @@ package tracking
 
 import (
 	"Service/gracequit"
+	"Service/tracking/sink"
 	"database/sql"
 	"time"
 )
@@ -44,6 +45,6 @@ var IP gatherSaver
 
 // InitIPGatherSaver 初始化tracking.IP
 func InitIPGatherSaver(g *gracequit.GraceQuit, db *sql.DB, saveInterval time.Duration) {
-	IP = newGatherSaver(g, ipStatisSQL, saveInterval)
-	IP.Start(db)
+	IP = newGatherSaver(g, "AdIPStatis", statsSink("AdIPStatis", sink.NewMySQL(db, ipStatisSQL)), saveInterval)
+	IP.Start()
 }
@@ -0,0 +1,27 @@
+package tracking
+
+import (
+	"Service/util/metrics"
+)
+
+var (
+	conversionSaveDuration = metrics.NewHistogramVec("conversions_save_duration_seconds",
+		"Time to write one batch of conversions to MySQL.", nil)
+	conversionsSpilled = metrics.NewCounterVec("conversions_spilled_total",
+		"Conversions that failed to be written and were spilled to disk.")
+)
+
+// QueueDepths 各个chan里面等待处理的数量，key是队列的名字
+func QueueDepths() map[string]int {
+	m := map[string]int{
+		"adstatis_gather": len(gatherChan),
+		"conversions":     len(conversionsChan),
+		"campaignmap":     len(campMapBuffer),
+	}
+	for _, gs := range []gatherSaver{IP, Ref, Domain, Slot} {
+		if gs.gather != nil {
+			m[gs.table+"_gather"] = len(gs.gather.GatherChan)
+		}
+	}
+	return m
+}
@@ -2,6 +2,7 @@ package tracking
 
 import (
 	"Service/gracequit"
+	"Service/tracking/sink"
 	"database/sql"
 	"time"
 )
@@ -44,6 +45,6 @@ var Ref gatherSaver
 
 // InitRefGatherSaver 初始化tracking.Ref
 func InitRefGatherSaver(g *gracequit.GraceQuit, db *sql.DB, saveInterval time.Duration) {
-	Ref = newGatherSaver(g, referrerStatisSQL, saveInterval)
-	Ref.Start(db)
+	Ref = newGatherSaver(g, "AdReferrerStatis", statsSink("AdReferrerStatis", sink.NewMySQL(db, referrerStatisSQL)), saveInterval)
+	Ref.Start()
 }
@@ -0,0 +1,43 @@
+package tracking
+
+import (
+	"time"
+
+	"Service/config"
+	"Service/log"
+)
+
+const defaultGatherInterval = 10 * 60 * time.Second
+
+// GatherInterval [TRACKING]里面key对应的汇总间隔(秒)，没有配置时10分钟
+func GatherInterval(key string) time.Duration {
+	interval := time.Duration(config.Int("TRACKING", key)) * time.Second
+	if interval <= 0 {
+		log.Warnf("config: TRACKING:%s not found. Using default interval: 10 minutes", key)
+		interval = defaultGatherInterval
+	}
+	return interval
+}
+
+// 汇总间隔可以在线修改，从下一次保存开始生效
+func init() {
+	config.OnReload(func() error {
+		d := GatherInterval("adstatis-interval")
+		select {
+		case <-newInterval:
+		default:
+		}
+		newInterval <- d
+		return nil
+	}, "TRACKING:adstatis-interval")
+
+	config.OnReload(func() error {
+		d := GatherInterval("ip-interval")
+		for _, gs := range []gatherSaver{IP, Ref, Domain, Slot} {
+			if gs.gather != nil {
+				gs.gather.SetInterval(d)
+			}
+		}
+		return nil
+	}, "TRACKING:ip-interval")
+}
@@ -2,30 +2,39 @@ package tracking
 
 import (
 	"Service/log"
+	"Service/tracking/sink"
 	"database/sql"
+	"fmt"
 	"sync"
 	"time"
 )
 
+const adStatisTable = "AdStatis"
+
 // Saving 一直执行保存操作
-// db参数暂时传过来
+// db参数暂时传过来，AdStatis按[STATSSINK]的配置写到MySQL或者其它的存储
 func Saving(db *sql.DB, stop chan struct{}) {
+	out := statsSink(adStatisTable, adStatisMySQL{db})
+	defer func() {
+		// 等sink缓冲的数据写完
+		if err := out.Close(); err != nil {
+			log.Errorf("[tracking][Saving] close sink failed:%v", err)
+		}
+	}()
+	// 重放在单独的goroutine里面，积压多的时候不挡住新的数据
+	stopReplay := replaying(func() { replayStatis(db) })
+	defer stopReplay()
+
 	for {
 		select {
 		case m := <-toSave:
-			err := doSave(db, m)
-			if err != nil {
-				log.Errorf("doSave failed:%v", err)
-			}
+			saveStatis(out, m)
 		case <-stop:
 			// 收所有的数据，防止的未写入数据库的
 			for {
 				select {
 				case m := <-toSave:
-					err := doSave(db, m)
-					if err != nil {
-						log.Errorf("doSave failed:%v", err)
-					}
+					saveStatis(out, m)
 				default:
 					goto allreceived
 				}
@@ -36,7 +45,68 @@ func Saving(db *sql.DB, stop chan struct{}) {
 	}
 }
 
-func doSave(db *sql.DB, m map[string]*adStaticTableFields) error {
+// adStatisRowKey AdStatis一行的key部分，KeysMD5是MySQL表的unique key
+type adStatisRowKey struct {
+	AdStatisKey
+	KeysMD5 string
+}
+
+func saveStatis(out sink.StatsSink, m map[string]*adStaticTableFields) {
+	if len(m) == 0 {
+		// 如果没有数据需要存储，直接退出
+		return
+	}
+	rows := make([]sink.Row, 0, len(m))
+	for keyMD5, fields := range m {
+		rows = append(rows, sink.Row{
+			Key:   adStatisRowKey{fields.AdStatisKey, keyMD5},
+			Value: fields.adStatisValues,
+		})
+	}
+	if err := out.Write(adStatisTable, rows); err != nil {
+		log.Errorf("doSave failed:%v", err)
+	}
+}
+
+// adStatisMySQL AdStatis表的MySQL写入，同时更新UserBilling的totalEvents
+type adStatisMySQL struct {
+	db *sql.DB
+}
+
+func statisRows(rows []sink.Row) map[string]*adStaticTableFields {
+	m := make(map[string]*adStaticTableFields, len(rows))
+	for _, r := range rows {
+		k := r.Key.(adStatisRowKey)
+		m[k.KeysMD5] = &adStaticTableFields{k.AdStatisKey, r.Value.(adStatisValues)}
+	}
+	return m
+}
+
+// Write 写失败的行落到磁盘，恢复之后重放，所以不返回错误(返回错误sink会把写成功的也重试一遍)
+func (s adStatisMySQL) Write(table string, rows []sink.Row) error {
+	m := statisRows(rows)
+	failed, rejected, _ := doSave(s.db, m)
+	if len(failed) > 0 {
+		spillStatis(failed)
+	}
+	if len(rejected) > 0 {
+		rejectStatis(rejected)
+	}
+	return nil
+}
+
+// Overflow MySQL写得太慢缓冲满了，这一批先落到磁盘，之后重放，不能丢
+func (s adStatisMySQL) Overflow(table string, rows []sink.Row) {
+	spillStatis(statisRows(rows))
+}
+
+func (s adStatisMySQL) Close() error {
+	return nil
+}
+
+// doSave 返回没有写成功的数据：failed是可以重试的，rejected是数据库不接受的，
+// err是Prepare的错误或者最后一个可以重试的错误
+func doSave(db *sql.DB, m map[string]*adStaticTableFields) (failed, rejected map[string]*adStaticTableFields, err error) {
 	// 这样可以Prepare一下，存储更加快
 	start := time.Now()
 	defer func() {
@@ -45,18 +115,34 @@ func doSave(db *sql.DB, m map[string]*adStaticTableFields) error {
 
 	if len(m) == 0 {
 		// 如果没有数据需要存储，直接退出
-		return nil
+		return nil, nil, nil
 	}
 
 	// 提交Prepare可以避免重复解析SQL语句
 	stmt, err := db.Prepare(insertSQL)
 	if err != nil {
 		log.Errorf("[tracking][doSave] Prepare[%s] failed:%v", insertSQL, err)
-		return err
+		return m, nil, err
 	}
 	defer stmt.Close()
 
-	userEventsCount := make(map[int64]int64)
+	var mu sync.Mutex
+	fail := func(keyMD5 string, fields *adStaticTableFields, e error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if rowRejected(e) {
+			if rejected == nil {
+				rejected = make(map[string]*adStaticTableFields)
+			}
+			rejected[keyMD5] = fields
+			return
+		}
+		if failed == nil {
+			failed = make(map[string]*adStaticTableFields)
+		}
+		failed[keyMD5] = fields
+		err = e
+	}
 
 	w := sync.WaitGroup{}
 	for keyMD5, fields := range m {
@@ -66,6 +152,7 @@ func doSave(db *sql.DB, m map[string]*adStaticTableFields) error {
 				w.Done()
 				if x := recover(); x != nil {
 					log.Error("[tracking][doSave] insert panic:", x)
+					fail(keyMD5, fields, fmt.Errorf("insert panic:%v", x))
 				}
 			}()
 			_, err := stmt.Exec(
@@ -128,25 +215,35 @@ func doSave(db *sql.DB, m map[string]*adStaticTableFields) error {
 
 			if err != nil {
 				log.Error("[tracking][doSave] insert err:", err.Error(), "with field:", *fields)
+				fail(keyMD5, fields, err)
 			}
 		}(keyMD5, fields)
-		userEventsCount[fields.UserID] = userEventsCount[fields.UserID] + int64(fields.Impressions+fields.Visits+fields.Clicks+fields.Conversions)
 	}
 	w.Wait()
 
+	// 没有写成功的等重放的时候再计入totalEvents
+	userEventsCount := make(map[int64]int64)
+	for keyMD5, fields := range m {
+		_, f := failed[keyMD5]
+		_, r := rejected[keyMD5]
+		if !f && !r {
+			userEventsCount[fields.UserID] += int64(fields.Impressions + fields.Visits + fields.Clicks + fields.Conversions)
+		}
+	}
+
 	selectMaxId := `SELECT max(id) FROM UserBilling WHERE userId=?`
-	maxIdStmt, err := db.Prepare(selectMaxId)
-	if err != nil {
-		log.Errorf("[tracking][doSave] Prepare[%s] failed:%v", selectMaxId, err)
-		return err
+	maxIdStmt, berr := db.Prepare(selectMaxId)
+	if berr != nil {
+		log.Errorf("[tracking][doSave] Prepare[%s] failed:%v", selectMaxId, berr)
+		return
 	}
 	defer maxIdStmt.Close()
 
 	updateSql := `UPDATE UserBilling SET totalEvents = totalEvents + ? where id = ?`
-	updateStmt, err := db.Prepare(updateSql)
-	if err != nil {
-		log.Errorf("[tracking][doSave] Prepare[%s] failed:%v", updateSql, err)
-		return err
+	updateStmt, berr := db.Prepare(updateSql)
+	if berr != nil {
+		log.Errorf("[tracking][doSave] Prepare[%s] failed:%v", updateSql, berr)
+		return
 	}
 	defer updateStmt.Close()
 
@@ -164,7 +261,7 @@ func doSave(db *sql.DB, m map[string]*adStaticTableFields) error {
 	}
 	w.Wait()
 
-	return nil
+	return
 }
 
 func updateUserEvents(db *sql.DB, user, count int64, maxId *sql.Stmt, update *sql.Stmt) {
@@ -0,0 +1,80 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// clickHouseSink 通过HTTP接口INSERT ... FORMAT JSONEachRow写入，列名就是结构体的字段名
+type clickHouseSink struct {
+	url      string
+	database string
+	user     string
+	pass     string
+	client   *http.Client
+}
+
+// NewClickHouse addr是HTTP接口的地址，如http://127.0.0.1:8123/
+func NewClickHouse(addr, database, user, pass string, timeout time.Duration) StatsSink {
+	return &clickHouseSink{
+		url:      addr,
+		database: database,
+		user:     user,
+		pass:     pass,
+		client:   &http.Client{Timeout: timeout},
+	}
+}
+
+func (s *clickHouseSink) Write(table string, rows []Row) error {
+	return s.WriteToken(table, rows, "")
+}
+
+// WriteToken token不为空时作为insert_deduplication_token，同一个token的重试ClickHouse只写一次
+// (表要设置non_replicated_deduplication_window，见sql/createClickHouseTables.sql)
+func (s *clickHouseSink) WriteToken(table string, rows []Row, token string) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	var body bytes.Buffer
+	for _, r := range rows {
+		if err := writeJSONRow(&body, "", r); err != nil {
+			return err
+		}
+	}
+
+	if s.database != "" {
+		table = s.database + "." + table
+	}
+	q := url.Values{"query": {"INSERT INTO " + table + " FORMAT JSONEachRow"}}
+	if token != "" {
+		q.Set("insert_deduplication_token", token)
+	}
+	req, err := http.NewRequest("POST", s.url+"?"+q.Encode(), &body)
+	if err != nil {
+		return err
+	}
+	if s.user != "" {
+		req.Header.Set("X-ClickHouse-User", s.user)
+		req.Header.Set("X-ClickHouse-Key", s.pass)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("clickhouse insert into %s failed:%s %s", table, resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+func (s *clickHouseSink) Close() error {
+	return nil
+}
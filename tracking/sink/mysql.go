@@ -0,0 +1,61 @@
+package sink
+
+import (
+	"database/sql"
+	"sync"
+
+	"Service/log"
+	"Service/tracking/saver"
+)
+
+// mysqlSink 用insertSQL一行一行的写，参数是key的值，value的值，value的值(ON DUPLICATE KEY UPDATE累加)
+type mysqlSink struct {
+	db        *sql.DB
+	insertSQL string
+}
+
+// NewMySQL 写到insertSQL对应的表
+func NewMySQL(db *sql.DB, insertSQL string) StatsSink {
+	return &mysqlSink{db: db, insertSQL: insertSQL}
+}
+
+// Write 单行的失败只记日志，不返回错误：已经写进去的行重试会重复累加
+func (s *mysqlSink) Write(table string, rows []Row) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	// 提交Prepare可以避免重复解析SQL语句
+	stmt, err := s.db.Prepare(s.insertSQL)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	w := sync.WaitGroup{}
+	for _, r := range rows {
+		w.Add(1)
+		go func(r Row) {
+			defer func() {
+				w.Done()
+				if x := recover(); x != nil {
+					log.Error("[sink][mysql] insert panic:", x)
+				}
+			}()
+			var args saver.Args
+			args = args.AddFlatValues(r.Key)
+			args = args.AddFlatValues(r.Value)
+			args = args.AddFlatValues(r.Value)
+			if _, err := stmt.Exec(args...); err != nil {
+				log.Errorf("Exec sql:%s with args:%+v failed:%v", s.insertSQL, args, err)
+			}
+		}(r)
+	}
+	w.Wait()
+	return nil
+}
+
+// Close db是共享的，这里不关闭
+func (s *mysqlSink) Close() error {
+	return nil
+}
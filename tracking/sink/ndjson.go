@@ -0,0 +1,100 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// ndjsonFile 同一个文件(或者管道)只打开一次，多个表共享，按行加锁写入
+type ndjsonFile struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	w    *bufio.Writer
+	refs int
+}
+
+var (
+	filesMu sync.Mutex
+	files   = make(map[string]*ndjsonFile)
+)
+
+// ndjsonSink 每行一个JSON对象，"table"字段是表名，其它的字段和ClickHouse的列一样
+// 可以写到普通文件，也可以写到命名管道给其它程序(比如Kafka的producer)读
+type ndjsonSink struct {
+	file *ndjsonFile
+}
+
+// NewNDJSON 追加写到path，path为"-"时写到标准输出
+func NewNDJSON(path string) (StatsSink, error) {
+	filesMu.Lock()
+	defer filesMu.Unlock()
+	nf, ok := files[path]
+	if !ok {
+		f := os.Stdout
+		if path != "-" {
+			var err error
+			f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				return nil, err
+			}
+		}
+		nf = &ndjsonFile{path: path, f: f, w: bufio.NewWriter(f)}
+		files[path] = nf
+	}
+	nf.refs++
+	return &ndjsonSink{file: nf}, nil
+}
+
+func (s *ndjsonSink) Write(table string, rows []Row) error {
+	nf := s.file
+	nf.mu.Lock()
+	defer nf.mu.Unlock()
+	for _, r := range rows {
+		if err := writeJSONRow(nf.w, table, r); err != nil {
+			return err
+		}
+	}
+	return nf.w.Flush()
+}
+
+// Close 最后一个使用者关闭文件
+func (s *ndjsonSink) Close() error {
+	filesMu.Lock()
+	defer filesMu.Unlock()
+	nf := s.file
+	nf.mu.Lock()
+	defer nf.mu.Unlock()
+	err := nf.w.Flush()
+	nf.refs--
+	if nf.refs == 0 {
+		delete(files, nf.path)
+		if nf.f != os.Stdout {
+			if cerr := nf.f.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+// writeJSONRow table不为空时加一个table字段
+func writeJSONRow(w io.Writer, table string, r Row) error {
+	names, values := r.Fields()
+	m := make(map[string]interface{}, len(names)+1)
+	for i, name := range names {
+		m[name] = values[i]
+	}
+	if table != "" {
+		m["table"] = table
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
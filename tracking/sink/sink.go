@@ -0,0 +1,179 @@
+// Package sink 汇总之后的统计数据的存储
+// 同一份数据可以同时写到多个存储(MySQL, ClickHouse, NDJSON文件)，
+// 每个存储有自己的缓冲和重试，一个慢了或者挂了不影响其它的
+package sink
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"Service/log"
+	"Service/tracking/saver"
+	"Service/util/metrics"
+)
+
+var (
+	saveDuration = metrics.NewHistogramVec("stats_save_duration_seconds",
+		"Time to write one batch of statistics to a sink, including retries.", nil, "sink", "table")
+	saveFailures = metrics.NewCounterVec("stats_save_failures_total",
+		"Batches dropped by a sink after all retries failed.", "sink", "table")
+)
+
+// Row 一行统计数据，Key是unique key部分，Value是累加的部分，都是结构体
+type Row struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// Fields 按结构体字段的顺序返回列名和值，Cost/Revenue和MySQL里面一样是乘了1000000的整数
+func (r Row) Fields() (names []string, values []interface{}) {
+	args := saver.Args{}.AddFlat(r.Key).AddFlat(r.Value)
+	names = make([]string, 0, len(args)/2)
+	values = make([]interface{}, 0, len(args)/2)
+	for i := 0; i+1 < len(args); i += 2 {
+		names = append(names, args[i].(string))
+		values = append(values, args[i+1])
+	}
+	return
+}
+
+// StatsSink 统计数据的存储
+type StatsSink interface {
+	// Write 写一批数据，返回error时调用者可以重试，所以一批数据要么全部写入，要么都没有写入
+	Write(table string, rows []Row) error
+	// Close 把缓冲的数据写完再关闭
+	Close() error
+}
+
+// Overflower Buffered的缓冲满了的时候，如果存储实现了这个接口，这一批交给Overflow(比如落到磁盘)，不丢弃
+type Overflower interface {
+	Overflow(table string, rows []Row)
+}
+
+// TokenWriter 可以按token去重的存储，同一批数据重试的时候token不变，
+// 超时之后其实已经写进去的那一次不会被重复累加
+type TokenWriter interface {
+	WriteToken(table string, rows []Row, token string) error
+}
+
+type fanOut []StatsSink
+
+// FanOut 同时写到多个存储
+func FanOut(sinks ...StatsSink) StatsSink {
+	if len(sinks) == 1 {
+		return sinks[0]
+	}
+	return fanOut(sinks)
+}
+
+func (f fanOut) Write(table string, rows []Row) error {
+	return f.each(func(s StatsSink) error { return s.Write(table, rows) })
+}
+
+func (f fanOut) Close() error {
+	return f.each(StatsSink.Close)
+}
+
+func (f fanOut) each(fn func(s StatsSink) error) error {
+	var errs []string
+	for _, s := range f {
+		if err := fn(s); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+type batch struct {
+	table string
+	rows  []Row
+	token string // 这一批的id，重试的时候不变
+}
+
+// bufferedSink 在自己的协程里面写，失败的按1s,2s,4s...重试retries次
+type bufferedSink struct {
+	name    string
+	s       StatsSink
+	retries int
+	backoff time.Duration
+	batches chan batch
+	done    chan struct{}
+
+	start int64 // 启动的时间，和seq一起生成token，重启之后也不会重复
+	seq   int64
+}
+
+// Buffered 最多缓冲buffer批数据，满了之后s实现了Overflower的交给Overflow，否则Write直接返回错误(丢弃这一批)
+func Buffered(name string, s StatsSink, buffer, retries int) StatsSink {
+	b := &bufferedSink{
+		name:    name,
+		s:       s,
+		retries: retries,
+		backoff: time.Second,
+		batches: make(chan batch, buffer),
+		done:    make(chan struct{}),
+		start:   time.Now().UnixNano(),
+	}
+	go b.running()
+	return b
+}
+
+func (b *bufferedSink) Write(table string, rows []Row) error {
+	select {
+	case b.batches <- batch{table, rows, fmt.Sprintf("%s-%s-%d-%d", b.name, table, b.start, atomic.AddInt64(&b.seq, 1))}:
+		return nil
+	default:
+		if o, ok := b.s.(Overflower); ok {
+			log.Warnf("[sink][%s] buffer is full, %d %s records overflowed", b.name, len(rows), table)
+			o.Overflow(table, rows)
+			return nil
+		}
+		return fmt.Errorf("%s sink buffer is full, %d rows of %s dropped", b.name, len(rows), table)
+	}
+}
+
+func (b *bufferedSink) running() {
+	defer close(b.done)
+	for bt := range b.batches {
+		b.write(bt)
+	}
+}
+
+func (b *bufferedSink) write(bt batch) {
+	start := time.Now()
+	wait := b.backoff
+	for i := 0; ; i++ {
+		var err error
+		if tw, ok := b.s.(TokenWriter); ok {
+			err = tw.WriteToken(bt.table, bt.rows, bt.token)
+		} else {
+			err = b.s.Write(bt.table, bt.rows)
+		}
+		if err == nil {
+			log.Infof("[sink][%s] save %d %s records take: %v", b.name, len(bt.rows), bt.table, time.Since(start))
+			saveDuration.Observe(time.Since(start).Seconds(), b.name, bt.table)
+			return
+		}
+		if i >= b.retries {
+			saveDuration.Observe(time.Since(start).Seconds(), b.name, bt.table)
+			saveFailures.Inc(b.name, bt.table)
+			log.Errorf("[sink][%s] save %d %s records failed after %d retries, dropped:%v", b.name, len(bt.rows), bt.table, i, err)
+			return
+		}
+		log.Warnf("[sink][%s] save %d %s records failed, retry in %v:%v", b.name, len(bt.rows), bt.table, wait, err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// Close 等缓冲的数据都写完
+func (b *bufferedSink) Close() error {
+	close(b.batches)
+	<-b.done
+	return b.s.Close()
+}
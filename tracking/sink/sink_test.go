@@ -0,0 +1,246 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testKey struct {
+	UserID    int64
+	Timestamp int64
+	IP        string
+}
+
+type testValue struct {
+	Visits int
+	Cost   int64
+}
+
+var testRows = []Row{
+	{testKey{1, 1490292000000, "1.2.3.4"}, testValue{2, 3000000}},
+	{testKey{1, 1490292000000, "5.6.7.8"}, testValue{1, 0}},
+}
+
+func TestRowFields(t *testing.T) {
+	names, values := testRows[0].Fields()
+	if strings.Join(names, ",") != "UserID,Timestamp,IP,Visits,Cost" {
+		t.Errorf("names = %v", names)
+	}
+	if len(values) != 5 || values[2] != "1.2.3.4" || values[4] != int64(3000000) {
+		t.Errorf("values = %v", values)
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.ndjson")
+
+	// 两个表共享同一个文件
+	a, err := NewNDJSON(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := NewNDJSON(path)
+	a.Write("AdIPStatis", testRows)
+	b.Write("AdReferrerStatis", testRows[:1])
+	a.Close()
+	b.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []map[string]interface{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var m map[string]interface{}
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			t.Fatalf("bad line %q:%v", sc.Text(), err)
+		}
+		lines = append(lines, m)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("%d lines, want 3", len(lines))
+	}
+	if lines[0]["table"] != "AdIPStatis" || lines[0]["IP"] != "1.2.3.4" || lines[0]["Visits"] != 2.0 {
+		t.Errorf("first line = %v", lines[0])
+	}
+	if lines[2]["table"] != "AdReferrerStatis" {
+		t.Errorf("last line = %v", lines[2])
+	}
+}
+
+func TestClickHouse(t *testing.T) {
+	var query, token, body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("query")
+		token = r.URL.Query().Get("insert_deduplication_token")
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		if strings.Contains(body, "5.6.7.8") {
+			http.Error(w, "Code: 60. Table does not exist", http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	s := NewClickHouse(ts.URL+"/", "AdClickTool", "", "", time.Second)
+	if err := s.Write("AdIPStatis", testRows[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if query != "INSERT INTO AdClickTool.AdIPStatis FORMAT JSONEachRow" {
+		t.Errorf("query = %q", query)
+	}
+	if strings.Count(body, "\n") != 1 || !strings.Contains(body, `"IP":"1.2.3.4"`) {
+		t.Errorf("body = %q", body)
+	}
+	if err := s.Write("AdIPStatis", testRows); err == nil || !strings.Contains(err.Error(), "Code: 60") {
+		t.Errorf("error from clickhouse not returned:%v", err)
+	}
+	if token != "" {
+		t.Errorf("token = %q without WriteToken", token)
+	}
+	if err := s.(TokenWriter).WriteToken("AdIPStatis", testRows[:1], "clickhouse-1"); err != nil || token != "clickhouse-1" {
+		t.Errorf("WriteToken = %v, token %q", err, token)
+	}
+}
+
+// tokenSink 第一次失败，记下每次写的token
+type tokenSink struct {
+	flakySink
+	tokens []string
+}
+
+func (s *tokenSink) WriteToken(table string, rows []Row, token string) error {
+	s.tokens = append(s.tokens, token)
+	return s.Write(table, rows)
+}
+
+func TestBufferedToken(t *testing.T) {
+	s := &tokenSink{flakySink: flakySink{fails: 1}}
+	b := Buffered("test", s, 10, 2).(*bufferedSink)
+	b.backoff = time.Millisecond
+	b.Write("AdIPStatis", testRows)
+	b.Write("AdIPStatis", testRows)
+	b.Close()
+
+	// 重试用同一个token，下一批换一个
+	if len(s.tokens) != 3 || s.tokens[0] == "" || s.tokens[0] != s.tokens[1] || s.tokens[2] == s.tokens[1] {
+		t.Errorf("tokens = %q", s.tokens)
+	}
+	if s.rows != 4 {
+		t.Errorf("rows = %d want 4", s.rows)
+	}
+}
+
+type flakySink struct {
+	fails  int // 前面fails次Write失败
+	writes int
+	rows   int
+	closed bool
+}
+
+func (f *flakySink) Write(table string, rows []Row) error {
+	f.writes++
+	if f.writes <= f.fails {
+		return errors.New("unavailable")
+	}
+	f.rows += len(rows)
+	return nil
+}
+
+func (f *flakySink) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestBufferedRetry(t *testing.T) {
+	ok, flaky, down := &flakySink{}, &flakySink{fails: 1}, &flakySink{fails: 100}
+	var bs []StatsSink
+	for _, s := range []*flakySink{ok, flaky, down} {
+		b := Buffered("test", s, 10, 2).(*bufferedSink)
+		b.backoff = time.Millisecond
+		bs = append(bs, b)
+	}
+	out := FanOut(bs...)
+	if err := out.Write("AdIPStatis", testRows); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok.rows != 2 || ok.writes != 1 || !ok.closed {
+		t.Errorf("ok sink = %+v", ok)
+	}
+	if flaky.rows != 2 || flaky.writes != 2 {
+		t.Errorf("flaky sink should succeed on retry: %+v", flaky)
+	}
+	if down.rows != 0 || down.writes != 3 {
+		t.Errorf("down sink should give up after 2 retries: %+v", down)
+	}
+}
+
+func TestBufferedFull(t *testing.T) {
+	block := make(chan struct{})
+	s := Buffered("test", blockingSink(block), 1, 0)
+	s.Write("t", testRows) // 协程拿走之后阻塞
+	time.Sleep(10 * time.Millisecond)
+	s.Write("t", testRows) // 缓冲里面一个
+	if err := s.Write("t", testRows); err == nil {
+		t.Error("Write should fail when the buffer is full")
+	}
+	close(block)
+	s.Close()
+}
+
+func TestBufferedOverflow(t *testing.T) {
+	block := make(chan struct{})
+	o := &overflowSink{blockingSink: block}
+	s := Buffered("test", o, 1, 0)
+	s.Write("t", testRows)
+	time.Sleep(10 * time.Millisecond)
+	s.Write("t", testRows)
+	// 满了交给Overflow，不丢
+	if err := s.Write("t", testRows[:1]); err != nil {
+		t.Errorf("Write with Overflower = %v", err)
+	}
+	if o.rows != 1 {
+		t.Errorf("overflowed %d rows, want 1", o.rows)
+	}
+	close(block)
+	s.Close()
+}
+
+type overflowSink struct {
+	blockingSink
+	rows int
+}
+
+func (o *overflowSink) Overflow(table string, rows []Row) {
+	o.rows += len(rows)
+}
+
+type blockingSink chan struct{}
+
+func (b blockingSink) Write(table string, rows []Row) error {
+	<-b
+	return nil
+}
+
+func (b blockingSink) Close() error {
+	return nil
+}
@@ -0,0 +1,68 @@
+package tracking
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"Service/config"
+	"Service/log"
+	"Service/tracking/sink"
+)
+
+const (
+	defaultSinkBuffer  = 100
+	defaultSinkRetries = 3
+)
+
+// statsSink 按[STATSSINK]的sinks(逗号分隔，默认mysql)组合table的存储
+// mysql是这个表原来的MySQL写入；每个存储各自缓冲和重试
+func statsSink(table string, mysql sink.StatsSink) sink.StatsSink {
+	kinds := config.String("STATSSINK", "sinks")
+	if kinds == "" {
+		kinds = "mysql"
+	}
+	buffer := config.Int("STATSSINK", "buffer")
+	if buffer <= 0 {
+		buffer = defaultSinkBuffer
+	}
+	retries := defaultSinkRetries
+	if r, err := strconv.Atoi(config.String("STATSSINK", "retries")); err == nil && r >= 0 {
+		retries = r
+	}
+
+	var sinks []sink.StatsSink
+	for _, kind := range strings.Split(kinds, ",") {
+		switch kind = strings.TrimSpace(kind); kind {
+		case "mysql":
+			sinks = append(sinks, sink.Buffered(kind, mysql, buffer, retries))
+		case "clickhouse":
+			timeout := time.Duration(config.Int("STATSSINK", "clickhouse-timeout")) * time.Second
+			if timeout <= 0 {
+				timeout = 30 * time.Second
+			}
+			s := sink.NewClickHouse(
+				config.String("STATSSINK", "clickhouse-url"),
+				config.String("STATSSINK", "clickhouse-db"),
+				config.String("STATSSINK", "clickhouse-user"),
+				config.String("STATSSINK", "clickhouse-pass"),
+				timeout)
+			sinks = append(sinks, sink.Buffered(kind, s, buffer, retries))
+		case "ndjson":
+			s, err := sink.NewNDJSON(config.String("STATSSINK", "ndjson"))
+			if err != nil {
+				log.Errorf("[tracking][statsSink] open ndjson sink for %s failed:%v", table, err)
+				continue
+			}
+			sinks = append(sinks, sink.Buffered(kind, s, buffer, retries))
+		case "":
+		default:
+			log.Errorf("[tracking][statsSink] unknown sink %s for %s", kind, table)
+		}
+	}
+	if len(sinks) == 0 {
+		log.Errorf("[tracking][statsSink] no sink for %s, fall back to mysql", table)
+		return mysql
+	}
+	return sink.FanOut(sinks...)
+}
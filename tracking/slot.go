@@ -0,0 +1,54 @@
+package tracking
+
+import (
+	"Service/gracequit"
+	"Service/tracking/sink"
+	"database/sql"
+	"time"
+)
+
+// AdLanderSlotStatis表的支持工作
+// 多个offer的lander，按照/click/N的N(slot)分别统计，/click的slot为0
+// 使用方式：tracking.Slot.AddClick(k, 1)
+
+// SlotStatisKey AdLanderSlotStatis表里面的Unique Key部分
+type SlotStatisKey struct {
+	UserID     int64
+	Timestamp  int64
+	CampaignID int64
+	LanderID   int64
+	Slot       int64
+	OfferID    int64
+}
+
+var slotStatisSQL = `INSERT INTO AdLanderSlotStatis
+(UserID,
+Timestamp,
+CampaignID,
+LanderID,
+Slot,
+OfferID,
+Visits,
+Clicks,
+Conversions,
+Cost,
+Revenue,
+Impressions)
+VALUES
+(?,?,?,?,?,?,?,?,?,?,?,?)
+ON DUPLICATE KEY UPDATE
+Visits = Visits+?,
+Clicks = Clicks+?,
+Conversions = Conversions+?,
+Cost = Cost+?,
+Revenue = Revenue+?,
+Impressions = Impressions+?`
+
+// Slot 默认的AdLanderSlotStatis汇总存储
+var Slot gatherSaver
+
+// InitSlotGatherSaver 初始化tracking.Slot
+func InitSlotGatherSaver(g *gracequit.GraceQuit, db *sql.DB, saveInterval time.Duration) {
+	Slot = newGatherSaver(g, "AdLanderSlotStatis", statsSink("AdLanderSlotStatis", sink.NewMySQL(db, slotStatisSQL)), saveInterval)
+	Slot.Start()
+}
@@ -0,0 +1,238 @@
+// Package spill 数据库写失败的数据先落到本地磁盘，恢复之后再重放
+// 每一批数据一个文件，先写临时文件再rename，崩溃不会留下写了一半的文件
+package spill
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	suffix        = ".spill"
+	quarantineDir = "quarantine"
+)
+
+// ErrCorrupt Replay的fn返回这个错误(或者包装了它的错误)表示文件的内容解析不了，
+// 重放多少次都不会成功，文件移到quarantine子目录，继续重放后面的
+var ErrCorrupt = errors.New("corrupt spill data")
+
+// ErrUnavailable Replay的fn返回这个错误(或者包装了它的错误)表示数据库连不上，和文件的内容无关，
+// 停止这次重放，也不算作文件的一次失败
+var ErrUnavailable = errors.New("database unavailable")
+
+// Dir 一个目录保存一种数据
+type Dir struct {
+	dir string
+
+	mu  sync.Mutex // 保护seq和文件列表，Append的文件名不会和正在重放的重复
+	seq uint64
+
+	replaying int32 // 同时只能有一个Replay
+
+	maxAttempts int            // 一个文件失败这么多次之后移到quarantine，0为不限制
+	maxFiles    int            // 一次Replay最多重放的文件数，0为不限制
+	attempts    map[string]int // 文件名 -> 失败的次数，只有Replay使用
+
+	files       int64 // 积压的批数
+	bytes       int64 // 积压的字节数
+	quarantined int64 // 移到quarantine的批数
+}
+
+// Open 打开dir，不存在时创建；上次没有重放完的文件会统计到积压里面
+func Open(dir string) (*Dir, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	d := &Dir{dir: dir, attempts: make(map[string]int)}
+	names, err := d.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if fi, err := os.Stat(name); err == nil {
+			d.files++
+			d.bytes += fi.Size()
+		}
+	}
+	return d, nil
+}
+
+// list 按写入的顺序返回所有的文件
+func (d *Dir) list() ([]string, error) {
+	names, err := filepath.Glob(filepath.Join(d.dir, "*"+suffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// SetLimits 设置一个文件最多失败的次数和一次Replay最多重放的文件数，0为不限制
+// 在第一次Replay之前调用
+func (d *Dir) SetLimits(maxAttempts, maxFiles int) {
+	d.maxAttempts, d.maxFiles = maxAttempts, maxFiles
+}
+
+// Append 同步写一批数据，返回的时候数据已经在磁盘上了
+func (d *Dir) Append(b []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.seq++
+	// 文件名按时间排序，同一纳秒的用seq区分
+	name := filepath.Join(d.dir, fmt.Sprintf("%020d-%08d%s", time.Now().UnixNano(), d.seq%100000000, suffix))
+	if err := writeFile(name, b); err != nil {
+		return err
+	}
+	atomic.AddInt64(&d.files, 1)
+	atomic.AddInt64(&d.bytes, int64(len(b)))
+	return nil
+}
+
+// Replay 按顺序重放调用时已有的文件，已经有Replay在跑的时候直接返回
+// fn返回ErrCorrupt时文件移到quarantine子目录，继续后面的；返回ErrUnavailable时停止，文件保留下次再试
+// 返回的rest是没有写成功的部分，为nil时删除文件，否则用rest替换文件内容
+// 返回其它error或者rest不为nil时算作这个文件失败一次，停止这次重放；失败maxAttempts次的文件移到quarantine，
+// 这样数据库永远不接受的数据不会一直挡住后面的
+// 只在列文件的时候加锁，fn写数据库的时候Append不用等
+func (d *Dir) Replay(fn func(b []byte) (rest []byte, err error)) (replayed int, err error) {
+	if !atomic.CompareAndSwapInt32(&d.replaying, 0, 1) {
+		return 0, nil
+	}
+	defer atomic.StoreInt32(&d.replaying, 0)
+
+	d.mu.Lock()
+	names, err := d.list()
+	d.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if d.maxFiles > 0 && len(names) > d.maxFiles {
+		names = names[:d.maxFiles]
+	}
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return replayed, err
+		}
+		rest, err := fn(b)
+		base := filepath.Base(name)
+		switch {
+		case errors.Is(err, ErrCorrupt):
+			if qerr := d.quarantine(name, int64(len(b))); qerr != nil {
+				return replayed, fmt.Errorf("quarantine %s failed:%v", base, qerr)
+			}
+			continue
+		case errors.Is(err, ErrUnavailable):
+			return replayed, fmt.Errorf("replay %s failed:%v", base, err)
+		case err == nil && rest == nil:
+			if err := os.Remove(name); err != nil {
+				return replayed, err
+			}
+			delete(d.attempts, base)
+			atomic.AddInt64(&d.files, -1)
+			atomic.AddInt64(&d.bytes, -int64(len(b)))
+			replayed++
+			continue
+		case err == nil:
+			// 写成功的部分去掉
+			if err := writeFile(name, rest); err != nil {
+				return replayed, err
+			}
+			atomic.AddInt64(&d.bytes, int64(len(rest)-len(b)))
+			replayed++
+			b = rest
+		}
+
+		// 这个文件失败了一次
+		d.attempts[base]++
+		if d.maxAttempts > 0 && d.attempts[base] >= d.maxAttempts {
+			if qerr := d.quarantine(name, int64(len(b))); qerr != nil {
+				return replayed, fmt.Errorf("quarantine %s failed:%v", base, qerr)
+			}
+			continue
+		}
+		if err != nil {
+			return replayed, fmt.Errorf("replay %s failed:%v", base, err)
+		}
+		// 部分失败说明数据库又出问题了，后面的等下次
+		break
+	}
+	return replayed, nil
+}
+
+// Reject 数据库不接受的数据直接写到quarantine子目录，不进积压，留着人工处理
+func (d *Dir) Reject(b []byte) error {
+	dir := filepath.Join(d.dir, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.seq++
+	name := filepath.Join(dir, fmt.Sprintf("%020d-%08d-rejected%s", time.Now().UnixNano(), d.seq%100000000, suffix))
+	d.mu.Unlock()
+	if err := writeFile(name, b); err != nil {
+		return err
+	}
+	atomic.AddInt64(&d.quarantined, 1)
+	return nil
+}
+
+// quarantine 把解析不了或者一直失败的文件移出积压，留着人工处理
+func (d *Dir) quarantine(name string, size int64) error {
+	dir := filepath.Join(d.dir, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(name, filepath.Join(dir, filepath.Base(name))); err != nil {
+		return err
+	}
+	delete(d.attempts, filepath.Base(name))
+	atomic.AddInt64(&d.files, -1)
+	atomic.AddInt64(&d.bytes, -size)
+	atomic.AddInt64(&d.quarantined, 1)
+	return nil
+}
+
+// Backlog 积压的批数和字节数
+func (d *Dir) Backlog() (files, bytes int64) {
+	return atomic.LoadInt64(&d.files), atomic.LoadInt64(&d.bytes)
+}
+
+// Quarantined 这次启动以来移到quarantine的批数，包括Reject的
+func (d *Dir) Quarantined() int64 {
+	return atomic.LoadInt64(&d.quarantined)
+}
+
+func (d *Dir) String() string {
+	return strings.TrimSuffix(d.dir, string(filepath.Separator))
+}
+
+func writeFile(name string, b []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,206 @@
+package spill
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpillReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []string{"a", "bb", "ccc"} {
+		if err := d.Append([]byte(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if files, bytes := d.Backlog(); files != 3 || bytes != 6 {
+		t.Errorf("Backlog = %d,%d want 3,6", files, bytes)
+	}
+
+	// 数据库不可用，第一批就失败，全部保留
+	n, err := d.Replay(func(b []byte) ([]byte, error) { return nil, errors.New("db down") })
+	if err == nil || n != 0 {
+		t.Errorf("Replay = %d,%v", n, err)
+	}
+
+	// 重启之后积压还在
+	d, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := d.Backlog(); files != 3 {
+		t.Fatalf("Backlog after reopen = %d batches", files)
+	}
+
+	// 第一批写成功，第二批只写成功一部分，后面的下次再写
+	var got []string
+	n, err = d.Replay(func(b []byte) ([]byte, error) {
+		got = append(got, string(b))
+		if string(b) == "bb" {
+			return []byte("b"), nil
+		}
+		return nil, nil
+	})
+	if err != nil || n != 2 || len(got) != 2 || got[0] != "a" {
+		t.Errorf("Replay = %d,%v got %q", n, err, got)
+	}
+	if files, bytes := d.Backlog(); files != 2 || bytes != 4 {
+		t.Errorf("Backlog = %d,%d want 2,4", files, bytes)
+	}
+
+	got = got[:0]
+	d.Replay(func(b []byte) ([]byte, error) {
+		got = append(got, string(b))
+		return nil, nil
+	})
+	if len(got) != 2 || got[0] != "b" || got[1] != "ccc" {
+		t.Errorf("replayed %q, want the rest in order", got)
+	}
+	if files, bytes := d.Backlog(); files != 0 || bytes != 0 {
+		t.Errorf("Backlog = %d,%d after replay", files, bytes)
+	}
+}
+
+func TestReplayQuarantine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []string{"a", "bad", "ccc"} {
+		if err := d.Append([]byte(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 解析不了的文件不能挡住后面的，fn写数据库的时候Append也不用等
+	var got []string
+	n, err := d.Replay(func(b []byte) ([]byte, error) {
+		if string(b) == "bad" {
+			return nil, fmt.Errorf("%w:unexpected end of JSON input", ErrCorrupt)
+		}
+		got = append(got, string(b))
+		if string(b) == "a" {
+			if err := d.Append([]byte("dd")); err != nil {
+				t.Error(err)
+			}
+			// 已经在重放了，不会重入
+			if n, err := d.Replay(func(b []byte) ([]byte, error) { return nil, errors.New("should not run") }); n != 0 || err != nil {
+				t.Errorf("nested Replay = %d,%v", n, err)
+			}
+		}
+		return nil, nil
+	})
+	if err != nil || n != 2 || len(got) != 2 || got[0] != "a" || got[1] != "ccc" {
+		t.Errorf("Replay = %d,%v got %q", n, err, got)
+	}
+	if q := d.Quarantined(); q != 1 {
+		t.Errorf("Quarantined = %d want 1", q)
+	}
+	if files, bytes := d.Backlog(); files != 1 || bytes != 2 {
+		t.Errorf("Backlog = %d,%d want 1,2", files, bytes)
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, quarantineDir, "*"+suffix)); len(names) != 1 {
+		t.Errorf("quarantined files %q", names)
+	}
+
+	// 重启之后quarantine里面的不算积压
+	d, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := d.Backlog(); files != 1 {
+		t.Errorf("Backlog after reopen = %d batches", files)
+	}
+}
+
+func TestReplayLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetLimits(2, 2)
+	for _, b := range []string{"poison", "b", "c"} {
+		if err := d.Append([]byte(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	fn := func(b []byte) ([]byte, error) {
+		got = append(got, string(b))
+		if string(b) == "poison" {
+			return nil, errors.New("Data too long for column")
+		}
+		return nil, nil
+	}
+	unavailable := func(b []byte) ([]byte, error) {
+		return nil, fmt.Errorf("%w:connection refused", ErrUnavailable)
+	}
+
+	// 数据库连不上不算文件的失败
+	for i := 0; i < 3; i++ {
+		if n, err := d.Replay(unavailable); err == nil || n != 0 {
+			t.Fatalf("Replay unavailable = %d,%v", n, err)
+		}
+	}
+	if n, err := d.Replay(fn); err == nil || n != 0 || d.Quarantined() != 0 {
+		t.Fatalf("first Replay = %d,%v quarantined %d", n, err, d.Quarantined())
+	}
+
+	// 第二次失败移到quarantine，后面的继续，一次最多2个文件
+	got = got[:0]
+	if n, err := d.Replay(fn); err != nil || n != 1 {
+		t.Errorf("second Replay = %d,%v", n, err)
+	}
+	if len(got) != 2 || got[0] != "poison" || got[1] != "b" {
+		t.Errorf("replayed %q, want poison and b", got)
+	}
+	if q := d.Quarantined(); q != 1 {
+		t.Errorf("Quarantined = %d want 1", q)
+	}
+	if files, bytes := d.Backlog(); files != 1 || bytes != 1 {
+		t.Errorf("Backlog = %d,%d want 1,1", files, bytes)
+	}
+
+	// 数据库不接受的数据直接进quarantine，不算积压
+	if err := d.Reject([]byte("rejected")); err != nil {
+		t.Fatal(err)
+	}
+	if q := d.Quarantined(); q != 2 {
+		t.Errorf("Quarantined after Reject = %d want 2", q)
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, quarantineDir, "*"+suffix)); len(names) != 2 {
+		t.Errorf("quarantined files %q", names)
+	}
+	d, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := d.Backlog(); files != 1 {
+		t.Errorf("Backlog after reopen = %d batches", files)
+	}
+}
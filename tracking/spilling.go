@@ -0,0 +1,293 @@
+package tracking
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"Service/config"
+	"Service/log"
+	"Service/tracking/spill"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// 数据库写失败的AdStatis和Conversion先写到[TRACKING] spill-dir下面，
+// 每隔spill-interval秒(以及启动的时候)在单独的goroutine里面重放一次，每次最多spill-replay-files个文件
+// 数据库不接受的行(数据错误)直接写到quarantine，一个文件重放失败spill-max-attempts次之后也移到quarantine
+
+const (
+	statisSpillName     = "adstatis"
+	conversionSpillName = "conversions"
+
+	defaultSpillDir         = "spill"
+	defaultSpillInterval    = 30 * time.Second
+	defaultSpillMaxAttempts = 20
+	defaultSpillReplayFiles = 100
+)
+
+var errNothingSaved = errors.New("nothing saved")
+
+var spills = struct {
+	sync.Mutex
+	dirs map[string]*spill.Dir
+}{dirs: make(map[string]*spill.Dir)}
+
+// spillDir 打开失败时返回nil，下次再试
+func spillDir(name string) *spill.Dir {
+	spills.Lock()
+	defer spills.Unlock()
+	if d, ok := spills.dirs[name]; ok {
+		return d
+	}
+	dir := config.String("TRACKING", "spill-dir")
+	if dir == "" {
+		dir = defaultSpillDir
+	}
+	d, err := spill.Open(filepath.Join(dir, name))
+	if err != nil {
+		log.Errorf("[tracking][spillDir] open %s spill failed:%v", name, err)
+		return nil
+	}
+	maxAttempts := config.Int("TRACKING", "spill-max-attempts")
+	if maxAttempts <= 0 {
+		maxAttempts = defaultSpillMaxAttempts
+	}
+	maxFiles := config.Int("TRACKING", "spill-replay-files")
+	if maxFiles <= 0 {
+		maxFiles = defaultSpillReplayFiles
+	}
+	d.SetLimits(maxAttempts, maxFiles)
+	spills.dirs[name] = d
+	return d
+}
+
+func spillReplayInterval() time.Duration {
+	if n := config.Int("TRACKING", "spill-interval"); n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return defaultSpillInterval
+}
+
+// replaying 在单独的goroutine里面重放，启动的时候一次，之后每隔spill-interval一次，
+// 积压很多的时候也不会挡住新数据的写入
+// 返回的函数停止重放，等正在进行的重放结束之后返回
+func replaying(replay func()) (stop func()) {
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// 启动的时候先重放上次没有写进去的
+		replay()
+		ticker := time.NewTicker(spillReplayInterval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				replay()
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// dbUnavailable 数据库连不上、连接断了之类的错误，和写的数据无关
+func dbUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return true
+	}
+	var me *mysql.MySQLError
+	if errors.As(err, &me) {
+		switch me.Number {
+		case 1040, 1053, 1203: // Too many connections, Server shutdown, max_user_connections
+			return true
+		}
+	}
+	return false
+}
+
+// rowRejected MySQL因为这一行的数据拒绝写入(字段太长、类型不对等)，重试多少次都一样
+// 连接的错误、锁等待超时和死锁可以重试
+func rowRejected(err error) bool {
+	var me *mysql.MySQLError
+	if !errors.As(err, &me) || dbUnavailable(err) {
+		return false
+	}
+	switch me.Number {
+	case 1205, 1213: // Lock wait timeout, Deadlock
+		return false
+	}
+	return true
+}
+
+// Backlog 磁盘上还没有重放的数据
+type Backlog struct {
+	Batches int64
+	Bytes   int64
+}
+
+// SpillBacklog adstatis和conversions积压的数据
+func SpillBacklog() map[string]Backlog {
+	m := make(map[string]Backlog)
+	for _, name := range []string{statisSpillName, conversionSpillName} {
+		if d := spillDir(name); d != nil {
+			files, bytes := d.Backlog()
+			m[name] = Backlog{files, bytes}
+		}
+	}
+	return m
+}
+
+func spillTo(name string, v interface{}, count int) {
+	d := spillDir(name)
+	if d == nil {
+		log.Errorf("[tracking][spill] no spill dir, %d %s lost", count, name)
+		return
+	}
+	b, err := json.Marshal(v)
+	if err == nil {
+		err = d.Append(b)
+	}
+	if err != nil {
+		log.Errorf("[tracking][spill] spill %d %s failed, lost:%v", count, name, err)
+		return
+	}
+	files, bytes := d.Backlog()
+	log.Warnf("[tracking][spill] %d %s spilled to %s, backlog %d batches %d bytes", count, name, d, files, bytes)
+}
+
+// rejectTo 数据库不接受的数据直接放到quarantine，不再重放
+func rejectTo(name string, v interface{}, count int) {
+	d := spillDir(name)
+	if d == nil {
+		log.Errorf("[tracking][reject] no spill dir, %d rejected %s lost", count, name)
+		return
+	}
+	b, err := json.Marshal(v)
+	if err == nil {
+		err = d.Reject(b)
+	}
+	if err != nil {
+		log.Errorf("[tracking][reject] quarantine %d rejected %s failed, lost:%v", count, name, err)
+		return
+	}
+	log.Errorf("[tracking][reject] %d %s rejected by database, moved to quarantine of %s", count, name, d)
+}
+
+func replayFrom(name string, fn func(b []byte) ([]byte, error)) {
+	d := spillDir(name)
+	if d == nil {
+		return
+	}
+	if files, _ := d.Backlog(); files == 0 {
+		return
+	}
+	quarantined := d.Quarantined()
+	n, err := d.Replay(fn)
+	files, bytes := d.Backlog()
+	if q := d.Quarantined() - quarantined; q > 0 {
+		log.Errorf("[tracking][replay] %s %d batches moved to quarantine", name, q)
+	}
+	if err != nil {
+		log.Errorf("[tracking][replay] %s replayed %d batches, backlog %d batches %d bytes:%v", name, n, files, bytes, err)
+		return
+	}
+	log.Infof("[tracking][replay] %s replayed %d batches, backlog %d batches %d bytes", name, n, files, bytes)
+}
+
+// statisSpill 落盘的一行AdStatis
+type statisSpill struct {
+	Key    adStatisRowKey
+	Values adStatisValues
+}
+
+func encodeStatis(m map[string]*adStaticTableFields) []statisSpill {
+	rows := make([]statisSpill, 0, len(m))
+	for keyMD5, fields := range m {
+		rows = append(rows, statisSpill{adStatisRowKey{fields.AdStatisKey, keyMD5}, fields.adStatisValues})
+	}
+	return rows
+}
+
+func spillStatis(m map[string]*adStaticTableFields) {
+	spillTo(statisSpillName, encodeStatis(m), len(m))
+}
+
+func rejectStatis(m map[string]*adStaticTableFields) {
+	rejectTo(statisSpillName, encodeStatis(m), len(m))
+}
+
+func replayStatis(db *sql.DB) {
+	replayFrom(statisSpillName, func(b []byte) ([]byte, error) {
+		var rows []statisSpill
+		if err := json.Unmarshal(b, &rows); err != nil {
+			return nil, fmt.Errorf("%w:%v", spill.ErrCorrupt, err)
+		}
+		m := make(map[string]*adStaticTableFields, len(rows))
+		for _, r := range rows {
+			m[r.Key.KeysMD5] = &adStaticTableFields{r.Key.AdStatisKey, r.Values}
+		}
+		failed, rejected, err := doSave(db, m)
+		if len(rejected) > 0 {
+			rejectStatis(rejected)
+		}
+		switch {
+		case len(failed) == 0:
+			return nil, nil
+		case len(failed) == len(m) && dbUnavailable(err):
+			return nil, fmt.Errorf("%w:%v", spill.ErrUnavailable, err)
+		case len(failed) == len(m):
+			return nil, fmt.Errorf("%w:%v", errNothingSaved, err)
+		}
+		return json.Marshal(encodeStatis(failed))
+	})
+}
+
+func spillConversions(conversions []*Conversion) {
+	spillTo(conversionSpillName, conversions, len(conversions))
+}
+
+func rejectConversions(conversions []*Conversion) {
+	rejectTo(conversionSpillName, conversions, len(conversions))
+}
+
+func replayConversions(db *sql.DB) {
+	replayFrom(conversionSpillName, func(b []byte) ([]byte, error) {
+		var conversions []*Conversion
+		if err := json.Unmarshal(b, &conversions); err != nil {
+			return nil, fmt.Errorf("%w:%v", spill.ErrCorrupt, err)
+		}
+		failed, rejected, err := saveConversions(db, conversions)
+		if len(rejected) > 0 {
+			rejectConversions(rejected)
+		}
+		switch {
+		case len(failed) == 0:
+			return nil, nil
+		case len(failed) == len(conversions) && dbUnavailable(err):
+			return nil, fmt.Errorf("%w:%v", spill.ErrUnavailable, err)
+		case len(failed) == len(conversions):
+			return nil, fmt.Errorf("%w:%v", errNothingSaved, err)
+		}
+		return json.Marshal(failed)
+	})
+}
@@ -0,0 +1,35 @@
+package tracking
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestSpillErrorClass(t *testing.T) {
+	cases := []struct {
+		err         error
+		unavailable bool
+		rejected    bool
+	}{
+		{nil, false, false},
+		{driver.ErrBadConn, true, false},
+		{fmt.Errorf("exec:%w", mysql.ErrInvalidConn), true, false},
+		{&mysql.MySQLError{Number: 1040, Message: "Too many connections"}, true, false},
+		{&mysql.MySQLError{Number: 1213, Message: "Deadlock found"}, false, false},
+		{&mysql.MySQLError{Number: 1406, Message: "Data too long for column"}, false, true},
+		{&mysql.MySQLError{Number: 1366, Message: "Incorrect integer value"}, false, true},
+		{errors.New("insert panic"), false, false},
+	}
+	for _, c := range cases {
+		if got := dbUnavailable(c.err); got != c.unavailable {
+			t.Errorf("dbUnavailable(%v) = %v", c.err, got)
+		}
+		if got := rowRejected(c.err); got != c.rejected {
+			t.Errorf("rowRejected(%v) = %v", c.err, got)
+		}
+	}
+}
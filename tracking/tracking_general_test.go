@@ -31,7 +31,15 @@ func init() {
 
 }
 
+// requireDB 连不上测试数据库的时候跳过需要MySQL的测试
+func requireDB(t *testing.T) {
+	if err := db.Ping(); err != nil {
+		t.Skipf("mysql is not available:%v", err)
+	}
+}
+
 func TestConversions(t *testing.T) {
+	requireDB(t)
 	// 启动Conversion保存
 	gracequit.StartGoroutine(func(c gracequit.StopSigChan) {
 		SavingConversions(db, c)
@@ -53,6 +61,7 @@ func TestConversions(t *testing.T) {
 }
 
 func TestTracking(t *testing.T) {
+	requireDB(t)
 	// 启动保存
 	gracequit.StartGoroutine(func(c gracequit.StopSigChan) {
 		Saving(db, c)
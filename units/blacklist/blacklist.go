@@ -14,7 +14,16 @@ var blacklists = make(map[int64]*UserBlacklists)
 
 // UserBlacklists 用户所有的BotBlacklistConfig
 type UserBlacklists struct {
-	lists []BotBlacklistConfig
+	lists    []BotBlacklistConfig
+	compiled *compiledBlacklist // 为nil时逐条比较
+}
+
+// NewUserBlacklists 编译用户所有的BotBlacklistConfig，之后不能再修改lists
+func NewUserBlacklists(lists []BotBlacklistConfig) *UserBlacklists {
+	return &UserBlacklists{
+		lists:    lists,
+		compiled: compile(lists),
+	}
 }
 
 // UserReqAllowed 判断是否允许这次调用
@@ -36,15 +45,20 @@ func UserReqAllowed(userId int64, remoteAddr, userAgent string) bool {
 }
 
 // Allowed 返回一个IP和和个UserAgent的用户是否允许访问campaign url
+// remoteIP可以是IPv4或者IPv6
 func (l *UserBlacklists) Allowed(remoteIP, userAgent string) (bool, error) {
-	ipInt, err := ipcmp.IPToInt64(remoteIP)
+	ip, err := ipcmp.ParseIP128(remoteIP)
 	if err != nil {
 		return true, err
 	}
 
+	if l.compiled != nil {
+		return l.compiled.allowed(ip, userAgent), nil
+	}
+
 	for _, l := range l.lists {
 		log.Debug("UserBlacklists", remoteIP, userAgent, l.IpRange)
-		if !l.Allowed(ipInt, userAgent) {
+		if !l.Allowed128(ip, userAgent) {
 			return false, nil
 		}
 	}
@@ -77,11 +91,7 @@ func ReloadUserBlacklist(userIDs string) {
 			log.Errorf("[ReloadUserBlacklist]userIDs(%s) contains invalid integer\n", userIDs)
 			return
 		}
-		lists := DBGetUserBlacklists(uId)
-		p := &UserBlacklists{
-			lists: lists,
-		}
-		SetUserBlacklist(uId, p)
+		SetUserBlacklist(uId, NewUserBlacklists(DBGetUserBlacklists(uId)))
 	}
 	return
 }
@@ -102,19 +112,29 @@ func (b *BotBlacklistConfig) UserAgentAllowed(ua string) bool {
 	return true
 }
 
-// IPAllowed 返回一个IP是否允许访问
+// IPAllowed 返回一个IPv4是否允许访问
 func (b *BotBlacklistConfig) IPAllowed(ip ipcmp.IP_INT) bool {
+	return b.IP128Allowed(ipcmp.FromIPInt(ip))
+}
+
+// IP128Allowed 返回一个IP是否允许访问
+func (b *BotBlacklistConfig) IP128Allowed(ip ipcmp.IP128) bool {
 	for _, r := range b.IpRange {
-		if r.IpIntIn(ip) {
+		if r.IP128In(ip) {
 			return false
 		}
 	}
 	return true
 }
 
-// Allowed 返回一个IP和一个user agent是否允许访问
+// Allowed 返回一个IPv4和一个user agent是否允许访问
 func (b *BotBlacklistConfig) Allowed(ip ipcmp.IP_INT, ua string) bool {
-	ipAllowed := b.IPAllowed(ip)
+	return b.Allowed128(ipcmp.FromIPInt(ip), ua)
+}
+
+// Allowed128 返回一个IP和一个user agent是否允许访问
+func (b *BotBlacklistConfig) Allowed128(ip ipcmp.IP128, ua string) bool {
+	ipAllowed := b.IP128Allowed(ip)
 	if ipAllowed {
 		return true
 	}
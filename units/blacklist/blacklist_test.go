@@ -0,0 +1,158 @@
+package blacklist
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestCompiledBlacklist(t *testing.T) {
+	lists := []BotBlacklistConfig{
+		mustBuild(t, `["1.2.3.0 - 1.2.3.100", "2001:db8::/64"]`, `["curl", "python-requests"]`),
+		mustBuild(t, `["1.2.3.50 - 1.2.3.200"]`, ``),
+		mustBuild(t, `["1.2.3.90 - 1.2.3.250", "1.2.3.95"]`, `["bot"]`),
+		mustBuild(t, `["5.6.7.8"]`, `["", "never"]`),
+		mustBuild(t, `["255.255.255.255", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"]`, `["x"]`),
+	}
+	l := NewUserBlacklists(lists)
+
+	cases := []struct {
+		ip, ua  string
+		allowed bool
+	}{
+		{"1.2.3.10", "curl/7.1", false},
+		{"1.2.3.10", "Mozilla/5.0", true},
+		{"1.2.3.60", "Mozilla/5.0", false}, // 第二条不限ua
+		{"1.2.3.201", "Mozilla/5.0", true},
+		{"1.2.3.201", "Googlebot", false},
+		{"1.2.3.251", "Googlebot", true},
+		{"1.2.2.255", "curl", true},
+		{"2001:db8::1", "python-requests/2", false},
+		{"2001:db8:0:1::1", "python-requests/2", true},
+		{"5.6.7.8", "anything", false}, // 空的ua模式匹配所有
+		{"255.255.255.255", "x", false},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "x", false},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe", "x", true},
+	}
+	for _, c := range cases {
+		allowed, err := l.Allowed(c.ip, c.ua)
+		if err != nil || allowed != c.allowed {
+			t.Errorf("Allowed(%s, %s) got %v err:%v, expected %v", c.ip, c.ua, allowed, err, c.allowed)
+		}
+	}
+
+	empty := NewUserBlacklists(nil)
+	if allowed, _ := empty.Allowed("1.2.3.4", "curl"); !allowed {
+		t.Errorf("empty blacklist should allow everything")
+	}
+}
+
+// TestCompiledMatchesLinear 随机的列表和请求，编译之后的结果要和逐条比较的一样
+func TestCompiledMatchesLinear(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	lists := randomLists(r, 50, 20)
+	linear := &UserBlacklists{lists: lists}
+	compiled := NewUserBlacklists(lists)
+	for i := 0; i < 20000; i++ {
+		ip, ua := randomIP(r), randomUA(r)
+		a, _ := linear.Allowed(ip, ua)
+		b, _ := compiled.Allowed(ip, ua)
+		if a != b {
+			t.Fatalf("Allowed(%s, %s) linear:%v compiled:%v", ip, ua, a, b)
+		}
+	}
+}
+
+func mustBuild(t *testing.T, ipRange, userAgent string) BotBlacklistConfig {
+	c, err := BuildBlacklistConfig(1, 2, ipRange, userAgent, 1)
+	if err != nil {
+		t.Fatalf("BuildBlacklistConfig(%s, %s) failed:%v", ipRange, userAgent, err)
+	}
+	return c
+}
+
+var uaWords = []string{"Mozilla", "Chrome", "Safari", "curl", "bot", "spider", "python", "Java", "Go-http-client", "Android", "iPhone", "Edge"}
+
+// 都在10.0.0.0/16和2001:db8::/120里面，这样随机的请求有足够多的命中
+func randomIP(r *rand.Rand) string {
+	if r.Intn(4) == 0 {
+		return fmt.Sprintf("2001:db8::%x", r.Intn(256))
+	}
+	return fmt.Sprintf("10.0.%d.%d", r.Intn(256), r.Intn(256))
+}
+
+func randomUA(r *rand.Rand) string {
+	return fmt.Sprintf("%s/%d.0 (%s) %s", uaWords[r.Intn(len(uaWords))], r.Intn(100), uaWords[r.Intn(len(uaWords))], uaWords[r.Intn(len(uaWords))])
+}
+
+func randomLists(r *rand.Rand, n, ranges int) []BotBlacklistConfig {
+	lists := make([]BotBlacklistConfig, 0, n)
+	for i := 0; i < n; i++ {
+		var ips, uas []string
+		for j := 0; j < ranges; j++ {
+			switch r.Intn(4) {
+			case 0:
+				ips = append(ips, randomIP(r))
+			case 1:
+				ips = append(ips, fmt.Sprintf("10.0.%d.0/24", r.Intn(256)))
+			case 2:
+				lo := r.Intn(250)
+				ips = append(ips, fmt.Sprintf("2001:db8::%x-2001:db8::%x", lo, lo+r.Intn(6)))
+			default:
+				a, b := r.Intn(256), r.Intn(256)
+				ips = append(ips, fmt.Sprintf("10.0.%d.%d - 10.0.%d.%d", a, r.Intn(256), a, b))
+			}
+		}
+		// 四分之一的列表不限ua
+		if r.Intn(4) != 0 {
+			for j := 0; j < 1+r.Intn(3); j++ {
+				w := uaWords[r.Intn(len(uaWords))]
+				uas = append(uas, w[:1+r.Intn(len(w))])
+			}
+		}
+		ipRange, _ := json.Marshal(ips)
+		userAgent := ""
+		if len(uas) > 0 {
+			b, _ := json.Marshal(uas)
+			userAgent = string(b)
+		}
+		c, err := BuildBlacklistConfig(int64(i), 1, string(ipRange), userAgent, 1)
+		if err != nil {
+			panic(err)
+		}
+		lists = append(lists, c)
+	}
+	return lists
+}
+
+func benchmarkAllowed(b *testing.B, l *UserBlacklists) {
+	r := rand.New(rand.NewSource(2))
+	ips, uas := make([]string, 1024), make([]string, 1024)
+	for i := range ips {
+		ips[i], uas[i] = randomIP(r), randomUA(r)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.Allowed(ips[i%1024], uas[i%1024])
+	}
+}
+
+// 一个用户10个列表，每个列表500条
+func BenchmarkAllowedLinear(b *testing.B) {
+	lists := randomLists(rand.New(rand.NewSource(1)), 10, 500)
+	benchmarkAllowed(b, &UserBlacklists{lists: lists})
+}
+
+func BenchmarkAllowedCompiled(b *testing.B) {
+	lists := randomLists(rand.New(rand.NewSource(1)), 10, 500)
+	benchmarkAllowed(b, NewUserBlacklists(lists))
+}
+
+func BenchmarkCompile(b *testing.B) {
+	lists := randomLists(rand.New(rand.NewSource(1)), 10, 500)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		compile(lists)
+	}
+}
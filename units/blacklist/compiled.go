@@ -0,0 +1,137 @@
+package blacklist
+
+import (
+	"sort"
+
+	"Service/util/ahocorasick"
+	"Service/util/ipcmp"
+)
+
+// compiledBlacklist 一个用户所有BotBlacklistConfig编译之后的结果
+// 和逐条调用BotBlacklistConfig.Allowed的结果一样:
+// 某一条的IP范围包含这个IP，并且(没有设置user agent或者包含其中一个)，就不允许访问
+//
+// 所有的IP范围按起点切成互不重叠的段，starts[i]到starts[i+1]之前为segs[i]，二分查找
+// 所有的user agent放到一个Aho-Corasick自动机里面，一次扫描找出命中的那些列表
+type compiledBlacklist struct {
+	starts []ipcmp.IP128
+	segs   []segment
+	ua     *ahocorasick.Matcher
+	owner  []int32 // ua模式串的下标 -> lists的下标
+}
+
+// segment 覆盖这一段IP的列表
+type segment struct {
+	all   bool    // 有不限user agent的列表，直接禁止
+	lists []int32 // 需要再看user agent的列表，升序
+}
+
+func (s segment) equal(o segment) bool {
+	if s.all != o.all || len(s.lists) != len(o.lists) {
+		return false
+	}
+	for i := range s.lists {
+		if s.lists[i] != o.lists[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type boundary struct {
+	ip    ipcmp.IP128
+	list  int32
+	start bool
+}
+
+func compile(lists []BotBlacklistConfig) *compiledBlacklist {
+	c := &compiledBlacklist{}
+
+	// 没有设置user agent，或者有空的user agent(任何ua都包含)的列表，不用再看user agent
+	all := make([]bool, len(lists))
+	var patterns []string
+	for i, l := range lists {
+		all[i] = len(l.UserAgent) == 0
+		for _, ua := range l.UserAgent {
+			if ua == "" {
+				all[i] = true
+			}
+		}
+		if all[i] {
+			continue
+		}
+		for _, ua := range l.UserAgent {
+			patterns = append(patterns, ua)
+			c.owner = append(c.owner, int32(i))
+		}
+	}
+	c.ua = ahocorasick.New(patterns)
+
+	var bs []boundary
+	for i, l := range lists {
+		for _, r := range l.IpRange {
+			bs = append(bs, boundary{ip: r.First(), list: int32(i), start: true})
+			if end, ok := r.Last().Next(); ok {
+				bs = append(bs, boundary{ip: end, list: int32(i)})
+			}
+		}
+	}
+	sort.Slice(bs, func(i, j int) bool { return bs[i].ip.Compare(bs[j].ip) < 0 })
+
+	// 扫描所有的边界，active为当前覆盖的列表以及覆盖的次数(同一个列表的范围可能重叠)
+	active := make(map[int32]int)
+	for i := 0; i < len(bs); {
+		ip := bs[i].ip
+		for ; i < len(bs) && bs[i].ip == ip; i++ {
+			if bs[i].start {
+				active[bs[i].list]++
+			} else if active[bs[i].list]--; active[bs[i].list] == 0 {
+				delete(active, bs[i].list)
+			}
+		}
+
+		var seg segment
+		for l := range active {
+			if all[l] {
+				seg.all = true
+				seg.lists = nil
+				break
+			}
+			seg.lists = append(seg.lists, l)
+		}
+		sort.Slice(seg.lists, func(i, j int) bool { return seg.lists[i] < seg.lists[j] })
+
+		// 和前一段一样的合并掉
+		if n := len(c.segs); n > 0 && c.segs[n-1].equal(seg) {
+			continue
+		}
+		if len(c.segs) == 0 && !seg.all && len(seg.lists) == 0 {
+			continue
+		}
+		c.starts = append(c.starts, ip)
+		c.segs = append(c.segs, seg)
+	}
+	return c
+}
+
+func (c *compiledBlacklist) allowed(ip ipcmp.IP128, ua string) bool {
+	i := sort.Search(len(c.starts), func(i int) bool { return c.starts[i].Compare(ip) > 0 }) - 1
+	if i < 0 {
+		return true
+	}
+	seg := c.segs[i]
+	if seg.all {
+		return false
+	}
+	if len(seg.lists) == 0 {
+		return true
+	}
+	blocked := false
+	c.ua.Match(ua, func(p int) bool {
+		owner := c.owner[p]
+		j := sort.Search(len(seg.lists), func(j int) bool { return seg.lists[j] >= owner })
+		blocked = j < len(seg.lists) && seg.lists[j] == owner
+		return !blocked
+	})
+	return !blocked
+}
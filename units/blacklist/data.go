@@ -131,7 +131,7 @@ func DBGetUserBlacklists(userId int64) []BotBlacklistConfig {
 }
 
 func parseIpRanges(s string) ([]ipcmp.IPCompare, error) {
-	// ["1.2.3.4", "1.2.3.4-1.2.3.7", "5.6.7.8"]
+	// ["1.2.3.4", "1.2.3.4-1.2.3.7", "5.6.7.0/24", "2001:db8::1", "2001:db8::1-2001:db8::ff", "2001:db8::/32"]
 	var ips []string
 	err := json.Unmarshal([]byte(s), &ips)
 	if err != nil {
@@ -102,3 +102,39 @@ func TestBlacklistConfig2(t *testing.T) {
 	}
 
 }
+
+// TestBlacklistConfigMixed IPv4和IPv6混在一起的列表
+func TestBlacklistConfigMixed(t *testing.T) {
+	ipRange := `["1.2.3.4", "10.0.0.0/8", "2001:db8::1", "2001:db8::10 - 2001:db8::1f", "2001:db9::/48"]`
+	c, err := BuildBlacklistConfig(1, 2, ipRange, ``, 1)
+	if err != nil {
+		t.Fatalf("BuildBlacklistConfig failed:%v", err)
+	}
+	for _, l := range []*UserBlacklists{{lists: []BotBlacklistConfig{c}}, NewUserBlacklists([]BotBlacklistConfig{c})} {
+		notAllowed := []string{"1.2.3.4", "10.20.30.40:5060", "2001:db8::1", "2001:0db8::0001", "[2001:db8::1f]:80", "2001:db9:0:ffff::1", "::ffff:10.0.0.1"}
+		for _, ip := range notAllowed {
+			allowed, err := l.Allowed(ip, "")
+			if err != nil || allowed {
+				t.Errorf("%s should not allowed, compiled:%v err:%v", ip, l.compiled != nil, err)
+			}
+		}
+
+		allowed := []string{"1.2.3.5", "11.0.0.1", "2001:db8::2", "2001:db8::20", "2001:db9:1::1", "::1.2.3.4"}
+		for _, ip := range allowed {
+			ok, err := l.Allowed(ip, "")
+			if err != nil || !ok {
+				t.Errorf("%s should allowed, compiled:%v err:%v", ip, l.compiled != nil, err)
+			}
+		}
+
+		if _, err := l.Allowed("not an ip", ""); err == nil {
+			t.Errorf("invalid ip should return error")
+		}
+	}
+
+	for _, bad := range []string{`["1.2.3.4 - 2001:db8::1"]`, `["2001:db8::/200"]`, `["2001:db8::zz"]`} {
+		if _, err := parseIpRanges(bad); err == nil {
+			t.Errorf("parseIpRanges(%s) should fail", bad)
+		}
+	}
+}
@@ -16,7 +16,8 @@ type GlobalBlacklist struct {
 	lock sync.RWMutex
 }
 
-var ipLineParser = regexp.MustCompile(`([0-9]+\.[0-9]+\.[0-9]+\.[0-9]+)[\s]*#[\s]*(.*)`)
+// IPv4或者IPv6，IP是否合法由ipcmp.ParseIP128判断
+var ipLineParser = regexp.MustCompile(`([0-9]+\.[0-9]+\.[0-9]+\.[0-9]+|[0-9A-Fa-f]*:[0-9A-Fa-f:.]+)[\s]*#[\s]*(.*)`)
 
 // ErrLineFormatError 格式错误
 var ErrLineFormatError = errors.New("Format error")
@@ -24,6 +25,7 @@ var ErrLineFormatError = errors.New("Format error")
 func (g *GlobalBlacklist) addLine(line string) error {
 	line = strings.TrimSpace(line)
 	// 1.0.0.4				 # 2013-04-02, 1.0.0.4, AUS, 50
+	// 2001:db8::4		 # 2017-01-18, example.net, USA, 1
 	l := ipLineParser.FindStringSubmatch(line)
 	if len(l) == 0 {
 		return ErrLineFormatError
@@ -34,8 +36,11 @@ func (g *GlobalBlacklist) addLine(line string) error {
 	}
 
 	ips, desc := l[1], l[2]
-	ipn, _ := ipcmp.IPToInt64(ips)
-	g.set.AddIP(ipn, desc)
+	ipn, err := ipcmp.ParseIP128(ips)
+	if err != nil {
+		return ErrLineFormatError
+	}
+	g.set.AddIP128(ipn, desc)
 	return nil
 }
 
@@ -90,3 +90,33 @@ func TestGlobalBlackList(t *testing.T) {
 	}
 
 }
+
+func TestGlobalBlacklistMixed(t *testing.T) {
+	g := New()
+	lines := []string{
+		"1.1.169.109			 # 2017-01-18, node-86l.pool-1-1.dynamic.totbb.net, THA, 1",
+		"2001:db8::4		 # 2017-01-18, example.net, USA, 1",
+		"::ffff:5.6.7.8 # mapped",
+	}
+	for _, line := range lines {
+		if err := g.addLine(line); err != nil {
+			t.Errorf("addLine(%s) failed:%v", line, err)
+		}
+	}
+	for _, line := range []string{"2001:db8::zz # bad", "1.2.3 # bad", "# comment"} {
+		if err := g.addLine(line); err == nil {
+			t.Errorf("addLine(%s) should fail", line)
+		}
+	}
+
+	for _, addr := range []string{"1.1.169.109:80", "2001:0db8::4", "[2001:db8::4]:443", "5.6.7.8"} {
+		if _, in := g.AddrIn(addr); !in {
+			t.Errorf("%s should in", addr)
+		}
+	}
+	for _, addr := range []string{"1.1.169.110", "2001:db8::5", "::4"} {
+		if _, in := g.AddrIn(addr); in {
+			t.Errorf("%s should not in", addr)
+		}
+	}
+}
@@ -3,7 +3,6 @@ package campaign
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"sync"
@@ -11,8 +10,11 @@ import (
 	"Service/common"
 	"Service/log"
 	"Service/request"
+	"Service/units/capping"
 	"Service/units/ffrule"
 	"Service/units/flow"
+	"Service/units/offer"
+	"Service/units/tspostback"
 )
 
 const (
@@ -25,6 +27,22 @@ const (
 	TargetTypeOffer  = 5
 )
 
+const (
+	//0:Do-not-track-costs;1:cpc;2:cpa;3:cpm;4:auto;5:revshare
+	CostModelNone     = 0
+	CostModelCPC      = 1
+	CostModelCPA      = 2
+	CostModelCPM      = 3
+	CostModelAuto     = 4
+	CostModelRevShare = 5
+)
+
+const (
+	//0:停止;1:运行
+	StatusStopped = 0
+	StatusRunning = 1
+)
+
 // TrafficSourceConfig 对应数据库里面的TrafficSource
 type TrafficSourceConfig struct {
 	Id               int64
@@ -72,6 +90,7 @@ type CampaignConfig struct {
 	CPCValue          float64
 	CPAValue          float64
 	CPMValue          float64
+	RevShareValue     float64 // 占payout的百分比
 	PostbackUrl       string
 	PixelRedirectUrl  string //TODO
 	RedirectMode      int64
@@ -115,6 +134,9 @@ type Campaign struct {
 
 	// fraud filter rules
 	ff []int64
+
+	// visits/conversions/revenue caps
+	caps capping.Caps
 }
 
 var cmu sync.RWMutex                           // protects the following
@@ -220,6 +242,7 @@ func newCampaign(c CampaignConfig) (ca *Campaign) {
 	ca = &Campaign{
 		CampaignConfig: c,
 		ff:             ffrule.DBGetCampaignAvailableFFRuleIds(c.Id),
+		caps:           capping.DBGetCaps(capping.ElementCampaign, c.Id),
 	}
 	return
 }
@@ -363,9 +386,10 @@ func (ca *Campaign) OnLPOfferRequest(w http.ResponseWriter, req request.Request)
 		return errors.New("Nil ca")
 	}
 	//log.Infof("[Campaign][OnLPOfferRequest]Campaign(%s) handles request(%s)\n", ca.String(), req.String())
-
-	for _, ruleId := range ca.ff {
-		ffrule.GetRule(ruleId).OnVisits(req)
+	if ca.Status == StatusStopped && ffrule.Paused(ca.Id) {
+		// 用户停止的campaign照常处理，只有ffrule的pause动作停止的不再接受新的visit
+		// 用户重新开启campaign，或者pause过期之后恢复
+		return fmt.Errorf("Campaign(%d) is paused by ffrule for request(%s)", ca.Id, req.Id())
 	}
 
 	//req.SetTSExternalID(&ca.TrafficSource.ExternalId)
@@ -377,6 +401,24 @@ func (ca *Campaign) OnLPOfferRequest(w http.ResponseWriter, req request.Request)
 	req.SetTrafficSourceName(ca.TrafficSourceName)
 	req.SetCampaignCountry(ca.Country)
 
+	// 放在设置traffic source之后，ffrule的tspostback动作需要替换url里面的token
+	for _, ruleId := range ca.ff {
+		ffrule.GetRule(ruleId).OnVisits(req)
+	}
+
+	// ffrule的safepage动作命中的流量直接跳转，不走flow
+	if u := ffrule.SafePage(ca.Id, req); u != "" {
+		req.Redirect(w, gr, req.ParseUrlTokens(u))
+		return nil
+	}
+
+	if c := ca.caps.Exceeded(); c != nil {
+		if served, err := ca.onCapExceeded(w, req, c); served {
+			return err
+		}
+	}
+	ca.caps.Count(capping.MetricClicks, 1)
+
 	if ca.TargetType == TargetTypeUrl {
 		if ca.TargetUrl != "" {
 			req.Redirect(w, gr, req.ParseUrlTokens(ca.TargetUrl))
@@ -395,6 +437,38 @@ func (ca *Campaign) OnLPOfferRequest(w http.ResponseWriter, req request.Request)
 	return fmt.Errorf("Invalid dstination for request(%s) in campaign(%d)", req.Id(), ca.Id)
 }
 
+// onCapExceeded campaign超出cap时，按照cap的设置把流量导到指定offer或者fallback url
+// campaign级别没有"下一个offer"，这种情况下有fallback url就用，没有就忽略cap
+func (ca *Campaign) onCapExceeded(w http.ResponseWriter, req request.Request, c *capping.CapConfig) (served bool, err error) {
+	switch c.Action {
+	case capping.ActionRedirectOffer:
+		o := offer.GetOffer(c.RedirectOfferId)
+		if o != nil {
+			req.SetOfferId(o.Id)
+			req.SetOptOfferId(o.Id)
+			req.SetOptAffiliateId(o.AffiliateNetworkId)
+			return true, o.OnLPOfferRequest(w, req)
+		}
+	case capping.ActionNextOffer, capping.ActionFallbackUrl:
+		if c.FallbackUrl != "" {
+			req.Redirect(w, gr, req.ParseUrlTokens(c.FallbackUrl))
+			return true, nil
+		}
+	}
+	log.Warnf("[Campaign][onCapExceeded]Request(%s) exceeds %s but no destination available in campaign(%d)\n",
+		req.Id(), c.String(), ca.Id)
+	return false, nil
+}
+
+// countConversion conversion发生时，给conversions和revenue的cap计数，并交给ffrule统计
+func (ca *Campaign) countConversion(req request.Request) {
+	ca.caps.Count(capping.MetricConversions, 1)
+	ca.caps.Count(capping.MetricRevenue, req.Payout())
+	for _, ruleId := range ca.ff {
+		ffrule.GetRule(ruleId).OnConversion(req)
+	}
+}
+
 func (ca *Campaign) OnLandingPageClick(w http.ResponseWriter, req request.Request) error {
 	if ca == nil {
 		return errors.New("Nil ca")
@@ -418,12 +492,12 @@ func (ca *Campaign) OnImpression(w http.ResponseWriter, req request.Request) err
 	if ca == nil {
 		return errors.New("Nil ca")
 	}
-	for _, ruleId := range ca.ff {
-		ffrule.GetRule(ruleId).OnImpression(req)
-	}
 	req.SetTrafficSourceId(ca.TrafficSourceId)
 	req.SetTrafficSourceName(ca.TrafficSourceName)
 	req.SetCampaignCountry(ca.Country)
+	for _, ruleId := range ca.ff {
+		ffrule.GetRule(ruleId).OnImpression(req)
+	}
 	return nil
 }
 
@@ -433,19 +507,8 @@ func (ca *Campaign) OnS2SPostback(w http.ResponseWriter, req request.Request) er
 	}
 
 	// 对于直接跳转到指定URL的campaign，也要能够postback回traffic source
-	go func(req request.Request) {
-		var err error
-		defer func() {
-			if x := recover(); x != nil {
-				log.Errorf("[Campaign][OnS2SPostback]PostbackToTrafficSource to trafficsource(%d) failed for request(%s) in campaign(%d) with err(%v)\n", ca.TrafficSourceId, req.Id(), ca.Id, x)
-			} else if err != nil {
-				log.Errorf("[Campaign][OnS2SPostback]PostbackToTrafficSource to trafficsource(%d) failed for request(%s) in campaign(%d) with err(%s)\n", ca.TrafficSourceId, req.Id(), ca.Id, err.Error())
-			}
-		}()
-		// 这里的err可能是因为对traffic source的postaback失败，暂时对这种错误不记录
-		//TODO 找个地方，记录往traffic source的postback失败
-		err = ca.PostbackToTrafficSource(req)
-	}(req)
+	ca.asyncPostbackToTrafficSource(req)
+	ca.countConversion(req)
 
 	if req.FlowId() == 0 {
 		return nil
@@ -463,12 +526,20 @@ func (ca *Campaign) OnS2SPostback(w http.ResponseWriter, req request.Request) er
 	return nil
 }
 
-func (ca *Campaign) OnConversionPixel(w http.ResponseWriter, req request.Request) error {
-	return nil
-}
-
-func (ca *Campaign) OnConversionScript(w http.ResponseWriter, req request.Request) error {
-	return nil
+// asyncPostbackToTrafficSource 在后台把conversion回传给traffic source，不阻塞当前请求
+func (ca *Campaign) asyncPostbackToTrafficSource(req request.Request) {
+	go func(req request.Request) {
+		var err error
+		defer func() {
+			if x := recover(); x != nil {
+				log.Errorf("[Campaign][asyncPostbackToTrafficSource]PostbackToTrafficSource to trafficsource(%d) failed for request(%s) in campaign(%d) with err(%v)\n", ca.TrafficSourceId, req.Id(), ca.Id, x)
+			} else if err != nil {
+				log.Errorf("[Campaign][asyncPostbackToTrafficSource]PostbackToTrafficSource to trafficsource(%d) failed for request(%s) in campaign(%d) with err(%s)\n", ca.TrafficSourceId, req.Id(), ca.Id, err.Error())
+			}
+		}()
+		// 发送失败会由tspostback重试，这里的err只可能是入队失败
+		err = ca.PostbackToTrafficSource(req)
+	}(req)
 }
 
 func (ca *Campaign) getPostbackUrl() string {
@@ -478,33 +549,19 @@ func (ca *Campaign) getPostbackUrl() string {
 	return ca.TrafficSource.PostbackURL
 }
 
+// PostbackToTrafficSource 把conversion放入回传队列，由tspostback负责发送和重试
 func (ca *Campaign) PostbackToTrafficSource(req request.Request) error {
-	//TODO 需要检查用户是否已经针对该campaign单独设置了PostbackUrl
 	url := req.ParseUrlTokens(ca.getPostbackUrl())
 	if len(url) == 0 {
 		// 有可能不需要postback
 		return nil
 	}
 
-	err := func() error {
-		resp, err := http.Get(url)
-		if err != nil {
-			return err
-		}
-
-		body, err := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			return err
-		}
-		log.Infof("[campaign][PostbackToTrafficSource] req:%v success:[%s] with url(%s)\n",
-			req.Id(), body, url)
-		return nil
-	}()
-
-	if err != nil {
-		log.Errorf("[campaign][PostbackToTrafficSource] req:%v postback failed:[%v] with url(%s)\n", req.Id(), err, url)
-	}
-
-	return nil
+	return tspostback.Enqueue(tspostback.Job{
+		ClickId:         req.Id(),
+		UserId:          ca.UserId,
+		CampaignId:      ca.Id,
+		TrafficSourceId: ca.TrafficSourceId,
+		Url:             url,
+	})
 }
@@ -0,0 +1,58 @@
+package campaign
+
+import (
+	"Service/request"
+	"Service/units/ffrule"
+)
+
+// ffrule的nocost动作命中的流量都不记cost
+
+// VisitCost visit时按cost model应该记的cost
+func (c CampaignConfig) VisitCost(req request.Request) (float64, bool) {
+	if ffrule.NoCost(c.Id, req) {
+		return 0, false
+	}
+	switch c.CostModel {
+	case CostModelCPC:
+		return validCost(c.CPCValue)
+	case CostModelAuto:
+		return validCost(req.Cost())
+	}
+	return 0, false
+}
+
+// ImpressionCost impression时按cost model应该记的cost，CPM平摊到每次impression
+func (c CampaignConfig) ImpressionCost(req request.Request) (float64, bool) {
+	if ffrule.NoCost(c.Id, req) {
+		return 0, false
+	}
+	switch c.CostModel {
+	case CostModelCPM:
+		return validCost(c.CPMValue / 1000.0)
+	case CostModelAuto:
+		return validCost(req.Cost())
+	}
+	return 0, false
+}
+
+// ConversionCost conversion时按cost model应该记的cost
+// CPA为固定值，RevShare为payout的百分比，调用之前req.SetPayout要先设置好
+func (c CampaignConfig) ConversionCost(req request.Request) (float64, bool) {
+	if ffrule.NoCost(c.Id, req) {
+		return 0, false
+	}
+	switch c.CostModel {
+	case CostModelCPA:
+		return validCost(c.CPAValue)
+	case CostModelRevShare:
+		return validCost(req.Payout() * c.RevShareValue / 100.0)
+	}
+	return 0, false
+}
+
+func validCost(cost float64) (float64, bool) {
+	if cost <= 0 {
+		return 0, false
+	}
+	return cost, true
+}
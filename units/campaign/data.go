@@ -8,6 +8,7 @@ import (
 	"Service/common"
 	"Service/db"
 	"Service/log"
+	"Service/units/capping"
 	"Service/units/ffrule"
 	"Service/units/flow"
 )
@@ -22,6 +23,7 @@ var campaignDBCache common.DBCache
 
 func EnableCampaignsDBCache() {
 	log.Info("EnableCampaignsDBCache Begin")
+	capping.EnableCapDBCache()
 	flow.EnableFlowDBCache()
 	ffrule.EnableRuleDBCache()
 	enableTSDBCache()
@@ -43,6 +45,7 @@ func DisableCampaignsDBCache() {
 	disableTSDBCache()
 	ffrule.DisableRuleDBCache()
 	flow.DisableFlowDBCache()
+	capping.DisableCapDBCache()
 	log.Info("DisableCampaignsDBCache")
 }
 
@@ -70,7 +73,7 @@ func disableUserCampaignsDBCache() {
 // no cache
 func dbGetAllUserAvailableCampaigns() (userCampaigns map[int64][]CampaignConfig) {
 	d := dbgetter()
-	sql := "SELECT id, name, userId, hash, url, impPixelUrl, trafficSourceId, trafficSourceName, costModel, cpcValue, cpaValue, cpmValue, postbackUrl, pixelRedirectUrl, redirectMode, targetType, targetFlowId, targetUrl, status, country FROM TrackingCampaign WHERE deleted=0"
+	sql := "SELECT id, name, userId, hash, url, impPixelUrl, trafficSourceId, trafficSourceName, costModel, cpcValue, cpaValue, cpmValue, revShareValue, postbackUrl, pixelRedirectUrl, redirectMode, targetType, targetFlowId, targetUrl, status, country FROM TrackingCampaign WHERE deleted=0"
 	rows, err := d.Query(sql)
 
 	if err != nil {
@@ -83,7 +86,7 @@ func dbGetAllUserAvailableCampaigns() (userCampaigns map[int64][]CampaignConfig)
 
 	for rows.Next() {
 		var c CampaignConfig
-		if err := rows.Scan(&c.Id, &c.Name, &c.UserId, &c.Hash, &c.Url, &c.ImpPixelUrl, &c.TrafficSourceId, &c.TrafficSourceName, &c.CostModel, &c.CPCValue, &c.CPAValue, &c.CPMValue, &c.PostbackUrl, &c.PixelRedirectUrl, &c.RedirectMode, &c.TargetType, &c.TargetFlowId, &c.TargetUrl, &c.Status, &c.Country); err != nil {
+		if err := rows.Scan(&c.Id, &c.Name, &c.UserId, &c.Hash, &c.Url, &c.ImpPixelUrl, &c.TrafficSourceId, &c.TrafficSourceName, &c.CostModel, &c.CPCValue, &c.CPAValue, &c.CPMValue, &c.RevShareValue, &c.PostbackUrl, &c.PixelRedirectUrl, &c.RedirectMode, &c.TargetType, &c.TargetFlowId, &c.TargetUrl, &c.Status, &c.Country); err != nil {
 			log.Errorf("[campaign][dbGetAllUserAvailableCampaigns] scan failed:%v", err)
 			return nil
 		}
@@ -260,7 +263,7 @@ func DBGetCampaignTrafficConfig(trafficSourceId int64) (
 // no cache
 func dbGetAvailableCampaigns() []CampaignConfig {
 	d := dbgetter()
-	sql := "SELECT id, name, userId, hash, url, impPixelUrl, trafficSourceId, trafficSourceName, costModel, cpcValue, cpaValue, cpmValue, postbackUrl, pixelRedirectUrl, redirectMode, targetType, targetFlowId, targetUrl, status, country FROM TrackingCampaign WHERE deleted=0"
+	sql := "SELECT id, name, userId, hash, url, impPixelUrl, trafficSourceId, trafficSourceName, costModel, cpcValue, cpaValue, cpmValue, revShareValue, postbackUrl, pixelRedirectUrl, redirectMode, targetType, targetFlowId, targetUrl, status, country FROM TrackingCampaign WHERE deleted=0"
 	rows, err := d.Query(sql)
 	if err != nil {
 		log.Errorf("[campaign][dbGetAvailableCampaigns]Query: %s failed:%v", sql, err)
@@ -271,7 +274,7 @@ func dbGetAvailableCampaigns() []CampaignConfig {
 	var arr []CampaignConfig
 	for rows.Next() {
 		var c CampaignConfig
-		if err := rows.Scan(&c.Id, &c.Name, &c.UserId, &c.Hash, &c.Url, &c.ImpPixelUrl, &c.TrafficSourceId, &c.TrafficSourceName, &c.CostModel, &c.CPCValue, &c.CPAValue, &c.CPMValue, &c.PostbackUrl, &c.PixelRedirectUrl, &c.RedirectMode, &c.TargetType, &c.TargetFlowId, &c.TargetUrl, &c.Status, &c.Country); err != nil {
+		if err := rows.Scan(&c.Id, &c.Name, &c.UserId, &c.Hash, &c.Url, &c.ImpPixelUrl, &c.TrafficSourceId, &c.TrafficSourceName, &c.CostModel, &c.CPCValue, &c.CPAValue, &c.CPMValue, &c.RevShareValue, &c.PostbackUrl, &c.PixelRedirectUrl, &c.RedirectMode, &c.TargetType, &c.TargetFlowId, &c.TargetUrl, &c.Status, &c.Country); err != nil {
 			log.Errorf("[campaign][dbGetAvailableCampaigns] scan failed:%v", err)
 			return nil
 		}
@@ -302,7 +305,7 @@ func DBGetUserCampaigns(userId int64) (arr []CampaignConfig) {
 	}
 
 	d := dbgetter()
-	sql := "SELECT id, name, userId, hash, url, impPixelUrl, trafficSourceId, trafficSourceName, costModel, cpcValue, cpaValue, cpmValue, postbackUrl, pixelRedirectUrl, redirectMode, targetType, targetFlowId, targetUrl, status, country FROM TrackingCampaign WHERE userId=? AND deleted=0"
+	sql := "SELECT id, name, userId, hash, url, impPixelUrl, trafficSourceId, trafficSourceName, costModel, cpcValue, cpaValue, cpmValue, revShareValue, postbackUrl, pixelRedirectUrl, redirectMode, targetType, targetFlowId, targetUrl, status, country FROM TrackingCampaign WHERE userId=? AND deleted=0"
 	rows, err := d.Query(sql, userId)
 	if err != nil {
 		log.Errorf("[campaign][DBGetUserCampaigns]Query: %s failed:%v", sql, err)
@@ -312,7 +315,7 @@ func DBGetUserCampaigns(userId int64) (arr []CampaignConfig) {
 
 	for rows.Next() {
 		var c CampaignConfig
-		if err := rows.Scan(&c.Id, &c.Name, &c.UserId, &c.Hash, &c.Url, &c.ImpPixelUrl, &c.TrafficSourceId, &c.TrafficSourceName, &c.CostModel, &c.CPCValue, &c.CPAValue, &c.CPMValue, &c.PostbackUrl, &c.PixelRedirectUrl, &c.RedirectMode, &c.TargetType, &c.TargetFlowId, &c.TargetUrl, &c.Status, &c.Country); err != nil {
+		if err := rows.Scan(&c.Id, &c.Name, &c.UserId, &c.Hash, &c.Url, &c.ImpPixelUrl, &c.TrafficSourceId, &c.TrafficSourceName, &c.CostModel, &c.CPCValue, &c.CPAValue, &c.CPMValue, &c.RevShareValue, &c.PostbackUrl, &c.PixelRedirectUrl, &c.RedirectMode, &c.TargetType, &c.TargetFlowId, &c.TargetUrl, &c.Status, &c.Country); err != nil {
 			log.Errorf("[campaign][DBGetUserCampaigns] scan failed:%v", err)
 			return nil
 		}
@@ -338,10 +341,10 @@ func DBGetCampaign(campaignId int64) (c CampaignConfig) {
 	}
 
 	d := dbgetter()
-	sql := "SELECT id, name, userId, hash, url, impPixelUrl, trafficSourceId, trafficSourceName, costModel, cpcValue, cpaValue, cpmValue, postbackUrl, pixelRedirectUrl, redirectMode, targetType, targetFlowId, targetUrl, status, country FROM TrackingCampaign WHERE id=?"
+	sql := "SELECT id, name, userId, hash, url, impPixelUrl, trafficSourceId, trafficSourceName, costModel, cpcValue, cpaValue, cpmValue, revShareValue, postbackUrl, pixelRedirectUrl, redirectMode, targetType, targetFlowId, targetUrl, status, country FROM TrackingCampaign WHERE id=?"
 	row := d.QueryRow(sql, campaignId)
 
-	if err := row.Scan(&c.Id, &c.Name, &c.UserId, &c.Hash, &c.Url, &c.ImpPixelUrl, &c.TrafficSourceId, &c.TrafficSourceName, &c.CostModel, &c.CPCValue, &c.CPAValue, &c.CPMValue, &c.PostbackUrl, &c.PixelRedirectUrl, &c.RedirectMode, &c.TargetType, &c.TargetFlowId, &c.TargetUrl, &c.Status, &c.Country); err != nil {
+	if err := row.Scan(&c.Id, &c.Name, &c.UserId, &c.Hash, &c.Url, &c.ImpPixelUrl, &c.TrafficSourceId, &c.TrafficSourceName, &c.CostModel, &c.CPCValue, &c.CPAValue, &c.CPMValue, &c.RevShareValue, &c.PostbackUrl, &c.PixelRedirectUrl, &c.RedirectMode, &c.TargetType, &c.TargetFlowId, &c.TargetUrl, &c.Status, &c.Country); err != nil {
 		log.Errorf("[campaign][DBGetCampaign] scan failed:%v", err)
 		return
 	}
@@ -357,10 +360,10 @@ func DBGetCampaign(campaignId int64) (c CampaignConfig) {
 // no cache(特殊，因为Load阶段不会使用)
 func DBGetCampaignByHash(campaignHash string) (c CampaignConfig) {
 	d := dbgetter()
-	sql := "SELECT id, name, userId, hash, url, impPixelUrl, trafficSourceId, trafficSourceName, costModel, cpcValue, cpaValue, cpmValue, postbackUrl, pixelRedirectUrl, redirectMode, targetType, targetFlowId, targetUrl, status, country FROM TrackingCampaign WHERE hash=?"
+	sql := "SELECT id, name, userId, hash, url, impPixelUrl, trafficSourceId, trafficSourceName, costModel, cpcValue, cpaValue, cpmValue, revShareValue, postbackUrl, pixelRedirectUrl, redirectMode, targetType, targetFlowId, targetUrl, status, country FROM TrackingCampaign WHERE hash=?"
 	row := d.QueryRow(sql, campaignHash)
 
-	if err := row.Scan(&c.Id, &c.Name, &c.UserId, &c.Hash, &c.Url, &c.ImpPixelUrl, &c.TrafficSourceId, &c.TrafficSourceName, &c.CostModel, &c.CPCValue, &c.CPAValue, &c.CPMValue, &c.PostbackUrl, &c.PixelRedirectUrl, &c.RedirectMode, &c.TargetType, &c.TargetFlowId, &c.TargetUrl, &c.Status, &c.Country); err != nil {
+	if err := row.Scan(&c.Id, &c.Name, &c.UserId, &c.Hash, &c.Url, &c.ImpPixelUrl, &c.TrafficSourceId, &c.TrafficSourceName, &c.CostModel, &c.CPCValue, &c.CPAValue, &c.CPMValue, &c.RevShareValue, &c.PostbackUrl, &c.PixelRedirectUrl, &c.RedirectMode, &c.TargetType, &c.TargetFlowId, &c.TargetUrl, &c.Status, &c.Country); err != nil {
 		log.Errorf("[campaign][DBGetCampaign] campaignHash:%s scan failed:%v", campaignHash, err)
 		return
 	}
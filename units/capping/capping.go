@@ -0,0 +1,165 @@
+// Package capping 实现campaign/lander/offer的cap控制
+//
+// 每个element可以有多条cap，分别按clicks/conversions/revenue计数，
+// 周期为daily/hourly/total，daily和hourly在cap所设时区的整点重置。
+// 计数保存在shared的click store中(默认为redis)，多台机器共用同一份计数。
+package capping
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"Service/clickstore"
+	"Service/log"
+)
+
+// 可以设置cap的element
+const (
+	ElementCampaign = "campaign"
+	ElementLander   = "lander"
+	ElementOffer    = "offer"
+)
+
+// 计数的维度
+// clicks对campaign来说是visits，对lander来说是lander的展示次数，对offer来说是跳转到offer的次数
+const (
+	MetricClicks      = 0
+	MetricConversions = 1
+	MetricRevenue     = 2
+)
+
+// 计数的周期
+const (
+	PeriodDaily  = 0
+	PeriodHourly = 1
+	PeriodTotal  = 2
+)
+
+// 超出cap之后的处理方式
+const (
+	ActionRedirectOffer = 0 // 跳转到RedirectOfferId
+	ActionNextOffer     = 1 // 跳转到path中的下一个offer
+	ActionFallbackUrl   = 2 // 跳转到FallbackUrl
+)
+
+// 计数key在周期结束之后多保留一段时间再过期
+const expireSlack = time.Hour
+
+// CapConfig 对应数据库里面的Cap
+type CapConfig struct {
+	Id              int64
+	UserId          int64
+	Element         string
+	ElementId       int64
+	Metric          int
+	Period          int
+	Value           float64
+	TimezoneId      int64
+	Action          int
+	RedirectOfferId int64
+	FallbackUrl     string
+}
+
+func (c CapConfig) ID() int64 {
+	return c.Id
+}
+
+func (c CapConfig) String() string {
+	return fmt.Sprintf("Cap %s:%d metric:%d period:%d value:%v", c.Element, c.ElementId, c.Metric, c.Period, c.Value)
+}
+
+// key 当前周期的计数key，以及这个周期结束的时间(PeriodTotal为零值)
+func (c CapConfig) key(now time.Time) (string, time.Time) {
+	pk, end := periodOf(c.Period, now, GetLocation(c.TimezoneId))
+	return fmt.Sprintf("cap:%s:%d:%d:%d:%d:%s", c.Element, c.ElementId, c.Metric, c.Period, c.TimezoneId, pk), end
+}
+
+// periodOf 返回now在loc时区所处的周期，以及周期结束的时间
+func periodOf(period int, now time.Time, loc *time.Location) (string, time.Time) {
+	now = now.In(loc)
+	y, m, d := now.Date()
+	switch period {
+	case PeriodHourly:
+		start := time.Date(y, m, d, now.Hour(), 0, 0, 0, loc)
+		return start.Format("2006010215"), start.Add(time.Hour)
+	case PeriodTotal:
+		return "total", time.Time{}
+	default:
+		return now.Format("20060102"), time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+	}
+}
+
+// Caps 一个element的所有cap
+type Caps []CapConfig
+
+// Count 给所有metric维度的cap计数
+// clicks和conversions的delta为1，revenue的delta为payout
+func (cs Caps) Count(metric int, delta float64) {
+	if len(cs) == 0 || delta == 0 {
+		return
+	}
+	store := clickstore.Get(clickstore.Shared)
+	if store == nil {
+		log.Errorf("[capping][Count]shared click store does not exist\n")
+		return
+	}
+
+	now := time.Now()
+	for _, c := range cs {
+		if c.Metric != metric {
+			continue
+		}
+		k, end := c.key(now)
+		var ttl time.Duration
+		if !end.IsZero() {
+			ttl = end.Add(expireSlack).Sub(now)
+		}
+		if _, err := store.IncrByFloat(k, delta, ttl); err != nil {
+			log.Errorf("[capping][Count]IncrByFloat %s by %v failed:%v\n", k, delta, err)
+		}
+	}
+}
+
+// Exceeded 返回第一条已经达到上限的cap，都没有达到则返回nil
+// click store出错的时候不做限制
+func (cs Caps) Exceeded() *CapConfig {
+	if len(cs) == 0 {
+		return nil
+	}
+	store := clickstore.Get(clickstore.Shared)
+	if store == nil {
+		log.Errorf("[capping][Exceeded]shared click store does not exist\n")
+		return nil
+	}
+
+	now := time.Now()
+	keys := make([]string, len(cs))
+	for i := range cs {
+		keys[i], _ = cs[i].key(now)
+	}
+	vs, err := store.MGet(keys...)
+	if err != nil {
+		log.Errorf("[capping][Exceeded]MGet %v failed:%v\n", keys, err)
+		return nil
+	}
+
+	for i, v := range vs {
+		if i >= len(cs) || cs[i].Value <= 0 {
+			continue
+		}
+		if v == "" { // 本周期还没有计数
+			continue
+		}
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.Errorf("[capping][Exceeded]Invalid counter %s=%s\n", keys[i], v)
+			continue
+		}
+		if n >= cs[i].Value {
+			log.Infof("[capping][Exceeded]%s reached with %v\n", cs[i].String(), n)
+			return &cs[i]
+		}
+	}
+	return nil
+}
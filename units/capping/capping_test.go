@@ -0,0 +1,89 @@
+package capping
+
+import (
+	"testing"
+	"time"
+
+	"Service/clickstore"
+)
+
+func TestPeriodOf(t *testing.T) {
+	shanghai := time.FixedZone("+08:00", 8*3600)
+	// 2017-03-21 17:30 UTC，上海已经是第二天
+	now := time.Date(2017, 3, 21, 17, 30, 0, 0, time.UTC)
+
+	cases := []struct {
+		period int
+		loc    *time.Location
+		key    string
+		end    time.Time
+	}{
+		{PeriodDaily, time.UTC, "20170321", time.Date(2017, 3, 22, 0, 0, 0, 0, time.UTC)},
+		{PeriodDaily, shanghai, "20170322", time.Date(2017, 3, 23, 0, 0, 0, 0, shanghai)},
+		{PeriodHourly, time.UTC, "2017032117", time.Date(2017, 3, 21, 18, 0, 0, 0, time.UTC)},
+		{PeriodHourly, shanghai, "2017032201", time.Date(2017, 3, 22, 2, 0, 0, 0, shanghai)},
+		{PeriodTotal, shanghai, "total", time.Time{}},
+	}
+	for _, c := range cases {
+		key, end := periodOf(c.period, now, c.loc)
+		if key != c.key || !end.Equal(c.end) {
+			t.Errorf("periodOf(%d, %v, %v) = %s,%v; want %s,%v", c.period, now, c.loc, key, end, c.key, c.end)
+		}
+	}
+}
+
+func TestPeriodOfResetsAtMidnight(t *testing.T) {
+	ny := time.FixedZone("-05:00", -5*3600)
+	before := time.Date(2017, 3, 21, 23, 59, 59, 0, ny)
+	after := before.Add(time.Second)
+
+	k1, end := periodOf(PeriodDaily, before, ny)
+	k2, _ := periodOf(PeriodDaily, after, ny)
+	if k1 == k2 {
+		t.Errorf("daily key did not change at midnight: %s", k1)
+	}
+	if !end.Equal(after) {
+		t.Errorf("daily period ends at %v, want %v", end, after)
+	}
+}
+
+func TestFixedZone(t *testing.T) {
+	cases := map[string]int{
+		"+08:00": 8 * 3600,
+		"-05:30": -(5*3600 + 30*60),
+		"+00:00": 0,
+		"09:00":  9 * 3600,
+		"bad":    0,
+		"":       0,
+	}
+	for shift, want := range cases {
+		_, offset := time.Date(2017, 1, 1, 0, 0, 0, 0, fixedZone(Timezone{UtcShift: shift})).Zone()
+		if offset != want {
+			t.Errorf("fixedZone(%q) offset = %d, want %d", shift, offset, want)
+		}
+	}
+}
+
+func TestCapsCountAndExceeded(t *testing.T) {
+	clickstore.Set(clickstore.Shared, clickstore.NewMemoryStore())
+	defer clickstore.Set(clickstore.Shared, nil)
+
+	cs := Caps{
+		{Id: 1, Element: ElementOffer, ElementId: 7, Metric: MetricClicks, Period: PeriodDaily, Value: 2},
+		{Id: 2, Element: ElementOffer, ElementId: 7, Metric: MetricRevenue, Period: PeriodTotal, Value: 10},
+	}
+	if c := cs.Exceeded(); c != nil {
+		t.Fatalf("%s exceeded without any count", c.String())
+	}
+
+	cs.Count(MetricClicks, 1)
+	cs.Count(MetricRevenue, 6.5)
+	if c := cs.Exceeded(); c != nil {
+		t.Fatalf("%s exceeded too early", c.String())
+	}
+
+	cs.Count(MetricRevenue, 3.5)
+	if c := cs.Exceeded(); c == nil || c.Id != 2 {
+		t.Errorf("revenue cap should be exceeded, got %v", c)
+	}
+}
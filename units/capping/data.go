@@ -0,0 +1,258 @@
+package capping
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"Service/common"
+	"Service/db"
+	"Service/log"
+)
+
+// dbgetter 默认的拿数据库的东西
+// 方便测试的地方替换这个接口
+var dbgetter = func() *sql.DB {
+	return db.GetDB("DB")
+}
+
+type Timezone struct {
+	Id       int64
+	Name     string
+	Region   string
+	UtcShift string
+}
+
+func (t Timezone) String() string {
+	return fmt.Sprintf("Timezone %d:%s", t.Id, t.Region)
+}
+
+func (t Timezone) ID() int64 {
+	return t.Id
+}
+
+const capColumns = "id, userId, element, elementId, metric, period, value, timezoneId, action, redirectOfferId, fallbackUrl"
+
+// no cache
+func dbGetAvailableCaps() (caps []CapConfig) {
+	d := dbgetter()
+	sql := "SELECT " + capColumns + " FROM Cap WHERE deleted=0"
+	rows, err := d.Query(sql)
+	if err != nil {
+		log.Errorf("[capping][dbGetAvailableCaps]Query %s failed:%v", sql, err)
+		return nil
+	}
+	defer rows.Close()
+
+	var c CapConfig
+	for rows.Next() {
+		if err := rows.Scan(&c.Id, &c.UserId, &c.Element, &c.ElementId, &c.Metric, &c.Period, &c.Value,
+			&c.TimezoneId, &c.Action, &c.RedirectOfferId, &c.FallbackUrl); err != nil {
+			log.Errorf("[capping][dbGetAvailableCaps]Scan %s failed:%v", sql, err)
+			return nil
+		}
+		caps = append(caps, c)
+	}
+	return
+}
+
+// with cache
+func DBGetCaps(element string, elementId int64) (caps Caps) {
+	if elementId <= 0 {
+		return
+	}
+
+	if dc := capDBCaches[element]; dc != nil && dc.Enabled() {
+		for _, v := range dc.Get(elementId) {
+			caps = append(caps, v.(CapConfig))
+		}
+		return
+	}
+
+	d := dbgetter()
+	sql := "SELECT " + capColumns + " FROM Cap WHERE element=? AND elementId=? AND deleted=0"
+	rows, err := d.Query(sql, element, elementId)
+	if err != nil {
+		log.Errorf("[capping][DBGetCaps]Query %s with %s:%d failed:%v", sql, element, elementId, err)
+		return nil
+	}
+	defer rows.Close()
+
+	var c CapConfig
+	for rows.Next() {
+		if err := rows.Scan(&c.Id, &c.UserId, &c.Element, &c.ElementId, &c.Metric, &c.Period, &c.Value,
+			&c.TimezoneId, &c.Action, &c.RedirectOfferId, &c.FallbackUrl); err != nil {
+			log.Errorf("[capping][DBGetCaps]Scan %s failed:%v", sql, err)
+			return nil
+		}
+		caps = append(caps, c)
+	}
+	return
+}
+
+func dbGetAvailableTimezones() []Timezone {
+	d := dbgetter()
+	sql := `SELECT id, name, region, utcShift FROM Timezones`
+	rows, err := d.Query(sql)
+	if err != nil {
+		log.Errorf("[capping][dbGetAvailableTimezones]Query %s failed:%v", sql, err)
+		return nil
+	}
+	defer rows.Close()
+
+	var c Timezone
+	var arr []Timezone
+	for rows.Next() {
+		err := rows.Scan(&c.Id,
+			&c.Name,
+			&c.Region,
+			&c.UtcShift,
+		)
+
+		if err != nil {
+			log.Errorf("[capping][dbGetAvailableTimezones]Scan %s failed:%v", sql, err)
+			return nil
+		}
+
+		arr = append(arr, c)
+	}
+	return arr
+}
+
+func GetTimezone(timezonesId int64) Timezone {
+	var c Timezone
+	if timezonesDBCache.Enabled() {
+		v := timezonesDBCache.Get(timezonesId)
+		if v == nil {
+			log.Errorf("[GetTimezone]timezone(%d) does not exist in timezonesDBCache\n", timezonesId)
+			return c
+		}
+		return v.(Timezone)
+	}
+
+	d := dbgetter()
+	sql := `SELECT id, name, region, utcShift FROM Timezones WHERE id=? `
+	row := d.QueryRow(sql, timezonesId)
+
+	err := row.Scan(&c.Id,
+		&c.Name,
+		&c.Region,
+		&c.UtcShift,
+	)
+
+	if err != nil {
+		log.Errorf("[capping][GetTimezone]Scan %s failed:%v", sql, err)
+		return c
+	}
+
+	return c
+}
+
+var locMux sync.RWMutex
+var locations = make(map[int64]*time.Location)
+
+// GetLocation 时区id对应的Location，找不到的时候使用UTC
+func GetLocation(timezonesId int64) *time.Location {
+	if timezonesId <= 0 {
+		return time.UTC
+	}
+
+	locMux.RLock()
+	loc := locations[timezonesId]
+	locMux.RUnlock()
+	if loc != nil {
+		return loc
+	}
+
+	tz := GetTimezone(timezonesId)
+	if tz.Id == 0 {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(tz.Region)
+	if err != nil {
+		// 系统中没有tzdata的时候，退而使用固定的utcShift
+		loc = fixedZone(tz)
+	}
+
+	locMux.Lock()
+	locations[timezonesId] = loc
+	locMux.Unlock()
+	return loc
+}
+
+// fixedZone 解析+08:00/-05:30格式的utcShift
+func fixedZone(tz Timezone) *time.Location {
+	s := strings.TrimSpace(tz.UtcShift)
+	if len(s) < 2 {
+		return time.UTC
+	}
+	sign := 1
+	switch s[0] {
+	case '-':
+		sign = -1
+		s = s[1:]
+	case '+':
+		s = s[1:]
+	}
+	hm := strings.SplitN(s, ":", 2)
+	h, err := strconv.Atoi(hm[0])
+	if err != nil {
+		return time.UTC
+	}
+	m := 0
+	if len(hm) == 2 {
+		m, _ = strconv.Atoi(hm[1])
+	}
+	return time.FixedZone(tz.UtcShift, sign*(h*3600+m*60))
+}
+
+var timezonesDBCache common.DBCache
+var capDBCaches = map[string]*common.DBSliceCache{
+	ElementCampaign: new(common.DBSliceCache),
+	ElementLander:   new(common.DBSliceCache),
+	ElementOffer:    new(common.DBSliceCache),
+}
+
+func EnableTimezonesDBCache() {
+	log.Info("EnableTimezonesDBCache Begin")
+	origin := dbGetAvailableTimezones()
+	data := make([]common.HasID, len(origin))
+	for i, _ := range origin {
+		data[i] = origin[i]
+	}
+	timezonesDBCache.Init(data)
+	log.Info("EnableTimezonesDBCache End")
+}
+
+func DisableTimezonesDBCache() {
+	timezonesDBCache.Clear()
+	log.Info("DisableTimezonesDBCache")
+}
+
+func EnableCapDBCache() {
+	log.Info("EnableCapDBCache Begin")
+	EnableTimezonesDBCache()
+
+	data := make(map[string]map[int64][]common.HasID)
+	for _, c := range dbGetAvailableCaps() {
+		if data[c.Element] == nil {
+			data[c.Element] = make(map[int64][]common.HasID)
+		}
+		data[c.Element][c.ElementId] = append(data[c.Element][c.ElementId], c)
+	}
+	for element, dc := range capDBCaches {
+		dc.Init(data[element])
+	}
+	log.Info("EnableCapDBCache End")
+}
+
+func DisableCapDBCache() {
+	for _, dc := range capDBCaches {
+		dc.Clear()
+	}
+	DisableTimezonesDBCache()
+	log.Info("DisableCapDBCache")
+}
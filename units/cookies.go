@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
 	"Service/common"
 	"Service/log"
 	"Service/request"
+	"Service/units/frequency"
 )
 
 //const (
@@ -53,6 +55,22 @@ func SetCookie(w http.ResponseWriter, step string, req request.Request) {
 	http.SetCookie(w, cookie(step, req))
 }
 
+const visitorCookieAge = 365 * 24 * time.Hour
+
+// SetVisitorCookie 设置长期的访客id，没有的话用当前的request id，返回访客id
+func SetVisitorCookie(w http.ResponseWriter, req request.Request) string {
+	vid := frequency.VisitorId(req)
+	http.SetCookie(w, &http.Cookie{
+		Domain:   req.TrackingDomain(),
+		Path:     "/",
+		Name:     frequency.VisitorCookie,
+		Value:    vid,
+		HttpOnly: true,
+		Expires:  time.Now().Add(visitorCookieAge),
+	})
+	return vid
+}
+
 func ParseCookie(step string, r *http.Request) (req request.Request, err error) {
 	switch step {
 	case request.ReqImpression:
@@ -63,6 +81,10 @@ func ParseCookie(step string, r *http.Request) (req request.Request, err error)
 	//OK
 	case request.ReqS2SPostback: // 实际上Postback是单独解析的，现在不走这条线
 	//OK
+	case request.ReqConversionPixel:
+	//OK
+	case request.ReqConversionScript:
+	//OK
 	default:
 		return nil, fmt.Errorf("unsupported step(%s)", step)
 	}
@@ -108,7 +130,7 @@ func ParseCookie(step string, r *http.Request) (req request.Request, err error)
 			return nil, fmt.Errorf("request step(%s) does not match last step(%s) for request(%s)",
 				step, es, reqId)
 		}
-	case request.ReqS2SPostback:
+	case request.ReqS2SPostback, request.ReqConversionPixel, request.ReqConversionScript:
 		switch es {
 		case request.ReqLPOffer:
 		case request.ReqLPClick:
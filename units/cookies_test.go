@@ -0,0 +1,84 @@
+package units
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"Service/clickstore"
+	"Service/units/frequency"
+)
+
+type visitorRequest struct {
+	fakeRequest
+	id      string
+	cookies map[string]string
+}
+
+func (r *visitorRequest) Id() string                    { return r.id }
+func (r *visitorRequest) CookieValue(key string) string { return r.cookies[key] }
+func (r *visitorRequest) TrackingDomain() string        { return "u1.example.com" }
+func (r *visitorRequest) CampaignId() int64             { return 2 }
+func (r *visitorRequest) RemoteIp() string              { return "" }
+func (r *visitorRequest) OfferId() int64                { return 0 }
+func (r *visitorRequest) cookie(c *http.Cookie) *visitorRequest {
+	r.cookies[c.Name] = c.Value
+	return r
+}
+
+func newVisitorRequest(id string) *visitorRequest {
+	return &visitorRequest{id: id, cookies: make(map[string]string)}
+}
+
+// visit 和OnLPOfferRequest一样设置访客cookie并计数，返回写到浏览器的cookie
+func visit(t *testing.T, req *visitorRequest) *http.Cookie {
+	w := httptest.NewRecorder()
+	vid := SetVisitorCookie(w, req)
+	frequency.RecordVisit(req, vid)
+	for _, c := range w.Result().Cookies() {
+		if c.Name == frequency.VisitorCookie {
+			if c.Value != vid {
+				t.Errorf("cookie %s, visitor id %s", c.Value, vid)
+			}
+			return c
+		}
+	}
+	t.Fatal("visitor cookie not set")
+	return nil
+}
+
+func TestVisitorIdKept(t *testing.T) {
+	clickstore.Set(clickstore.Local, clickstore.NewMemoryStore())
+	defer clickstore.Set(clickstore.Local, nil)
+
+	// 第一次访问没有cookie，访客id为request id；同一次访问的click即使没有带cookie也是同一个访客
+	c := visit(t, newVisitorRequest("req1"))
+	if c.Value != "req1" {
+		t.Fatalf("first visitor id = %s, want req1", c.Value)
+	}
+	frequency.RecordClick(newVisitorRequest("req1"), frequency.VisitorId(newVisitorRequest("req1")))
+
+	// 之后的访问带着cookie，换了request id还是原来的访客
+	if c2 := visit(t, newVisitorRequest("req2").cookie(c)); c2.Value != "req1" {
+		t.Errorf("second visitor id = %s, want req1", c2.Value)
+	}
+	click := newVisitorRequest("req2").cookie(c)
+	frequency.RecordClick(click, frequency.VisitorId(click))
+
+	if n := frequency.VisitorCount("req1", frequency.EventVisit, "c2"); n != 2 {
+		t.Errorf("visits of visitor = %d, want 2", n)
+	}
+	if n := frequency.VisitorCount("req1", frequency.EventClick, "c2"); n != 2 {
+		t.Errorf("clicks of visitor = %d, want 2", n)
+	}
+	if n := frequency.VisitorCount("req2", frequency.EventVisit, "c2"); n != 0 {
+		t.Errorf("visits of req2 = %d, want 0", n)
+	}
+
+	// 非法的cookie不用
+	bad := newVisitorRequest("req3")
+	bad.cookies[frequency.VisitorCookie] = "freq:v:x"
+	if c3 := visit(t, bad); c3.Value != "req3" {
+		t.Errorf("visitor id with invalid cookie = %s, want req3", c3.Value)
+	}
+}
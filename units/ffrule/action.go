@@ -0,0 +1,284 @@
+package ffrule
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"Service/common"
+	"Service/log"
+	"Service/units/blacklist"
+	"Service/units/tspostback"
+)
+
+// Rule命中之后执行的动作，FraudFilterRule.actions为json数组，例如:
+//
+//	[{"type":"blacklist"},{"type":"safepage","url":"http://safe.example.com/","duration":3600},
+//	 {"type":"email","to":["ops@example.com"]},{"type":"webhook","url":"https://hooks.example.com/ff"},
+//	 {"type":"tspostback","url":"http://ts.example.com/negative?clickid={externalid}"}]
+//
+// 为空时只有blacklist，和原来的行为一样
+// 每个动作的结果都记到FraudFilterLog.actions里面
+const (
+	ActionBlacklist  = "blacklist"  // IP加到用户的BotBlacklist
+	ActionPause      = "pause"      // 停止campaign
+	ActionSafePage   = "safepage"   // 这个dimension值的visit跳转到url，不再走flow
+	ActionNoCost     = "nocost"     // 这个dimension值的流量不再记cost
+	ActionEmail      = "email"      // 发邮件给to
+	ActionWebhook    = "webhook"    // POST命中的信息到url
+	ActionTSPostback = "tspostback" // 通过traffic source的postback url回传负面信号，url支持request的token
+)
+
+const defaultSanctionDuration = 24 * 3600 // seconds
+
+type Action struct {
+	Type     string   `json:"type"`
+	Url      string   `json:"url,omitempty"`
+	To       []string `json:"to,omitempty"`
+	Duration int64    `json:"duration,omitempty"` // pause/safepage/nocost的有效时间，秒，0为defaultSanctionDuration，负数为永久
+}
+
+func (a Action) validate() error {
+	switch a.Type {
+	case ActionBlacklist, ActionPause, ActionNoCost:
+	case ActionSafePage, ActionWebhook, ActionTSPostback:
+		if a.Url == "" {
+			return fmt.Errorf("%s action needs url", a.Type)
+		}
+		if a.Type == ActionWebhook {
+			return checkWebhookURL(a.Url)
+		}
+	case ActionEmail:
+		if len(a.To) == 0 {
+			return errors.New("email action needs to")
+		}
+		for _, addr := range a.To {
+			if err := checkMailAddress(addr); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported action type(%s)", a.Type)
+	}
+	return nil
+}
+
+// expiresAt 从now开始的过期时间，0为永久
+func (a Action) expiresAt(now int64) int64 {
+	switch {
+	case a.Duration < 0:
+		return 0
+	case a.Duration == 0:
+		return now + defaultSanctionDuration
+	}
+	return now + a.Duration
+}
+
+// parseActions 解析FraudFilterRule.actions，为空时返回默认的blacklist
+// 不认识或者缺少参数的动作跳过，和错误一起返回
+func parseActions(s string) (actions []Action, err error) {
+	if strings.TrimSpace(s) == "" {
+		return []Action{{Type: ActionBlacklist}}, nil
+	}
+	var all []Action
+	if err = json.Unmarshal([]byte(s), &all); err != nil {
+		return nil, fmt.Errorf("invalid actions(%s):%v", s, err)
+	}
+	var errs []string
+	signal := false
+	for _, a := range all {
+		a.Type = strings.ToLower(strings.TrimSpace(a.Type))
+		if e := a.validate(); e != nil {
+			errs = append(errs, e.Error())
+			continue
+		}
+		if a.Type == ActionTSPostback {
+			// Event里面只带一个替换过的url
+			if signal {
+				errs = append(errs, "only one tspostback action is supported")
+				continue
+			}
+			signal = true
+		}
+		actions = append(actions, a)
+	}
+	if len(errs) > 0 {
+		err = fmt.Errorf("invalid actions(%s):%s", s, strings.Join(errs, ";"))
+	}
+	return
+}
+
+// ActionResult 一个动作的执行结果，存在FraudFilterLog.actions里面
+type ActionResult struct {
+	Type      string `json:"type"`
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+	TimeStamp int64  `json:"ts"`
+}
+
+// actionBatch 一批命中里面需要通知其它服务的消息，最后一起发
+type actionBatch struct {
+	blacklistUsers []string
+	campaigns      []string // userId.update.campaign.campaignId
+	sanctions      []string // FFRuleSanction.id
+}
+
+func (b *actionBatch) publish() {
+	if len(b.blacklistUsers) > 0 {
+		if err := PublishMsg(strings.Join(common.RemoveDuplicates(b.blacklistUsers), ",")); err != nil {
+			log.Errorf("[ffrule][actionBatch.publish]blacklist users:%v\n", err)
+		}
+	}
+	for _, msg := range common.RemoveDuplicates(b.campaigns) {
+		if err := publish(campaignChannel, msg); err != nil {
+			log.Errorf("[ffrule][actionBatch.publish]campaign(%s):%v\n", msg, err)
+		}
+	}
+	for _, msg := range b.sanctions {
+		if err := publish(SanctionChannel, msg); err != nil {
+			log.Errorf("[ffrule][actionBatch.publish]sanction(%s):%v\n", msg, err)
+		}
+	}
+}
+
+// hitContext 执行动作时需要的命中信息
+type hitContext struct {
+	Hit
+	LogId int64
+	batch *actionBatch
+}
+
+// actionHandlers 每种动作的执行函数，返回记录到审计日志里面的说明
+// 测试的时候可以替换
+var actionHandlers = map[string]func(c *hitContext, a Action) (detail string, err error){
+	ActionBlacklist:  doBlacklist,
+	ActionPause:      doPause,
+	ActionSafePage:   doSanction,
+	ActionNoCost:     doSanction,
+	ActionEmail:      doEmail,
+	ActionWebhook:    doWebhook,
+	ActionTSPostback: doTSPostback,
+}
+
+// runActions 依次执行rule的所有动作，某个动作失败不影响其它的
+func runActions(c *hitContext) []ActionResult {
+	results := make([]ActionResult, 0, len(c.Rule.Actions))
+	for _, a := range c.Rule.Actions {
+		res := ActionResult{Type: a.Type}
+		if h := actionHandlers[a.Type]; h == nil {
+			res.Error = "unsupported action"
+		} else if detail, err := h(c, a); err != nil {
+			res.Detail, res.Error = detail, err.Error()
+		} else {
+			res.Detail, res.OK = detail, true
+		}
+		res.TimeStamp = time.Now().Unix()
+		if !res.OK {
+			log.Errorf("[ffrule][runActions]rule(%d) log(%d) %s failed:%s\n", c.Rule.Id, c.LogId, a.Type, res.Error)
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// doBlacklist 命中的IP(rule有USERAGENT条件时还有UA)加到用户的BotBlacklist
+// ISP、referrer之类的dimension没有对应的IP范围，跳过
+func doBlacklist(c *hitContext, a Action) (string, error) {
+	r, e := c.Rule, c.Event
+	ipRange := r.dim.blacklistRange(e.dimension())
+	if ipRange == "" {
+		return fmt.Sprintf("skipped:dimension %s has no ip range", r.Dimension), nil
+	}
+	var userAgent []string
+	for _, cond := range r.Conditions {
+		if cond.Key == ConditionHeaderUserAgent {
+			userAgent = []string{e.UA}
+			break
+		}
+	}
+	name := fmt.Sprintf("FFRule(%s) Generated", r.Name)
+	if err := blacklist.DBInsertUserBlacklist(name, r.UserId, []string{ipRange}, userAgent); err != nil {
+		return "", err
+	}
+	c.batch.blacklistUsers = append(c.batch.blacklistUsers, fmt.Sprintf("%d", r.UserId))
+	return ipRange, nil
+}
+
+func doPause(c *hitContext, a Action) (string, error) {
+	changed, err := dbPauseCampaign(c.Rule.UserId, c.Event.CampaignId)
+	if err != nil {
+		return "", err
+	}
+	if changed {
+		c.batch.campaigns = append(c.batch.campaigns, fmt.Sprintf("%d.update.campaign.%d", c.Rule.UserId, c.Event.CampaignId))
+	}
+	// 用户停止的campaign仍然接受visit，只有ffrule停止的才拒绝，所以另外记一条pause的Sanction
+	detail, err := doSanction(c, a)
+	if err != nil {
+		return "", err
+	}
+	if !changed {
+		return fmt.Sprintf("campaign(%d) already paused;%s", c.Event.CampaignId, detail), nil
+	}
+	return fmt.Sprintf("campaign(%d) paused;%s", c.Event.CampaignId, detail), nil
+}
+
+func doSanction(c *hitContext, a Action) (string, error) {
+	s := Sanction{
+		RuleId:     c.Rule.Id,
+		LogId:      c.LogId,
+		CampaignId: c.Event.CampaignId,
+		Dimension:  c.Rule.Dimension,
+		Value:      c.Event.dimension(),
+		Action:     a.Type,
+		ExpiresAt:  a.expiresAt(time.Now().Unix()),
+	}
+	if a.Type == ActionSafePage {
+		s.Url = a.Url
+	}
+	id, err := dbInsertSanction(s)
+	if err != nil {
+		return "", err
+	}
+	c.batch.sanctions = append(c.batch.sanctions, fmt.Sprintf("%d", id))
+	return fmt.Sprintf("sanction(%d) %s=%s until %d", id, s.Dimension, s.Value, s.ExpiresAt), nil
+}
+
+func doEmail(c *hitContext, a Action) (string, error) {
+	n := newNotification(c)
+	subject := fmt.Sprintf("FFRule(%s) hit campaign(%d) %s=%s", n.RuleName, n.CampaignId, n.Dimension, n.Value)
+	if err := sendMail(a.To, subject, n.text()); err != nil {
+		return "", err
+	}
+	return strings.Join(a.To, ","), nil
+}
+
+func doWebhook(c *hitContext, a Action) (string, error) {
+	status, err := postWebhook(a.Url, newNotification(c))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %d", a.Url, status), nil
+}
+
+// doTSPostback Event.Signal是producer用request替换过token的url
+func doTSPostback(c *hitContext, a Action) (string, error) {
+	e := c.Event
+	if e.Signal == "" {
+		return "", errors.New("no postback url rendered for this event")
+	}
+	err := tspostback.Enqueue(tspostback.Job{
+		ClickId:         e.ClickId,
+		UserId:          c.Rule.UserId,
+		CampaignId:      e.CampaignId,
+		TrafficSourceId: e.TrafficSourceId,
+		Url:             e.Signal,
+	})
+	if err != nil {
+		return "", err
+	}
+	return e.Signal, nil
+}
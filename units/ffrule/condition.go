@@ -0,0 +1,304 @@
+package ffrule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 条件表达式:
+//
+//	PV>500,UserAgent>100,Clicks>100                      逗号和AND一样
+//	(CTR>=80 AND Clicks>20) OR NoClickVisits>1000
+//	UAs>=5 && TTC<300 || NoConvClicks>200
+//
+// AND(&&,逗号)的优先级高于OR(||)，可以用括号；比较符号为> >= < <= =
+// 所有的数量都是在同一个dimension值(如同一个IP)下，TimeSpan之内统计的
+
+const (
+	ReqTypeImpression = 0x1
+	ReqTypeVisit      = 0x2
+	ReqTypeClick      = 0x4
+	ReqTypeConversion = 0x8
+)
+
+const (
+	ConditionHeaderPV            = "PV"        // impressions+visits
+	ConditionHeaderUserAgent     = "USERAGENT" // 当前请求的user agent的impressions+visits
+	ConditionHeaderClick         = "CLICKS"
+	ConditionHeaderImpressions   = "IMPRESSIONS"
+	ConditionHeaderVisits        = "VISITS"
+	ConditionHeaderConversions   = "CONVERSIONS"
+	ConditionHeaderUserAgents    = "UAS"           // 不同的user agent的数量
+	ConditionHeaderCTR           = "CTR"           // clicks/visits，百分比
+	ConditionHeaderNoClickVisits = "NOCLICKVISITS" // visits-clicks
+	ConditionHeaderNoConvClicks  = "NOCONVCLICKS"  // clicks-conversions
+	ConditionHeaderTTC           = "TTC"           // 平均time-to-click(visit到click)，毫秒
+)
+
+// 每种条件需要统计的请求类型
+var conditionTypes = map[string]int{
+	ConditionHeaderPV:            ReqTypeImpression | ReqTypeVisit,
+	ConditionHeaderUserAgent:     ReqTypeImpression | ReqTypeVisit,
+	ConditionHeaderClick:         ReqTypeClick,
+	ConditionHeaderImpressions:   ReqTypeImpression,
+	ConditionHeaderVisits:        ReqTypeVisit,
+	ConditionHeaderConversions:   ReqTypeConversion,
+	ConditionHeaderUserAgents:    ReqTypeImpression | ReqTypeVisit | ReqTypeClick,
+	ConditionHeaderCTR:           ReqTypeVisit | ReqTypeClick,
+	ConditionHeaderNoClickVisits: ReqTypeVisit | ReqTypeClick,
+	ConditionHeaderNoConvClicks:  ReqTypeClick | ReqTypeConversion,
+	ConditionHeaderTTC:           ReqTypeClick,
+}
+
+type Condition struct {
+	T     int    // 用来快速判断是否需要应用于某种case;是ReqType的按位或
+	Key   string // all upper
+	Op    string // > >= < <= =
+	Value float64
+}
+
+func (c Condition) String() string {
+	return c.Key + c.Op + strconv.FormatFloat(c.Value, 'f', -1, 64)
+}
+
+// Hit v为这个条件统计出来的值
+func (c Condition) Hit(v float64) bool {
+	switch c.Op {
+	case ">":
+		return v > c.Value
+	case ">=":
+		return v >= c.Value
+	case "<":
+		return v < c.Value
+	case "<=":
+		return v <= c.Value
+	case "=":
+		return v == c.Value
+	}
+	return false
+}
+
+const (
+	ExprAnd = "AND"
+	ExprOr  = "OR"
+)
+
+// Expr 条件表达式，叶子节点Op为空，只有Cond
+type Expr struct {
+	Op       string // ExprAnd/ExprOr
+	Cond     Condition
+	Children []*Expr
+}
+
+// Eval value返回某个条件统计出来的值，ok为false时(如没有visit时的CTR)这个条件不满足
+func (e *Expr) Eval(value func(c Condition) (v float64, ok bool)) bool {
+	switch e.Op {
+	case ExprAnd:
+		for _, c := range e.Children {
+			if !c.Eval(value) {
+				return false
+			}
+		}
+		return true
+	case ExprOr:
+		for _, c := range e.Children {
+			if c.Eval(value) {
+				return true
+			}
+		}
+		return false
+	}
+	v, ok := value(e.Cond)
+	return ok && e.Cond.Hit(v)
+}
+
+func (e *Expr) String() string {
+	if e.Op == "" {
+		return e.Cond.String()
+	}
+	s := make([]string, len(e.Children))
+	for i, c := range e.Children {
+		s[i] = c.String()
+		if c.Op == ExprOr && e.Op == ExprAnd {
+			s[i] = "(" + s[i] + ")"
+		}
+	}
+	return strings.Join(s, " "+e.Op+" ")
+}
+
+// Conditions 所有的叶子条件
+func (e *Expr) Conditions() (conditions []Condition) {
+	if e.Op == "" {
+		return []Condition{e.Cond}
+	}
+	for _, c := range e.Children {
+		conditions = append(conditions, c.Conditions()...)
+	}
+	return
+}
+
+// ParseConditions 解析条件表达式，返回所有的叶子条件
+func ParseConditions(sCondition string) (conditions []Condition) {
+	e, err := ParseExpr(sCondition)
+	if err != nil {
+		return nil
+	}
+	return e.Conditions()
+}
+
+// ParseExpr 解析条件表达式，大小写不敏感
+func ParseExpr(s string) (*Expr, error) {
+	tokens, err := tokenize(strings.ToUpper(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid conditions(%s):%v", s, err)
+	}
+	p := &parser{tokens: tokens}
+	e, err := p.or()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid conditions(%s):%v", s, err)
+	}
+	return e, nil
+}
+
+func tokenize(s string) (tokens []string, err error) {
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+			continue
+		case c == '(' || c == ')' || c == ',':
+			tokens = append(tokens, s[i:i+1])
+			i++
+			continue
+		case strings.HasPrefix(s[i:], "&&"):
+			tokens = append(tokens, ExprAnd)
+			i += 2
+			continue
+		case strings.HasPrefix(s[i:], "||"):
+			tokens = append(tokens, ExprOr)
+			i += 2
+			continue
+		case strings.HasPrefix(s[i:], ">=") || strings.HasPrefix(s[i:], "<="):
+			tokens = append(tokens, s[i:i+2])
+			i += 2
+			continue
+		case c == '>' || c == '<':
+			tokens = append(tokens, s[i:i+1])
+			i++
+			continue
+		case c == '=':
+			tokens = append(tokens, "=")
+			if i++; i < len(s) && s[i] == '=' {
+				i++
+			}
+			continue
+		}
+
+		j := i
+		for j < len(s) && (s[j] >= 'A' && s[j] <= 'Z' || s[j] >= '0' && s[j] <= '9' || s[j] == '.' || s[j] == '_') {
+			j++
+		}
+		if j == i {
+			return nil, fmt.Errorf("unexpected %q", s[i:i+1])
+		}
+		tokens = append(tokens, s[i:j])
+		i = j
+	}
+	return
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// or := and { OR and }
+func (p *parser) or() (*Expr, error) {
+	e, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	children := []*Expr{e}
+	for p.peek() == ExprOr {
+		p.next()
+		if e, err = p.and(); err != nil {
+			return nil, err
+		}
+		children = append(children, e)
+	}
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &Expr{Op: ExprOr, Children: children}, nil
+}
+
+// and := factor { (AND|,) factor }
+func (p *parser) and() (*Expr, error) {
+	e, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	children := []*Expr{e}
+	for p.peek() == ExprAnd || p.peek() == "," {
+		p.next()
+		if e, err = p.factor(); err != nil {
+			return nil, err
+		}
+		children = append(children, e)
+	}
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &Expr{Op: ExprAnd, Children: children}, nil
+}
+
+// factor := ( or ) | KEY op NUMBER
+func (p *parser) factor() (*Expr, error) {
+	if p.peek() == "(" {
+		p.next()
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t != ")" {
+			return nil, fmt.Errorf("expect ) but got %q", t)
+		}
+		return e, nil
+	}
+
+	key := p.next()
+	t, ok := conditionTypes[key]
+	if !ok {
+		return nil, fmt.Errorf("unknown condition %q", key)
+	}
+	op := p.next()
+	switch op {
+	case ">", ">=", "<", "<=", "=":
+	default:
+		return nil, fmt.Errorf("invalid operation %q after %s", op, key)
+	}
+	s := p.next()
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q after %s%s", s, key, op)
+	}
+	return &Expr{Cond: Condition{T: t, Key: key, Op: op, Value: v}}, nil
+}
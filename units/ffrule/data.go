@@ -2,6 +2,7 @@ package ffrule
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 
 	"Service/common"
@@ -19,7 +20,7 @@ var dbgetter = func() *sql.DB {
 //no cache
 func dbGetAvailableRules() (rules []RuleConfig) {
 	d := dbgetter()
-	sql := `SELECT id,name,status,userId,dimension,timeSpan,FraudFilterRule.condition FROM FraudFilterRule WHERE deleted=0`
+	sql := `SELECT id,name,status,userId,dimension,timeSpan,FraudFilterRule.condition,actions FROM FraudFilterRule WHERE deleted=0`
 	rows, err := d.Query(sql)
 	if err != nil {
 		log.Errorf("[ffrule][dbGetAvailableRules]Query: %s failed:%v", sql, err)
@@ -29,7 +30,7 @@ func dbGetAvailableRules() (rules []RuleConfig) {
 	var status int
 	for rows.Next() {
 		var rule RuleConfig
-		if err := rows.Scan(&rule.Id, &rule.Name, &status, &rule.UserId, &rule.Dimension, &rule.TimeSpan, &rule.Conditions); err != nil {
+		if err := rows.Scan(&rule.Id, &rule.Name, &status, &rule.UserId, &rule.Dimension, &rule.TimeSpan, &rule.Conditions, &rule.Actions); err != nil {
 			log.Errorf("[ffrule][dbGetAvailableRules]Query: %s failed:%v", sql, err)
 			rows.Close()
 			return
@@ -90,9 +91,9 @@ func DBGetRule(ruleId int64) (rule RuleConfig) {
 
 	d := dbgetter()
 	var status int
-	sql := `SELECT id,name,status,userId,dimension,timeSpan,FraudFilterRule.condition FROM FraudFilterRule WHERE id=? AND deleted=0`
+	sql := `SELECT id,name,status,userId,dimension,timeSpan,FraudFilterRule.condition,actions FROM FraudFilterRule WHERE id=? AND deleted=0`
 	if err := d.QueryRow(sql, ruleId).
-		Scan(&rule.Id, &rule.Name, &status, &rule.UserId, &rule.Dimension, &rule.TimeSpan, &rule.Conditions); err != nil {
+		Scan(&rule.Id, &rule.Name, &status, &rule.UserId, &rule.Dimension, &rule.TimeSpan, &rule.Conditions, &rule.Actions); err != nil {
 		log.Errorf("[ffrule][DBGetRule]QueryRow: %s with id:%v failed:%v", sql, ruleId, err)
 	}
 	rule.Active = (status == 1)
@@ -301,14 +302,13 @@ func DBSaveFFHitRecords(l hitLog) (int64, error) {
 	d := dbgetter()
 	sqlStr := "INSERT INTO FraudFilterLog(`ruleId`,`dimension`,`hit`,`condition`,`timeStamp`) VALUES(?,?,?,?,?)"
 	r := GetRule(l.RuleId)
+	if r == nil {
+		return 0, fmt.Errorf("rule(%d) not found", l.RuleId)
+	}
 
 	condition := ""
-	for i, c := range r.Conditions {
-		if i == 0 {
-			condition += fmt.Sprintf("%s%s%d", c.Key, c.Op, c.Value)
-		} else {
-			condition += fmt.Sprintf(",%s%s%d", c.Key, c.Op, c.Value)
-		}
+	if r.Expr != nil {
+		condition = r.Expr.String()
 	}
 	res, err := d.Exec(sqlStr, l.RuleId, r.Dimension, 1, condition, l.TimeStamp)
 	if err != nil {
@@ -337,12 +337,97 @@ func DBSaveFraudFilterLogDetail(logId int64, l hitLog) error {
 }
 
 func PublishMsg(msg string) error {
-	var msgChannel = "channel_blacklist_changed_users"
+	return publish("channel_blacklist_changed_users", msg)
+}
+
+func publish(channel, msg string) error {
 	redis := db.GetRedisClient("MSGQUEUE")
-	pubSub := redis.Publish(msgChannel, msg)
+	if redis == nil {
+		return errors.New("MSGQUEUE redis client is nil")
+	}
+	pubSub := redis.Publish(channel, msg)
 	if err := pubSub.Err(); err != nil {
-		log.Errorf("[ffrule][PublishMsg]Publish: %s failed:%v", msg, err)
+		log.Errorf("[ffrule][publish]Publish: %s to %s failed:%v", msg, channel, err)
+		return err
+	}
+	return nil
+}
+
+// DBSaveFFActions 把动作的执行结果记到FraudFilterLog.actions
+func DBSaveFFActions(logId int64, results []ActionResult) error {
+	bs, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	d := dbgetter()
+	sqlStr := "UPDATE FraudFilterLog SET `actions`=? WHERE id=?"
+	if _, err := d.Exec(sqlStr, string(bs), logId); err != nil {
+		log.Errorf("[ffrule][DBSaveFFActions]Exec: %s with logId:%v failed:%v", sqlStr, logId, err)
 		return err
 	}
 	return nil
 }
+
+// dbPauseCampaign 停止campaign，changed为false表示本来就是停止的
+func dbPauseCampaign(userId, campaignId int64) (changed bool, err error) {
+	d := dbgetter()
+	sqlStr := "UPDATE TrackingCampaign SET `status`=0 WHERE id=? AND userId=? AND `status`<>0"
+	res, err := d.Exec(sqlStr, campaignId, userId)
+	if err != nil {
+		log.Errorf("[ffrule][dbPauseCampaign]Exec: %s with id:%v failed:%v", sqlStr, campaignId, err)
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func dbInsertSanction(s Sanction) (int64, error) {
+	d := dbgetter()
+	sqlStr := "INSERT INTO FFRuleSanction(`ruleId`,`logId`,`campaignId`,`dimension`,`value`,`action`,`url`,`expiresAt`) VALUES(?,?,?,?,?,?,?,?)"
+	res, err := d.Exec(sqlStr, s.RuleId, s.LogId, s.CampaignId, s.Dimension, s.Value, s.Action, s.Url, s.ExpiresAt)
+	if err != nil {
+		log.Errorf("[ffrule][dbInsertSanction]Exec: %s with campaign:%v failed:%v", sqlStr, s.CampaignId, err)
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+const sanctionColumns = "id,ruleId,logId,campaignId,dimension,value,action,url,expiresAt"
+
+func scanSanction(row interface {
+	Scan(dest ...interface{}) error
+}) (s Sanction, err error) {
+	err = row.Scan(&s.Id, &s.RuleId, &s.LogId, &s.CampaignId, &s.Dimension, &s.Value, &s.Action, &s.Url, &s.ExpiresAt)
+	return
+}
+
+func dbGetSanction(id int64) (Sanction, error) {
+	d := dbgetter()
+	sqlStr := "SELECT " + sanctionColumns + " FROM FFRuleSanction WHERE id=?"
+	s, err := scanSanction(d.QueryRow(sqlStr, id))
+	if err != nil {
+		log.Errorf("[ffrule][dbGetSanction]QueryRow: %s with id:%v failed:%v", sqlStr, id, err)
+	}
+	return s, err
+}
+
+//no cache
+func dbGetActiveSanctions(now int64) (list []Sanction, err error) {
+	d := dbgetter()
+	sqlStr := "SELECT " + sanctionColumns + " FROM FFRuleSanction WHERE expiresAt=0 OR expiresAt>?"
+	rows, err := d.Query(sqlStr, now)
+	if err != nil {
+		log.Errorf("[ffrule][dbGetActiveSanctions]Query: %s failed:%v", sqlStr, err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		s, err := scanSanction(rows)
+		if err != nil {
+			log.Errorf("[ffrule][dbGetActiveSanctions]scan failed:%v", err)
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
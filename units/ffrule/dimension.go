@@ -0,0 +1,112 @@
+package ffrule
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"Service/request"
+	"Service/util/ipcmp"
+)
+
+// Rule按照Dimension的值分别统计，比如同一个IP，同一个/24网段
+const (
+	DimensionIP       = "IP"
+	DimensionSubnet   = "SUBNET"   // IPv4为/24，IPv6为/64
+	DimensionISP      = "ISP"      // 运营商
+	DimensionReferrer = "REFERRER" // referrer的域名
+	DimensionTSVar    = "V"        // V1~V10，traffic source的参数
+)
+
+// dimension 解析过的Rule.Dimension
+type dimension struct {
+	name string
+	n    uint // DimensionTSVar的序号，从0开始
+}
+
+func (d dimension) String() string {
+	if d.name == DimensionTSVar {
+		return fmt.Sprintf("%s%d", DimensionTSVar, d.n+1)
+	}
+	return d.name
+}
+
+// parseDimension 空的当作IP，大小写不敏感
+func parseDimension(s string) (d dimension, err error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	switch s {
+	case "", DimensionIP:
+		return dimension{name: DimensionIP}, nil
+	case DimensionSubnet, "IP/24", "IP24":
+		return dimension{name: DimensionSubnet}, nil
+	case DimensionISP:
+		return dimension{name: DimensionISP}, nil
+	case DimensionReferrer, "REFERRERDOMAIN":
+		return dimension{name: DimensionReferrer}, nil
+	}
+	if strings.HasPrefix(s, DimensionTSVar) {
+		n, err := strconv.Atoi(s[len(DimensionTSVar):])
+		if err == nil && n >= 1 && n <= request.VarsMaxNum {
+			return dimension{name: DimensionTSVar, n: uint(n - 1)}, nil
+		}
+	}
+	return d, fmt.Errorf("unsupported dimension(%s)", s)
+}
+
+// value 请求在这个dimension上的值，空的表示不统计
+func (d dimension) value(req request.Request) string {
+	switch d.name {
+	case DimensionIP:
+		return canonicalIP(req.RemoteIp())
+	case DimensionSubnet:
+		return subnet(req.RemoteIp())
+	case DimensionISP:
+		return req.ISP()
+	case DimensionReferrer:
+		return req.ReferrerDomain()
+	case DimensionTSVar:
+		return req.Vars(d.n)
+	}
+	return ""
+}
+
+// canonicalIP IPv6的同一个地址可以有不同的写法，统一之后再统计；解析不了的原样保留
+func canonicalIP(s string) string {
+	if c := ipcmp.Canonical(s); c != "" {
+		return c
+	}
+	return strings.TrimSpace(s)
+}
+
+// subnet IPv4的/24，IPv6的/64，如1.2.3.0/24
+func subnet(ip string) string {
+	a, err := ipcmp.ParseIP128(ip)
+	if err != nil {
+		return ""
+	}
+	p := a.NetIP()
+	if v4 := p.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return p.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// blacklistRange 命中时加到BotBlacklist里面的IP范围
+// 只有IP和SUBNET可以转换成IP范围，其它的返回空
+func (d dimension) blacklistRange(value string) string {
+	switch d.name {
+	case DimensionIP:
+		if ipcmp.Canonical(value) == "" {
+			return ""
+		}
+		return value
+	case DimensionSubnet:
+		cmp, err := ipcmp.NewIPCompare(value)
+		if err != nil {
+			return ""
+		}
+		return cmp.First().String() + "-" + cmp.Last().String()
+	}
+	return ""
+}
@@ -0,0 +1,253 @@
+package ffrule
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Event 一次需要FFRule检查的请求，由producer(sengine/spostback)发出，consumer(sffrule)处理
+type Event struct {
+	RuleId     int64  `json:"r"`
+	CampaignId int64  `json:"c"`
+	Type       int    `json:"t"`           // ReqTypeImpression/ReqTypeVisit/ReqTypeClick/ReqTypeConversion
+	Dim        string `json:"d,omitempty"` // Rule.Dimension的值，空的时候用IP
+	IP         string `json:"ip"`
+	UA         string `json:"ua,omitempty"`
+	TTC        int64  `json:"ttc,omitempty"` // click时visit到click的时间，毫秒
+	TimeStamp  int64  `json:"ts"`            // in seconds
+
+	// 只有rule有tspostback动作时才有
+	ClickId         string `json:"ci,omitempty"`
+	TrafficSourceId int64  `json:"tsi,omitempty"`
+	Signal          string `json:"sig,omitempty"` // 替换过token的postback url
+}
+
+func (e Event) dimension() string {
+	if e.Dim != "" {
+		return e.Dim
+	}
+	return e.IP
+}
+
+// Hit 命中的rule以及触发命中的那个事件
+type Hit struct {
+	Rule  *Rule
+	Event Event
+}
+
+type entry struct {
+	ts  int64
+	typ int
+	ua  string
+	ttc int64
+}
+
+// bucket 同一个rule，同一个campaign，同一个dimension值的滑动窗口
+// 只保留(latest-span, latest]之间的请求，各种数量随着请求的进出增量更新
+type bucket struct {
+	ruleId  int64
+	span    int64
+	entries []entry // 按ts升序
+
+	types     map[int]int    // 每种请求类型的数量
+	pvByUA    map[string]int // 每个user agent的impressions+visits
+	ua        map[string]int // 每个user agent的请求数
+	ttc, ttcN int64          // 有TTC的click的TTC总和和数量
+}
+
+func newBucket(ruleId int64) *bucket {
+	return &bucket{
+		ruleId: ruleId,
+		types:  make(map[int]int),
+		pvByUA: make(map[string]int),
+		ua:     make(map[string]int),
+	}
+}
+
+func (b *bucket) latest() int64 {
+	if len(b.entries) == 0 {
+		return 0
+	}
+	return b.entries[len(b.entries)-1].ts
+}
+
+func (b *bucket) count(e entry, delta int) {
+	b.types[e.typ] += delta
+	if e.ua != "" {
+		if e.typ&(ReqTypeImpression|ReqTypeVisit) != 0 {
+			if b.pvByUA[e.ua] += delta; b.pvByUA[e.ua] == 0 {
+				delete(b.pvByUA, e.ua)
+			}
+		}
+		if b.ua[e.ua] += delta; b.ua[e.ua] == 0 {
+			delete(b.ua, e.ua)
+		}
+	}
+	if e.ttc > 0 {
+		b.ttc += int64(delta) * e.ttc
+		b.ttcN += int64(delta)
+	}
+}
+
+func (b *bucket) add(e entry) {
+	n := len(b.entries)
+	if n > 0 && e.ts <= b.latest()-b.span {
+		return // 已经在窗口之外
+	}
+	i := n
+	if n > 0 && b.entries[n-1].ts > e.ts {
+		// 不同的producer之间可能会稍微乱序
+		i = sort.Search(n, func(j int) bool { return b.entries[j].ts > e.ts })
+	}
+	b.entries = append(b.entries, entry{})
+	copy(b.entries[i+1:], b.entries[i:])
+	b.entries[i] = e
+	b.count(e, 1)
+
+	latest := b.latest()
+	k := 0
+	for k < len(b.entries) && b.entries[k].ts <= latest-b.span {
+		b.count(b.entries[k], -1)
+		k++
+	}
+	if k > 0 {
+		b.entries = append(b.entries[:0], b.entries[k:]...)
+	}
+}
+
+func (b *bucket) expired(now int64) bool {
+	return len(b.entries) == 0 || b.latest() <= now-b.span
+}
+
+// value 条件c在这个窗口里面的值，e是当前的事件
+func (b *bucket) value(c Condition, e Event) (float64, bool) {
+	imps, visits := b.types[ReqTypeImpression], b.types[ReqTypeVisit]
+	clicks, convs := b.types[ReqTypeClick], b.types[ReqTypeConversion]
+	switch c.Key {
+	case ConditionHeaderPV:
+		return float64(imps + visits), true
+	case ConditionHeaderUserAgent:
+		return float64(b.pvByUA[e.UA]), true
+	case ConditionHeaderClick:
+		return float64(clicks), true
+	case ConditionHeaderImpressions:
+		return float64(imps), true
+	case ConditionHeaderVisits:
+		return float64(visits), true
+	case ConditionHeaderConversions:
+		return float64(convs), true
+	case ConditionHeaderUserAgents:
+		return float64(len(b.ua)), true
+	case ConditionHeaderCTR:
+		if visits == 0 {
+			return 0, false
+		}
+		return float64(clicks) * 100 / float64(visits), true
+	case ConditionHeaderNoClickVisits:
+		if visits < clicks {
+			return 0, true
+		}
+		return float64(visits - clicks), true
+	case ConditionHeaderNoConvClicks:
+		if clicks < convs {
+			return 0, true
+		}
+		return float64(clicks - convs), true
+	case ConditionHeaderTTC:
+		if b.ttcN == 0 {
+			return 0, false
+		}
+		return float64(b.ttc) / float64(b.ttcN), true
+	}
+	return 0, false
+}
+
+// Engine 按事件到达的顺序增量计数，每个事件都马上检查一次它的rule
+// 命中之后相关的窗口清空，并且在一个TimeSpan之内不再计数，
+// 同一波请求只触发一次动作，过了冷却期再重新计数
+type Engine struct {
+	rule func(ruleId int64) *Rule
+
+	lock      sync.Mutex // protects buckets and cooldowns
+	buckets   map[string]*bucket
+	cooldowns map[string]int64 // 命中过的窗口 -> 冷却结束的时间戳
+}
+
+// NewEngine rule用来根据ruleId找到Rule，找不到时返回nil
+func NewEngine(rule func(ruleId int64) *Rule) *Engine {
+	return &Engine{
+		rule:      rule,
+		buckets:   make(map[string]*bucket),
+		cooldowns: make(map[string]int64),
+	}
+}
+
+// Add 记录一个事件，并检查它的rule是否命中
+func (en *Engine) Add(e Event) (h Hit, hit bool) {
+	r := en.rule(e.RuleId)
+	if r == nil || !r.Active || r.Expr == nil || e.Type&r.t == 0 {
+		return
+	}
+
+	k := fmt.Sprintf("%d_%d_%s", r.Id, e.CampaignId, e.dimension())
+	en.lock.Lock()
+	defer en.lock.Unlock()
+	if until, ok := en.cooldowns[k]; ok {
+		if e.TimeStamp < until {
+			return
+		}
+		delete(en.cooldowns, k)
+	}
+	b := en.buckets[k]
+	if b == nil {
+		b = newBucket(r.Id)
+		en.buckets[k] = b
+	}
+	b.span = r.TimeSpan // rule的TimeSpan可能修改过
+	b.add(entry{ts: e.TimeStamp, typ: e.Type, ua: e.UA, ttc: e.TTC})
+
+	if !r.Expr.Eval(func(c Condition) (float64, bool) { return b.value(c, e) }) {
+		return
+	}
+	// 命中之后把相关的记录都清掉，冷却期内的请求不再计数
+	delete(en.buckets, k)
+	en.cooldowns[k] = e.TimeStamp + r.TimeSpan
+	return Hit{Rule: r, Event: e}, true
+}
+
+// Sweep 清除now时已经过期的窗口和冷却期，以及rule已经删除或者不再Active的窗口
+func (en *Engine) Sweep(now int64) {
+	en.lock.Lock()
+	ruleIds := make(map[int64]bool)
+	for _, b := range en.buckets {
+		ruleIds[b.ruleId] = true
+	}
+	en.lock.Unlock()
+
+	// 找rule可能要查数据库，不要拿着锁
+	for id := range ruleIds {
+		r := en.rule(id)
+		ruleIds[id] = r != nil && r.Active
+	}
+
+	en.lock.Lock()
+	defer en.lock.Unlock()
+	for k, b := range en.buckets {
+		if active, ok := ruleIds[b.ruleId]; (ok && !active) || b.expired(now) {
+			delete(en.buckets, k)
+		}
+	}
+	for k, until := range en.cooldowns {
+		if until <= now {
+			delete(en.cooldowns, k)
+		}
+	}
+}
+
+// Len 当前窗口的数量
+func (en *Engine) Len() int {
+	en.lock.Lock()
+	defer en.lock.Unlock()
+	return len(en.buckets)
+}
@@ -1 +1,565 @@
 package ffrule
+
+import (
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testEngine(configs ...RuleConfig) *Engine {
+	rs := make(map[int64]*Rule)
+	for _, c := range configs {
+		rs[c.Id] = newRule(c)
+	}
+	return NewEngine(func(id int64) *Rule { return rs[id] })
+}
+
+// stream 按顺序喂事件，返回命中的事件下标
+func stream(en *Engine, events []Event) (hits []int) {
+	for i, e := range events {
+		if _, hit := en.Add(e); hit {
+			hits = append(hits, i)
+		}
+	}
+	return
+}
+
+func visits(ip string, ts ...int64) []Event {
+	events := make([]Event, len(ts))
+	for i, t := range ts {
+		events[i] = Event{RuleId: 1, CampaignId: 10, Type: ReqTypeVisit, IP: ip, TimeStamp: t}
+	}
+	return events
+}
+
+func equal(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestConditionHit(t *testing.T) {
+	cs := ParseConditions("PV>3,UserAgent>1,Clicks>0")
+	if len(cs) != 3 {
+		t.Fatalf("ParseConditions got %+v", cs)
+	}
+	if cs[0].Hit(3) || !cs[0].Hit(4) {
+		t.Error("PV>3 should hit from 4")
+	}
+	if cs[2].T != ReqTypeClick || !cs[2].Hit(1) {
+		t.Errorf("Clicks>0 got %+v", cs[2])
+	}
+	if ParseConditions("PV>x") != nil || ParseConditions("FOO>1") != nil {
+		t.Error("invalid conditions should be rejected")
+	}
+}
+
+func TestEnginePV(t *testing.T) {
+	en := testEngine(RuleConfig{Id: 1, Active: true, TimeSpan: 10, Conditions: "PV>3"})
+
+	// 第4个在10秒以内的请求命中，冷却10秒之后重新计数
+	got := stream(en, visits("1.2.3.4", 0, 2, 4, 6, 7, 8, 9, 10, 16, 17, 18, 19))
+	if want := []int{3, 11}; !equal(got, want) {
+		t.Errorf("hits %v, want %v", got, want)
+	}
+
+	// 间隔4秒，10秒内最多只有3个
+	got = stream(en, visits("1.2.3.5", 100, 104, 108, 112, 116, 120, 124))
+	if len(got) != 0 {
+		t.Errorf("sparse requests hit at %v", got)
+	}
+
+	// 不同IP分开计数
+	var mixed []Event
+	for i := int64(0); i < 3; i++ {
+		mixed = append(mixed, visits("5.5.5.5", 200+i)...)
+		mixed = append(mixed, visits("6.6.6.6", 200+i)...)
+	}
+	if got = stream(en, mixed); len(got) != 0 {
+		t.Errorf("ips should be counted separately, hit at %v", got)
+	}
+}
+
+func TestEngineCooldown(t *testing.T) {
+	en := testEngine(RuleConfig{Id: 1, Active: true, TimeSpan: 60, Conditions: "PV>=5"})
+
+	// 3倍阈值的请求只触发一次动作
+	var ts []int64
+	for i := int64(0); i < 15; i++ {
+		ts = append(ts, 100+i)
+	}
+	if got := stream(en, visits("1.2.3.4", ts...)); !equal(got, []int{4}) {
+		t.Errorf("hits %v, want [4]", got)
+	}
+	// 冷却期内其它IP照常计数
+	if got := stream(en, visits("1.2.3.5", 110, 111, 112, 113, 114)); !equal(got, []int{4}) {
+		t.Errorf("other ip hits %v, want [4]", got)
+	}
+
+	// 冷却期过了之后清掉，重新计数
+	en.Sweep(170)
+	if n := len(en.cooldowns); n != 1 {
+		t.Errorf("%d cooldowns after sweep, want 1", n)
+	}
+	en.Sweep(175)
+	if n := len(en.cooldowns); n != 0 {
+		t.Errorf("%d cooldowns after sweep, want 0", n)
+	}
+	if got := stream(en, visits("1.2.3.4", 170, 171, 172, 173, 174)); !equal(got, []int{4}) {
+		t.Errorf("hits after cooldown %v, want [4]", got)
+	}
+}
+
+func TestEngineOutOfOrder(t *testing.T) {
+	en := testEngine(RuleConfig{Id: 1, Active: true, TimeSpan: 10, Conditions: "PV>2"})
+
+	// 50秒的那个已经在窗口之外
+	if got := stream(en, visits("1.2.3.4", 60, 50, 58)); len(got) != 0 {
+		t.Errorf("hit at %v", got)
+	}
+	if got := stream(en, visits("1.2.3.4", 55)); !equal(got, []int{0}) {
+		t.Errorf("hits %v, want [0]", got)
+	}
+}
+
+func TestEngineTypes(t *testing.T) {
+	en := testEngine(RuleConfig{Id: 1, Active: true, TimeSpan: 60, Conditions: "Clicks>1"})
+
+	events := visits("1.2.3.4", 1, 2, 3, 4, 5)
+	for i := 0; i < 2; i++ {
+		events = append(events, Event{RuleId: 1, CampaignId: 10, Type: ReqTypeClick, IP: "1.2.3.4", TimeStamp: int64(10 + i)})
+	}
+	if got := stream(en, events); !equal(got, []int{6}) {
+		t.Errorf("hits %v, want [6]", got)
+	}
+}
+
+func TestEngineUserAgent(t *testing.T) {
+	en := testEngine(RuleConfig{Id: 1, Active: true, TimeSpan: 60, Conditions: "UserAgent>1"})
+
+	events := []Event{
+		{RuleId: 1, Type: ReqTypeImpression, IP: "1.2.3.4", UA: "a", TimeStamp: 1},
+		{RuleId: 1, Type: ReqTypeImpression, IP: "1.2.3.4", UA: "b", TimeStamp: 2},
+		{RuleId: 1, Type: ReqTypeVisit, IP: "1.2.3.4", UA: "a", TimeStamp: 3},
+	}
+	if got := stream(en, events); !equal(got, []int{2}) {
+		t.Errorf("hits %v, want [2]", got)
+	}
+}
+
+// 多个条件都满足才命中，点击和访问各自计数
+func TestEngineAnd(t *testing.T) {
+	en := testEngine(RuleConfig{Id: 1, Active: true, TimeSpan: 60, Conditions: "PV>2,Clicks>0"})
+
+	events := visits("1.2.3.4", 1, 2, 3, 4)
+	events = append(events, Event{RuleId: 1, CampaignId: 10, Type: ReqTypeClick, IP: "1.2.3.4", TimeStamp: 5})
+	if got := stream(en, events); !equal(got, []int{4}) {
+		t.Errorf("hits %v, want [4]", got)
+	}
+}
+
+func TestEngineInactive(t *testing.T) {
+	rs := map[int64]*Rule{
+		1: newRule(RuleConfig{Id: 1, Active: true, TimeSpan: 60, Conditions: "PV>5"}),
+		2: newRule(RuleConfig{Id: 2, Active: false, TimeSpan: 60, Conditions: "PV>0"}),
+	}
+	en := NewEngine(func(id int64) *Rule { return rs[id] })
+
+	events := visits("1.2.3.4", 1, 2, 3)
+	for _, e := range events {
+		e.RuleId = 2
+		if _, hit := en.Add(e); hit {
+			t.Error("inactive rule should not hit")
+		}
+	}
+	stream(en, events)
+	if n := en.Len(); n != 1 {
+		t.Fatalf("%d windows, want 1", n)
+	}
+
+	// 还在窗口内
+	en.Sweep(30)
+	if n := en.Len(); n != 1 {
+		t.Errorf("%d windows after sweep, want 1", n)
+	}
+	// rule被删除
+	delete(rs, 1)
+	en.Sweep(30)
+	if n := en.Len(); n != 0 {
+		t.Errorf("%d windows after rule deleted, want 0", n)
+	}
+
+	// 过期
+	rs[1] = newRule(RuleConfig{Id: 1, Active: true, TimeSpan: 60, Conditions: "PV>5"})
+	stream(en, events)
+	en.Sweep(63)
+	if n := en.Len(); n != 0 {
+		t.Errorf("%d windows after expired, want 0", n)
+	}
+}
+
+func TestParseExpr(t *testing.T) {
+	for s, want := range map[string]string{
+		"PV>500,UserAgent>100,Clicks>100":               "PV>500 AND USERAGENT>100 AND CLICKS>100",
+		"ctr >= 80 and clicks>20 or NoClickVisits>1000": "CTR>=80 AND CLICKS>20 OR NOCLICKVISITS>1000",
+		"UAs>=5 && (TTC<300 || NoConvClicks>200)":       "UAS>=5 AND (TTC<300 OR NOCONVCLICKS>200)",
+		"((Visits<=1.5))":                               "VISITS<=1.5",
+		"Impressions==3 OR Conversions=0, PV>1":         "IMPRESSIONS=3 OR CONVERSIONS=0 AND PV>1",
+	} {
+		e, err := ParseExpr(s)
+		if err != nil {
+			t.Errorf("%s:%v", s, err)
+			continue
+		}
+		if got := e.String(); got != want {
+			t.Errorf("%s got %s, want %s", s, got, want)
+		}
+		// String的结果可以再解析回来
+		if e2, err := ParseExpr(e.String()); err != nil || e2.String() != want {
+			t.Errorf("%s reparse got %v %v", want, e2, err)
+		}
+	}
+
+	for _, s := range []string{"", "PV", "PV>", "PV>>1", "FOO>1", "PV>1 AND", "(PV>1", "PV>1)", "PV>1 CLICKS>1", "PV!1"} {
+		if _, err := ParseExpr(s); err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+
+	cs := ParseConditions("CTR>50 OR TTC<100")
+	if len(cs) != 2 || cs[0].T != ReqTypeVisit|ReqTypeClick || cs[1].T != ReqTypeClick {
+		t.Errorf("ParseConditions got %+v", cs)
+	}
+}
+
+func event(typ int, ip, ua string, ts int64) Event {
+	return Event{RuleId: 1, CampaignId: 10, Type: typ, IP: ip, UA: ua, TimeStamp: ts}
+}
+
+func TestEngineMetrics(t *testing.T) {
+	for _, c := range []struct {
+		conditions string
+		events     []Event
+		want       []int
+	}{
+		// 点击率过高
+		{"CTR>=100 AND Clicks>1", []Event{
+			event(ReqTypeVisit, "1.1.1.1", "", 1), event(ReqTypeClick, "1.1.1.1", "", 2),
+			event(ReqTypeVisit, "1.1.1.1", "", 3), event(ReqTypeClick, "1.1.1.1", "", 4),
+		}, []int{3}},
+		// 没有visit时CTR不满足
+		{"CTR>=0", []Event{event(ReqTypeClick, "1.1.1.1", "", 1)}, nil},
+		// 一个IP很多不同的user agent
+		{"UAs>2", []Event{
+			event(ReqTypeVisit, "1.1.1.1", "a", 1), event(ReqTypeVisit, "1.1.1.1", "a", 2),
+			event(ReqTypeImpression, "1.1.1.1", "b", 3), event(ReqTypeClick, "1.1.1.1", "c", 4),
+		}, []int{3}},
+		// 只访问不点击
+		{"NoClickVisits>=3", []Event{
+			event(ReqTypeVisit, "1.1.1.1", "", 1), event(ReqTypeVisit, "1.1.1.1", "", 2),
+			event(ReqTypeClick, "1.1.1.1", "", 3), event(ReqTypeVisit, "1.1.1.1", "", 4),
+			event(ReqTypeVisit, "1.1.1.1", "", 5),
+		}, []int{4}},
+		// 只点击不转化
+		{"NoConvClicks>1", []Event{
+			event(ReqTypeClick, "1.1.1.1", "", 1), event(ReqTypeConversion, "1.1.1.1", "", 2),
+			event(ReqTypeClick, "1.1.1.1", "", 3), event(ReqTypeClick, "1.1.1.1", "", 4),
+		}, []int{3}},
+		// OR，任何一个满足都命中
+		{"Visits>2 OR Clicks>0", []Event{
+			event(ReqTypeVisit, "1.1.1.1", "", 1), event(ReqTypeClick, "1.1.1.1", "", 2),
+			event(ReqTypeVisit, "1.1.1.1", "", 62), event(ReqTypeVisit, "1.1.1.1", "", 63),
+			event(ReqTypeVisit, "1.1.1.1", "", 64),
+		}, []int{1, 4}},
+	} {
+		en := testEngine(RuleConfig{Id: 1, Active: true, TimeSpan: 60, Conditions: c.conditions})
+		if got := stream(en, c.events); !equal(got, c.want) {
+			t.Errorf("%s hits %v, want %v", c.conditions, got, c.want)
+		}
+	}
+}
+
+func TestEngineTTC(t *testing.T) {
+	en := testEngine(RuleConfig{Id: 1, Active: true, TimeSpan: 60, Conditions: "TTC<300 AND Clicks>=2"})
+
+	clicks := []Event{event(ReqTypeClick, "1.1.1.1", "", 1), event(ReqTypeClick, "1.1.1.1", "", 2), event(ReqTypeClick, "1.1.1.1", "", 3)}
+	clicks[0].TTC, clicks[1].TTC, clicks[2].TTC = 1000, 100, 50
+	// 平均1000,550,383
+	if got := stream(en, clicks); len(got) != 0 {
+		t.Errorf("hit at %v", got)
+	}
+
+	// 第一个click出了窗口之后平均为75
+	late := event(ReqTypeClick, "1.1.1.1", "", 61)
+	late.TTC = 75
+	if got := stream(en, []Event{late}); !equal(got, []int{0}) {
+		t.Errorf("hits %v, want [0]", got)
+	}
+}
+
+func TestDimension(t *testing.T) {
+	for s, want := range map[string]string{"": "IP", "ip": "IP", "ip/24": "SUBNET", "Referrer": "REFERRER", "isp": "ISP", "v3": "V3", "V10": "V10"} {
+		d, err := parseDimension(s)
+		if err != nil || d.String() != want {
+			t.Errorf("%q got %v %v, want %s", s, d, err, want)
+		}
+	}
+	for _, s := range []string{"V0", "V11", "COUNTRY"} {
+		if _, err := parseDimension(s); err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+
+	if s := subnet("10.1.2.3"); s != "10.1.2.0/24" {
+		t.Errorf("subnet got %s", s)
+	}
+	if s := subnet("2001:db8:1:2:3::4"); s != "2001:db8:1:2::/64" {
+		t.Errorf("subnet got %s", s)
+	}
+	d := dimension{name: DimensionSubnet}
+	if r := d.blacklistRange("10.1.2.0/24"); r != "10.1.2.0-10.1.2.255" {
+		t.Errorf("blacklistRange got %s", r)
+	}
+	if r := (dimension{name: DimensionISP}).blacklistRange("Some ISP"); r != "" {
+		t.Errorf("blacklistRange got %s", r)
+	}
+	if r := d.blacklistRange(subnet("2001:db8:1:2:3::4")); r != "2001:db8:1:2::-2001:db8:1:2:ffff:ffff:ffff:ffff" {
+		t.Errorf("blacklistRange got %s", r)
+	}
+	ipd := dimension{name: DimensionIP}
+	if v := canonicalIP(" 2001:0DB8::0001 "); v != "2001:db8::1" || ipd.blacklistRange(v) != v {
+		t.Errorf("canonicalIP got %s", v)
+	}
+	if r := ipd.blacklistRange("unknown"); r != "" {
+		t.Errorf("blacklistRange got %s", r)
+	}
+
+	// 同一个网段的不同IP一起统计
+	en := testEngine(RuleConfig{Id: 1, Active: true, TimeSpan: 60, Dimension: "SUBNET", Conditions: "PV>2"})
+	var events []Event
+	for i, ip := range []string{"10.1.2.3", "10.1.2.4", "10.1.3.5", "10.1.2.6"} {
+		e := event(ReqTypeVisit, ip, "", int64(i))
+		e.Dim = subnet(ip)
+		events = append(events, e)
+	}
+	if got := stream(en, events); !equal(got, []int{3}) {
+		t.Errorf("hits %v, want [3]", got)
+	}
+
+	// 无效的rule不处理任何请求
+	en = testEngine(RuleConfig{Id: 1, Active: true, TimeSpan: 60, Dimension: "COUNTRY", Conditions: "PV>0"})
+	if got := stream(en, visits("1.1.1.1", 1, 2)); len(got) != 0 {
+		t.Errorf("invalid rule hit at %v", got)
+	}
+}
+
+func TestParseActions(t *testing.T) {
+	actions, err := parseActions("")
+	if err != nil || len(actions) != 1 || actions[0].Type != ActionBlacklist {
+		t.Fatalf("empty actions:%+v %v", actions, err)
+	}
+
+	actions, err = parseActions(`[{"type":"Pause"},{"type":"safepage"},{"type":"email","to":["a@b.com"]},{"type":"unknown"},
+		{"type":"tspostback","url":"http://ts/1"},{"type":"tspostback","url":"http://ts/2"}]`)
+	if err == nil {
+		t.Fatal("invalid actions should be reported")
+	}
+	var types []string
+	for _, a := range actions {
+		types = append(types, a.Type)
+	}
+	if len(types) != 3 || types[0] != ActionPause || types[1] != ActionEmail || types[2] != ActionTSPostback {
+		t.Fatalf("valid actions should be kept, got %v", types)
+	}
+
+	if _, err := parseActions("blacklist"); err == nil {
+		t.Fatal("non-json actions should fail")
+	}
+
+	now := int64(1000)
+	for _, c := range []struct {
+		d, expires int64
+	}{{0, now + defaultSanctionDuration}, {60, now + 60}, {-1, 0}} {
+		if got := (Action{Duration: c.d}).expiresAt(now); got != c.expires {
+			t.Errorf("duration %d:expect %d got %d", c.d, c.expires, got)
+		}
+	}
+}
+
+func TestRunActions(t *testing.T) {
+	origin := actionHandlers
+	defer func() { actionHandlers = origin }()
+
+	var called []string
+	actionHandlers = map[string]func(c *hitContext, a Action) (string, error){
+		ActionPause: func(c *hitContext, a Action) (string, error) {
+			called = append(called, a.Type)
+			return "", errors.New("db down")
+		},
+		ActionWebhook: func(c *hitContext, a Action) (string, error) {
+			called = append(called, a.Type)
+			return a.Url, nil
+		},
+	}
+
+	r := newRule(RuleConfig{Id: 1, Active: true, TimeSpan: 10, Conditions: "PV>1",
+		Actions: `[{"type":"pause"},{"type":"webhook","url":"http://hook"},{"type":"nocost"}]`})
+	results := runActions(&hitContext{Hit: Hit{Rule: r}, LogId: 5, batch: &actionBatch{}})
+	if len(called) != 2 || called[0] != ActionPause || called[1] != ActionWebhook {
+		t.Fatalf("a failed action should not stop the others, called %v", called)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expect 3 results, got %+v", results)
+	}
+	if results[0].OK || results[0].Error != "db down" {
+		t.Errorf("pause:%+v", results[0])
+	}
+	if !results[1].OK || results[1].Detail != "http://hook" {
+		t.Errorf("webhook:%+v", results[1])
+	}
+	if results[2].OK || results[2].Error == "" {
+		t.Errorf("nocost without handler:%+v", results[2])
+	}
+}
+
+func TestDoBlacklistSkip(t *testing.T) {
+	r := newRule(RuleConfig{Id: 1, Dimension: "ISP", Conditions: "PV>1"})
+	b := &actionBatch{}
+	detail, err := doBlacklist(&hitContext{Hit: Hit{Rule: r, Event: Event{Dim: "Comcast", IP: "1.2.3.4"}}, batch: b}, Action{Type: ActionBlacklist})
+	if err != nil || detail == "" || len(b.blacklistUsers) != 0 {
+		t.Fatalf("ISP hit should be skipped:%s %v %v", detail, err, b.blacklistUsers)
+	}
+}
+
+func TestSanctionStore(t *testing.T) {
+	st := newSanctionStore()
+	now := int64(1000)
+	add := func(s Sanction) {
+		if err := st.add(&s, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add(Sanction{Id: 1, CampaignId: 10, Dimension: "IP", Value: "1.2.3.4", Action: ActionSafePage, Url: "http://safe", ExpiresAt: now + 10})
+	add(Sanction{Id: 2, CampaignId: 10, Dimension: "SUBNET", Value: "5.6.7.0/24", Action: ActionNoCost})
+	add(Sanction{Id: 3, CampaignId: 10, Dimension: "IP", Value: "9.9.9.9", Action: ActionNoCost, ExpiresAt: now - 1})
+	add(Sanction{Id: 1, CampaignId: 10, Dimension: "IP", Value: "1.2.3.4", Action: ActionSafePage, Url: "http://safe", ExpiresAt: now + 10})
+	if st.len() != 2 {
+		t.Fatalf("expired and duplicated sanctions should be ignored, got %d", st.len())
+	}
+	if err := st.add(&Sanction{Id: 4, Dimension: "foo"}, now); err == nil {
+		t.Fatal("invalid dimension should fail")
+	}
+
+	valueOf := func(ip string) func(d dimension) string {
+		return func(d dimension) string {
+			if d.name == DimensionSubnet {
+				return subnet(ip)
+			}
+			return ip
+		}
+	}
+	if s := st.find(10, ActionSafePage, now, valueOf("1.2.3.4")); s == nil || s.Url != "http://safe" {
+		t.Errorf("safepage should match:%+v", s)
+	}
+	if s := st.find(10, ActionSafePage, now+10, valueOf("1.2.3.4")); s != nil {
+		t.Errorf("safepage should expire:%+v", s)
+	}
+	if s := st.find(10, ActionNoCost, now, valueOf("5.6.7.8")); s == nil || s.Id != 2 {
+		t.Errorf("nocost subnet should match:%+v", s)
+	}
+	if s := st.find(11, ActionNoCost, now, valueOf("5.6.7.8")); s != nil {
+		t.Errorf("other campaign should not match:%+v", s)
+	}
+	if s := st.find(10, ActionNoCost, now, valueOf("1.2.3.4")); s != nil {
+		t.Errorf("safepage should not be nocost:%+v", s)
+	}
+
+	if st.paused(10, now) {
+		t.Error("campaign without pause sanction should not be paused")
+	}
+	add(Sanction{Id: 5, CampaignId: 12, Dimension: "IP", Value: "1.2.3.4", Action: ActionPause, ExpiresAt: now + 10})
+	if !st.paused(12, now) || st.paused(12, now+10) || st.paused(10, now) {
+		t.Error("pause should only affect campaign 12 before it expires")
+	}
+}
+
+func TestMailHeader(t *testing.T) {
+	subject := "FFRule(r) hit campaign(1) ua=x\r\nBcc: evil@example.com\n中文"
+	v := headerValue(subject)
+	if strings.ContainsAny(v, "\r\n") {
+		t.Fatalf("headerValue(%q)=%q", subject, v)
+	}
+	encoded := mime.QEncoding.Encode("UTF-8", v)
+	if strings.ContainsAny(encoded, "\r\n") {
+		t.Errorf("encoded subject %q", encoded)
+	}
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(encoded); err != nil || decoded != v {
+		t.Errorf("decode %q:%q %v", encoded, decoded, err)
+	}
+
+	for _, addr := range []string{"a@b.com", "x.y@example.org"} {
+		if err := checkMailAddress(addr); err != nil {
+			t.Errorf("checkMailAddress(%s):%v", addr, err)
+		}
+	}
+	for _, addr := range []string{"", "a", "a@b.com\r\nBcc: c@d.com", "A <a@b.com>", "a@b.com,c@d.com"} {
+		if err := checkMailAddress(addr); err == nil {
+			t.Errorf("checkMailAddress(%q) should fail", addr)
+		}
+	}
+}
+
+func TestWebhookURL(t *testing.T) {
+	for _, u := range []string{"http://hook.example.com/x", "https://hook.example.com:8443/"} {
+		if err := checkWebhookURL(u); err != nil {
+			t.Errorf("checkWebhookURL(%s):%v", u, err)
+		}
+	}
+	for _, u := range []string{"file:///etc/passwd", "gopher://x", "ftp://hook.example.com", "//hook.example.com", "http://"} {
+		if err := checkWebhookURL(u); err == nil {
+			t.Errorf("checkWebhookURL(%s) should fail", u)
+		}
+	}
+
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::ffff:127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := publicIP(net.ParseIP(tt.ip)); got != tt.public {
+			t.Errorf("publicIP(%s)=%v", tt.ip, got)
+		}
+	}
+
+	// httptest在127.0.0.1上，连不上才对
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+	defer srv.Close()
+	if _, err := postWebhook(srv.URL, notification{}); err == nil || called {
+		t.Errorf("webhook to loopback should be blocked:%v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package ffrule
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"Service/config"
+)
+
+const webhookTimeout = 5 * time.Second
+
+// notification email和webhook发出去的命中信息
+type notification struct {
+	LogId      int64  `json:"logId"`
+	RuleId     int64  `json:"ruleId"`
+	RuleName   string `json:"ruleName"`
+	UserId     int64  `json:"userId"`
+	CampaignId int64  `json:"campaignId"`
+	Dimension  string `json:"dimension"`
+	Value      string `json:"value"`
+	IP         string `json:"ip"`
+	UserAgent  string `json:"userAgent,omitempty"`
+	Condition  string `json:"condition"`
+	TimeStamp  int64  `json:"timeStamp"`
+}
+
+func newNotification(c *hitContext) notification {
+	r, e := c.Rule, c.Event
+	n := notification{
+		LogId:      c.LogId,
+		RuleId:     r.Id,
+		RuleName:   r.Name,
+		UserId:     r.UserId,
+		CampaignId: e.CampaignId,
+		Dimension:  r.Dimension,
+		Value:      e.dimension(),
+		IP:         e.IP,
+		UserAgent:  e.UA,
+		TimeStamp:  e.TimeStamp,
+	}
+	if r.Expr != nil {
+		n.Condition = r.Expr.String()
+	}
+	return n
+}
+
+func (n notification) text() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Rule: %s(%d)\r\n", n.RuleName, n.RuleId)
+	fmt.Fprintf(&b, "Condition: %s\r\n", n.Condition)
+	fmt.Fprintf(&b, "Campaign: %d\r\n", n.CampaignId)
+	fmt.Fprintf(&b, "%s: %s\r\n", n.Dimension, n.Value)
+	fmt.Fprintf(&b, "IP: %s\r\n", n.IP)
+	fmt.Fprintf(&b, "User-Agent: %s\r\n", n.UserAgent)
+	fmt.Fprintf(&b, "Time: %s\r\n", time.Unix(n.TimeStamp, 0).UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "Log: %d\r\n", n.LogId)
+	return b.String()
+}
+
+// sendMail 用配置文件中[SMTP]的服务器发送纯文本邮件
+func sendMail(to []string, subject, body string) error {
+	host := config.String("SMTP", "host")
+	if host == "" {
+		return errors.New("[SMTP] host is not configured")
+	}
+	port := config.String("SMTP", "port")
+	if port == "" {
+		port = "25"
+	}
+	from := config.String("SMTP", "from")
+	if from == "" {
+		return errors.New("[SMTP] from is not configured")
+	}
+
+	var auth smtp.Auth
+	if user := config.String("SMTP", "user"); user != "" {
+		auth = smtp.PlainAuth("", user, config.String("SMTP", "password"), host)
+	}
+
+	for _, addr := range to {
+		if err := checkMailAddress(addr); err != nil {
+			return err
+		}
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", headerValue(from))
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ","))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", headerValue(subject)))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(body)
+	return smtp.SendMail(net.JoinHostPort(host, port), auth, from, to, msg.Bytes())
+}
+
+// headerValue 邮件头里面的值可能来自请求(比如dimension的值)，去掉换行防止插入别的邮件头
+func headerValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// checkMailAddress to只能是一个单纯的邮件地址
+func checkMailAddress(addr string) error {
+	a, err := mail.ParseAddress(addr)
+	if err != nil || a.Address != addr {
+		return fmt.Errorf("invalid email address(%s)", addr)
+	}
+	return nil
+}
+
+// checkWebhookURL webhook的url只允许http(s)
+func checkWebhookURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid webhook url(%s):%v", s, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("webhook url(%s) must be http(s)", s)
+	}
+	return nil
+}
+
+// publicIP webhook的url是用户填的，不能让它访问内网、本机和link-local(云主机的metadata)地址
+func publicIP(ip net.IP) bool {
+	if ip == nil || ip.IsUnspecified() || ip.IsLoopback() || ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		// 0.0.0.0/8、100.64.0.0/10(CGN)、255.255.255.255
+		if ip4[0] == 0 || ip4[0] == 100 && ip4[1]&0xc0 == 64 || ip4.Equal(net.IPv4bcast) {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookDialControl 在建立连接的时候检查解析出来的IP，DNS解析到内网的域名和跳转也一样拦住
+func webhookDialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicIP(net.ParseIP(host)) {
+		return fmt.Errorf("webhook address %s is not allowed", host)
+	}
+	return nil
+}
+
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		// 不走代理，否则检查的是代理的地址
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: webhookDialControl,
+		}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+		MaxIdleConnsPerHost: 2,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 3 {
+			return errors.New("too many redirects")
+		}
+		return checkWebhookURL(req.URL.String())
+	},
+}
+
+// postWebhook POST json格式的命中信息，非2xx当作失败
+func postWebhook(url string, n notification) (status int, err error) {
+	if err := checkWebhookURL(url); err != nil {
+		return 0, err
+	}
+	body, err := json.Marshal(n)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook %s returned %s", url, resp.Status)
+	}
+	return resp.StatusCode, nil
+}
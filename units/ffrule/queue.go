@@ -0,0 +1,226 @@
+package ffrule
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"Service/config"
+	"Service/db"
+	"Service/log"
+)
+
+// producer和consumer之间通过LOCALFFCACHE上的一个list传递事件:
+// producer RPUSH，consumer BLPOP之后再成批地取，不再用KEYS扫描
+// Redis出错时只记日志并退避重试，不会panic
+
+const (
+	eventQueue      = "FFRULE_EVENTS"
+	eventBatch      = 1000
+	popTimeout      = time.Second
+	defaultQueueMax = 1000000 // consumer停掉的时候list最多保留这么多事件
+	defaultFFSweep  = 10      // seconds
+	minRedisBackoff = time.Second
+	maxRedisBackoff = 30 * time.Second
+	legacyScanCount = 1000
+)
+
+// 旧版本的key:(PV|UA|CK)_RuleId_CampaignId_IPINT[_UABase64Encoded]
+var legacyKeyPatterns = []string{KeyHeaderPV + "_[0-9]*", KeyHeaderUserAgent + "_[0-9]*", KeyHeaderClick + "_[0-9]*"}
+
+func redisClient() (*redis.Client, error) {
+	cli := db.GetRedisClient("LOCALFFCACHE")
+	if cli == nil {
+		return nil, errors.New("LOCALFFCACHE redis client is nil")
+	}
+	return cli, nil
+}
+
+// backoff Redis出错时的等待时间，连续出错时加倍
+type backoff time.Duration
+
+func (b *backoff) wait() {
+	if *b < backoff(minRedisBackoff) {
+		*b = backoff(minRedisBackoff)
+	}
+	time.Sleep(time.Duration(*b))
+	if *b *= 2; *b > backoff(maxRedisBackoff) {
+		*b = backoff(maxRedisBackoff)
+	}
+}
+
+func (b *backoff) reset() {
+	*b = 0
+}
+
+func pushEvents(values []interface{}, max int64) error {
+	cli, err := redisClient()
+	if err != nil {
+		return err
+	}
+	_, err = cli.Pipelined(func(p redis.Pipeliner) error {
+		p.RPush(eventQueue, values...)
+		p.LTrim(eventQueue, -max, -1)
+		return nil
+	})
+	return err
+}
+
+// eventsProducing 把事件成批地写到Redis，写失败的那一批丢掉
+func eventsProducing(events <-chan Event) {
+	max := int64(config.Int("FFRule", "queue-max"))
+	if max <= 0 {
+		max = defaultQueueMax
+	}
+	var bo backoff
+	values := make([]interface{}, 0, eventBatch)
+	for e := range events {
+		values = values[:0]
+		for {
+			b, err := json.Marshal(e)
+			if err == nil {
+				values = append(values, b)
+			}
+			if len(values) >= eventBatch {
+				break
+			}
+			var ok bool
+			select {
+			case e, ok = <-events:
+			default:
+			}
+			if !ok {
+				break
+			}
+		}
+		if err := pushEvents(values, max); err != nil {
+			log.Errorf("[ffrule][eventsProducing]drop %d events:%v\n", len(values), err)
+			bo.wait()
+			continue
+		}
+		bo.reset()
+	}
+}
+
+// popEvents 等待最多popTimeout，取出最多n个事件
+func popEvents(n int64) (events []Event, err error) {
+	cli, err := redisClient()
+	if err != nil {
+		return nil, err
+	}
+	first, err := cli.BLPop(popTimeout, eventQueue).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(first) != 2 {
+		return nil, fmt.Errorf("unexpected BLPOP reply:%v", first)
+	}
+
+	var rest *redis.StringSliceCmd
+	if _, err = cli.TxPipelined(func(p redis.Pipeliner) error {
+		rest = p.LRange(eventQueue, 0, n-2)
+		p.LTrim(eventQueue, n-1, -1)
+		return nil
+	}); err != nil {
+		// 第一个已经取出来了，不能丢
+		log.Errorf("[ffrule][popEvents]read batch failed:%v\n", err)
+		rest = nil
+	}
+
+	values := first[1:]
+	if rest != nil {
+		values = append(values, rest.Val()...)
+	}
+	events = make([]Event, 0, len(values))
+	for _, v := range values {
+		var e Event
+		if err := json.Unmarshal([]byte(v), &e); err != nil {
+			log.Errorf("[ffrule][popEvents]invalid event(%s):%v\n", v, err)
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// eventsHandling 不停地从Redis读事件交给engine，处理命中的结果，并定期清除过期的窗口
+func eventsHandling(engine *Engine) {
+	interval := config.Int("FFRule", "interval")
+	if interval <= 0 {
+		interval = defaultFFSweep
+	}
+	go dropLegacyKeys()
+
+	var bo backoff
+	lastSweep := time.Now()
+	for {
+		if err := consume(engine); err != nil {
+			log.Errorf("[ffrule][eventsHandling]%v\n", err)
+			bo.wait()
+		} else {
+			bo.reset()
+		}
+		if time.Since(lastSweep) >= time.Duration(interval)*time.Second {
+			engine.Sweep(time.Now().Unix())
+			lastSweep = time.Now()
+			log.Debugf("[ffrule][eventsHandling]%d windows\n", engine.Len())
+		}
+	}
+}
+
+func consume(engine *Engine) (err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("panic:%v %s", x, string(debug.Stack()))
+		}
+	}()
+
+	events, err := popEvents(eventBatch)
+	if err != nil {
+		return err
+	}
+	var hits []Hit
+	for _, e := range events {
+		if h, hit := engine.Add(e); hit {
+			hits = append(hits, h)
+		}
+	}
+	handleHits(hits)
+	return nil
+}
+
+// dropLegacyKeys 删除旧版本留下的PV_*/UA_*/CK_* list
+func dropLegacyKeys() {
+	cli, err := redisClient()
+	if err != nil {
+		log.Errorf("[ffrule][dropLegacyKeys]%v\n", err)
+		return
+	}
+	for _, pattern := range legacyKeyPatterns {
+		var cursor uint64
+		var keys []string
+		for {
+			keys, cursor, err = cli.Scan(cursor, pattern, legacyScanCount).Result()
+			if err != nil {
+				log.Errorf("[ffrule][dropLegacyKeys]scan %s failed:%v\n", pattern, err)
+				return
+			}
+			if len(keys) > 0 {
+				if err = cli.Del(keys...).Err(); err != nil {
+					log.Errorf("[ffrule][dropLegacyKeys]del failed:%v\n", err)
+					return
+				}
+			}
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+}
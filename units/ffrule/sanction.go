@@ -0,0 +1,177 @@
+package ffrule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"Service/log"
+	"Service/request"
+)
+
+// Sanction pause/safepage/nocost动作生成的处罚:在ExpiresAt之前campaign不再接受新的visit，
+// 或者campaign里面dimension为value的流量跳转到Url，或者不记cost
+// consumer写到FFRuleSanction之后把id发到SanctionChannel，producer(sengine/spostback)收到后加载
+type Sanction struct {
+	Id         int64
+	RuleId     int64
+	LogId      int64
+	CampaignId int64
+	Dimension  string
+	Value      string
+	Action     string // ActionPause/ActionSafePage/ActionNoCost
+	Url        string
+	ExpiresAt  int64 // unix时间戳，0为永久
+
+	dim dimension
+}
+
+func (s *Sanction) active(now int64) bool {
+	return s.ExpiresAt == 0 || s.ExpiresAt > now
+}
+
+// SanctionChannel 新的Sanction通知，payload为FFRuleSanction.id
+const SanctionChannel = "channel_ffrule_sanctions"
+
+// campaignChannel pause之后通知重新加载campaign，payload为userId.update.campaign.campaignId
+const campaignChannel = "channel_campaign_changed_users"
+
+type sanctionStore struct {
+	lock       sync.RWMutex
+	ids        map[int64]bool
+	byCampaign map[int64][]*Sanction
+}
+
+var sanctions = newSanctionStore()
+
+func newSanctionStore() *sanctionStore {
+	return &sanctionStore{
+		ids:        make(map[int64]bool),
+		byCampaign: make(map[int64][]*Sanction),
+	}
+}
+
+// add 已经过期或者已经加过的忽略
+func (st *sanctionStore) add(s *Sanction, now int64) error {
+	dim, err := parseDimension(s.Dimension)
+	if err != nil {
+		return fmt.Errorf("sanction(%d):%v", s.Id, err)
+	}
+	s.dim = dim
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if !s.active(now) || st.ids[s.Id] {
+		return nil
+	}
+	// 顺便清掉这个campaign已经过期的
+	var list []*Sanction
+	for _, o := range st.byCampaign[s.CampaignId] {
+		if o.active(now) {
+			list = append(list, o)
+		} else {
+			delete(st.ids, o.Id)
+		}
+	}
+	st.byCampaign[s.CampaignId] = append(list, s)
+	st.ids[s.Id] = true
+	return nil
+}
+
+// find campaign里面value(dimension)命中的第一个action类型的Sanction
+func (st *sanctionStore) find(campaignId int64, action string, now int64, value func(d dimension) string) *Sanction {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	list := st.byCampaign[campaignId]
+	if len(list) == 0 {
+		return nil
+	}
+	values := make(map[dimension]string)
+	for _, s := range list {
+		if s.Action != action || !s.active(now) {
+			continue
+		}
+		v, ok := values[s.dim]
+		if !ok {
+			v = value(s.dim)
+			values[s.dim] = v
+		}
+		if v != "" && v == s.Value {
+			return s
+		}
+	}
+	return nil
+}
+
+// paused campaign是否有生效的pause
+func (st *sanctionStore) paused(campaignId int64, now int64) bool {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	for _, s := range st.byCampaign[campaignId] {
+		if s.Action == ActionPause && s.active(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (st *sanctionStore) len() int {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	return len(st.ids)
+}
+
+// LoadSanctions 加载数据库中所有没有过期的Sanction，producer启动的时候调用
+func LoadSanctions() error {
+	list, err := dbGetActiveSanctions(time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for i := range list {
+		if err := sanctions.add(&list[i], now); err != nil {
+			log.Errorf("[ffrule][LoadSanctions]%v\n", err)
+		}
+	}
+	log.Infof("[ffrule][LoadSanctions]%d sanctions loaded\n", sanctions.len())
+	return nil
+}
+
+// ReloadSanction 处理SanctionChannel的通知，payload为逗号分隔的FFRuleSanction.id
+func ReloadSanction(payload string) error {
+	for _, s := range strings.Split(payload, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil || id <= 0 {
+			return fmt.Errorf("invalid sanction id(%s)", s)
+		}
+		sa, err := dbGetSanction(id)
+		if err != nil {
+			return err
+		}
+		if err := sanctions.add(&sa, time.Now().Unix()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Paused campaign是否被ffrule的pause动作停止，并且还没有过期
+func Paused(campaignId int64) bool {
+	return sanctions.paused(campaignId, time.Now().Unix())
+}
+
+// SafePage req在campaign中命中safepage时返回要跳转的url，否则返回空
+func SafePage(campaignId int64, req request.Request) string {
+	s := sanctions.find(campaignId, ActionSafePage, time.Now().Unix(), func(d dimension) string { return d.value(req) })
+	if s == nil {
+		return ""
+	}
+	return s.Url
+}
+
+// NoCost req在campaign中命中nocost时返回true，这个请求不记cost
+func NoCost(campaignId int64, req request.Request) bool {
+	return sanctions.find(campaignId, ActionNoCost, time.Now().Unix(), func(d dimension) string { return d.value(req) }) != nil
+}
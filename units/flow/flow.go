@@ -199,11 +199,3 @@ func (f *Flow) OnS2SPostback(w http.ResponseWriter, req request.Request) error {
 	}
 	return r.OnS2SPostback(w, req)
 }
-
-func (f *Flow) OnConversionPixel(w http.ResponseWriter, req request.Request) error {
-	return nil
-}
-
-func (f *Flow) OnConversionScript(w http.ResponseWriter, req request.Request) error {
-	return nil
-}
@@ -0,0 +1,184 @@
+// Package frequency 记录访客/IP/对象的访问次数，供rule的f.xx,F.xx,request.xx,click.xx等条件使用
+// 计数保存在local的click store里面(默认为本机的LOCALREQCACHE)，所以只是本机的次数
+package frequency
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"Service/clickstore"
+	"Service/config"
+	"Service/log"
+	"Service/request"
+)
+
+const (
+	// VisitorCookie 长期保存访客id的cookie名字
+	VisitorCookie = "tvid"
+
+	EventVisit = "visit" // campaign的visits
+	EventClick = "click" // campaign的lander clicks，或者被送到offer的次数
+
+	defaultWindow = 24 * time.Hour
+	dailyExpire   = 48 * time.Hour
+)
+
+var windowOnce sync.Once
+var window time.Duration
+
+// Window 按访客/IP计数的时间窗口，从第一次计数开始算
+// 配置在[FREQUENCY] window，单位为小时，默认24小时
+func Window() time.Duration {
+	windowOnce.Do(func() {
+		window = time.Duration(config.Int("FREQUENCY", "window")) * time.Hour
+		if window <= 0 {
+			window = defaultWindow
+		}
+	})
+	return window
+}
+
+// Object 把rule里面的xx转成计数对象和事件
+// campaign:当前campaign的visits，c<id>:campaign的visits，o<id>:被送到offer的次数
+func Object(xx string, req request.Request) (obj, event string, ok bool) {
+	if xx == "campaign" {
+		return fmt.Sprintf("c%d", req.CampaignId()), EventVisit, true
+	}
+	if len(xx) < 2 {
+		return "", "", false
+	}
+	if _, err := strconv.ParseInt(xx[1:], 10, 64); err != nil {
+		return "", "", false
+	}
+	switch xx[0] {
+	case 'c':
+		return xx, EventVisit, true
+	case 'o':
+		return xx, EventClick, true
+	}
+	return "", "", false
+}
+
+// ValidVisitorId 访客id来自cookie，不能太长，也不能带redis key的分隔符
+func ValidVisitorId(visitorId string) bool {
+	return visitorId != "" && len(visitorId) <= 64 && !strings.ContainsAny(visitorId, ": ")
+}
+
+// VisitorId 当前请求的访客id，第一次访问没有cookie的时候用request id
+// SetVisitorCookie会把同样的id写到cookie里面
+func VisitorId(req request.Request) string {
+	vid := req.CookieValue(VisitorCookie)
+	if !ValidVisitorId(vid) {
+		vid = req.Id()
+	}
+	return vid
+}
+
+func visitorKey(visitorId, event, obj string) string {
+	return fmt.Sprintf("freq:v:%s:%s:%s", visitorId, event, obj)
+}
+
+func ipKey(ip, event, obj string) string {
+	return fmt.Sprintf("freq:ip:%s:%s:%s", ip, event, obj)
+}
+
+func totalKey(event, obj string, daily bool, now time.Time) string {
+	if daily {
+		return fmt.Sprintf("freq:d%s:%s:%s", now.UTC().Format("20060102"), event, obj)
+	}
+	return fmt.Sprintf("freq:all:%s:%s", event, obj)
+}
+
+// RecordVisit campaign的visit成功之后调用
+// 直接送到offer的visit，同时算作offer的一次click
+func RecordVisit(req request.Request, visitorId string) {
+	now := time.Now()
+	items := counters(req, visitorId, EventVisit, []string{fmt.Sprintf("c%d", req.CampaignId())}, now)
+	if req.OfferId() > 0 {
+		items = append(items, counters(req, visitorId, EventClick, []string{fmt.Sprintf("o%d", req.OfferId())}, now)...)
+	}
+	record(items)
+}
+
+// RecordClick lander click成功之后调用
+func RecordClick(req request.Request, visitorId string) {
+	objs := []string{fmt.Sprintf("c%d", req.CampaignId())}
+	if req.OfferId() > 0 {
+		objs = append(objs, fmt.Sprintf("o%d", req.OfferId()))
+	}
+	record(counters(req, visitorId, EventClick, objs, time.Now()))
+}
+
+// counters 事件需要加1的所有计数，第一次计数的时候设置过期时间，ttl为0的不过期
+func counters(req request.Request, visitorId, event string, objs []string, now time.Time) (items []clickstore.Incr) {
+	incr := func(key string, ttl time.Duration) {
+		items = append(items, clickstore.Incr{Key: key, Delta: 1, TTL: ttl})
+	}
+	for _, obj := range objs {
+		if ValidVisitorId(visitorId) {
+			incr(visitorKey(visitorId, event, obj), Window())
+		}
+		if req.RemoteIp() != "" {
+			incr(ipKey(req.RemoteIp(), event, obj), Window())
+		}
+		incr(totalKey(event, obj, false, now), 0)
+		incr(totalKey(event, obj, true, now), dailyExpire)
+	}
+	return
+}
+
+// record 一个请求的所有计数一次写入
+func record(items []clickstore.Incr) {
+	store := clickstore.Get(clickstore.Local)
+	if store == nil {
+		log.Errorf("[frequency][record]local click store does not exist\n")
+		return
+	}
+	if err := store.IncrMulti(items); err != nil {
+		log.Errorf("[frequency][record]Incr %d counters failed:%v\n", len(items), err)
+	}
+}
+
+func get(key string) int64 {
+	store := clickstore.Get(clickstore.Local)
+	if store == nil {
+		log.Errorf("[frequency][get]local click store does not exist\n")
+		return 0
+	}
+	v, err := store.Get(key)
+	if err != nil {
+		if err != clickstore.ErrNotFound {
+			log.Errorf("[frequency][get]Get %s failed:%v\n", key, err)
+		}
+		return 0
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Errorf("[frequency][get]Invalid counter %s=%s\n", key, v)
+	}
+	return int64(n)
+}
+
+// VisitorCount 访客在窗口期内的次数
+func VisitorCount(visitorId, event, obj string) int64 {
+	if !ValidVisitorId(visitorId) {
+		return 0
+	}
+	return get(visitorKey(visitorId, event, obj))
+}
+
+// IPCount IP在窗口期内的次数
+func IPCount(ip, event, obj string) int64 {
+	if ip == "" {
+		return 0
+	}
+	return get(ipKey(ip, event, obj))
+}
+
+// TotalCount 对象的总次数，daily为true时为当天(UTC)的次数
+func TotalCount(event, obj string, daily bool) int64 {
+	return get(totalKey(event, obj, daily, time.Now()))
+}
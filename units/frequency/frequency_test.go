@@ -0,0 +1,29 @@
+package frequency
+
+import (
+	"testing"
+)
+
+func TestValidVisitorId(t *testing.T) {
+	cases := map[string]bool{
+		"":                       false,
+		"a1b2c3":                 true,
+		"freq:v:x":               false,
+		"has space":              false,
+		string(make([]byte, 65)): false,
+	}
+	for id, want := range cases {
+		if got := ValidVisitorId(id); got != want {
+			t.Errorf("ValidVisitorId(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestKeys(t *testing.T) {
+	if k := visitorKey("abc", EventVisit, "c1"); k != "freq:v:abc:visit:c1" {
+		t.Errorf("visitorKey = %s", k)
+	}
+	if k := ipKey("1.2.3.4", EventClick, "o2"); k != "freq:ip:1.2.3.4:click:o2" {
+		t.Errorf("ipKey = %s", k)
+	}
+}
@@ -0,0 +1,60 @@
+package units
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"Service/clickstore"
+	"Service/config"
+	"Service/db"
+	"Service/health"
+	"Service/util/ip2location"
+)
+
+// InitHealth 在mux上注册/healthz和/readyz，检查DB、click store和bnotify用的redis，
+// ipdb为true时还检查IP库；同时开始监听drain的信号
+func InitHealth(mux *http.ServeMux, ipdb bool) {
+	if n := config.Int("HEALTH", "check-timeout"); n > 0 {
+		health.CheckTimeout = time.Duration(n) * time.Second
+	}
+
+	health.Register("units", func() error {
+		if !started {
+			return errors.New("not started")
+		}
+		return nil
+	})
+	health.Register("db", func() error {
+		d := db.GetDB("DB")
+		if d == nil {
+			return errors.New("connect failed")
+		}
+		return d.Ping()
+	})
+	health.Register("redis.MSGQUEUE", func() error {
+		cli := db.GetRedisClient("MSGQUEUE")
+		if cli == nil {
+			return errors.New("connect failed")
+		}
+		return cli.Ping().Err()
+	})
+	for _, role := range []string{clickstore.Local, clickstore.Remote, clickstore.Shared} {
+		role := role
+		health.Register("clickstore."+role, func() error {
+			return clickstore.Ping(role)
+		})
+	}
+	if ipdb {
+		health.Register("ip2location", func() error {
+			if !ip2location.Opened() {
+				return errors.New("database not opened")
+			}
+			return nil
+		})
+	}
+
+	mux.HandleFunc("/healthz", health.Healthz)
+	mux.HandleFunc("/readyz", health.Readyz)
+	health.WatchSignal()
+}
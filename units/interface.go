@@ -1,8 +1,10 @@
 package units
 
 import (
+	"Service/clickstore"
 	"Service/config"
 	"Service/db"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,10 +19,12 @@ import (
 	"Service/log"
 	"Service/request"
 	"Service/tracking"
+	"Service/tracking/eventlog"
 	"Service/units/affiliate"
 	"Service/units/blacklist"
 	"Service/units/campaign"
 	"Service/units/ffrule"
+	"Service/units/frequency"
 	"Service/units/offer"
 	"Service/units/user"
 	"Service/util/ip"
@@ -59,6 +63,7 @@ func isCampaignHashValid(h string) bool {
 func OnLPOfferRequest(w http.ResponseWriter, r *http.Request) {
 	log.Infof("[Units][OnLPOfferRequest] campaign url: %s\n", r.URL.String())
 	if !started {
+		reject("OnLPOfferRequest", reasonNotStarted)
 		log.Errorf("[Units][OnLPOfferRequest]Not started for :%s\n", common.SchemeHostURI(r))
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -67,6 +72,7 @@ func OnLPOfferRequest(w http.ResponseWriter, r *http.Request) {
 	remoteAddr := ip.GetIP(r)
 	desc, in := blacklist.G.AddrIn(remoteAddr)
 	if in {
+		reject("OnLPOfferRequest", reasonBlacklist)
 		log.Warnf("[units][OnLPOfferRequest] RemoteAddr:%v is blocked by:%v", remoteAddr, desc)
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -82,6 +88,7 @@ func OnLPOfferRequest(w http.ResponseWriter, r *http.Request) {
 	domain := common.HostWithoutPort(r)
 	u := user.GetUserByDomain(domain)
 	if u == nil {
+		reject("OnLPOfferRequest", reasonUnknownDomain)
 		log.Errorf("[Units][OnLPOfferRequest]Invalid userdomain:%s for %s:%s\n", domain, requestId, common.SchemeHostURI(r))
 		w.Header().Set("Content-Type", "text/html")
 		w.WriteHeader(http.StatusNotFound)
@@ -90,6 +97,7 @@ func OnLPOfferRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if !u.Active() {
+		reject("OnLPOfferRequest", reasonInactiveUser)
 		log.Errorf("[Units][OnLPOfferRequest]User not active for %s:%s\n", requestId, common.SchemeHostURI(r))
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -97,6 +105,7 @@ func OnLPOfferRequest(w http.ResponseWriter, r *http.Request) {
 
 	allowed := blacklist.UserReqAllowed(u.Id, remoteAddr, r.UserAgent())
 	if !allowed {
+		reject("OnLPOfferRequest", reasonUserBlacklist)
 		log.Errorf("[Units][OnLPOfferRequest]User(%d) does not accept %s with ua(%s) for %s:%s\n", u.Id, remoteAddr, r.UserAgent(), requestId, common.SchemeHostURI(r))
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -104,6 +113,7 @@ func OnLPOfferRequest(w http.ResponseWriter, r *http.Request) {
 
 	campaignHash := common.GetCampaignHash(r)
 	if campaignHash == "" || !isCampaignHashValid(campaignHash) {
+		reject("OnLPOfferRequest", reasonBadHash)
 		log.Errorf("[Units][OnLPOfferRequest]Invalid campaignHash for %s:%s hash:%s\n", requestId, common.SchemeHostURI(r), campaignHash)
 		if u.RootDomainRedirect == "" {
 			w.Header().Set("Content-Type", "text/html")
@@ -124,6 +134,7 @@ func OnLPOfferRequest(w http.ResponseWriter, r *http.Request) {
 	if req == nil || err != nil { // 从cookie解析并load request失败的话，再从url的方式获取
 		req, err = request.CreateRequest(requestId, true, request.ReqLPOffer, r)
 		if req == nil || err != nil {
+			reject("OnLPOfferRequest", reasonBadRequest)
 			log.Errorf("[Units][OnLPOfferRequest]CreateRequest failed for %s;%s;%v\n", requestId, common.SchemeHostURI(r), err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
@@ -138,11 +149,13 @@ func OnLPOfferRequest(w http.ResponseWriter, r *http.Request) {
 	if req.CampaignId() > 0 { // 如果是从cache中获取campaignId的话，需要对比下campaignHash和campaignId是否匹配
 		ca = campaign.GetCampaignByHash(campaignHash)
 		if ca == nil {
+			reject("OnLPOfferRequest", reasonBadHash)
 			log.Errorf("[Units][OnImpression]Invalid campaignHash for %s:%s:%s\n", requestId, common.SchemeHostURI(r), campaignHash)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 		if ca.Id != req.CampaignId() {
+			reject("OnLPOfferRequest", reasonBadHash)
 			log.Errorf("[Units][OnImpression]CampaignHash(%s) does not match existing campaignId(%d) for %s:%s:%s\n",
 				campaignHash, req.CampaignId(), requestId, common.SchemeHostURI(r), campaignHash)
 			w.WriteHeader(http.StatusBadRequest)
@@ -154,6 +167,7 @@ func OnLPOfferRequest(w http.ResponseWriter, r *http.Request) {
 		if ca == nil {
 			ca = campaign.GetCampaignByHash(campaignHash)
 			if ca == nil {
+				reject("OnLPOfferRequest", reasonBadHash)
 				log.Errorf("[Units][OnImpression]Invalid campaignHash for %s:%s:%s\n", requestId, common.SchemeHostURI(r), campaignHash)
 				w.WriteHeader(http.StatusBadRequest)
 				return
@@ -174,6 +188,7 @@ func OnLPOfferRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	SetCookie(w, request.ReqLPOffer, req)
+	visitorId := SetVisitorCookie(w, req)
 
 	if err := u.OnLPOfferRequest(w, req); err != nil {
 		log.Errorf("[Units][OnLPOfferRequest]user.OnLPOfferRequest failed for %s;%s\n", req.String(), err.Error())
@@ -197,19 +212,22 @@ func OnLPOfferRequest(w http.ResponseWriter, r *http.Request) {
 	tracking.Domain.AddVisit(req.DomainKey(timestamp), 1)
 	tracking.Ref.AddVisit(req.ReferrerKey(timestamp), 1)
 	// }
+	eventlog.Record(eventlog.Visit, req)
+	frequency.RecordVisit(req, visitorId)
 
 	remoteCacheTime := time.Duration(-1)
 	if req.OfferId() > 0 || campaign.GetCampaign(req.CampaignId()).TargetType == campaign.TargetTypeUrl {
 		// 如果已经涉及到Offer，或者Campaign是直接打到某个Url，则保存时间变长，用于后面的Postback动作
-		remoteCacheTime = config.ClickCacheTime
+		remoteCacheTime = config.ClickCacheTime()
 	}
-	if !req.CacheSave(config.ReqCacheTime, remoteCacheTime) {
+	if !req.CacheSave(config.ReqCacheTime(), remoteCacheTime) {
 		log.Errorf("[Units][OnLPOfferRequest]req.CacheSave() failed for %s:%s\n", req.String(), common.SchemeHostURI(r))
 	}
 }
 
 func OnLandingPageClick(w http.ResponseWriter, r *http.Request) {
 	if !started {
+		reject("OnLandingPageClick", reasonNotStarted)
 		log.Errorf("[Units][OnLandingPageClick]Not started for :%s\n", common.SchemeHostURI(r))
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -217,6 +235,7 @@ func OnLandingPageClick(w http.ResponseWriter, r *http.Request) {
 	remoteAddr := ip.GetIP(r)
 	desc, in := blacklist.G.AddrIn(remoteAddr)
 	if in {
+		reject("OnLandingPageClick", reasonBlacklist)
 		log.Warnf("[units][OnLandingPageClick] RemoteAddr:%v is blocked by:%v", remoteAddr, desc)
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -225,6 +244,7 @@ func OnLandingPageClick(w http.ResponseWriter, r *http.Request) {
 	req, err := resolveRequest(request.ReqLPClick, r)
 	if err != nil || req == nil {
 		//TODO add error log
+		reject("OnLandingPageClick", reasonBadRequest)
 		log.Errorf("resolveRequest failed Cookies:%+v err:%v for :%s\n", r.Cookies(), err, common.SchemeHostURI(r))
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -235,6 +255,7 @@ func OnLandingPageClick(w http.ResponseWriter, r *http.Request) {
 		req.RuleId() <= 0 ||
 		req.PathId() <= 0 ||
 		req.LanderId() <= 0 {
+		reject("OnLandingPageClick", reasonBadRequest)
 		log.Errorf("[Units][OnLandingPageClick]CampaignId|FlowId|RuleId|PathId|LanderId is 0 for %s:%s\n",
 			req.Id(), common.SchemeHostURI(r))
 		w.WriteHeader(http.StatusBadRequest)
@@ -246,6 +267,7 @@ func OnLandingPageClick(w http.ResponseWriter, r *http.Request) {
 	domain := common.HostWithoutPort(r)
 	u := user.GetUserByDomain(domain)
 	if u == nil {
+		reject("OnLandingPageClick", reasonUnknownDomain)
 		log.Errorf("[Units][OnLandingPageClick]Invalid userdomain:%s for %s:%s\n", domain, req.Id(), common.SchemeHostURI(r))
 		w.Header().Set("Content-Type", "text/html")
 		w.WriteHeader(http.StatusNotFound)
@@ -253,6 +275,7 @@ func OnLandingPageClick(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if !u.Active() {
+		reject("OnLandingPageClick", reasonInactiveUser)
 		log.Errorf("[Units][OnLandingPageClick]User not active for %s:%s\n", req.Id(), common.SchemeHostURI(r))
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -276,13 +299,17 @@ func OnLandingPageClick(w http.ResponseWriter, r *http.Request) {
 	tracking.IP.AddClick(req.IPKey(timestamp), 1)
 	tracking.Domain.AddClick(req.DomainKey(timestamp), 1)
 	tracking.Ref.AddClick(req.ReferrerKey(timestamp), 1)
+	tracking.Slot.AddClick(req.SlotKey(timestamp), 1)
+	eventlog.Record(eventlog.Click, req)
+	// 和visit一样，没有cookie的时候用request id，这样同一次访问的visit和click还是同一个访客
+	frequency.RecordClick(req, frequency.VisitorId(req))
 
 	remoteCacheTime := time.Duration(-1)
 	if req.OfferId() > 0 {
 		// 如果已经涉及到Offer，则保存时间变长
-		remoteCacheTime = config.ClickCacheTime
+		remoteCacheTime = config.ClickCacheTime()
 	}
-	if !req.CacheSave(config.ReqCacheTime, remoteCacheTime) {
+	if !req.CacheSave(config.ReqCacheTime(), remoteCacheTime) {
 		log.Errorf("[Units][OnLandingPageClick]req.CacheSave() failed for %s:%s\n", req.String(), common.SchemeHostURI(r))
 	}
 }
@@ -303,6 +330,7 @@ func OnImpression(w http.ResponseWriter, r *http.Request) {
 	domain := common.HostWithoutPort(r)
 	u := user.GetUserByDomain(domain)
 	if u == nil {
+		reject("OnImpression", reasonUnknownDomain)
 		log.Errorf("[Units][OnLandingPageClick]Invalid userdomain:%s for %s:%s\n", domain, requestId, common.SchemeHostURI(r))
 		w.Header().Set("Content-Type", "text/html")
 		w.WriteHeader(http.StatusNotFound)
@@ -310,6 +338,7 @@ func OnImpression(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if !u.Active() {
+		reject("OnImpression", reasonInactiveUser)
 		log.Errorf("[Units][OnImpression]User not active for %s:%s\n", requestId, common.SchemeHostURI(r))
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -317,6 +346,7 @@ func OnImpression(w http.ResponseWriter, r *http.Request) {
 
 	campaignHash := common.GetCampaignHash(r)
 	if campaignHash == "" {
+		reject("OnImpression", reasonBadHash)
 		log.Errorf("[Units][OnImpression]Invalid campaignHash for %s:%s\n", requestId, common.SchemeHostURI(r))
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -324,6 +354,7 @@ func OnImpression(w http.ResponseWriter, r *http.Request) {
 
 	req, err := request.CreateRequest(requestId, true, request.ReqImpression, r)
 	if req == nil || err != nil {
+		reject("OnImpression", reasonBadRequest)
 		log.Errorf("[Units][OnImpression]CreateRequest failed for %s;%s with err(%v)\n", requestId, common.SchemeHostURI(r), err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -342,6 +373,7 @@ func OnImpression(w http.ResponseWriter, r *http.Request) {
 	// 通过campaign拿到traffic source，然后拿到其参数配置格式
 	ca := campaign.GetCampaignByHash(campaignHash)
 	if ca == nil {
+		reject("OnImpression", reasonBadHash)
 		log.Errorf("[Units][OnImpression]Invalid campaignHash for %s:%s:%s\n", requestId, common.SchemeHostURI(r), campaignHash)
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -367,17 +399,16 @@ func OnImpression(w http.ResponseWriter, r *http.Request) {
 	tracking.IP.AddImpression(req.IPKey(timestamp), 1)
 	tracking.Domain.AddImpression(req.DomainKey(timestamp), 1)
 	tracking.Ref.AddImpression(req.ReferrerKey(timestamp), 1)
+	eventlog.Record(eventlog.Impression, req)
 
-	if ca.CostModel == 3 { // CPM
-		user.TrackingCost(req, ca.CPMValue/1000.0)
-	} else if ca.CostModel == 4 { // Auto
-		user.TrackingCost(req, req.Cost())
+	if cost, ok := ca.ImpressionCost(req); ok {
+		user.TrackingCost(req, cost)
 	}
 
 	SetCookie(w, request.ReqImpression, req)
 
 	// OfferId不可能>0，所以只用保存一小段时间
-	if !req.CacheSave(config.ReqCacheTime, -1) {
+	if !req.CacheSave(config.ReqCacheTime(), -1) {
 		log.Errorf("[Units][OnImpression]req.CacheSave() failed for %s:%s\n", req.String(), common.SchemeHostURI(r))
 	}
 }
@@ -393,6 +424,7 @@ func parseIP(remoteAddr string) string {
 
 func OnS2SPostback(w http.ResponseWriter, r *http.Request) {
 	if !started {
+		reject("OnS2SPostback", reasonNotStarted)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -410,6 +442,7 @@ func OnS2SPostback(w http.ResponseWriter, r *http.Request) {
 
 	req, err := request.CreateRequest(clickId, false, request.ReqS2SPostback, r)
 	if req == nil || err != nil {
+		reject("OnS2SPostback", reasonBadRequest)
 		log.Errorf("[Units][OnS2SPostback]CreateRequest failed for %s;%v\n", common.SchemeHostURI(r), err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -432,6 +465,7 @@ func OnS2SPostback(w http.ResponseWriter, r *http.Request) {
 
 	isFirstCallback, finalPayout, err := checkPostback(req, clickId, txId, payoutStr, r)
 	if !isFirstCallback {
+		reject("OnS2SPostback", reasonDuplicate)
 		log.Warnf("[Units][OnS2SPostback]clickId:%v txId:%v payoutStr:%v postbackurl:%v discarded", clickId, txId, payoutStr, r.RequestURI)
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -445,6 +479,7 @@ func OnS2SPostback(w http.ResponseWriter, r *http.Request) {
 	u := user.GetUserByDomain(domain)
 
 	if u == nil {
+		reject("OnS2SPostback", reasonUnknownDomain)
 		log.Errorf("[Units][OnS2SPostback]Invalid userdomain:%s for %s:%s\n", domain, clickId, common.SchemeHostURI(r))
 		w.Header().Set("Content-Type", "text/html")
 		w.WriteHeader(http.StatusNotFound)
@@ -464,18 +499,43 @@ func OnS2SPostback(w http.ResponseWriter, r *http.Request) {
 	// 统计conversion
 	conv := req.ConversionKey()
 	tracking.SaveConversion(&conv)
+	eventlog.Record(eventlog.Postback, req)
 
 	remoteCacheTime := time.Duration(-1)
 	if req.OfferId() > 0 || campaign.GetCampaign(req.CampaignId()).TargetType == campaign.TargetTypeUrl {
 		// 如果已经涉及到Offer，或者Campaign是直接打到某个Url，则保存时间变长
-		remoteCacheTime = config.ClickCacheTime
+		remoteCacheTime = config.ClickCacheTime()
 	}
 
-	if !req.CacheSave(config.ReqCacheTime, remoteCacheTime) {
+	if !req.CacheSave(config.ReqCacheTime(), remoteCacheTime) {
 		log.Errorf("[Units][OnS2SPostback]req.CacheSave() failed for %s:%s\n", req.String(), common.SchemeHostURI(r))
 	}
 }
 
+const apiTokenHeader = "X-Api-Token"
+
+// userByDomain 方便测试的地方替换
+var userByDomain = user.GetUserByDomain
+
+// authorizedUser 按域名找到用户，并且检查X-Api-Token，失败时已经写好响应，返回nil
+func authorizedUser(handler string, w http.ResponseWriter, r *http.Request) *user.User {
+	domain := common.HostWithoutPort(r)
+	u := userByDomain(domain)
+	if u == nil {
+		reject(handler, reasonUnknownDomain)
+		log.Errorf("[Units][%s]Invalid userdomain:%s for %s\n", handler, domain, common.SchemeHostURI(r))
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	if !u.Authorized(r.Header.Get(apiTokenHeader)) {
+		reject(handler, reasonUnauthorized)
+		log.Errorf("[Units][%s]Unauthorized request for user(%d) from %s:%s\n", handler, u.Id, ip.GetIP(r), common.SchemeHostURI(r))
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil
+	}
+	return u
+}
+
 var uploadConvsFormat = regexp.MustCompile(`^[0-9a-zA-Z]+(\_[0-9]+)*(,\s*(\s*|[0-9]+\.?[0-9]*)\s*(,\s*[0-9a-zA-Z]*\s*)*)*$`)
 
 func OnUploadConversions(w http.ResponseWriter, r *http.Request) {
@@ -491,6 +551,7 @@ func OnUploadConversions(w http.ResponseWriter, r *http.Request) {
 	domain := common.HostWithoutPort(r)
 	u := user.GetUserByDomain(domain)
 	if u == nil {
+		reject("OnUploadConversions", reasonUnknownDomain)
 		log.Errorf("[Units][OnS2SPostback]Invalid userdomain:%s for %s:%s\n", domain, common.SchemeHostURI(r))
 		w.Header().Set("Content-Type", "text/html")
 		w.WriteHeader(http.StatusNotFound)
@@ -616,9 +677,10 @@ func OnUploadConversions(w http.ResponseWriter, r *http.Request) {
 		// 统计conversion
 		conv := req.ConversionKey()
 		tracking.SaveConversion(&conv)
+		eventlog.Record(eventlog.Postback, req)
 
 		// OfferId()肯定>0，所以直接保存长时间的即可
-		if !req.CacheSave(config.ReqCacheTime, config.ClickCacheTime) {
+		if !req.CacheSave(config.ReqCacheTime(), config.ClickCacheTime()) {
 			log.Errorf("[Units][OnUploadConversions]req.CacheSave() failed for %s:%s\n", req.String(), common.SchemeHostURI(r))
 		}
 	}
@@ -632,46 +694,113 @@ func OnUploadConversions(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// OnUploadCosts 按照TS的实际花费修正AdStatis的Cost，需要在X-Api-Token头中带上用户的apiToken
+// body为json数组，每一项把某个campaign在[from, to)内的cost按visits的比例重新分配:
+// [{"campaignId":1,"from":"2017-03-01T00:00:00+08:00","to":"2017-03-02T00:00:00+08:00","cost":12.5,"filters":{"v3":"zone1"}}]
+// 有错误的项会在返回的json中列出来，其它项正常处理
+func OnUploadCosts(w http.ResponseWriter, r *http.Request) {
+	if !started {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	u := authorizedUser("OnUploadCosts", w, r)
+	if u == nil {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf("[Units][OnUploadCosts]ReadAll body failed for %s;%v\n", common.SchemeHostURI(r), err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	type Entry struct {
+		CampaignId int64             `json:"campaignId"`
+		From       time.Time         `json:"from"`
+		To         time.Time         `json:"to"`
+		Cost       float64           `json:"cost"`
+		Filters    map[string]string `json:"filters"`
+	}
+	vs := make([]Entry, 0)
+	if err = json.Unmarshal(body, &vs); err != nil {
+		log.Errorf("[Units][OnUploadCosts]json.Unmarshal body failed for %s;%v\n", common.SchemeHostURI(r), err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	type Record struct {
+		I int    // 第几项, 0~
+		E string // error message
+	}
+	errRecord := make([]Record, 0)
+	for i, v := range vs {
+		if v.From.IsZero() || v.To.IsZero() {
+			errRecord = append(errRecord, Record{i, "from and to are required"})
+			continue
+		}
+		c := tracking.CostReconcile{
+			UserId:     u.Id,
+			CampaignId: v.CampaignId,
+			From:       v.From.UnixNano() / int64(time.Millisecond),
+			To:         v.To.UnixNano() / int64(time.Millisecond),
+			Cost:       v.Cost,
+			Filters:    v.Filters,
+		}
+		n, delta, err := tracking.ReconcileCost(db.GetDB("DB"), c)
+		if err != nil {
+			log.Errorf("[Units][OnUploadCosts]ReconcileCost failed for user(%d) %+v:%v\n", u.Id, v, err)
+			errRecord = append(errRecord, Record{i, err.Error()})
+			continue
+		}
+		eventlog.RecordCost(u.Id, v.CampaignId, c.From, delta, v.Filters)
+		log.Infof("[Units][OnUploadCosts]Cost of campaign(%d) in [%s, %s) with %v reconciled to %f over %d rows\n",
+			v.CampaignId, v.From, v.To, v.Filters, v.Cost, n)
+	}
+
+	if len(errRecord) > 0 {
+		resp, _ := json.Marshal(errRecord)
+		w.Header().Set(common.KHttpContentType, common.KHttpContentTypeJson)
+		w.Header().Set(common.KHttpContentLength, strconv.Itoa(len(resp)))
+		w.Write(resp)
+	}
+}
+
+// getOffer/getAffiliateNetwork 方便测试的地方替换
+var getOffer = offer.GetOffer
+var getAffiliateNetwork = affiliate.GetAffiliateNetwork
+
 func checkPostback(req request.Request, clickId, txId, payoutStr string, r *http.Request) (firstCallback bool, finalPayout float64, err error) {
 	payout, err := strconv.ParseFloat(payoutStr, 64)
 	if err != nil {
 		log.Errorf("[Units][checkPostback]ParseFloat with payoutStr:%v failed for %s;%v\n", payoutStr, common.SchemeHostURI(r), err)
 	}
 
+	// pixel/script是由用户浏览器发起的，url里面的payout谁都可以改，不能使用
+	trustPayout := req.Type() == request.ReqS2SPostback
+	if !trustPayout {
+		payout = 0
+	}
+
 	if req.OfferId() == 0 {
 		// 说明是直接跳转URL
-		isFirstCallback := func() bool {
-			//TODO 重构成此处不需要直接访问redis
-			svr := db.GetRedisClient(request.LocalCacheSvrTitle)
-			k := fmt.Sprintf("postback:%s:tx:%s:off:%d", clickId, txId, req.OfferId())
-			v := time.Now().Unix()
-			cmd := svr.SetNX(k, v, config.ReqCacheTime)
-			if cmd.Err() != nil {
-				log.Errorf("[units][checkPostback] SetNX k:%v v:%v failed:%v", k, v, cmd.Err())
-				return true
-			}
-
-			if cmd.Val() {
-				// 首次postback
-				log.Warnf("firsttime postback:k:%v v:%v", k, v)
-				return true
-			}
-
-			log.Warnf("Duplicate postback denied: clickId:%v txId:%v", clickId, txId)
-			return false
-		}()
+		isFirstCallback := firstPostback(clickId, txId, req.OfferId())
 
 		return isFirstCallback, payout, nil
 	}
 
+	o := getOffer(req.OfferId())
 	isFirstCallback := func() bool {
-		o := offer.GetOffer(req.OfferId())
 		if o == nil {
 			log.Errorf("GetOffer:%v failed clickId:%v", req.OfferId(), clickId)
 			return true
 		}
 
-		aff := affiliate.GetAffiliateNetwork(o.AffiliateNetworkId)
+		aff := getAffiliateNetwork(o.AffiliateNetworkId)
 		if aff == nil {
 			log.Errorf("GetAffiliateNetwork:%v failed clickId:%v", o.AffiliateNetworkId, clickId)
 			return true
@@ -679,6 +808,7 @@ func checkPostback(req request.Request, clickId, txId, payoutStr string, r *http
 
 		remoteAddr := ip.GetIP(r)
 		ip := parseIP(remoteAddr)
+		// 设置了IP白名单的affiliate network只接受白名单里的IP，浏览器发起的pixel/script也一样
 		if !aff.Allow(ip) {
 			log.Warnf("AffiliateNetworkId:%v blocked postback from:%v by it's white-listed IPs clickId:%v",
 				o.AffiliateNetworkId, remoteAddr, clickId)
@@ -690,30 +820,11 @@ func checkPostback(req request.Request, clickId, txId, payoutStr string, r *http
 			return true
 		}
 
-		// 一天时间
-		//TODO 重构成此处不需要直接访问redis
-		svr := db.GetRedisClient(request.LocalCacheSvrTitle)
-		k := fmt.Sprintf("postback:%s:tx:%s:off:%d", clickId, txId, req.OfferId())
-		v := time.Now().Unix()
-		cmd := svr.SetNX(k, v, config.ReqCacheTime)
-		if cmd.Err() != nil {
-			log.Errorf("[units][checkPostback] SetNX k:%v v:%v failed:%v", k, v, cmd.Err())
-			return true
-		}
-
-		if cmd.Val() {
-			// 首次postback
-			log.Warnf("firsttime postback:k:%v v:%v", k, v)
-			return true
-		}
-
-		log.Warnf("Duplicate postback denied: clickId:%v txId:%v", clickId, txId)
-		return false
+		return firstPostback(clickId, txId, req.OfferId())
 	}()
 
 	// 统计payout
 	finalPayout = func() float64 {
-		o := offer.GetOffer(req.OfferId())
 		if o == nil {
 			// 完全有可能是Campaign中自定义Url发生的Postback
 			log.Errorf("[Units][checkPostback] offer.GetOffer(%v) failed: no offer found", req.OfferId())
@@ -722,7 +833,11 @@ func checkPostback(req request.Request, clickId, txId, payoutStr string, r *http
 		// 并不优先使用postback回传的payout，严格按照用户的设定来做
 		switch o.PayoutMode {
 		case 0:
-			return payout
+			if trustPayout {
+				return payout
+			}
+			// pixel/script使用offer上设置的payout
+			return o.PayoutValue
 		case 1:
 			return o.PayoutValue
 		}
@@ -732,6 +847,32 @@ func checkPostback(req request.Request, clickId, txId, payoutStr string, r *http
 	return isFirstCallback, finalPayout, nil
 }
 
+// firstPostback 用postback去重key判断是否为第一次postback，去重key保存一天
+// click store出错的时候不去重
+func firstPostback(clickId, txId string, offerId int64) bool {
+	s := clickstore.Get(clickstore.Local)
+	if s == nil {
+		log.Errorf("[units][firstPostback]local click store does not exist")
+		return true
+	}
+	k := fmt.Sprintf("postback:%s:tx:%s:off:%d", clickId, txId, offerId)
+	v := strconv.FormatInt(time.Now().Unix(), 10)
+	ok, err := s.SetNX(k, v, config.ReqCacheTime())
+	if err != nil {
+		log.Errorf("[units][checkPostback] SetNX k:%v v:%v failed:%v", k, v, err)
+		return true
+	}
+
+	if ok {
+		// 首次postback
+		log.Warnf("firsttime postback:k:%v v:%v", k, v)
+		return true
+	}
+
+	log.Warnf("Duplicate postback denied: clickId:%v txId:%v", clickId, txId)
+	return false
+}
+
 func checkUploadConversions(req request.Request, offerId int64, clickId, txId, payoutStr string, r *http.Request) (accept bool, finalPayout float64, err error) {
 	payout, err := strconv.ParseFloat(payoutStr, 64)
 	if err != nil {
@@ -799,20 +940,189 @@ func checkUploadConversions(req request.Request, offerId int64, clickId, txId, p
 	return accept, finalPayout, nil
 }
 
+const base64GifPixel = "R0lGODlhAQABAIAAAP///wAAACwAAAAAAQABAAACAkQBADs="
+
+var gifPixel, _ = base64.StdEncoding.DecodeString(base64GifPixel)
+
+// conversion.js只负责在服务端记录conversion，返回的脚本本身不做任何事情
+var conversionScript = []byte("/* conversion */")
+
+// 浏览器发起的conversion请求不能被缓存，否则同一个用户的后续conversion会丢失
+func setNoCacheHeaders(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+}
+
+// OnConversionPixel 处理<img src=".../conversion.gif">方式的conversion
+// 无论conversion是否被接受，都返回1x1的gif，避免在advertiser页面上显示破图
 func OnConversionPixel(w http.ResponseWriter, r *http.Request) {
 	if !started {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	if err := onConversion(request.ReqConversionPixel, w, r); err != nil {
+		log.Errorf("[Units][OnConversionPixel]Conversion discarded for %s;%s\n", common.SchemeHostURI(r), err.Error())
+	}
+
+	setNoCacheHeaders(w)
+	w.Header().Set(common.KHttpContentType, "image/gif")
+	w.Header().Set(common.KHttpContentLength, strconv.Itoa(len(gifPixel)))
+	w.Write(gifPixel)
 }
 
+// OnConversionScript 处理<script src=".../conversion.js">方式的conversion
 func OnConversionScript(w http.ResponseWriter, r *http.Request) {
 	if !started {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	if err := onConversion(request.ReqConversionScript, w, r); err != nil {
+		log.Errorf("[Units][OnConversionScript]Conversion discarded for %s;%s\n", common.SchemeHostURI(r), err.Error())
+	}
+
+	setNoCacheHeaders(w)
+	w.Header().Set(common.KHttpContentType, common.KHttpContentTypeJsonp)
+	w.Header().Set(common.KHttpContentLength, strconv.Itoa(len(conversionScript)))
+	w.Write(conversionScript)
+}
+
+// onConversion pixel和script共用的conversion处理，流程和OnS2SPostback一致
+// 优先使用url中的cid，没有的话再从tstep cookie中获取
+// 不会往w中写任何内容，由调用方负责返回
+func onConversion(step string, w http.ResponseWriter, r *http.Request) error {
+	originClickId := r.URL.Query().Get(common.UrlTokenClickId)
+	clickId := originClickId
+	underlinePos := strings.Index(clickId, "_")
+	if underlinePos != -1 {
+		clickId = clickId[:underlinePos]
+	}
+
+	payoutStr := r.URL.Query().Get(common.UrlTokenPayout)
+	txId := r.URL.Query().Get(common.UrlTokenTransactionId)
+
+	var req request.Request
+	var err error
+	if clickId != "" {
+		req, err = request.CreateRequest(clickId, false, step, r)
+	} else {
+		req, err = ParseCookie(step, r)
+	}
+	if req == nil || err != nil {
+		return fmt.Errorf("resolve request failed:%v", err)
+	}
+	clickId = req.Id()
+
+	// 后面统计信息要使用
+	req.SetTransactionId(txId)
+	log.Infof("[Units][onConversion]Received valid %s with %s(%s;%s;%s;%s)\n", step, common.SchemeHostURI(r), clickId, req.CampaignHash(), payoutStr, txId)
+
+	if underlinePos != -1 {
+		oid, err := strconv.ParseInt(originClickId[underlinePos+1:], 10, 64)
+		if err != nil {
+			log.Errorf("parse offer id from:%s failed:%v", originClickId, err)
+		} else {
+			originOfferId := req.OfferId()
+			req.SetOfferId(oid)
+			log.Infof("originClickId:%s originOfferId:%d newOfferId:%d", originClickId, originOfferId, oid)
+		}
+	}
+
+	// 和S2S postback使用同一个去重key，同时配置pixel和postback时只会统计一次
+	isFirstCallback, finalPayout, _ := checkPostback(req, clickId, txId, payoutStr, r)
+	if !isFirstCallback {
+		return fmt.Errorf("duplicated conversion clickId:%v txId:%v payoutStr:%v", clickId, txId, payoutStr)
+	}
+
+	// 后面会用到payout，所以这里要提前设置好
+	req.SetPayout(finalPayout)
+	req.SetPostbackTimeStamp(time.Now().UnixNano() / int64(time.Millisecond))
+
+	domain := common.HostWithoutPort(r)
+	u := user.GetUserByDomain(domain)
+	if u == nil {
+		return fmt.Errorf("invalid userdomain:%s for %s", domain, clickId)
+	}
+
+	// 各个unit对pixel/script的处理和S2S postback完全一样
+	if err := u.OnS2SPostback(w, req); err != nil {
+		return fmt.Errorf("user.OnS2SPostback failed for %s %s;%s", step, req.String(), err.Error())
+	}
+
+	user.TrackingRevenue(req, finalPayout)
+	user.TrackingConversion(req, 1)
+
+	// 统计conversion
+	conv := req.ConversionKey()
+	tracking.SaveConversion(&conv)
+	eventlog.Record(eventlog.Postback, req)
+
+	remoteCacheTime := time.Duration(-1)
+	if req.OfferId() > 0 || campaign.GetCampaign(req.CampaignId()).TargetType == campaign.TargetTypeUrl {
+		// 如果已经涉及到Offer，或者Campaign是直接打到某个Url，则保存时间变长
+		remoteCacheTime = config.ClickCacheTime()
+	}
+
+	if !req.CacheSave(config.ReqCacheTime(), remoteCacheTime) {
+		log.Errorf("[Units][onConversion]req.CacheSave() failed for %s:%s\n", req.String(), common.SchemeHostURI(r))
+	}
+	return nil
+}
+
+// OnCostUpdate TS事后通知某个click的实际cost，/cost?cid=xxx&cost=0.05
+// 只对cost model为Auto的campaign有效，和已经记过的cost的差值补记到原来的统计时间点
+func OnCostUpdate(w http.ResponseWriter, r *http.Request) {
+	if !started {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// 能改任何click的cost，和cost上传一样需要X-Api-Token
+	u := authorizedUser("OnCostUpdate", w, r)
+	if u == nil {
+		return
+	}
+
+	clickId := r.URL.Query().Get(common.UrlTokenClickId)
+	costStr := r.URL.Query().Get(common.UrlTokenCost)
+	log.Infof("[Units][OnCostUpdate]Received cost update with %s(%s;%s)\n", common.SchemeHostURI(r), clickId, costStr)
+
+	cost, err := strconv.ParseFloat(costStr, 64)
+	if err != nil || cost < 0 {
+		log.Errorf("[Units][OnCostUpdate]Invalid cost(%s) for %s\n", costStr, common.SchemeHostURI(r))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	req, err := request.CreateRequest(clickId, false, request.ReqCostUpdate, r)
+	if req == nil || err != nil {
+		reject("OnCostUpdate", reasonBadRequest)
+		log.Errorf("[Units][OnCostUpdate]CreateRequest failed for %s;%v\n", common.SchemeHostURI(r), err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if req.UserId() != u.Id {
+		reject("OnCostUpdate", reasonUnauthorized)
+		log.Errorf("[Units][OnCostUpdate]Click(%s) of user(%d) can not be updated by user(%d)\n", clickId, req.UserId(), u.Id)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if err := u.UpdateCost(req, cost); err != nil {
+		log.Errorf("[Units][OnCostUpdate]user.UpdateCost failed for %s;%s\n", req.String(), err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	remoteCacheTime := time.Duration(-1)
+	if req.OfferId() > 0 || campaign.GetCampaign(req.CampaignId()).TargetType == campaign.TargetTypeUrl {
+		remoteCacheTime = config.ClickCacheTime()
+	}
+	if !req.CacheSave(config.ReqCacheTime(), remoteCacheTime) {
+		log.Errorf("[Units][OnCostUpdate]req.CacheSave() failed for %s:%s\n", req.String(), common.SchemeHostURI(r))
+	}
 }
 
 // OnDoubleMetaRefresh 处理double meta refresh 请求
@@ -0,0 +1,56 @@
+package units
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"Service/units/user"
+)
+
+func TestOnCostUpdateUnauthorized(t *testing.T) {
+	oldStarted, oldLookup := started, userByDomain
+	defer func() { started, userByDomain = oldStarted, oldLookup }()
+	started = true
+
+	u := &user.User{}
+	u.Id = 1
+	u.ApiToken = "secret"
+	userByDomain = func(domain string) *user.User {
+		if domain == "u1.example.com" {
+			return u
+		}
+		return nil
+	}
+
+	tests := []struct {
+		host   string
+		token  string
+		status int
+	}{
+		{"unknown.example.com", "secret", http.StatusNotFound},
+		{"u1.example.com", "", http.StatusUnauthorized},
+		{"u1.example.com", "wrong", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/cost?cid=abc&cost=0.05", nil)
+		if tt.token != "" {
+			r.Header.Set(apiTokenHeader, tt.token)
+		}
+		w := httptest.NewRecorder()
+		OnCostUpdate(w, r)
+		if w.Code != tt.status {
+			t.Errorf("host(%s) token(%s):got status %d, want %d", tt.host, tt.token, w.Code, tt.status)
+		}
+	}
+
+	// 用户没有设置token的时候，任何token都不行
+	u.ApiToken = ""
+	r := httptest.NewRequest(http.MethodGet, "http://u1.example.com/cost?cid=abc&cost=0.05", nil)
+	r.Header.Set(apiTokenHeader, "secret")
+	w := httptest.NewRecorder()
+	OnCostUpdate(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("empty api token:got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
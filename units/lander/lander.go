@@ -9,6 +9,7 @@ import (
 
 	"Service/log"
 	"Service/request"
+	"Service/units/capping"
 )
 
 type LanderConfig struct {
@@ -29,6 +30,7 @@ func (c LanderConfig) ID() int64 {
 
 type Lander struct {
 	LanderConfig
+	caps capping.Caps
 }
 
 var cmu sync.RWMutex // protects the following
@@ -98,6 +100,7 @@ func newLander(c LanderConfig) (l *Lander) {
 	}
 	l = &Lander{
 		LanderConfig: c,
+		caps:         capping.DBGetCaps(capping.ElementLander, c.Id),
 	}
 	return
 }
@@ -117,10 +120,25 @@ func (l *Lander) OnLPOfferRequest(w http.ResponseWriter, req request.Request) er
 
 	req.SetLanderId(l.Id)
 	req.SetLanderName(l.Name)
+	l.caps.Count(capping.MetricClicks, 1)
 	req.Redirect(w, gr, req.ParseUrlTokens(l.Url))
 	return nil
 }
 
+// CapExceeded 返回已经达到上限的cap，没有则返回nil
+func (l *Lander) CapExceeded() *capping.CapConfig {
+	if l == nil {
+		return nil
+	}
+	return l.caps.Exceeded()
+}
+
+// countConversion conversion发生时，给conversions和revenue的cap计数
+func (l *Lander) countConversion(req request.Request) {
+	l.caps.Count(capping.MetricConversions, 1)
+	l.caps.Count(capping.MetricRevenue, req.Payout())
+}
+
 // Lander不需要处理该请求
 //func (l *Lander) OnLandingPageClick(w http.ResponseWriter, req request.Request) error {
 //	return nil
@@ -131,14 +149,6 @@ func (l *Lander) OnImpression(w http.ResponseWriter, req request.Request) error
 }
 
 func (l *Lander) OnS2SPostback(w http.ResponseWriter, req request.Request) error {
-	// lander不做特别处理应该也可以，但是接口先留下来
-	return nil
-}
-
-func (l *Lander) OnConversionPixel(w http.ResponseWriter, req request.Request) error {
-	return nil
-}
-
-func (l *Lander) OnConversionScript(w http.ResponseWriter, req request.Request) error {
+	l.countConversion(req)
 	return nil
 }
@@ -0,0 +1,77 @@
+package units
+
+import (
+	"net/http"
+
+	"Service/config"
+	"Service/log"
+	"Service/request"
+	"Service/tracking"
+	"Service/tracking/eventlog"
+	"Service/util/metrics"
+)
+
+// 请求被拒绝的原因
+const (
+	reasonNotStarted    = "not_started"
+	reasonBlacklist     = "blacklist"      // 全局黑名单
+	reasonUserBlacklist = "user_blacklist" // 用户自己设置的IP/UA黑名单
+	reasonUnknownDomain = "unknown_domain"
+	reasonInactiveUser  = "inactive_user"
+	reasonBadHash       = "bad_hash"
+	reasonBadRequest    = "bad_request"  // 参数或者cookie解析不出request
+	reasonDuplicate     = "duplicate"    // 重复的postback
+	reasonUnauthorized  = "unauthorized" // X-Api-Token不对
+)
+
+var rejected = metrics.NewCounterVec("requests_rejected_total",
+	"Requests rejected before tracking, by handler and reason.", "handler", "reason")
+
+func reject(handler, reason string) {
+	rejected.Inc(handler, reason)
+}
+
+const defaultMetricsURL = "/metrics"
+
+// InitMetrics 在mux上注册[METRICS] url(默认/metrics)，只允许allow里面的IP/网段访问
+// 同时注册各个队列的长度、磁盘积压和事件日志丢弃数量，每个进程只能调用一次
+func InitMetrics(mux *http.ServeMux) error {
+	metrics.NewGaugeVecFunc("queue_depth", "Items waiting in internal channels.", "queue",
+		func() map[string]float64 {
+			m := map[string]float64{"reqcache_tosave": float64(request.RemoteCacheQueueDepth())}
+			for k, v := range tracking.QueueDepths() {
+				m[k] = float64(v)
+			}
+			return m
+		})
+	metrics.NewGaugeVecFunc("spill_backlog_batches", "Batches spilled to disk and not yet replayed.", "name",
+		func() map[string]float64 {
+			m := make(map[string]float64)
+			for k, b := range tracking.SpillBacklog() {
+				m[k] = float64(b.Batches)
+			}
+			return m
+		})
+	metrics.NewGaugeVecFunc("spill_backlog_bytes", "Bytes spilled to disk and not yet replayed.", "name",
+		func() map[string]float64 {
+			m := make(map[string]float64)
+			for k, b := range tracking.SpillBacklog() {
+				m[k] = float64(b.Bytes)
+			}
+			return m
+		})
+	metrics.NewCounterFunc("eventlog_dropped_events_total", "Raw events dropped because the event log buffer was full.",
+		func() float64 { return float64(eventlog.Dropped()) })
+
+	url := config.String("METRICS", "url")
+	if url == "" {
+		url = defaultMetricsURL
+	}
+	h, err := metrics.AllowOnly(metrics.Handler(), config.String("METRICS", "allow"))
+	if err != nil {
+		return err
+	}
+	mux.Handle(url, h)
+	log.Infof("[units][InitMetrics] metrics served at %s", url)
+	return nil
+}
@@ -5,42 +5,12 @@ import (
 	"Service/db"
 	"Service/log"
 	"database/sql"
-	"time"
 )
 
 //func DBGetAllOffers() []OfferConfig {
 //	return nil
 //}
 
-func dbGetAvailableTimezones() []Timezone {
-	d := dbgetter()
-	sql := `SELECT id, name, region, utcShift FROM Timezones`
-	rows, err := d.Query(sql)
-	if err != nil {
-		log.Errorf("[offer][dbGetAvailableTimezones]Query %s failed:%v", sql, err)
-		return nil
-	}
-	defer rows.Close()
-
-	var c Timezone
-	var arr []Timezone
-	for rows.Next() {
-		err := rows.Scan(&c.Id,
-			&c.Name,
-			&c.Region,
-			&c.UtcShift,
-		)
-
-		if err != nil {
-			log.Errorf("[offer][dbGetAvailableTimezones]Scan %s failed:%v", sql, err)
-			return nil
-		}
-
-		arr = append(arr, c)
-	}
-	return arr
-}
-
 //no cache
 func dbGetAvailableOffers() []OfferConfig {
 	d := dbgetter()
@@ -151,43 +121,6 @@ func DBGetOffer(offerId int64) (c OfferConfig) {
 	return c
 }
 
-func GetLocation(timezonesId int64) *time.Location {
-	tz := GetTimezone(timezonesId)
-	if tz.Id == 0 {
-		return nil
-	}
-	loc, _ := time.LoadLocation(tz.Region)
-	return loc
-}
-func GetTimezone(timezonesId int64) Timezone {
-	var c Timezone
-	if offerDBCache.Enabled() {
-		v := timezonesDBCache.Get(timezonesId)
-		if v == nil {
-			log.Errorf("[GetLocation]timezone(%d) does not exist in GetLocation\n", timezonesId)
-			return c
-		}
-		return v.(Timezone)
-	}
-
-	d := dbgetter()
-	sql := `SELECT id, name, region, utcShift FROM Timezones WHERE id=? `
-	row := d.QueryRow(sql, timezonesId)
-
-	err := row.Scan(&c.Id,
-		&c.Name,
-		&c.Region,
-		&c.UtcShift,
-	)
-
-	if err != nil {
-		log.Errorf("[offer][GetTimezone]Scan %s failed:%v", sql, err)
-		return c
-	}
-
-	return c
-}
-
 // dbgetter 默认的拿数据库的东西
 // 方便测试的地方替换这个接口
 var dbgetter = func() *sql.DB {
@@ -195,23 +128,6 @@ var dbgetter = func() *sql.DB {
 }
 
 var offerDBCache common.DBCache
-var timezonesDBCache common.DBCache
-
-func EnableTimezonesDBCache() {
-	log.Info("EnableTimezonesDBCache Begin")
-	origin := dbGetAvailableTimezones()
-	data := make([]common.HasID, len(origin))
-	for i, _ := range origin {
-		data[i] = origin[i]
-	}
-	timezonesDBCache.Init(data)
-	log.Info("EnableTimezonesDBCache End")
-}
-
-func DisableTimezonesDBCache() {
-	timezonesDBCache.Clear()
-	log.Info("DisableTimezonesDBCache")
-}
 
 func EnableOfferDBCache() {
 	log.Info("EnableOfferDBCache Begin")
@@ -222,11 +138,9 @@ func EnableOfferDBCache() {
 	}
 	offerDBCache.Init(data)
 	log.Info("EnableOfferDBCache End")
-	EnableTimezonesDBCache()
 }
 
 func DisableOfferDBCache() {
 	offerDBCache.Clear()
 	log.Info("DisableOfferDBCache")
-	DisableTimezonesDBCache()
 }
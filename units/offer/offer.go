@@ -7,15 +7,12 @@ import (
 	"net/url"
 	"sync"
 
-	"Service/db"
 	"Service/log"
 	"Service/request"
 	"Service/units/affiliate"
-	"time"
+	"Service/units/capping"
 )
 
-const TrackCacheSvrTitle = "MSGQUEUE"
-
 type OfferConfig struct {
 	Id                   int64
 	Name                 string
@@ -32,21 +29,6 @@ type OfferConfig struct {
 	RedirectOfferId      int64
 }
 
-type Timezone struct {
-	Id       int64
-	Name     string
-	Region   string
-	UtcShift string
-}
-
-func (t Timezone) String() string {
-	return fmt.Sprintf("Offer %d:%s", t.Id, t.Region)
-}
-
-func (t Timezone) ID() int64 {
-	return t.Id
-}
-
 func (c OfferConfig) String() string {
 	return fmt.Sprintf("Offer %d:%d", c.Id, c.UserId)
 }
@@ -55,8 +37,31 @@ func (c OfferConfig) ID() int64 {
 	return c.Id
 }
 
+// legacyCap 兼容Offer表中原有的daily cap设置：按conversions计数，每天重置
+func (c OfferConfig) legacyCap() (capping.CapConfig, bool) {
+	if c.CapEnabled != 1 || c.DailyCap <= 0 {
+		return capping.CapConfig{}, false
+	}
+	action := capping.ActionRedirectOffer
+	if c.RedirectOfferId <= 0 {
+		action = capping.ActionNextOffer
+	}
+	return capping.CapConfig{
+		UserId:          c.UserId,
+		Element:         capping.ElementOffer,
+		ElementId:       c.Id,
+		Metric:          capping.MetricConversions,
+		Period:          capping.PeriodDaily,
+		Value:           float64(c.DailyCap),
+		TimezoneId:      c.CapTimezoneId,
+		Action:          action,
+		RedirectOfferId: c.RedirectOfferId,
+	}, true
+}
+
 type Offer struct {
 	OfferConfig
+	caps capping.Caps
 }
 
 var cmu sync.RWMutex                        // protects the following
@@ -189,6 +194,10 @@ func newOffer(c OfferConfig) (o *Offer) {
 	}
 	o = &Offer{
 		OfferConfig: c,
+		caps:        capping.DBGetCaps(capping.ElementOffer, c.Id),
+	}
+	if lc, ok := c.legacyCap(); ok {
+		o.caps = append(o.caps, lc)
 	}
 	return
 }
@@ -212,103 +221,26 @@ func (o *Offer) OnLPOfferRequest(w http.ResponseWriter, req request.Request) err
 	req.SetAffiliateId(o.AffiliateNetworkId)
 	req.SetAffiliateName(o.AffiliateNetworkName)
 
-	//Cap控制
-	if o.CapEnabled == 1 {
-		if o.CapControlled() {
-			redirectOfferId := o.RedirectOfferId
-
-			if redirectOfferId > 0 {
-				req.SetOfferId(redirectOfferId)
-				req.SetOptOfferId(redirectOfferId)
-				req.SetOptAffiliateId(GetOffer(redirectOfferId).AffiliateNetworkId)
-				ro := GetOffer(redirectOfferId)
-				if ro != nil {
-					return ro.OnLPOfferRequest(w, req)
-				}
-			}
-		}
-	}
+	// cap是否超出由path在选择offer的时候检查
+	o.caps.Count(capping.MetricClicks, 1)
 
 	req.Redirect(w, gr, req.ParseUrlTokens(o.Url))
 
 	return nil
 }
 
-func (o *Offer) CapControlled() bool {
-	if o.CapEnabled == 1 && o.RedirectOfferId > 0 {
-		impCnt := o.GetImpCount()
-		log.Infof("[Offer] get imp count:%d", impCnt)
-		if impCnt >= o.DailyCap {
-			return true
-		}
-	}
-	return false
-}
-
-func (o *Offer) GetImpCount() int64 {
-	var impCnt int64
-	svr := db.GetRedisClient(TrackCacheSvrTitle)
-	if svr == nil {
-		log.Errorf("[Offer]%s local Redis DB does not exist", TrackCacheSvrTitle)
-		return impCnt
-	}
-	//key := "offer" + fmt.Sprintf("_%d", o.Id)
-
-	key := o.GetImpKey()
-	impCnt, err := svr.Get(key).Int64()
-
-	log.Info("---GetImpCount", key, impCnt)
-
-	if err != nil {
-		log.Errorf("[Offer]%s local Redis DB does not exist", TrackCacheSvrTitle)
-		return impCnt
-	}
-	return impCnt
-}
-
-func (o *Offer) SetImpCount() error {
-	svr := db.GetRedisClient(TrackCacheSvrTitle)
-	if svr == nil {
-		return fmt.Errorf("[Offer]%s local Redis DB does not exist", TrackCacheSvrTitle)
-	}
-	//err := svr.Set(o.Id, v, localExpire).Err()
-	//key := "offer" + fmt.Sprintf("_%d", o.Id)
-
-	key := o.GetImpKey()
-	err := svr.Incr(key).Err()
-	if err != nil {
-		log.Errorf("[Offer]set local key:%d err:%v\n", o.Id, err)
+// CapExceeded 返回已经达到上限的cap，没有则返回nil
+func (o *Offer) CapExceeded() *capping.CapConfig {
+	if o == nil {
+		return nil
 	}
-
-	/*
-		loc := GetLocation(o.CapTimezoneId)
-		if loc != nil {
-			now := time.Now().In(loc)
-			y, m, d := now.Year(), now.Month(), now.Day()
-			end := time.Date(y, m, d+1, 0, 0, 0, 0, loc)
-			dur := end.Sub(now)
-			svr.Expire(key, dur)
-		}
-	*/
-
-	svr.Expire(key, 24*time.Hour)
-
-	log.Infof("[Offer]set local key:%d \n", o.Id)
-	return nil
+	return o.caps.Exceeded()
 }
 
-func (o *Offer) GetImpKey() string {
-	now := time.Now()
-
-	loc := GetLocation(o.CapTimezoneId)
-	if loc != nil {
-		now = now.In(loc)
-	}
-
-	y, m, d := now.Year(), now.Month(), now.Day()
-
-	key := fmt.Sprintf("offer_conversion_%d_%v%v%v", o.Id, y, m, d)
-	return key
+// countConversion conversion发生时，给conversions和revenue的cap计数
+func (o *Offer) countConversion(req request.Request) {
+	o.caps.Count(capping.MetricConversions, 1)
+	o.caps.Count(capping.MetricRevenue, req.Payout())
 }
 
 func (o *Offer) OnLandingPageClick(w http.ResponseWriter, req request.Request) error {
@@ -330,22 +262,7 @@ func (o *Offer) OnLandingPageClick(w http.ResponseWriter, req request.Request) e
 		appended = req.Id()
 	}
 
-	//Cap控制
-	if o.CapEnabled == 1 {
-		if o.CapControlled() {
-			redirectOfferId := o.RedirectOfferId
-
-			if redirectOfferId > 0 {
-				req.SetOfferId(redirectOfferId)
-				req.SetOptOfferId(redirectOfferId)
-				req.SetOptAffiliateId(GetOffer(redirectOfferId).AffiliateNetworkId)
-				ro := GetOffer(redirectOfferId)
-				if ro != nil {
-					return ro.OnLandingPageClick(w, req)
-				}
-			}
-		}
-	}
+	o.caps.Count(capping.MetricClicks, 1)
 
 	req.Redirect(w, gr, req.ParseUrlTokens(o.Url)+appended)
 	req.SetId(oldId)
@@ -362,26 +279,7 @@ func (o *Offer) OnS2SPostback(w http.ResponseWriter, req request.Request) error
 		return fmt.Errorf("Nil o for request(%s)", req.Id())
 	}
 
-	// CAP control
-	if o.CapEnabled == 1 && o.RedirectOfferId > 0 {
-		o.SetImpCount()
-	}
-
-	return nil
-}
-
-func (o *Offer) OnConversionPixel(w http.ResponseWriter, req request.Request) error {
-	// CAP control
-	if o.CapEnabled == 1 && o.RedirectOfferId > 0 {
-		o.SetImpCount()
-	}
-	return nil
-}
+	o.countConversion(req)
 
-func (o *Offer) OnConversionScript(w http.ResponseWriter, req request.Request) error {
-	// CAP control
-	if o.CapEnabled == 1 && o.RedirectOfferId > 0 {
-		o.SetImpCount()
-	}
 	return nil
 }
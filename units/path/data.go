@@ -18,7 +18,7 @@ var dbgetter = func() *sql.DB {
 //no cache
 func dbGetAvailablePaths() []PathConfig {
 	d := dbgetter()
-	sql := "SELECT id, userId, redirectMode, directLink, status FROM Path WHERE deleted=0"
+	sql := "SELECT id, userId, redirectMode, directLink, status, sticky, autoOptimize FROM Path WHERE deleted=0"
 	rows, err := d.Query(sql)
 	if err != nil {
 		log.Errorf("[path][dbGetAvailablePaths]Query: %s failed:%v", sql, err)
@@ -29,7 +29,7 @@ func dbGetAvailablePaths() []PathConfig {
 	var c PathConfig
 	var arr []PathConfig
 	for rows.Next() {
-		if err := rows.Scan(&c.Id, &c.UserId, &c.RedirectMode, &c.DirectLink, &c.Status); err != nil {
+		if err := rows.Scan(&c.Id, &c.UserId, &c.RedirectMode, &c.DirectLink, &c.Status, &c.Sticky, &c.AutoOptimize); err != nil {
 			log.Errorf("[path][dbGetAvailablePaths] scan failed:%v", err)
 			return nil
 		}
@@ -40,7 +40,7 @@ func dbGetAvailablePaths() []PathConfig {
 
 //func DBGetUserPaths(userId int64) []PathConfig {
 //	d := dbgetter()
-//	sql := "SELECT id, userId, redirectMode, directLink, status FROM Path WHERE userId=? AND deleted=0"
+//	sql := "SELECT id, userId, redirectMode, directLink, status, sticky, autoOptimize FROM Path WHERE userId=? AND deleted=0"
 //	rows, err := d.Query(sql)
 //	if err != nil {
 //		log.Errorf("[path][DBGetUserPaths]Query: %s failed:%v", sql, err)
@@ -51,7 +51,7 @@ func dbGetAvailablePaths() []PathConfig {
 //	var c PathConfig
 //	var arr []PathConfig
 //	for rows.Next() {
-//		if err := rows.Scan(&c.Id, &c.UserId, &c.RedirectMode, &c.DirectLink, &c.Status); err != nil {
+//		if err := rows.Scan(&c.Id, &c.UserId, &c.RedirectMode, &c.DirectLink, &c.Status, &c.Sticky, &c.AutoOptimize); err != nil {
 //			log.Errorf("[path][DBGetAvailablePaths] scan failed:%v", err)
 //			return nil
 //		}
@@ -72,10 +72,10 @@ func DBGetPath(pathId int64) (c PathConfig) {
 	}
 
 	d := dbgetter()
-	sql := "SELECT id, userId, redirectMode, directLink, status FROM Path WHERE id=?"
+	sql := "SELECT id, userId, redirectMode, directLink, status, sticky, autoOptimize FROM Path WHERE id=?"
 	row := d.QueryRow(sql, pathId)
 
-	if err := row.Scan(&c.Id, &c.UserId, &c.RedirectMode, &c.DirectLink, &c.Status); err != nil {
+	if err := row.Scan(&c.Id, &c.UserId, &c.RedirectMode, &c.DirectLink, &c.Status, &c.Sticky, &c.AutoOptimize); err != nil {
 		log.Errorf("[path][DBGetPath] pathId:%v scan failed:%v", pathId, err)
 		return
 	}
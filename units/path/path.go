@@ -3,16 +3,18 @@ package path
 import (
 	"errors"
 	"fmt"
-	"math/rand"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
 
 	"Service/log"
 	"Service/request"
+	"Service/units/capping"
 	"Service/units/lander"
 	"Service/units/offer"
+	"Service/units/rotation"
 )
 
 const (
@@ -26,6 +28,8 @@ type PathConfig struct {
 	RedirectMode int64
 	DirectLink   int64
 	Status       int64
+	Sticky       int64 // 0:每次随机;1:按IP+UA固定;2:按访客cookie固定
+	AutoOptimize int64 // 0:按配置的权重;1:按EPC优化;2:按CR优化
 }
 
 func (c PathConfig) String() string {
@@ -63,20 +67,11 @@ type Path struct {
 	lwSum   uint64 // lander总权重
 	offers  []PathOffer
 	owSum   uint64 // offer总权重
-}
-
-func (p *Path) RandOwSum() int {
-	if p.owSum == 0 {
-		return 0
-	}
-	return rand.Intn(int(p.owSum))
-}
 
-func (p *Path) RandLwSum() int {
-	if p.lwSum == 0 {
-		return 0
-	}
-	return rand.Intn(int(p.lwSum))
+	landerArms []rotation.Arm
+	offerArms  []rotation.Arm
+	lr         rotation.Rotator // lander的选择方式
+	or         rotation.Rotator // offer的选择方式
 }
 
 var cmu sync.RWMutex // protects the following
@@ -160,45 +155,108 @@ func newPath(c PathConfig) (p *Path) {
 		offers:     offers,
 		lwSum:      lwSum,
 		owSum:      owSum,
+		landerArms: make([]rotation.Arm, len(landers)),
+		offerArms:  make([]rotation.Arm, len(offers)),
+		lr:         newRotator(c, "l", rotation.ElementLander),
+		or:         newRotator(c, "o", rotation.ElementOffer),
+	}
+	for i, l := range landers {
+		p.landerArms[i] = rotation.Arm{Id: l.LanderId, Weight: l.Weight}
+	}
+	for i, o := range offers {
+		p.offerArms[i] = rotation.Arm{Id: o.OfferId, Weight: o.Weight}
 	}
 
 	return
 }
 
+func newRotator(c PathConfig, kind, element string) rotation.Rotator {
+	return rotation.Rotator{
+		Scope:    fmt.Sprintf("p%d:%s", c.Id, kind),
+		UserId:   c.UserId,
+		Sticky:   int(c.Sticky),
+		Optimize: int(c.AutoOptimize),
+		Element:  element,
+	}
+}
+
+// return value: >0 if valid;0 if invalid
+func (p *Path) RandLanderId(req request.Request) (id int64) {
+	id = p.lr.Pick(p.landerArms, req)
+	if id <= 0 {
+		log.Errorf("[Path][RandLanderId]Request(%s) does not match any lander(%d) in path(%d)",
+			req.Id(), p.lwSum, p.Id)
+	}
+	return
+}
+
 // return value: >0 if valid;0 if invalid
-func (p *Path) RandLanderId(reqId string) (id int64) {
-	x := p.RandLwSum() // rand.Intn(int(p.lwSum))
-	lx := 0
-	for _, l := range p.landers {
-		if l.LanderId <= 0 {
-			continue
+func (p *Path) RandOfferId(req request.Request) (id int64) {
+	id = p.or.Pick(p.offerArms, req)
+	if id <= 0 {
+		log.Errorf("[Path][RandOfferId]Request(%s) does not match any offer(%d) in path(%d)",
+			req.Id(), p.owSum, p.Id)
+	}
+	return
+}
+
+// nextOfferId 按照path中offer的顺序，返回cur之后第一个没有尝试过的offer
+func (p *Path) nextOfferId(cur int64, tried map[int64]bool) int64 {
+	start := 0
+	for i, po := range p.offers {
+		if po.OfferId == cur {
+			start = i + 1
+			break
 		}
-		lx += int(l.Weight)
-		if x < lx {
-			return l.LanderId
+	}
+	for i := 0; i < len(p.offers); i++ {
+		po := p.offers[(start+i)%len(p.offers)]
+		if po.OfferId > 0 && po.Weight > 0 && !tried[po.OfferId] {
+			return po.OfferId
 		}
 	}
-	log.Errorf("[Path][RandLanderId]Request(%s) does not match any lander(%d:%d) in path(%d)",
-		reqId, lx, x, p.Id)
 	return 0
 }
 
-// return value: >0 if valid;0 if invalid
-func (p *Path) RandOfferId(reqId string) (id int64) {
-	y := p.RandOwSum() // rand.Intn(int(p.owSum))
-	oy := 0
-	for _, o := range p.offers {
-		if o.OfferId <= 0 {
-			continue
+// resolveOffer 检查offer的cap，超出时按照cap的设置换成其他offer，或者返回fallback url
+// 所有候选都超出并且没有fallback url的时候，仍然使用最初选中的offer
+func (p *Path) resolveOffer(offerId int64, reqId string) (*offer.Offer, string) {
+	first := offer.GetOffer(offerId)
+	tried := make(map[int64]bool)
+	for o := first; o != nil && !tried[o.Id]; {
+		tried[o.Id] = true
+		c := o.CapExceeded()
+		if c == nil {
+			return o, ""
 		}
-		oy += int(o.Weight)
-		if y < oy {
-			return o.OfferId
+
+		var next int64
+		switch c.Action {
+		case capping.ActionRedirectOffer:
+			next = c.RedirectOfferId
+		case capping.ActionNextOffer:
+			next = p.nextOfferId(o.Id, tried)
+		case capping.ActionFallbackUrl:
+			if c.FallbackUrl != "" {
+				return nil, c.FallbackUrl
+			}
 		}
+		if next <= 0 {
+			break
+		}
+		log.Infof("[Path][resolveOffer]Request(%s) offer(%d) capped, try offer(%d) in path(%d)\n", reqId, o.Id, next, p.Id)
+		o = offer.GetOffer(next)
 	}
-	log.Errorf("[Path][RandOfferId]Request(%s) does not match any offer(%d:%d) in path(%d)",
-		reqId, oy, y, p.Id)
-	return 0
+
+	log.Warnf("[Path][resolveOffer]Request(%s) no uncapped offer found from offer(%d) in path(%d)\n", reqId, offerId, p.Id)
+	return first, ""
+}
+
+var gr = &http.Request{
+	Method: "GET",
+	URL: &url.URL{
+		Path: "",
+	},
 }
 
 func (p *Path) OnLPOfferRequest(w http.ResponseWriter, req request.Request) error {
@@ -209,27 +267,52 @@ func (p *Path) OnLPOfferRequest(w http.ResponseWriter, req request.Request) erro
 
 	req.SetRedirectMode(p.RedirectMode)
 
+	offerId := int64(0)
 	if p.DirectLink == 0 {
-		landerId := p.RandLanderId(req.Id())
+		landerId := p.RandLanderId(req)
 		if landerId > 0 {
-			req.SetLanderId(landerId)
-			// set optional offer id & affiliate network id
-			offerId := p.RandOfferId(req.Id())
-			req.SetOptOfferId(offerId)
-			if offer.GetOffer(offerId) != nil {
-				// do not panic here
-				req.SetOptAffiliateId(offer.GetOffer(offerId).AffiliateNetworkId)
+			l := lander.GetLander(landerId)
+			c := l.CapExceeded()
+			if c == nil {
+				req.SetLanderId(landerId)
+				// set optional offer id & affiliate network id
+				offerId := p.RandOfferId(req)
+				req.SetOptOfferId(offerId)
+				if offer.GetOffer(offerId) != nil {
+					// do not panic here
+					req.SetOptAffiliateId(offer.GetOffer(offerId).AffiliateNetworkId)
+				}
+				return l.OnLPOfferRequest(w, req)
+			}
+
+			// lander超出cap，跳过lander直接去offer
+			switch c.Action {
+			case capping.ActionRedirectOffer:
+				offerId = c.RedirectOfferId
+			case capping.ActionFallbackUrl:
+				if c.FallbackUrl != "" {
+					req.Redirect(w, gr, req.ParseUrlTokens(c.FallbackUrl))
+					return nil
+				}
 			}
-			return lander.GetLander(landerId).OnLPOfferRequest(w, req)
 		}
 	}
 
-	offerId := p.RandOfferId(req.Id())
+	if offerId <= 0 {
+		offerId = p.RandOfferId(req)
+	}
 	if offerId > 0 {
-		req.SetOfferId(offerId)
-		req.SetOptOfferId(offerId)
-		req.SetOptAffiliateId(offer.GetOffer(offerId).AffiliateNetworkId)
-		return offer.GetOffer(offerId).OnLPOfferRequest(w, req)
+		o, fallback := p.resolveOffer(offerId, req.Id())
+		if fallback != "" {
+			req.Redirect(w, gr, req.ParseUrlTokens(fallback))
+			return nil
+		}
+		if o != nil {
+			req.SetOfferId(o.Id)
+			req.SetOptOfferId(o.Id)
+			req.SetOptAffiliateId(o.AffiliateNetworkId)
+			return o.OnLPOfferRequest(w, req)
+		}
 	}
 
 	return fmt.Errorf(
@@ -260,35 +343,71 @@ func (p *Path) OnLandingPageClick(w http.ResponseWriter, req request.Request) er
 		}
 	*/
 
-	pp := strings.Split(strings.TrimRight(req.TrackingPath(), "/"), "/")
+	var numberOfOffers int64
+	if l := lander.GetLander(req.LanderId()); l != nil {
+		numberOfOffers = l.NumberOfOffers
+	}
+	offerId, slot, err := p.clickTarget(req.TrackingPath(), req.OptOfferId(), numberOfOffers, func() int64 { return p.RandOfferId(req) })
+	if err != nil {
+		return fmt.Errorf("%v for request(%s) in path(%d)", err, req.Id(), p.Id)
+	}
+	req.SetSlot(slot)
+	return p.clickOffer(w, req, offerId)
+}
+
+// clickTarget 解析/click或者/click/N，返回要去的offer和slot(/click为0)
+// /click优先使用visit时已经选好的optOfferId，不在path里面时用rand按照权重选择
+// /click/N按照指定顺序(1~)选择，N不能超过path的offer数，lander设置了NumberOfOffers时也不能超过它
+func (p *Path) clickTarget(trackingPath string, optOfferId, numberOfOffers int64, rand func() int64) (offerId, slot int64, err error) {
+	pp := strings.Split(strings.TrimRight(trackingPath, "/"), "/")
 	switch len(pp) {
-	case 2: // path为/click或/click/，按照权重选择一个Offer
-		offerId := p.RandOfferId(req.Id())
-		if offerId > 0 {
-			o := offer.GetOffer(offerId)
-			if o != nil {
-				req.SetOfferId(offerId)
-				return o.OnLandingPageClick(w, req)
-			}
+	case 2:
+		offerId = optOfferId
+		if !p.hasOffer(offerId) {
+			offerId = rand()
 		}
-	case 3: // path为/click/N，按照指定顺序(1~)选择一个Offer
-		i, err := strconv.ParseInt(pp[2], 10, 64)
-		if err != nil || i == 0 || i > int64(len(p.offers)) {
-			return fmt.Errorf("Target offer path(%s)(i:%d) parse failed err(%v) for request(%s) in path(%d)(offers:%d)",
-				req.TrackingPath(), i, err, req.Id(), p.Id, len(p.offers))
+	case 3:
+		slot, err = strconv.ParseInt(pp[2], 10, 64)
+		if err != nil || slot <= 0 || slot > int64(len(p.offers)) {
+			return 0, 0, fmt.Errorf("Target offer path(%s)(i:%d) parse failed err(%v)(offers:%d)",
+				trackingPath, slot, err, len(p.offers))
 		}
-		//TODO 是否需要加上lander的NumberOfOffers的检查？
-		if p.offers[i-1].OfferId > 0 {
-			o := offer.GetOffer(p.offers[i-1].OfferId)
-			if o != nil {
-				req.SetOfferId(p.offers[i-1].OfferId)
-				return o.OnLandingPageClick(w, req)
-			}
+		if numberOfOffers > 0 && slot > numberOfOffers {
+			return 0, 0, fmt.Errorf("Target offer path(%s) exceeds NumberOfOffers(%d) of lander", trackingPath, numberOfOffers)
 		}
+		offerId = p.offers[slot-1].OfferId
 	}
+	if offerId <= 0 {
+		return 0, 0, fmt.Errorf("Target offer path(%s) not found", trackingPath)
+	}
+	return offerId, slot, nil
+}
 
-	return fmt.Errorf("Target offer path(%s) not found for request(%s) in path(%d)",
-		req.TrackingPath(), req.Id(), p.Id)
+// hasOffer offerId是否还在path里面，并且权重不为0
+func (p *Path) hasOffer(offerId int64) bool {
+	if offerId <= 0 {
+		return false
+	}
+	for _, o := range p.offers {
+		if o.OfferId == offerId && o.Weight > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// clickOffer 从lander点击到offerId，offer超出cap时按照cap的设置处理
+func (p *Path) clickOffer(w http.ResponseWriter, req request.Request, offerId int64) error {
+	o, fallback := p.resolveOffer(offerId, req.Id())
+	if fallback != "" {
+		req.Redirect(w, gr, req.ParseUrlTokens(fallback))
+		return nil
+	}
+	if o == nil {
+		return fmt.Errorf("Target offer(%d) not found for request(%s) in path(%d)", offerId, req.Id(), p.Id)
+	}
+	req.SetOfferId(o.Id)
+	return o.OnLandingPageClick(w, req)
 }
 
 func (p *Path) OnImpression(w http.ResponseWriter, req request.Request) error {
@@ -318,11 +437,3 @@ func (p *Path) OnS2SPostback(w http.ResponseWriter, req request.Request) error {
 	return fmt.Errorf("Target offer id(%d) not found for request(%s) in path(%d)",
 		req.OfferId(), req.Id(), p.Id)
 }
-
-func (p *Path) OnConversionPixel(w http.ResponseWriter, req request.Request) error {
-	return nil
-}
-
-func (p *Path) OnConversionScript(w http.ResponseWriter, req request.Request) error {
-	return nil
-}
@@ -0,0 +1,53 @@
+package path
+
+import (
+	"testing"
+)
+
+func TestClickTarget(t *testing.T) {
+	p := &Path{offers: []PathOffer{{OfferId: 11, Weight: 50}, {OfferId: 12, Weight: 0}, {OfferId: 0, Weight: 50}}}
+	rand := func() int64 { return 11 }
+
+	cases := []struct {
+		path           string
+		optOfferId     int64
+		numberOfOffers int64
+		offerId, slot  int64
+	}{
+		{"/click", 0, 0, 11, 0},
+		{"/click/", 12, 0, 11, 0}, // 权重为0的不用
+		{"/click", 99, 0, 11, 0},  // 已经不在path里面
+		{"/click/1", 12, 0, 11, 1},
+		{"/click/2", 0, 2, 12, 2},
+		{"/click/2/", 0, 3, 12, 2},
+	}
+	for _, c := range cases {
+		offerId, slot, err := p.clickTarget(c.path, c.optOfferId, c.numberOfOffers, rand)
+		if err != nil || offerId != c.offerId || slot != c.slot {
+			t.Errorf("clickTarget(%s, %d, %d) = %d, %d, %v; want %d, %d",
+				c.path, c.optOfferId, c.numberOfOffers, offerId, slot, err, c.offerId, c.slot)
+		}
+	}
+
+	// 选好的offer还在path里面时直接使用，不再按权重选择
+	p.offers[1].Weight = 10
+	offerId, _, err := p.clickTarget("/click", 12, 0, func() int64 {
+		t.Error("rand should not be called")
+		return 11
+	})
+	if err != nil || offerId != 12 {
+		t.Errorf("optional offer = %d, %v; want 12", offerId, err)
+	}
+
+	for _, path := range []string{"/click/0", "/click/-1", "/click/4", "/click/x", "/click/3", "/click/a/b"} {
+		if _, _, err := p.clickTarget(path, 0, 0, rand); err == nil {
+			t.Errorf("clickTarget(%s) should fail", path)
+		}
+	}
+	if _, _, err := p.clickTarget("/click/2", 0, 1, rand); err == nil {
+		t.Error("slot beyond NumberOfOffers should fail")
+	}
+	if _, _, err := p.clickTarget("/click", 0, 0, func() int64 { return 0 }); err == nil {
+		t.Error("no offer picked should fail")
+	}
+}
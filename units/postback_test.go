@@ -0,0 +1,144 @@
+package units
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"Service/clickstore"
+	"Service/request"
+	"Service/units/affiliate"
+	"Service/units/offer"
+)
+
+type fakeRequest struct {
+	request.Request
+	t       string
+	offerId int64
+}
+
+func (r *fakeRequest) Type() string   { return r.t }
+func (r *fakeRequest) OfferId() int64 { return r.offerId }
+
+// withPostbackFakes 用内存click store和固定的offer/affiliate network替换掉真实的
+func withPostbackFakes(offers map[int64]*offer.Offer, affs map[int64]*affiliate.AffiliateNetwork) func() {
+	oldOffer, oldAff := getOffer, getAffiliateNetwork
+	getOffer = func(id int64) *offer.Offer { return offers[id] }
+	getAffiliateNetwork = func(id int64) *affiliate.AffiliateNetwork { return affs[id] }
+	clickstore.Set(clickstore.Local, clickstore.NewMemoryStore())
+	return func() {
+		getOffer, getAffiliateNetwork = oldOffer, oldAff
+		clickstore.Set(clickstore.Local, nil)
+	}
+}
+
+func newPostbackRequest(remoteAddr string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "http://u1.example.com/postback", nil)
+	r.RemoteAddr = remoteAddr
+	return r
+}
+
+func TestCheckPostbackDuplicate(t *testing.T) {
+	aff := &affiliate.AffiliateNetwork{}
+	aff.Id = 10
+	dupAff := &affiliate.AffiliateNetwork{}
+	dupAff.Id = 11
+	dupAff.DuplicatePostback = 1
+	o := &offer.Offer{}
+	o.Id, o.AffiliateNetworkId = 1, 10
+	dupO := &offer.Offer{}
+	dupO.Id, dupO.AffiliateNetworkId = 2, 11
+	defer withPostbackFakes(
+		map[int64]*offer.Offer{1: o, 2: dupO},
+		map[int64]*affiliate.AffiliateNetwork{10: aff, 11: dupAff})()
+
+	r := newPostbackRequest("203.0.113.1:1234")
+	tests := []struct {
+		t       string
+		offerId int64
+		clickId string
+		txId    string
+		first   bool
+	}{
+		{request.ReqS2SPostback, 1, "c1", "tx1", true},
+		{request.ReqS2SPostback, 1, "c1", "tx1", false},
+		// pixel和postback使用同一个去重key
+		{request.ReqConversionPixel, 1, "c1", "tx1", false},
+		{request.ReqConversionScript, 1, "c1", "tx2", true},
+		{request.ReqConversionPixel, 1, "c2", "tx1", true},
+		// 直接跳转URL的campaign没有offer，也要去重
+		{request.ReqConversionPixel, 0, "c3", "", true},
+		{request.ReqS2SPostback, 0, "c3", "", false},
+		// affiliate network允许重复postback
+		{request.ReqS2SPostback, 2, "c4", "tx1", true},
+		{request.ReqConversionPixel, 2, "c4", "tx1", true},
+	}
+	for i, tt := range tests {
+		req := &fakeRequest{t: tt.t, offerId: tt.offerId}
+		first, _, _ := checkPostback(req, tt.clickId, tt.txId, "1", r)
+		if first != tt.first {
+			t.Errorf("#%d %s(%s;%s;%d):got first %v, want %v", i, tt.t, tt.clickId, tt.txId, tt.offerId, first, tt.first)
+		}
+	}
+}
+
+func TestCheckPostbackWhiteList(t *testing.T) {
+	aff := &affiliate.AffiliateNetwork{}
+	aff.Id = 10
+	aff.IpWhiteList = []string{"198.51.100.7"}
+	o := &offer.Offer{}
+	o.Id, o.AffiliateNetworkId = 1, 10
+	defer withPostbackFakes(
+		map[int64]*offer.Offer{1: o},
+		map[int64]*affiliate.AffiliateNetwork{10: aff})()
+
+	for i, step := range []string{request.ReqS2SPostback, request.ReqConversionPixel, request.ReqConversionScript} {
+		req := &fakeRequest{t: step, offerId: 1}
+		if first, _, _ := checkPostback(req, "c1", "tx"+strconv.Itoa(i), "1", newPostbackRequest("203.0.113.1:1234")); first {
+			t.Errorf("%s from ip not in white list accepted", step)
+		}
+	}
+	req := &fakeRequest{t: request.ReqS2SPostback, offerId: 1}
+	if first, _, _ := checkPostback(req, "c1", "tx", "1", newPostbackRequest("198.51.100.7:1234")); !first {
+		t.Errorf("postback from white listed ip rejected")
+	}
+}
+
+func TestCheckPostbackPayout(t *testing.T) {
+	aff := &affiliate.AffiliateNetwork{}
+	aff.Id = 10
+	aff.DuplicatePostback = 1
+	auto := &offer.Offer{}
+	auto.Id, auto.AffiliateNetworkId, auto.PayoutMode, auto.PayoutValue = 1, 10, 0, 2.5
+	manual := &offer.Offer{}
+	manual.Id, manual.AffiliateNetworkId, manual.PayoutMode, manual.PayoutValue = 2, 10, 1, 3.5
+	defer withPostbackFakes(
+		map[int64]*offer.Offer{1: auto, 2: manual},
+		map[int64]*affiliate.AffiliateNetwork{10: aff})()
+
+	r := newPostbackRequest("203.0.113.1:1234")
+	tests := []struct {
+		t       string
+		offerId int64
+		payout  float64
+	}{
+		// auto:postback使用回传的payout，pixel/script不相信url里的payout
+		{request.ReqS2SPostback, 1, 100},
+		{request.ReqConversionPixel, 1, 2.5},
+		{request.ReqConversionScript, 1, 2.5},
+		// manual:都使用offer上设置的payout
+		{request.ReqS2SPostback, 2, 3.5},
+		{request.ReqConversionPixel, 2, 3.5},
+		// 没有offer
+		{request.ReqS2SPostback, 0, 100},
+		{request.ReqConversionPixel, 0, 0},
+	}
+	for i, tt := range tests {
+		req := &fakeRequest{t: tt.t, offerId: tt.offerId}
+		_, payout, _ := checkPostback(req, "c1", "tx"+strconv.Itoa(i), "100", r)
+		if payout != tt.payout {
+			t.Errorf("#%d %s(%d):got payout %v, want %v", i, tt.t, tt.offerId, payout, tt.payout)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package rotation
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"Service/db"
+)
+
+// dbgetter 默认的拿数据库的东西
+// 方便测试的地方替换这个接口
+var dbgetter = func() *sql.DB {
+	return db.GetDB("DB")
+}
+
+// dbGetStats 从AdStatis汇总since之后每个候选的数据
+// lander的样本数为visits；offer的样本数为clicks，direct link(没有lander)的为visits
+// 按UserID+Timestamp查询，用的是AdStatis的UserTimestampIndex
+func dbGetStats(userId int64, element string, arms []Arm, since time.Time) (map[int64]Stat, error) {
+	var column, trials string
+	switch element {
+	case ElementLander:
+		column, trials = "LanderID", "SUM(Visits)"
+	case ElementOffer:
+		column, trials = "OfferID", "SUM(IF(LanderID=0, Visits, Clicks))"
+	default:
+		return nil, fmt.Errorf("element(%s) can not be optimized", element)
+	}
+
+	args := []interface{}{userId, since.UnixNano() / int64(time.Millisecond)}
+	holders := make([]string, 0, len(arms))
+	for _, a := range arms {
+		if a.Id <= 0 {
+			continue
+		}
+		holders = append(holders, "?")
+		args = append(args, a.Id)
+	}
+	if len(holders) == 0 {
+		return nil, nil
+	}
+
+	d := dbgetter()
+	sql := fmt.Sprintf("SELECT %s, %s, SUM(Conversions), SUM(Revenue) FROM AdStatis WHERE UserID=? AND Timestamp>=? AND %s IN (%s) GROUP BY %s",
+		column, trials, column, strings.Join(holders, ","), column)
+	rows, err := d.Query(sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Query %s failed:%v", sql, err)
+	}
+	defer rows.Close()
+
+	stats := make(map[int64]Stat)
+	for rows.Next() {
+		var id int64
+		var s Stat
+		if err := rows.Scan(&id, &s.Trials, &s.Conversions, &s.Revenue); err != nil {
+			return nil, fmt.Errorf("Scan %s failed:%v", sql, err)
+		}
+		stats[id] = s
+	}
+	return stats, rows.Err()
+}
@@ -0,0 +1,325 @@
+// Package rotation 带权重的候选(lander/offer/path)的选择方式
+// 默认每个请求按权重随机；可以让同一个访客固定到同一个候选(sticky)，
+// 也可以根据AdStatis里面的EPC/CR自动调整权重(auto optimize)
+package rotation
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"Service/clickstore"
+	"Service/config"
+	"Service/log"
+	"Service/request"
+	"Service/units/frequency"
+)
+
+const (
+	StickyNone    = 0
+	StickyIPUA    = 1 // 按IP+UserAgent
+	StickyVisitor = 2 // 按访客cookie
+
+	OptimizeNone = 0
+	OptimizeEPC  = 1
+	OptimizeCR   = 2
+
+	ElementLander = "lander"
+	ElementOffer  = "offer"
+
+	// 按比例换算成整数权重时的总权重
+	weightScale = 10000
+)
+
+// Arm 一个候选
+type Arm struct {
+	Id     int64
+	Weight uint64
+}
+
+// Rotator 一组候选的选择方式
+type Rotator struct {
+	Scope    string // sticky和optimize结果的key，同一个path/rule内lander和offer要区分开
+	UserId   int64
+	Sticky   int
+	Optimize int
+	Element  string // 只有lander和offer可以optimize，AdStatis里面没有path的统计
+}
+
+// Pick 选出一个候选，没有可用的候选时返回0
+func (rt Rotator) Pick(arms []Arm, req request.Request) int64 {
+	var visitor string
+	if rt.Sticky != StickyNone {
+		visitor = rt.visitor(req)
+		if id := getSticky(rt.Scope, visitor); id > 0 {
+			for _, a := range arms {
+				if a.Id == id && a.Weight > 0 {
+					return id
+				}
+			}
+		}
+	}
+
+	ws := weights(arms)
+	if rt.Optimize != OptimizeNone && rt.Element != "" {
+		if ow := optimized(rt, arms); ow != nil {
+			ws = ow
+		}
+	}
+	id := pick(arms, ws, rand.Int63n)
+
+	if id > 0 && visitor != "" {
+		setSticky(rt.Scope, visitor, id)
+	}
+	return id
+}
+
+func (rt Rotator) visitor(req request.Request) string {
+	switch rt.Sticky {
+	case StickyIPUA:
+		sum := md5.Sum([]byte(req.RemoteIp() + "|" + req.UserAgent()))
+		return hex.EncodeToString(sum[:])
+	case StickyVisitor:
+		return frequency.VisitorId(req)
+	}
+	return ""
+}
+
+func weights(arms []Arm) []uint64 {
+	ws := make([]uint64, len(arms))
+	for i, a := range arms {
+		ws[i] = a.Weight
+	}
+	return ws
+}
+
+// pick 按权重随机选择，权重为0或者id不合法的候选不会被选中
+func pick(arms []Arm, ws []uint64, rnd func(n int64) int64) int64 {
+	var sum uint64
+	for i, a := range arms {
+		if a.Id > 0 {
+			sum += ws[i]
+		}
+	}
+	if sum == 0 {
+		return 0
+	}
+	x := uint64(rnd(int64(sum)))
+	var cx uint64
+	for i, a := range arms {
+		if a.Id <= 0 {
+			continue
+		}
+		cx += ws[i]
+		if x < cx {
+			return a.Id
+		}
+	}
+	return 0
+}
+
+type options struct {
+	stickyTTL   time.Duration
+	window      time.Duration
+	refresh     time.Duration
+	exploration float64
+	prior       float64
+}
+
+var optOnce sync.Once
+var opts options
+
+// loadOptions 读取[ROTATION]的配置，没有配置的用默认值
+func loadOptions() options {
+	optOnce.Do(func() {
+		opts.stickyTTL = time.Duration(config.Int("ROTATION", "stickyttl")) * time.Hour
+		if opts.stickyTTL <= 0 {
+			opts.stickyTTL = 30 * 24 * time.Hour
+		}
+		opts.window = time.Duration(config.Int("ROTATION", "window")) * time.Hour
+		if opts.window <= 0 {
+			opts.window = 72 * time.Hour
+		}
+		opts.refresh = time.Duration(config.Int("ROTATION", "refresh")) * time.Second
+		if opts.refresh <= 0 {
+			opts.refresh = 10 * time.Minute
+		}
+		opts.exploration = float64(config.Int("ROTATION", "exploration")) / 100
+		if opts.exploration <= 0 || opts.exploration > 1 {
+			opts.exploration = 0.1
+		}
+		opts.prior = float64(config.Int("ROTATION", "prior"))
+		if opts.prior <= 0 {
+			opts.prior = 100
+		}
+	})
+	return opts
+}
+
+func stickyKey(scope, visitor string) string {
+	return fmt.Sprintf("sticky:%s:%s", scope, visitor)
+}
+
+func getSticky(scope, visitor string) int64 {
+	if visitor == "" {
+		return 0
+	}
+	store := clickstore.Get(clickstore.Local)
+	if store == nil {
+		log.Errorf("[rotation][getSticky]local click store does not exist\n")
+		return 0
+	}
+	v, _ := store.Get(stickyKey(scope, visitor))
+	id, _ := strconv.ParseInt(v, 10, 64)
+	return id
+}
+
+func setSticky(scope, visitor string, id int64) {
+	store := clickstore.Get(clickstore.Local)
+	if store == nil {
+		log.Errorf("[rotation][setSticky]local click store does not exist\n")
+		return
+	}
+	if err := store.Set(stickyKey(scope, visitor), strconv.FormatInt(id, 10), loadOptions().stickyTTL); err != nil {
+		log.Errorf("[rotation][setSticky]Set %s failed:%v\n", stickyKey(scope, visitor), err)
+	}
+}
+
+// Stat 一个候选在统计窗口内的数据
+type Stat struct {
+	Trials      int64 // lander为visits，offer为送到offer的次数
+	Conversions int64
+	Revenue     int64 // 实际的值x1000000
+}
+
+type optimizedWeights struct {
+	weights    map[int64]uint64
+	at         time.Time
+	refreshing bool
+}
+
+var omu sync.Mutex // protects the following
+var optimizedCache = make(map[string]*optimizedWeights)
+
+// optimized 返回优化过的权重，还没有算好或者候选有变化的时候返回nil，使用配置的权重
+// 过期的时候在后台重新计算，不阻塞请求
+func optimized(rt Rotator, arms []Arm) []uint64 {
+	o := loadOptions()
+	omu.Lock()
+	ow := optimizedCache[rt.Scope]
+	if ow == nil {
+		ow = &optimizedWeights{}
+		optimizedCache[rt.Scope] = ow
+	}
+	stale := time.Since(ow.at) > o.refresh
+	var ws []uint64
+	if ow.weights != nil {
+		ws = make([]uint64, len(arms))
+		for i, a := range arms {
+			if a.Weight == 0 {
+				// 用户关掉的候选不再分配流量，不用等到下次重新计算
+				continue
+			}
+			w, ok := ow.weights[a.Id]
+			if !ok {
+				// 有新加的候选
+				ws, stale = nil, true
+				break
+			}
+			ws[i] = w
+		}
+	}
+	if stale && !ow.refreshing {
+		ow.refreshing = true
+		cp := make([]Arm, len(arms))
+		copy(cp, arms)
+		go refreshOptimized(rt, cp, ow)
+	}
+	omu.Unlock()
+	return ws
+}
+
+func refreshOptimized(rt Rotator, arms []Arm, ow *optimizedWeights) {
+	defer func() {
+		if x := recover(); x != nil {
+			log.Errorf("[rotation][refreshOptimized]%s panic:%v\n", rt.Scope, x)
+		}
+		omu.Lock()
+		ow.refreshing = false
+		ow.at = time.Now()
+		omu.Unlock()
+	}()
+
+	o := loadOptions()
+	stats, err := dbGetStats(rt.UserId, rt.Element, arms, time.Now().Add(-o.window))
+	if err != nil {
+		log.Errorf("[rotation][refreshOptimized]%s dbGetStats failed:%v\n", rt.Scope, err)
+		return
+	}
+	ws := optimizeWeights(arms, stats, rt.Optimize, o.exploration, o.prior)
+	m := make(map[int64]uint64, len(arms))
+	for i, a := range arms {
+		m[a.Id] = ws[i]
+	}
+	log.Infof("[rotation][refreshOptimized]%s weights:%v\n", rt.Scope, m)
+
+	omu.Lock()
+	ow.weights = m
+	omu.Unlock()
+}
+
+// optimizeWeights 根据统计数据计算权重
+// 每个候选先按照池化的均值做平滑(prior为先验的样本数)，避免样本少的候选被饿死，
+// 然后exploration的比例平均分给所有候选，剩下的按分数分配
+// 所有候选都没有收益/转化的时候，还是用配置的权重
+func optimizeWeights(arms []Arm, stats map[int64]Stat, metric int, exploration, prior float64) []uint64 {
+	value := func(s Stat) float64 {
+		if metric == OptimizeCR {
+			return float64(s.Conversions)
+		}
+		return float64(s.Revenue)
+	}
+
+	var n int
+	var totalValue, totalTrials float64
+	for _, a := range arms {
+		if a.Id <= 0 || a.Weight == 0 {
+			continue
+		}
+		n++
+		totalValue += value(stats[a.Id])
+		totalTrials += float64(stats[a.Id].Trials)
+	}
+	if n == 0 || totalValue <= 0 || totalTrials <= 0 {
+		return weights(arms)
+	}
+
+	mean := totalValue / totalTrials
+	scores := make([]float64, len(arms))
+	var totalScore float64
+	for i, a := range arms {
+		if a.Id <= 0 || a.Weight == 0 {
+			continue
+		}
+		s := stats[a.Id]
+		scores[i] = (value(s) + prior*mean) / (float64(s.Trials) + prior)
+		totalScore += scores[i]
+	}
+
+	ws := make([]uint64, len(arms))
+	for i, a := range arms {
+		if a.Id <= 0 || a.Weight == 0 {
+			continue
+		}
+		p := exploration/float64(n) + (1-exploration)*scores[i]/totalScore
+		ws[i] = uint64(p*weightScale + 0.5)
+		if ws[i] == 0 {
+			ws[i] = 1
+		}
+	}
+	return ws
+}
@@ -0,0 +1,83 @@
+package rotation
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPick(t *testing.T) {
+	arms := []Arm{{Id: 1, Weight: 30}, {Id: 0, Weight: 50}, {Id: 2, Weight: 0}, {Id: 3, Weight: 70}}
+	ws := weights(arms)
+	cases := map[int64]int64{0: 1, 29: 1, 30: 3, 99: 3}
+	for x, want := range cases {
+		got := pick(arms, ws, func(n int64) int64 {
+			if n != 100 {
+				t.Fatalf("total weight %d, want 100", n)
+			}
+			return x
+		})
+		if got != want {
+			t.Errorf("pick(%d) = %d, want %d", x, got, want)
+		}
+	}
+
+	if id := pick([]Arm{{Id: 1, Weight: 0}}, []uint64{0}, nil); id != 0 {
+		t.Errorf("pick with zero weights = %d, want 0", id)
+	}
+}
+
+func TestOptimizeWeights(t *testing.T) {
+	arms := []Arm{{Id: 1, Weight: 50}, {Id: 2, Weight: 50}, {Id: 3, Weight: 0}}
+
+	// 没有收益的时候用配置的权重
+	ws := optimizeWeights(arms, map[int64]Stat{1: {Trials: 1000}}, OptimizeEPC, 0.1, 100)
+	if ws[0] != 50 || ws[1] != 50 || ws[2] != 0 {
+		t.Errorf("weights without revenue = %v", ws)
+	}
+
+	stats := map[int64]Stat{
+		1: {Trials: 10000, Conversions: 100, Revenue: 200000000},
+		2: {Trials: 10000, Conversions: 300, Revenue: 100000000},
+	}
+	ws = optimizeWeights(arms, stats, OptimizeEPC, 0.1, 100)
+	if ws[0] <= ws[1] {
+		t.Errorf("EPC weights %v should favor arm 1", ws)
+	}
+	if ws[2] != 0 {
+		t.Errorf("disabled arm got weight %d", ws[2])
+	}
+	ws = optimizeWeights(arms, stats, OptimizeCR, 0.1, 100)
+	if ws[1] <= ws[0] {
+		t.Errorf("CR weights %v should favor arm 2", ws)
+	}
+
+	// exploration floor：没有数据的候选也至少分到exploration/n
+	stats = map[int64]Stat{1: {Trials: 100000, Revenue: 1000000000}}
+	ws = optimizeWeights(arms, stats, OptimizeEPC, 0.2, 100)
+	if ws[1] < weightScale/10 {
+		t.Errorf("unexplored arm weight %d below floor %d", ws[1], weightScale/10)
+	}
+}
+
+func TestOptimizedZeroWeight(t *testing.T) {
+	rt := Rotator{Scope: "test_zero_weight"}
+	omu.Lock()
+	optimizedCache[rt.Scope] = &optimizedWeights{weights: map[int64]uint64{1: 60, 2: 40}, at: time.Now()}
+	omu.Unlock()
+	defer func() {
+		omu.Lock()
+		delete(optimizedCache, rt.Scope)
+		omu.Unlock()
+	}()
+
+	arms := []Arm{{Id: 1, Weight: 50}, {Id: 2, Weight: 50}}
+	if ws := optimized(rt, arms); len(ws) != 2 || ws[0] != 60 || ws[1] != 40 {
+		t.Fatalf("optimized = %v, want [60 40]", ws)
+	}
+
+	// 缓存填好之后用户把2的权重改成0
+	arms[1].Weight = 0
+	if ws := optimized(rt, arms); len(ws) != 2 || ws[0] != 60 || ws[1] != 0 {
+		t.Errorf("optimized after weight set to 0 = %v, want [60 0]", ws)
+	}
+}
@@ -19,7 +19,7 @@ var dbgetter = func() *sql.DB {
 // no cache
 func dbGetAvailableRules() []RuleConfig {
 	d := dbgetter()
-	sql := "SELECT id, userId, json, status, `type` FROM Rule WHERE deleted=0"
+	sql := "SELECT id, userId, json, status, sticky, `type` FROM Rule WHERE deleted=0"
 	rows, err := d.Query(sql)
 	if err != nil {
 		log.Errorf("[rule][dbGetAvailableRules]Query: %s failed:%v", sql, err)
@@ -30,7 +30,7 @@ func dbGetAvailableRules() []RuleConfig {
 	var c RuleConfig
 	var arr []RuleConfig
 	for rows.Next() {
-		if err := rows.Scan(&c.Id, &c.UserId, &c.Json, &c.Status, &c.Type); err != nil {
+		if err := rows.Scan(&c.Id, &c.UserId, &c.Json, &c.Status, &c.Sticky, &c.Type); err != nil {
 			log.Errorf("[rule][dbGetAvailableRules] scan failed:%v", err)
 			return nil
 		}
@@ -41,7 +41,7 @@ func dbGetAvailableRules() []RuleConfig {
 
 //func DBGetUserRules(userId int64) []RuleConfig {
 //	d := dbgetter()
-//	sql := "SELECT id, userId, json, status, `type` FROM Rule WHERE userId=? AND deleted=0"
+//	sql := "SELECT id, userId, json, status, sticky, `type` FROM Rule WHERE userId=? AND deleted=0"
 //	rows, err := d.Query(sql, userId)
 //	if err != nil {
 //		log.Errorf("[rule][DBGetUserRules]Query: %s failed:%v", sql, err)
@@ -52,7 +52,7 @@ func dbGetAvailableRules() []RuleConfig {
 //	var c RuleConfig
 //	var arr []RuleConfig
 //	for rows.Next() {
-//		if err := rows.Scan(&c.Id, &c.UserId, &c.Json, &c.Status, &c.Type); err != nil {
+//		if err := rows.Scan(&c.Id, &c.UserId, &c.Json, &c.Status, &c.Sticky, &c.Type); err != nil {
 //			log.Errorf("[rule][DBGetUserRules] scan failed:%v", err)
 //			return nil
 //		}
@@ -73,10 +73,10 @@ func DBGetRule(ruleId int64) (c RuleConfig) {
 	}
 
 	d := dbgetter()
-	sql := "SELECT id, userId, json, status, `type` FROM Rule WHERE id=?"
+	sql := "SELECT id, userId, json, status, sticky, `type` FROM Rule WHERE id=?"
 	row := d.QueryRow(sql, ruleId)
 
-	if err := row.Scan(&c.Id, &c.UserId, &c.Json, &c.Status, &c.Type); err != nil {
+	if err := row.Scan(&c.Id, &c.UserId, &c.Json, &c.Status, &c.Sticky, &c.Type); err != nil {
 		log.Errorf("[rule][DBGetRule] ruleId:%v scan failed:%v", ruleId, err)
 		return
 	}
@@ -57,6 +57,11 @@ func (f fakeRequest) ExternalId() string {
 func (f fakeRequest) Cost() float64 {
 	return 0.0025
 }
+func (f fakeRequest) TrackedCost() (float64, int64) {
+	return 0, 0
+}
+func (f fakeRequest) AddTrackedCost(cost float64, timestamp int64) {
+}
 func (f fakeRequest) Vars(n uint) string {
 	return fmt.Sprintf("%d", n*10)
 }
@@ -272,6 +277,9 @@ func (f fakeRequest) ReferrerKey(timestamp int64) (key tracking.ReferrerStatisKe
 func (f fakeRequest) DomainKey(timestamp int64) (key tracking.ReferrerDomainStatisKey) {
 	return
 }
+func (f fakeRequest) SlotKey(timestamp int64) (key tracking.SlotStatisKey) {
+	return
+}
 func (f fakeRequest) ConversionKey() (key tracking.Conversion) {
 	return
 }
@@ -323,6 +331,11 @@ func (f fakeRequest) OptOfferId() int64 {
 }
 func (f fakeRequest) SetOptOfferId(id int64) {
 }
+func (f fakeRequest) Slot() int64 {
+	return 0
+}
+func (f fakeRequest) SetSlot(slot int64) {
+}
 func (f fakeRequest) OptAffiliateId() int64 {
 	return 1
 }
@@ -341,3 +354,15 @@ func (f fakeRequest) TSCampaignId() string {
 func (f fakeRequest) WebsiteId() string {
 	return ""
 }
+func (f fakeRequest) QueryParam(key string) string {
+	if key == "zoneid" {
+		return "12345"
+	}
+	return ""
+}
+func (f fakeRequest) CookieValue(key string) string {
+	if key == "publisher" {
+		return "pub-a"
+	}
+	return ""
+}
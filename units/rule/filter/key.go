@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"Service/request"
+	"Service/units/frequency"
 )
 
 const (
@@ -18,7 +19,16 @@ type KeyFunction func(req request.Request) string
 
 var keyFuncMap map[string]KeyFunction
 
+// prefixKeyFuncMap 带参数的key，比如get.zoneid，参数为前缀后面的部分
+var prefixKeyFuncMap map[string]func(name string) KeyFunction
+
 //TODO 修改注释
+// externalid      traffic source传过来的externalId
+// tscampaignid    traffic source传过来的campaignId
+// websiteid       traffic source传过来的websiteId
+// var1-var10      traffic source传过来的var1-var10
+// get.xx          请求中的url参数xx，xx不能以sys.开头，也不能带[或者{(留给下面还没有实现的写法)
+// cookie.xx       请求中名为xx的cookie
 // ip              调用方IP地址
 // country         IP所属国家
 // province        IP所属省
@@ -47,27 +57,26 @@ var keyFuncMap map[string]KeyFunction
 // height		   广告位高
 // size			   广告位宽*高
 // datacenter	   数据中心节点位置(US-WEST,US-EAST等)
-//TODO↓↓↓
+//TODO↓↓↓ 以下还没有实现，get.sys.xx、get.xx[index]、get.xx{n1.n2}在规则里面使用时解析失败
 // get.sys.cid     用户cookie id，用于标志唯一用户
 // get.sys.bid     用户分桶ID，0-f，共16个值，值可以使用函数f.bid()，这是一个用日期时间来计算0-f的值的函数
 // get.sys.bid2    用户分桶二级ID，0-f，共16个值
 // get.sys.si      当前广告位ID
 // get.sys.sdk     当前请求的sdk
 // get.sys.selector 当前广告来源selector
-// get.xx          接口请求中的get参数xx
 // get.xx[index]   接口请求中get参数xx的列表值（用逗号分隔）的索引（从0开始）为index的值
 // get.xx{n1.n2}   接口请求中get参数为xx的JSON节点为node1/node2的值
-// cookie.xx       Cookie中名为xx的值
-// request.xx      xx为adid，或字母g为前缀后跟流量组id，可使用多个，使用逗号分隔。对象的总请求量
-// d_request.xx    同requext.xx，但仅为当天的总量
+// f.xx            当前访客(cookie)在窗口期内的次数，xx为campaign(当前campaign的visits)，c<id>(campaign的visits)，o<id>(被送到offer的次数)
+// F.xx            同f.xx，但按IP计算
+// request.xx      xx同f.xx，对象的总量
+// d_request.xx    同request.xx，但仅为当天(UTC)的总量
+// click.xx        xx同f.xx，campaign为lander的点击量，offer为被送到offer的次数
+// d_click.xx      同click.xx，但仅为当天(UTC)的总量
+// (以上次数都不包括当前这次请求，并且只是本机的次数)
 // impression.xx   xx同reqest，对象的总展示总量
 // d_impression.xx 同impression.xx，但仅为当天的总量
-// click.xx        xx同request，对象的总点击量
-// d_click.xx      同click.xx，但仅为当天的总量
 // aclick.xx       xx同request，对象的弹出总量
 // d_aclick.xx     同aclick.xx，当天总量
-// f.xx            xx为频次ID，一般为adid
-// F.xx            xx为IP频次ID，一般为adid
 // user.xx         xx为用户属性
 // ip.xx           基于ip的行为频次
 func init() {
@@ -138,6 +147,15 @@ func init() {
 		"useragent": func(req request.Request) string {
 			return strings.ToUpper(req.UserAgent())
 		},
+		"externalid": func(req request.Request) string {
+			return strings.ToUpper(req.ExternalId())
+		},
+		"tscampaignid": func(req request.Request) string {
+			return strings.ToUpper(req.TSCampaignId())
+		},
+		"websiteid": func(req request.Request) string {
+			return strings.ToUpper(req.WebsiteId())
+		},
 		"var1": func(req request.Request) string {
 			return strings.ToUpper(req.Vars(0))
 		},
@@ -171,6 +189,76 @@ func init() {
 	}
 }
 
+// reservedGetPrefix get.sys.xx为系统参数，不是url参数
+const reservedGetPrefix = "sys."
+
+func init() {
+	prefixKeyFuncMap = map[string]func(name string) KeyFunction{
+		"get.": func(name string) KeyFunction {
+			if strings.HasPrefix(name, reservedGetPrefix) || strings.ContainsAny(name, "[{") {
+				return nil
+			}
+			return func(req request.Request) string {
+				return strings.ToUpper(req.QueryParam(name))
+			}
+		},
+		"cookie.": func(name string) KeyFunction {
+			return func(req request.Request) string {
+				return strings.ToUpper(req.CookieValue(name))
+			}
+		},
+		"f.": func(name string) KeyFunction {
+			return countKey(name, func(req request.Request, obj, event string) int64 {
+				return frequency.VisitorCount(req.CookieValue(frequency.VisitorCookie), event, obj)
+			})
+		},
+		"F.": func(name string) KeyFunction {
+			return countKey(name, func(req request.Request, obj, event string) int64 {
+				return frequency.IPCount(req.RemoteIp(), event, obj)
+			})
+		},
+		"request.": func(name string) KeyFunction {
+			return countKey(name, func(req request.Request, obj, event string) int64 {
+				return frequency.TotalCount(event, obj, false)
+			})
+		},
+		"d_request.": func(name string) KeyFunction {
+			return countKey(name, func(req request.Request, obj, event string) int64 {
+				return frequency.TotalCount(event, obj, true)
+			})
+		},
+		"click.": func(name string) KeyFunction {
+			return countKey(name, func(req request.Request, obj, event string) int64 {
+				return frequency.TotalCount(frequency.EventClick, obj, false)
+			})
+		},
+		"d_click.": func(name string) KeyFunction {
+			return countKey(name, func(req request.Request, obj, event string) int64 {
+				return frequency.TotalCount(frequency.EventClick, obj, true)
+			})
+		},
+	}
+}
+
+// countKey 次数类的key，xx不合法的时候次数为0
+func countKey(xx string, count func(req request.Request, obj, event string) int64) KeyFunction {
+	return func(req request.Request) string {
+		obj, event, ok := frequency.Object(xx, req)
+		if !ok {
+			return "0"
+		}
+		return fmt.Sprintf("%d", count(req, obj, event))
+	}
+}
+
 func KF(key string) KeyFunction {
-	return keyFuncMap[key]
+	if f, ok := keyFuncMap[key]; ok {
+		return f
+	}
+	for prefix, pf := range prefixKeyFuncMap {
+		if strings.HasPrefix(key, prefix) && len(key) > len(prefix) {
+			return pf(key[len(prefix):])
+		}
+	}
+	return nil
 }
@@ -0,0 +1,48 @@
+package filter
+
+import (
+	"testing"
+)
+
+func TestParamKeys(t *testing.T) {
+	req := getFakeRequest()
+	cases := map[string]string{
+		"get.zoneid":       "12345",
+		"get.missing":      "",
+		"cookie.publisher": "PUB-A",
+		"externalid":       "EXTERNALYYY",
+		"var2":             "10",
+	}
+	for k, want := range cases {
+		f := KF(k)
+		if f == nil {
+			t.Errorf("KF(%s) is nil", k)
+			continue
+		}
+		if got := f(req); got != want {
+			t.Errorf("KF(%s) = %q, want %q", k, got, want)
+		}
+	}
+	if KF("get.") != nil || KF("nosuchkey") != nil {
+		t.Error("invalid key should return nil")
+	}
+	for _, k := range []string{"get.sys.cid", "get.sys.bid", "get.zoneid[0]", "get.info{a.b}"} {
+		if KF(k) != nil {
+			t.Errorf("reserved key %s should return nil", k)
+		}
+		if _, err := NewFilter(`[[["` + k + `","in","1"]]]`); err == nil {
+			t.Errorf("filter with reserved key %s should fail", k)
+		}
+	}
+	if _, err := NewFilter(`[[["nosuchkey","in","1"]]]`); err == nil {
+		t.Error("filter with unknown key should fail")
+	}
+
+	nf, err := NewFilter(`[[["get.zoneid","in","12345","23456"],["cookie.publisher","not in","pub-b"]]]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nf.Accept(req) {
+		t.Error("zoneid 12345 should be accepted")
+	}
+}
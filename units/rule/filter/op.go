@@ -3,6 +3,8 @@ package filter
 import (
 	"fmt"
 	"net"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -29,6 +31,8 @@ func AOF(op string) OperationFunction {
 // time between,time not between,
 // weekday in,weekday not in,
 // contain,not contain,(不区分大小写)
+// >,>=,<,<=,between,(按版本号比较，"ANDROID 8.1"这样带名字的表达式要求名字相同)
+// matches,not matches,(正则表达式，不区分大小写，NewFilter时预编译)
 func init() {
 	logicOpFunctions = map[string]OperationFunction{
 		"in": func(value string, expr []string, req request.Request) bool {
@@ -176,5 +180,148 @@ func init() {
 			}
 			return true
 		},
+		">": func(value string, expr []string, req request.Request) bool {
+			if len(expr) < 1 {
+				return false
+			}
+			r, ok := compareTo(value, expr[0])
+			return ok && r > 0
+		},
+		">=": func(value string, expr []string, req request.Request) bool {
+			if len(expr) < 1 {
+				return false
+			}
+			r, ok := compareTo(value, expr[0])
+			return ok && r >= 0
+		},
+		"<": func(value string, expr []string, req request.Request) bool {
+			if len(expr) < 1 {
+				return false
+			}
+			r, ok := compareTo(value, expr[0])
+			return ok && r < 0
+		},
+		"<=": func(value string, expr []string, req request.Request) bool {
+			if len(expr) < 1 {
+				return false
+			}
+			r, ok := compareTo(value, expr[0])
+			return ok && r <= 0
+		},
+		"between": func(value string, expr []string, req request.Request) bool {
+			// 包含两端
+			if len(expr) < 2 {
+				return false
+			}
+			lo, ok := compareTo(value, expr[0])
+			if !ok || lo < 0 {
+				return false
+			}
+			hi, ok := compareTo(value, expr[1])
+			return ok && hi <= 0
+		},
+		// 正常情况下condition里面已经有预编译好的正则，不会走到这里
+		"matches": func(value string, expr []string, req request.Request) bool {
+			re, _ := compileRegexps(expr)
+			return matchAny(re, value)
+		},
+		"not matches": func(value string, expr []string, req request.Request) bool {
+			re, _ := compileRegexps(expr)
+			return !matchAny(re, value)
+		},
+	}
+}
+
+// compileRegexps 编译matches/not matches的表达式
+// key的值都已经转成了大写，所以正则都不区分大小写
+func compileRegexps(expr []string) (re []*regexp.Regexp, err error) {
+	re = make([]*regexp.Regexp, 0, len(expr))
+	for _, e := range expr {
+		r, err := regexp.Compile("(?i)" + e)
+		if err != nil {
+			return re, err
+		}
+		re = append(re, r)
+	}
+	return re, nil
+}
+
+func matchAny(re []*regexp.Regexp, value string) bool {
+	for _, r := range re {
+		if r.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitVersion 把"ANDROID 8.1"这样的值拆成名字和版本号
+// 最后一段以数字开头的才当作版本号，纯数字的值名字为空
+func splitVersion(s string) (name, version string) {
+	s = strings.TrimSpace(strings.ToUpper(s))
+	i := strings.LastIndex(s, " ")
+	last := s[i+1:]
+	if last == "" || last[0] < '0' || last[0] > '9' {
+		return s, ""
+	}
+	if i < 0 {
+		return "", last
+	}
+	return strings.TrimSpace(s[:i]), last
+}
+
+// compareTo 比较value和expr的版本号，返回-1,0,1
+// 任意一方没有版本号，或者expr带了名字但是和value不同的时候，ok为false
+func compareTo(value, expr string) (r int, ok bool) {
+	vn, vv := splitVersion(value)
+	en, ev := splitVersion(expr)
+	if vv == "" || ev == "" {
+		return 0, false
+	}
+	if en != "" && en != vn {
+		return 0, false
+	}
+	return compareVersion(vv, ev), true
+}
+
+// compareVersion 按段比较版本号，缺少的段当作0，所以8.1和8.1.0相等
+// 每段先比较开头的数字，数字相同再按字符串比较剩下的部分(比如0b3)
+func compareVersion(a, b string) int {
+	as := strings.FieldsFunc(a, isVersionSep)
+	bs := strings.FieldsFunc(b, isVersionSep)
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := "0", "0"
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		xn, xr := splitLeadingNumber(x)
+		yn, yr := splitLeadingNumber(y)
+		switch {
+		case xn < yn:
+			return -1
+		case xn > yn:
+			return 1
+		case xr < yr:
+			return -1
+		case xr > yr:
+			return 1
+		}
+	}
+	return 0
+}
+
+func isVersionSep(r rune) bool {
+	return r == '.' || r == '_' || r == '-'
+}
+
+func splitLeadingNumber(s string) (n uint64, rest string) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
 	}
+	n, _ = strconv.ParseUint(s[:i], 10, 64)
+	return n, s[i:]
 }
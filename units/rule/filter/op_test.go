@@ -0,0 +1,89 @@
+package filter
+
+import (
+	"testing"
+)
+
+func TestCompareVersion(t *testing.T) {
+	cases := []struct {
+		a, b string
+		r    int
+	}{
+		{"8.1", "8.1", 0},
+		{"8.1", "8.1.0", 0},
+		{"8.10", "8.9", 1},
+		{"7.1.2", "8", -1},
+		{"55.0.2883.87", "55.0.2883.100", -1},
+		{"10_3_1", "10.3", 1},
+		{"1.0b3", "1.0b2", 1},
+		{"100", "50", 1},
+	}
+	for _, c := range cases {
+		if r := compareVersion(c.a, c.b); r != c.r {
+			t.Errorf("compareVersion(%s, %s) = %d, want %d", c.a, c.b, r, c.r)
+		}
+	}
+}
+
+func TestCompareOps(t *testing.T) {
+	cases := []struct {
+		value string
+		op    string
+		expr  []string
+		want  bool
+	}{
+		{"ANDROID 8.1", ">=", []string{"Android 8.1"}, true},
+		{"ANDROID 8.0.1", ">=", []string{"Android 8.1"}, false},
+		{"ANDROID 9", ">", []string{"8.1"}, true},
+		{"IOS 11.2", ">=", []string{"Android 8.1"}, false},
+		{"IOS 11.2", "<", []string{"Android 8.1"}, false},
+		{"IOS 9.1", "<", []string{"iOS 10"}, true},
+		{"IOS 9.1", "<=", []string{"9.1.0"}, true},
+		{"CHROME 55.0.2883.87", "between", []string{"Chrome 50", "Chrome 56"}, true},
+		{"CHROME 57.0", "between", []string{"Chrome 50", "Chrome 56"}, false},
+		{"CHROME", ">", []string{"1"}, false},
+		{"30", "between", []string{"10", "30"}, true},
+		{"ANDROID 8.1", ">", []string{}, false},
+	}
+	for _, c := range cases {
+		if got := LOF(c.op)(c.value, c.expr, getFakeRequest()); got != c.want {
+			t.Errorf("%q %s %v = %v, want %v", c.value, c.op, c.expr, got, c.want)
+		}
+	}
+}
+
+func TestRegexpConditions(t *testing.T) {
+	nf, err := NewFilter(`[[["os","matches","^ios (9|10)\\."],["browser","not matches","firefox"]]]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := nf.(*filterImpl)
+	if len(f.Filters[0].Condtions.Conditions[0].re) != 1 {
+		t.Fatal("regexp is not precompiled")
+	}
+	if !nf.Accept(getFakeRequest()) {
+		t.Error("IOS 9.1/Chrome should be accepted")
+	}
+
+	nf, err = NewFilter(`[[["os","matches","^android"]]]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nf.Accept(getFakeRequest()) {
+		t.Error("IOS 9.1 should not match ^android")
+	}
+
+	if _, err := NewFilter(`[[["os","matches","(ios"]]]`); err == nil {
+		t.Error("invalid regexp should fail NewFilter")
+	}
+}
+
+func TestVersionCondition(t *testing.T) {
+	nf, err := NewFilter(`[[["os",">=","iOS 9"],["browser","<","Chrome 56"]]]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nf.Accept(getFakeRequest()) {
+		t.Error("IOS 9.1/Chrome 55 should be accepted")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"regexp"
 	"strconv"
 
 	"Service/log"
@@ -17,6 +18,40 @@ type condition struct {
 	Key  string   `json:"key"`
 	Op   string   `json:"op"`
 	Expr []string `json:"expr"`
+
+	kf KeyFunction      // Key对应的取值函数
+	re []*regexp.Regexp // matches/not matches预编译的正则
+}
+
+// newCondition 从[key, op, expr...]创建条件，取值函数和正则在这里准备好
+func newCondition(s []string) (c condition, err error) {
+	c = condition{Key: s[0], Op: s[1], Expr: s[2:]}
+	if c.kf = KF(c.Key); c.kf == nil {
+		return c, fmt.Errorf("Unsupported key in condition %+v", s)
+	}
+	switch c.Op {
+	case "matches", "not matches":
+		c.re, err = compileRegexps(c.Expr)
+		if err != nil {
+			err = fmt.Errorf("Invalid regexp in condition %+v: %s", s, err.Error())
+		}
+	}
+	return
+}
+
+func (c condition) ok(req request.Request) bool {
+	value := c.kf(req)
+	switch c.Op {
+	case "matches":
+		if c.re != nil {
+			return matchAny(c.re, value)
+		}
+	case "not matches":
+		if c.re != nil {
+			return !matchAny(c.re, value)
+		}
+	}
+	return LOF(c.Op)(value, c.Expr, req)
 }
 
 type conditionlist struct { // combined conditions
@@ -166,7 +201,11 @@ func parseConditionList(cs []*simplejson.Json) (cl conditionlist, err error) {
 				return cl, err
 			}
 			cl.Combination = VarLogicAnd
-			cl.Conditions = []condition{condition{Key: s[0], Op: s[1], Expr: s[2:]}}
+			c, err := newCondition(s)
+			if err != nil {
+				return cl, err
+			}
+			cl.Conditions = []condition{c}
 		} else { // ["or/and/not", [condtion], [condition], ...]
 			la, err := cs[0].Array()
 			if err != nil {
@@ -201,7 +240,11 @@ func parseConditionList(cs []*simplejson.Json) (cl conditionlist, err error) {
 					err = fmt.Errorf("5 parseConditionList with invalid raw filter content %+#v.", String(cs))
 					return cl, err
 				}
-				cl.Conditions = append(cl.Conditions, condition{Key: s[0], Op: s[1], Expr: s[2:]})
+				c, err := newCondition(s)
+				if err != nil {
+					return cl, err
+				}
+				cl.Conditions = append(cl.Conditions, c)
 			}
 		}
 	default: // c = [condition], [condition], ...
@@ -218,7 +261,11 @@ func parseConditionList(cs []*simplejson.Json) (cl conditionlist, err error) {
 				err = fmt.Errorf("6 parseConditionList with invalid raw filter content %+#v.", String(cs))
 				return cl, err
 			}
-			cl.Conditions = append(cl.Conditions, condition{Key: s[0], Op: s[1], Expr: s[2:]})
+			nc, err := newCondition(s)
+			if err != nil {
+				return cl, err
+			}
+			cl.Conditions = append(cl.Conditions, nc)
 		}
 		return
 	}
@@ -335,7 +382,7 @@ func parseSingleOptionalAction(a *simplejson.Json) (oa optionalaction, err error
 func conditionOK(req request.Request, cl conditionlist) bool {
 	result := false
 	for _, c := range cl.Conditions {
-		b := LOF(c.Op)(KF(c.Key)(req), c.Expr, req)
+		b := c.ok(req)
 		switch cl.Combination {
 		case VarLogicAnd:
 			if !b {
@@ -3,13 +3,13 @@ package rule
 import (
 	"errors"
 	"fmt"
-	"math/rand"
 	"net/http"
 	"sync"
 
 	"Service/log"
 	"Service/request"
 	"Service/units/path"
+	"Service/units/rotation"
 	"Service/units/rule/filter"
 )
 
@@ -23,6 +23,7 @@ type RuleConfig struct {
 	UserId int64
 	Json   string
 	Status int64
+	Sticky int64 // 0:每次随机;1:按IP+UA固定;2:按访客cookie固定
 
 	Type int
 }
@@ -57,14 +58,11 @@ type Rule struct {
 	f     filter.Filter
 	paths []RulePath
 	pwSum uint64
-}
 
-// // Rand returns, as an int, a non-negative pseudo-random number in [0,n)
-func (r *Rule) Rand() int {
-	if r.pwSum <= 0 {
-		return 0
-	}
-	return rand.Intn(int(r.pwSum))
+	// 只包括running的path
+	// AdStatis里面没有path的统计，所以rule不支持auto optimize
+	arms []rotation.Arm
+	rr   rotation.Rotator
 }
 
 var cmu sync.RWMutex // protects the following
@@ -128,6 +126,16 @@ func newRule(c RuleConfig) (r *Rule) {
 		f:          f,
 		paths:      paths,
 		pwSum:      pwSum,
+		rr: rotation.Rotator{
+			Scope:  fmt.Sprintf("r%d:p", c.Id),
+			UserId: c.UserId,
+			Sticky: int(c.Sticky),
+		},
+	}
+	for _, p := range paths {
+		if p.Status == RulePathStatusRunning {
+			r.arms = append(r.arms, rotation.Arm{Id: p.PathId, Weight: p.Weight})
+		}
 	}
 	return
 }
@@ -167,22 +175,11 @@ func (r *Rule) OnLPOfferRequest(w http.ResponseWriter, req request.Request) erro
 	if !r.Accept(req) {
 		return fmt.Errorf("Request(%s) not accepted by rule(%d)", req.Id(), r.Id)
 	}
-	x := r.Rand()
-	cx := 0
-	for _, p := range r.paths {
-		if p.PathId <= 0 {
-			continue
-		}
-		if p.Status != path.StatusRunning {
-			continue
-		}
-		cx += int(p.Weight)
-		if x < cx {
-			req.SetPathId(p.PathId)
-			return path.GetPath(p.PathId).OnLPOfferRequest(w, req)
-		}
+	if pathId := r.rr.Pick(r.arms, req); pathId > 0 {
+		req.SetPathId(pathId)
+		return path.GetPath(pathId).OnLPOfferRequest(w, req)
 	}
-	return fmt.Errorf("Request(%s) does not match any path(%d:%d) in rule(%d)", req.Id(), cx, x, r.Id)
+	return fmt.Errorf("Request(%s) does not match any path(%d) in rule(%d)", req.Id(), r.pwSum, r.Id)
 }
 
 func (r *Rule) OnLandingPageClick(w http.ResponseWriter, req request.Request) error {
@@ -224,11 +221,3 @@ func (r *Rule) OnS2SPostback(w http.ResponseWriter, req request.Request) error {
 
 	return fmt.Errorf("Target Path(%d) not found for request(%s) in rule(%d)", req.PathId(), req.Id(), r.Id)
 }
-
-func (r *Rule) OnConversionPixel(w http.ResponseWriter, req request.Request) error {
-	return nil
-}
-
-func (r *Rule) OnConversionScript(w http.ResponseWriter, req request.Request) error {
-	return nil
-}
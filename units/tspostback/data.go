@@ -0,0 +1,189 @@
+package tspostback
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"Service/db"
+	"Service/log"
+)
+
+// dbgetter 默认的拿数据库的东西
+// 方便测试的地方替换这个接口
+var dbgetter = func() *sql.DB {
+	return db.GetDB("DB")
+}
+
+// TSPostbackLog的status
+const (
+	StatusPending   = 0 // 等待发送
+	StatusDelivered = 1 // 发送成功
+	StatusRetrying  = 2 // 发送失败，等待重试
+	StatusDead      = 3 // 重试次数用完或者不可重试的失败，即dead letter
+)
+
+// Delivery 对应数据库里面的TSPostbackLog，一条conversion往traffic source的回传记录
+type Delivery struct {
+	Id              int64
+	ClickId         string
+	UserId          int64
+	CampaignId      int64
+	TrafficSourceId int64
+	Url             string
+	Status          int
+	Attempts        int
+	HttpStatus      int
+	LastError       string
+	CreatedAt       int64
+	LastAttemptAt   int64
+	NextAttemptAt   int64
+	DeliveredAt     int64
+}
+
+const deliveryColumns = "id,clickId,userId,campaignId,trafficSourceId,url,status,attempts,httpStatus,lastError,createdAt,lastAttemptAt,nextAttemptAt,deliveredAt"
+
+func scanDelivery(row interface {
+	Scan(dest ...interface{}) error
+}, d *Delivery) error {
+	return row.Scan(&d.Id, &d.ClickId, &d.UserId, &d.CampaignId, &d.TrafficSourceId, &d.Url, &d.Status,
+		&d.Attempts, &d.HttpStatus, &d.LastError, &d.CreatedAt, &d.LastAttemptAt, &d.NextAttemptAt, &d.DeliveredAt)
+}
+
+func dbInsertDelivery(d *Delivery) (id int64, err error) {
+	sql := "INSERT INTO TSPostbackLog(clickId,userId,campaignId,trafficSourceId,url,status,createdAt,nextAttemptAt) VALUES(?,?,?,?,?,?,?,?)"
+	res, err := dbgetter().Exec(sql, d.ClickId, d.UserId, d.CampaignId, d.TrafficSourceId, d.Url, StatusPending, d.CreatedAt, d.NextAttemptAt)
+	if err != nil {
+		log.Errorf("[tspostback][dbInsertDelivery]Exec: %s with clickId:%v failed:%v", sql, d.ClickId, err)
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// dbClaimDelivery 占用一条到期的记录，lease之前其他worker(包括其他机器)不会再拿到它
+// 机器挂掉的话，lease到期后会被重新发送
+func dbClaimDelivery(id, now, lease int64) bool {
+	sql := "UPDATE TSPostbackLog SET nextAttemptAt=? WHERE id=? AND status IN (?,?) AND nextAttemptAt<=?"
+	res, err := dbgetter().Exec(sql, lease, id, StatusPending, StatusRetrying, now)
+	if err != nil {
+		log.Errorf("[tspostback][dbClaimDelivery]Exec: %s with id:%v failed:%v", sql, id, err)
+		return false
+	}
+	n, err := res.RowsAffected()
+	return err == nil && n == 1
+}
+
+func dbGetDelivery(id int64) (d Delivery, err error) {
+	sql := "SELECT " + deliveryColumns + " FROM TSPostbackLog WHERE id=?"
+	if err = scanDelivery(dbgetter().QueryRow(sql, id), &d); err != nil {
+		log.Errorf("[tspostback][dbGetDelivery]QueryRow: %s with id:%v failed:%v", sql, id, err)
+	}
+	return
+}
+
+// dbGetDueDeliveries 拿到已经到了发送时间的记录
+func dbGetDueDeliveries(now int64, limit int) (ids []int64) {
+	sql := "SELECT id FROM TSPostbackLog WHERE status IN (?,?) AND nextAttemptAt<=? ORDER BY nextAttemptAt LIMIT ?"
+	rows, err := dbgetter().Query(sql, StatusPending, StatusRetrying, now, limit)
+	if err != nil {
+		log.Errorf("[tspostback][dbGetDueDeliveries]Query: %s failed:%v", sql, err)
+		return
+	}
+	defer rows.Close()
+
+	var id int64
+	for rows.Next() {
+		if err := rows.Scan(&id); err != nil {
+			log.Errorf("[tspostback][dbGetDueDeliveries]Scan failed:%v", err)
+			return
+		}
+		ids = append(ids, id)
+	}
+	return
+}
+
+// dbUpdateDelivery 记录一次发送的结果
+func dbUpdateDelivery(d *Delivery) error {
+	sql := "UPDATE TSPostbackLog SET status=?,attempts=?,httpStatus=?,lastError=?,lastAttemptAt=?,nextAttemptAt=?,deliveredAt=? WHERE id=?"
+	_, err := dbgetter().Exec(sql, d.Status, d.Attempts, d.HttpStatus, truncate(d.LastError, 512),
+		d.LastAttemptAt, d.NextAttemptAt, d.DeliveredAt, d.Id)
+	if err != nil {
+		log.Errorf("[tspostback][dbUpdateDelivery]Exec: %s with id:%v failed:%v", sql, d.Id, err)
+	}
+	return err
+}
+
+// dbPostpone 不算作一次发送，只是推迟
+func dbPostpone(id, next int64) error {
+	sql := "UPDATE TSPostbackLog SET nextAttemptAt=? WHERE id=?"
+	_, err := dbgetter().Exec(sql, next, id)
+	if err != nil {
+		log.Errorf("[tspostback][dbPostpone]Exec: %s with id:%v failed:%v", sql, id, err)
+	}
+	return err
+}
+
+// DBGetDeliveries 某个click id所有的回传记录
+func DBGetDeliveries(clickId string) (ds []Delivery, err error) {
+	sql := "SELECT " + deliveryColumns + " FROM TSPostbackLog WHERE clickId=? ORDER BY id"
+	return dbQueryDeliveries(sql, clickId)
+}
+
+// DBGetDeadLetters 拿到dead letter记录，clickId为空、campaignId为0表示不限制
+func DBGetDeadLetters(clickId string, campaignId int64, limit int) (ds []Delivery, err error) {
+	where, args := deadLetterWhere(clickId, campaignId)
+	sql := "SELECT " + deliveryColumns + " FROM TSPostbackLog WHERE " + where + " ORDER BY id LIMIT ?"
+	return dbQueryDeliveries(sql, append(args, limit)...)
+}
+
+// DBReplayDeadLetters 把dead letter重新放回队列，重新计算重试次数
+func DBReplayDeadLetters(clickId string, campaignId int64, limit int, now int64) (n int64, err error) {
+	where, args := deadLetterWhere(clickId, campaignId)
+	sql := "UPDATE TSPostbackLog SET status=?,attempts=0,nextAttemptAt=? WHERE " + where + " ORDER BY id LIMIT ?"
+	args = append([]interface{}{StatusPending, now}, args...)
+	res, err := dbgetter().Exec(sql, append(args, limit)...)
+	if err != nil {
+		log.Errorf("[tspostback][DBReplayDeadLetters]Exec: %s failed:%v", sql, err)
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func deadLetterWhere(clickId string, campaignId int64) (string, []interface{}) {
+	conds := []string{"status=?"}
+	args := []interface{}{StatusDead}
+	if clickId != "" {
+		conds = append(conds, "clickId=?")
+		args = append(args, clickId)
+	}
+	if campaignId > 0 {
+		conds = append(conds, "campaignId=?")
+		args = append(args, campaignId)
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+func dbQueryDeliveries(sql string, args ...interface{}) (ds []Delivery, err error) {
+	rows, err := dbgetter().Query(sql, args...)
+	if err != nil {
+		log.Errorf("[tspostback][dbQueryDeliveries]Query: %s failed:%v", sql, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d Delivery
+		if err = scanDelivery(rows, &d); err != nil {
+			return nil, fmt.Errorf("scan failed:%v", err)
+		}
+		ds = append(ds, d)
+	}
+	return ds, rows.Err()
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,291 @@
+package tspostback
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeLog 内存里面的TSPostbackLog，只支持data.go里面用到的那几条语句
+type fakeLog struct {
+	mux  sync.Mutex
+	rows map[int64]*Delivery
+	next int64
+}
+
+var fakeLogs = struct {
+	sync.Mutex
+	m map[string]*fakeLog
+}{m: make(map[string]*fakeLog)}
+
+func init() {
+	sql.Register("tspostbacktest", fakeDriver{})
+}
+
+// withFakeDB 用一个空的fakeLog替换dbgetter，返回恢复的函数
+func withFakeDB(t *testing.T) (*fakeLog, func()) {
+	l := &fakeLog{rows: make(map[int64]*Delivery)}
+	fakeLogs.Lock()
+	fakeLogs.m[t.Name()] = l
+	fakeLogs.Unlock()
+	d, err := sql.Open("tspostbacktest", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := dbgetter
+	dbgetter = func() *sql.DB { return d }
+	return l, func() {
+		dbgetter = old
+		d.Close()
+	}
+}
+
+func (l *fakeLog) get(id int64) Delivery {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if d := l.rows[id]; d != nil {
+		return *d
+	}
+	return Delivery{}
+}
+
+// due 让id马上可以被发送
+func (l *fakeLog) due(id int64) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.rows[id].NextAttemptAt = 0
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeLogs.Lock()
+	defer fakeLogs.Unlock()
+	l := fakeLogs.m[name]
+	if l == nil {
+		return nil, errors.New("unknown fake db " + name)
+	}
+	return fakeConn{l}, nil
+}
+
+type fakeConn struct{ l *fakeLog }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.l, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+type fakeStmt struct {
+	l     *fakeLog
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+type fakeResult struct{ id, n int64 }
+
+func (r fakeResult) LastInsertId() (int64, error) { return r.id, nil }
+func (r fakeResult) RowsAffected() (int64, error) { return r.n, nil }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	l := s.l
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	i := func(n int) int64 { return args[n].(int64) }
+	switch {
+	case strings.HasPrefix(s.query, "INSERT INTO TSPostbackLog"):
+		l.next++
+		l.rows[l.next] = &Delivery{Id: l.next, ClickId: args[0].(string), UserId: i(1), CampaignId: i(2),
+			TrafficSourceId: i(3), Url: args[4].(string), Status: int(i(5)), CreatedAt: i(6), NextAttemptAt: i(7)}
+		return fakeResult{id: l.next, n: 1}, nil
+	case s.query == "UPDATE TSPostbackLog SET nextAttemptAt=? WHERE id=? AND status IN (?,?) AND nextAttemptAt<=?":
+		d := l.rows[i(1)]
+		if d == nil || (d.Status != int(i(2)) && d.Status != int(i(3))) || d.NextAttemptAt > i(4) {
+			return fakeResult{}, nil
+		}
+		d.NextAttemptAt = i(0)
+		return fakeResult{n: 1}, nil
+	case s.query == "UPDATE TSPostbackLog SET nextAttemptAt=? WHERE id=?":
+		if d := l.rows[i(1)]; d != nil {
+			d.NextAttemptAt = i(0)
+			return fakeResult{n: 1}, nil
+		}
+		return fakeResult{}, nil
+	case strings.HasPrefix(s.query, "UPDATE TSPostbackLog SET status=?,attempts=?,"):
+		d := l.rows[i(7)]
+		if d == nil {
+			return fakeResult{}, nil
+		}
+		d.Status, d.Attempts, d.HttpStatus, d.LastError = int(i(0)), int(i(1)), int(i(2)), args[3].(string)
+		d.LastAttemptAt, d.NextAttemptAt, d.DeliveredAt = i(4), i(5), i(6)
+		return fakeResult{n: 1}, nil
+	case strings.HasPrefix(s.query, "UPDATE TSPostbackLog SET status=?,attempts=0,nextAttemptAt=? WHERE "):
+		var n int64
+		for _, d := range l.match(s.query, args[2:len(args)-1], i(len(args)-1)) {
+			d.Status, d.Attempts, d.NextAttemptAt = int(i(0)), 0, i(1)
+			n++
+		}
+		return fakeResult{n: n}, nil
+	}
+	return nil, errors.New("unsupported exec " + s.query)
+}
+
+// match 按deadLetterWhere/clickId的条件找到的行，按id排序
+func (l *fakeLog) match(query string, args []driver.Value, limit int64) []*Delivery {
+	var ds []*Delivery
+	for _, d := range l.rows {
+		k := 0
+		ok := true
+		if strings.Contains(query, "status=?") {
+			ok = ok && d.Status == int(args[k].(int64))
+			k++
+		}
+		if strings.Contains(query, "clickId=?") {
+			ok = ok && d.ClickId == args[k].(string)
+			k++
+		}
+		if strings.Contains(query, "campaignId=?") {
+			ok = ok && d.CampaignId == args[k].(int64)
+		}
+		if ok {
+			ds = append(ds, d)
+		}
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i].Id < ds[j].Id })
+	if limit >= 0 && int64(len(ds)) > limit {
+		ds = ds[:limit]
+	}
+	return ds
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	l := s.l
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	var rows [][]driver.Value
+	full := func(d *Delivery) []driver.Value {
+		return []driver.Value{d.Id, d.ClickId, d.UserId, d.CampaignId, d.TrafficSourceId, d.Url, int64(d.Status),
+			int64(d.Attempts), int64(d.HttpStatus), d.LastError, d.CreatedAt, d.LastAttemptAt, d.NextAttemptAt, d.DeliveredAt}
+	}
+	switch {
+	case strings.HasSuffix(s.query, "FROM TSPostbackLog WHERE id=?"):
+		if d := l.rows[args[0].(int64)]; d != nil {
+			rows = append(rows, full(d))
+		}
+	case strings.HasPrefix(s.query, "SELECT id FROM TSPostbackLog WHERE status IN (?,?) AND nextAttemptAt<=?"):
+		var ds []*Delivery
+		for _, d := range l.rows {
+			if (d.Status == int(args[0].(int64)) || d.Status == int(args[1].(int64))) && d.NextAttemptAt <= args[2].(int64) {
+				ds = append(ds, d)
+			}
+		}
+		sort.Slice(ds, func(i, j int) bool {
+			return ds[i].NextAttemptAt < ds[j].NextAttemptAt || ds[i].NextAttemptAt == ds[j].NextAttemptAt && ds[i].Id < ds[j].Id
+		})
+		for k, d := range ds {
+			if int64(k) >= args[3].(int64) {
+				break
+			}
+			rows = append(rows, []driver.Value{d.Id})
+		}
+	case strings.HasPrefix(s.query, "SELECT "+deliveryColumns+" FROM TSPostbackLog WHERE "):
+		limit := int64(-1)
+		if strings.HasSuffix(s.query, "LIMIT ?") {
+			limit = args[len(args)-1].(int64)
+			args = args[:len(args)-1]
+		}
+		for _, d := range l.match(s.query, args, limit) {
+			rows = append(rows, full(d))
+		}
+	default:
+		return nil, errors.New("unsupported query " + s.query)
+	}
+	return &fakeRows{rows: rows}, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) > 0 && len(r.rows[0]) == 1 {
+		return []string{"id"}
+	}
+	return strings.Split(deliveryColumns, ",")
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func TestDBDeliveries(t *testing.T) {
+	l, restore := withFakeDB(t)
+	defer restore()
+
+	for i, clickId := range []string{"c1", "c2", "c3"} {
+		d := Delivery{ClickId: clickId, CampaignId: int64(i%2 + 1), Url: "http://ts.com/" + clickId, CreatedAt: 100, NextAttemptAt: int64(100 + i)}
+		if id, err := dbInsertDelivery(&d); err != nil || id != int64(i+1) {
+			t.Fatalf("dbInsertDelivery = %d, %v", id, err)
+		}
+	}
+
+	if ids := dbGetDueDeliveries(101, 10); len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Errorf("dbGetDueDeliveries(101) = %v, want [1 2]", ids)
+	}
+	if ids := dbGetDueDeliveries(200, 1); len(ids) != 1 || ids[0] != 1 {
+		t.Errorf("dbGetDueDeliveries with limit = %v, want [1]", ids)
+	}
+
+	// 拿到之后lease到期之前不能再拿
+	if !dbClaimDelivery(1, 200, 300) {
+		t.Fatal("dbClaimDelivery failed")
+	}
+	if dbClaimDelivery(1, 200, 300) {
+		t.Error("claimed delivery should not be claimed again before lease")
+	}
+	if !dbClaimDelivery(1, 300, 400) {
+		t.Error("delivery should be claimed again after lease")
+	}
+
+	d, err := dbGetDelivery(2)
+	if err != nil || d.ClickId != "c2" || d.Status != StatusPending {
+		t.Errorf("dbGetDelivery(2) = %+v, %v", d, err)
+	}
+	d.Status, d.Attempts, d.LastError = StatusDead, 3, strings.Repeat("x", 600)
+	if err := dbUpdateDelivery(&d); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.get(2); got.Status != StatusDead || got.Attempts != 3 || len(got.LastError) != 512 {
+		t.Errorf("updated delivery = %+v", got)
+	}
+
+	if ds, err := DBGetDeadLetters("", 0, 10); err != nil || len(ds) != 1 || ds[0].Id != 2 {
+		t.Errorf("DBGetDeadLetters = %+v, %v", ds, err)
+	}
+	if ds, _ := DBGetDeadLetters("c2", 1, 10); len(ds) != 0 {
+		t.Errorf("DBGetDeadLetters with other campaign = %+v", ds)
+	}
+	if ds, _ := DBGetDeliveries("c2"); len(ds) != 1 || ds[0].Url != "http://ts.com/c2" {
+		t.Errorf("DBGetDeliveries = %+v", ds)
+	}
+
+	n, err := DBReplayDeadLetters("c2", 0, 10, 500)
+	if err != nil || n != 1 {
+		t.Fatalf("DBReplayDeadLetters = %d, %v", n, err)
+	}
+	if got := l.get(2); got.Status != StatusPending || got.Attempts != 0 || got.NextAttemptAt != 500 {
+		t.Errorf("replayed delivery = %+v", got)
+	}
+}
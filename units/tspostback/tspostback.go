@@ -0,0 +1,314 @@
+// Package tspostback 负责把conversion可靠地回传给traffic source
+//
+// 每条回传先写入TSPostbackLog，再由后台worker发送，失败后按指数退避重试，
+// 重试次数用完的记录即为dead letter，可以用spbreplay重新放回队列。
+// 记录以数据库为准，进程重启或者多台机器同时运行都不会丢失或者重复发送。
+package tspostback
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"Service/config"
+	"Service/log"
+)
+
+// Job 一条需要回传的postback
+type Job struct {
+	ClickId         string
+	UserId          int64
+	CampaignId      int64
+	TrafficSourceId int64
+	Url             string
+}
+
+// 默认配置，对应配置文件中的[TSPOSTBACK]
+const (
+	defaultWorkers         = 8
+	defaultTimeout         = 10 * time.Second
+	defaultMaxAttempts     = 10
+	defaultBackoff         = 30 * time.Second
+	defaultMaxBackoff      = time.Hour
+	defaultHostConcurrency = 4
+	defaultPollInterval    = 5 * time.Second
+
+	pollBatch = 100
+	// 目标host并发已满时，推迟多久再试
+	hostBusyDelay = time.Second
+)
+
+type options struct {
+	workers         int
+	timeout         time.Duration
+	maxAttempts     int
+	backoff         time.Duration
+	maxBackoff      time.Duration
+	hostConcurrency int
+	pollInterval    time.Duration
+}
+
+func loadOptions() (o options) {
+	o.workers = config.Int("TSPOSTBACK", "workers")
+	if o.workers <= 0 {
+		o.workers = defaultWorkers
+	}
+	o.timeout = time.Duration(config.Int("TSPOSTBACK", "timeout")) * time.Second
+	if o.timeout <= 0 {
+		o.timeout = defaultTimeout
+	}
+	o.maxAttempts = config.Int("TSPOSTBACK", "maxattempts")
+	if o.maxAttempts <= 0 {
+		o.maxAttempts = defaultMaxAttempts
+	}
+	o.backoff = time.Duration(config.Int("TSPOSTBACK", "backoff")) * time.Second
+	if o.backoff <= 0 {
+		o.backoff = defaultBackoff
+	}
+	o.maxBackoff = time.Duration(config.Int("TSPOSTBACK", "maxbackoff")) * time.Second
+	if o.maxBackoff <= 0 {
+		o.maxBackoff = defaultMaxBackoff
+	}
+	o.hostConcurrency = config.Int("TSPOSTBACK", "hostconcurrency")
+	if o.hostConcurrency <= 0 {
+		o.hostConcurrency = defaultHostConcurrency
+	}
+	o.pollInterval = time.Duration(config.Int("TSPOSTBACK", "pollinterval")) * time.Second
+	if o.pollInterval <= 0 {
+		o.pollInterval = defaultPollInterval
+	}
+	return
+}
+
+// 新加入的记录直接通知worker，不用等到下一次poll
+var ready = make(chan int64, 1024)
+
+// Enqueue 保存一条postback，由Delivering在后台发送
+// 数据库不可用时直接发送一次，保证不会比原来的行为更差
+func Enqueue(job Job) error {
+	if job.Url == "" {
+		return errors.New("empty url")
+	}
+
+	now := time.Now().Unix()
+	d := Delivery{
+		ClickId:         job.ClickId,
+		UserId:          job.UserId,
+		CampaignId:      job.CampaignId,
+		TrafficSourceId: job.TrafficSourceId,
+		Url:             job.Url,
+		CreatedAt:       now,
+		NextAttemptAt:   now,
+	}
+	id, err := dbInsertDelivery(&d)
+	if err != nil {
+		log.Errorf("[tspostback][Enqueue]Save postback for clickId:%v failed:%v, deliver directly\n", job.ClickId, err)
+		_, err = newSender(loadOptions()).send(job.Url)
+		return err
+	}
+
+	select {
+	case ready <- id:
+	default:
+		// 满了也没关系，poll的时候会拿到
+	}
+	return nil
+}
+
+// Delivering 后台发送TSPostbackLog中到期的postback，直到stop
+func Delivering(stop chan struct{}) {
+	o := loadOptions()
+	s := newSender(o)
+	log.Infof("[tspostback][Delivering]Start with options:%+v\n", o)
+
+	// stop只会收到一次信号，worker们通过done来退出
+	done := make(chan struct{})
+	w := sync.WaitGroup{}
+	for i := 0; i < o.workers; i++ {
+		w.Add(1)
+		go func() {
+			defer w.Done()
+			for {
+				select {
+				case id := <-ready:
+					s.process(id)
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	defer func() {
+		close(done)
+		w.Wait()
+		log.Infof("[tspostback][Delivering]Stopped\n")
+	}()
+
+	ticker := time.NewTicker(o.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, id := range dbGetDueDeliveries(time.Now().Unix(), pollBatch) {
+				select {
+				case ready <- id:
+				case <-stop:
+					return
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+type sender struct {
+	opts   options
+	client *http.Client
+	hosts  *hostLimiter
+}
+
+func newSender(o options) *sender {
+	return &sender{
+		opts:   o,
+		client: &http.Client{Timeout: o.timeout},
+		hosts:  newHostLimiter(o.hostConcurrency),
+	}
+}
+
+// process 发送一条记录，并把结果写回数据库
+func (s *sender) process(id int64) {
+	defer func() {
+		if x := recover(); x != nil {
+			log.Errorf("[tspostback][process]id:%v panic:%v\n", id, x)
+		}
+	}()
+
+	now := time.Now()
+	// lease要比发送超时长，否则可能被其他worker重复发送
+	lease := now.Add(2 * s.opts.timeout).Unix()
+	if !dbClaimDelivery(id, now.Unix(), lease) {
+		// 已经被其他worker拿走，或者已经不需要发送
+		return
+	}
+
+	d, err := dbGetDelivery(id)
+	if err != nil {
+		return
+	}
+
+	host := hostOf(d.Url)
+	if !s.hosts.acquire(host) {
+		dbPostpone(id, now.Add(hostBusyDelay).Unix())
+		return
+	}
+	code, err := s.send(d.Url)
+	s.hosts.release(host)
+
+	d.Attempts++
+	d.HttpStatus = code
+	d.LastAttemptAt = time.Now().Unix()
+	switch {
+	case err == nil:
+		d.Status = StatusDelivered
+		d.DeliveredAt = d.LastAttemptAt
+		d.LastError = ""
+		log.Infof("[tspostback][process]clickId:%v delivered with url(%s) after %d attempts\n", d.ClickId, d.Url, d.Attempts)
+	case !retryable(code) || d.Attempts >= s.opts.maxAttempts:
+		d.Status = StatusDead
+		d.LastError = err.Error()
+		log.Errorf("[tspostback][process]clickId:%v dead after %d attempts with url(%s):%v\n", d.ClickId, d.Attempts, d.Url, err)
+	default:
+		d.Status = StatusRetrying
+		d.LastError = err.Error()
+		d.NextAttemptAt = time.Now().Add(backoff(d.Attempts, s.opts.backoff, s.opts.maxBackoff)).Unix()
+		log.Warnf("[tspostback][process]clickId:%v attempt %d failed with url(%s):%v\n", d.ClickId, d.Attempts, d.Url, err)
+	}
+	dbUpdateDelivery(&d)
+}
+
+// send 发送一次，非2xx都算失败，返回http status code(网络错误时为0)
+func (s *sender) send(u string) (int, error) {
+	resp, err := s.client.Get(u)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// retryable 4xx说明url本身有问题，重试也没有用，超时和限流除外
+func retryable(code int) bool {
+	if code >= 400 && code < 500 {
+		return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// backoff 第attempts次失败之后需要等待的时间：base*2^(attempts-1)，不超过max，并加上最多20%的抖动
+func backoff(attempts int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/5+1))
+}
+
+func hostOf(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	return pu.Host
+}
+
+// hostLimiter 限制同时往同一个host发送的请求数，避免把traffic source打挂
+type hostLimiter struct {
+	mux   sync.Mutex
+	limit int
+	used  map[string]int
+}
+
+func newHostLimiter(limit int) *hostLimiter {
+	return &hostLimiter{limit: limit, used: make(map[string]int)}
+}
+
+// acquire 不阻塞，host已满时返回false
+func (h *hostLimiter) acquire(host string) bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.used[host] >= h.limit {
+		return false
+	}
+	h.used[host]++
+	return true
+}
+
+func (h *hostLimiter) release(host string) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.used[host] <= 1 {
+		delete(h.used, host)
+		return
+	}
+	h.used[host]--
+}
+
+// Replay 把符合条件的dead letter重新放回队列，由正在运行的Delivering发送
+func Replay(clickId string, campaignId int64, limit int) (int64, error) {
+	return DBReplayDeadLetters(clickId, campaignId, limit, time.Now().Unix())
+}
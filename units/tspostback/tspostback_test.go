@@ -0,0 +1,237 @@
+package tspostback
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	base, max := 30*time.Second, time.Hour
+	cases := []struct {
+		attempts int
+		min      time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{8, time.Hour},
+		{50, time.Hour},
+	}
+	for _, c := range cases {
+		d := backoff(c.attempts, base, max)
+		if d < c.min || d > c.min+c.min/5 {
+			t.Errorf("backoff(%d) = %v, want [%v, %v]", c.attempts, d, c.min, c.min+c.min/5)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	cases := map[int]bool{
+		0:                              true,
+		http.StatusInternalServerError: true,
+		http.StatusBadGateway:          true,
+		http.StatusTooManyRequests:     true,
+		http.StatusRequestTimeout:      true,
+		http.StatusNotFound:            false,
+		http.StatusBadRequest:          false,
+	}
+	for code, want := range cases {
+		if got := retryable(code); got != want {
+			t.Errorf("retryable(%d) = %v, want %v", code, got, want)
+		}
+	}
+}
+
+func TestHostLimiter(t *testing.T) {
+	h := newHostLimiter(2)
+	if !h.acquire("a.com") || !h.acquire("a.com") {
+		t.Fatal("acquire within limit failed")
+	}
+	if h.acquire("a.com") {
+		t.Error("acquire over limit succeeded")
+	}
+	if !h.acquire("b.com") {
+		t.Error("limit should be per host")
+	}
+	h.release("a.com")
+	if !h.acquire("a.com") {
+		t.Error("acquire after release failed")
+	}
+	h.release("a.com")
+	h.release("a.com")
+	h.release("b.com")
+	if len(h.used) != 0 {
+		t.Errorf("used = %v, want empty", h.used)
+	}
+}
+
+// fakeTS 返回codes里面的状态码，用完之后一直返回最后一个
+type fakeTS struct {
+	*httptest.Server
+	hits  int32
+	codes []int
+}
+
+func newFakeTS(codes ...int) *fakeTS {
+	ts := &fakeTS{codes: codes}
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&ts.hits, 1))
+		if n > len(ts.codes) {
+			n = len(ts.codes)
+		}
+		w.WriteHeader(ts.codes[n-1])
+	}))
+	return ts
+}
+
+func (ts *fakeTS) count() int {
+	return int(atomic.LoadInt32(&ts.hits))
+}
+
+func testSender() *sender {
+	return newSender(options{
+		timeout:         time.Second,
+		maxAttempts:     3,
+		backoff:         time.Minute,
+		maxBackoff:      time.Hour,
+		hostConcurrency: 1,
+	})
+}
+
+// enqueue 加入一条postback，顺便把ready里面的id拿掉
+func enqueue(t *testing.T, url string) int64 {
+	if err := Enqueue(Job{ClickId: "click", UserId: 1, CampaignId: 2, TrafficSourceId: 3, Url: url}); err != nil {
+		t.Fatal(err)
+	}
+	return <-ready
+}
+
+func TestProcessDelivered(t *testing.T) {
+	l, restore := withFakeDB(t)
+	defer restore()
+	ts := newFakeTS(http.StatusOK)
+	defer ts.Close()
+
+	s := testSender()
+	id := enqueue(t, ts.URL+"/postback?click=click")
+	s.process(id)
+	d := l.get(id)
+	if d.Status != StatusDelivered || d.Attempts != 1 || d.HttpStatus != http.StatusOK || d.DeliveredAt == 0 || ts.count() != 1 {
+		t.Errorf("delivered = %+v, hits %d", d, ts.count())
+	}
+
+	// 已经发送成功的不会再发送
+	s.process(id)
+	if ts.count() != 1 {
+		t.Errorf("delivered postback sent again, hits %d", ts.count())
+	}
+}
+
+func TestProcessRetryAndDeadLetter(t *testing.T) {
+	l, restore := withFakeDB(t)
+	defer restore()
+	ts := newFakeTS(http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusBadGateway, http.StatusOK)
+	defer ts.Close()
+
+	s := testSender()
+	id := enqueue(t, ts.URL)
+	s.process(id)
+	d := l.get(id)
+	if d.Status != StatusRetrying || d.Attempts != 1 || d.HttpStatus != http.StatusInternalServerError || d.LastError == "" {
+		t.Fatalf("after first failure = %+v", d)
+	}
+	if wait := d.NextAttemptAt - d.LastAttemptAt; wait < 60 || wait > 73 {
+		t.Errorf("first retry after %ds, want about 60s", wait)
+	}
+
+	// 还没有到重试的时间
+	s.process(id)
+	if ts.count() != 1 {
+		t.Errorf("postback retried before backoff, hits %d", ts.count())
+	}
+
+	l.due(id)
+	s.process(id)
+	d = l.get(id)
+	if d.Status != StatusRetrying || d.Attempts != 2 {
+		t.Fatalf("after second failure = %+v", d)
+	}
+	if wait := d.NextAttemptAt - d.LastAttemptAt; wait < 120 || wait > 145 {
+		t.Errorf("second retry after %ds, want about 120s", wait)
+	}
+
+	// 第maxAttempts次失败之后成为dead letter
+	l.due(id)
+	s.process(id)
+	d = l.get(id)
+	if d.Status != StatusDead || d.Attempts != 3 || d.HttpStatus != http.StatusBadGateway {
+		t.Fatalf("after last failure = %+v", d)
+	}
+	l.due(id)
+	s.process(id)
+	if ts.count() != 3 {
+		t.Errorf("dead letter sent again, hits %d", ts.count())
+	}
+	if ds, err := DBGetDeadLetters("click", 2, 10); err != nil || len(ds) != 1 || ds[0].Id != id {
+		t.Errorf("DBGetDeadLetters = %+v, %v", ds, err)
+	}
+
+	// 放回队列之后重新计算次数，这次发送成功
+	if n, err := Replay("click", 2, 10); err != nil || n != 1 {
+		t.Fatalf("Replay = %d, %v", n, err)
+	}
+	if ids := dbGetDueDeliveries(time.Now().Unix(), pollBatch); len(ids) != 1 || ids[0] != id {
+		t.Fatalf("due after replay = %v", ids)
+	}
+	s.process(id)
+	d = l.get(id)
+	if d.Status != StatusDelivered || d.Attempts != 1 || ts.count() != 4 {
+		t.Errorf("after replay = %+v, hits %d", d, ts.count())
+	}
+	if ds, _ := DBGetDeadLetters("", 0, 10); len(ds) != 0 {
+		t.Errorf("dead letters after replay = %+v", ds)
+	}
+}
+
+func TestProcessNotRetryable(t *testing.T) {
+	l, restore := withFakeDB(t)
+	defer restore()
+	ts := newFakeTS(http.StatusNotFound)
+	defer ts.Close()
+
+	id := enqueue(t, ts.URL)
+	testSender().process(id)
+	if d := l.get(id); d.Status != StatusDead || d.Attempts != 1 || d.HttpStatus != http.StatusNotFound {
+		t.Errorf("4xx = %+v", d)
+	}
+}
+
+func TestProcessHostBusy(t *testing.T) {
+	l, restore := withFakeDB(t)
+	defer restore()
+	ts := newFakeTS(http.StatusOK)
+	defer ts.Close()
+
+	s := testSender()
+	id := enqueue(t, ts.URL)
+	host := hostOf(ts.URL)
+	s.hosts.acquire(host)
+	s.process(id)
+	d := l.get(id)
+	if d.Status != StatusPending || d.Attempts != 0 || ts.count() != 0 {
+		t.Errorf("busy host = %+v, hits %d", d, ts.count())
+	}
+	if d.NextAttemptAt < time.Now().Unix() {
+		t.Errorf("busy host not postponed: %+v", d)
+	}
+
+	s.hosts.release(host)
+	l.due(id)
+	s.process(id)
+	if d := l.get(id); d.Status != StatusDelivered || ts.count() != 1 {
+		t.Errorf("after host released = %+v, hits %d", d, ts.count())
+	}
+}
@@ -22,7 +22,7 @@ func DBGetAllUsers() []UserConfig {
 //no cache
 func dbGetAvailableUsers() []UserConfig {
 	d := dbgetter()
-	sql := "SELECT id, idText, rootDomainRedirect, status FROM User WHERE deleted=0"
+	sql := "SELECT id, idText, rootDomainRedirect, status, apiToken FROM User WHERE deleted=0"
 	rows, err := d.Query(sql)
 
 	if err != nil {
@@ -38,7 +38,7 @@ func dbGetAvailableUsers() []UserConfig {
 	var arr []UserConfig
 	for rows.Next() {
 		var c UserConfig
-		if err := rows.Scan(&c.Id, &c.IdText, &c.RootDomainRedirect, &c.Status); err != nil {
+		if err := rows.Scan(&c.Id, &c.IdText, &c.RootDomainRedirect, &c.Status, &c.ApiToken); err != nil {
 			log.Errorf("[user][DBGetAvailableUsers] scan failed:%v and continue", err)
 			//rows.Close()
 			//return nil
@@ -61,10 +61,10 @@ func dbGetAvailableUsers() []UserConfig {
 //no cache
 func dbGetUserInfo(userId int64) (c UserConfig) {
 	d := dbgetter()
-	sql := "SELECT id, idText, rootDomainRedirect, status FROM User WHERE id=?"
+	sql := "SELECT id, idText, rootDomainRedirect, status, apiToken FROM User WHERE id=?"
 	row := d.QueryRow(sql, userId)
 
-	if err := row.Scan(&c.Id, &c.IdText, &c.RootDomainRedirect, &c.Status); err != nil {
+	if err := row.Scan(&c.Id, &c.IdText, &c.RootDomainRedirect, &c.Status, &c.ApiToken); err != nil {
 		log.Errorf("[user][DBGetUserInfo] scan failed:%v", err)
 		return
 	}
@@ -11,6 +11,7 @@ import (
 
 	"Service/units/blacklist"
 	"Service/units/campaign"
+	"Service/units/ffrule"
 	"Service/units/flow"
 	"Service/units/lander"
 	"Service/units/offer"
@@ -90,12 +91,14 @@ type CollectorCampChangedUsers struct {
 	ChanStop				chan bool
 	ChanUser				chan string
 	ChanBlacklist		chan string
+	ChanSanction		chan string
 }
 
 func NewCollectorCampChangeUsers() *CollectorCampChangedUsers {
 	return &CollectorCampChangedUsers {
 		ChanUser: make(chan string, buffsize),
 		ChanBlacklist: make(chan string, buffsize),
+		ChanSanction: make(chan string, buffsize),
 
 		ChanStop: make(chan bool),
 	}
@@ -108,6 +111,7 @@ func (c *CollectorCampChangedUsers) Close() {
 	c.pubsub.Close()
 	close(c.ChanUser)
 	close(c.ChanBlacklist)
+	close(c.ChanSanction)
 }
 
 //Update handle user's update information
@@ -130,6 +134,10 @@ func (c *CollectorCampChangedUsers) Update() {
 			select {
 				case msg := <- c.ChanBlacklist:
 					blacklist.ReloadUserBlacklist(msg)
+				case msg := <- c.ChanSanction:
+					if err := ffrule.ReloadSanction(msg); err != nil {
+						log.Errorf("user.reloader.CollectorCampChangedUsers.Update ReloadSanction failed with err(%s)\n", err.Error())
+					}
 				case msg := <- c.ChanUser:
 					log.Debugf("user.reloader.CollectorCampChangedUsers.Update user channel receive: %s\n", msg)
 					if err := ReloadUserInfo(msg); err != nil {
@@ -149,7 +157,7 @@ func (c *CollectorCampChangedUsers) Start() {
 	log.Infof("user CollectorCampChangedUsers: running with MSGQUEUE redis:%v...", cli)
 
 	var err error
-	c.pubsub = cli.Subscribe(subscribe, botblacklist)
+	c.pubsub = cli.Subscribe(subscribe, botblacklist, ffrule.SanctionChannel)
 	if err != nil {
 		log.Errorf("collector: PSubscribe %v failed:%v", subscribe, err)
 		return
@@ -173,6 +181,8 @@ func (c *CollectorCampChangedUsers) Start() {
 			if received.Channel == botblacklist {
 				//c.BlacklistUsers = append(c.BlacklistUsers, received.Payload)
 				c.ChanBlacklist <- received.Payload
+			} else if received.Channel == ffrule.SanctionChannel {
+				c.ChanSanction <- received.Payload
 			} else {
 				log.Debug("user.reloader.CollectorCampChangedUsers.start receive user payload=%v and send into channel\n", received.Payload)
 				c.ChanUser <- received.Payload
@@ -219,7 +229,7 @@ func (r Reloader) Running() {
 	log.Infof("user reloader: running with MSGQUEUE redis:%v...", redis)
 
 	// redis.S
-	pubsub := redis.Subscribe(subscribe, botblacklist)
+	pubsub := redis.Subscribe(subscribe, botblacklist, ffrule.SanctionChannel)
 	if pubsub == nil {
 		log.Errorf("user reloader: PSubscribe  failed\n")
 		return
@@ -242,6 +252,10 @@ func (r Reloader) Running() {
 		// 直接加载这个用户相关信息即可
 		if received.Channel == botblacklist {
 			blacklist.ReloadUserBlacklist(received.Payload)
+		} else if received.Channel == ffrule.SanctionChannel {
+			if err := ffrule.ReloadSanction(received.Payload); err != nil {
+				log.Errorf("[Reloader][Running]ReloadSanction failed with err(%s)\n", err.Error())
+			}
 		} else {
 			log.Debugf("user.reloader.CollectorCampChangedUsers.Update user_campaign_change info : %s", received.Payload)
 			if err := ReloadUserInfo(received.Payload); err != nil {
@@ -1,6 +1,7 @@
 package user
 
 import (
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"net/http"
@@ -36,6 +37,7 @@ type UserConfig struct {
 	IdText             string
 	Status             int64
 	RootDomainRedirect string
+	ApiToken           string // 调用cost上传等接口时使用，为空则不允许调用
 	Domains            []UserDomain
 }
 
@@ -166,32 +168,24 @@ func (u *User) OnLPOfferRequest(w http.ResponseWriter, req request.Request) erro
 
 	// 统计Cost信息
 	// CPC: Campaign的次数*每次的成本
-	// CPA: postback的次数*每次的成本
-	// CPM: Impression的次数*每次
+	// CPM: 在Impression里面处理
+	// CPA/RevShare: 在PostBack里面处理
 	// Auto: Campaign里面的Cost参数
-	// '0:Do-not-track-costs;1:cpc;2:cpa;3:cpm;4:auto?'
-	//TODO 有bug，需要针对不同广告类型区分对待
-	switch ca.CostModel {
-	case 0:
-	// Do nothing
-	case 1:
-		cost := ca.CPCValue
-		TrackingCost(req, cost)
-	case 2:
-	// 在PostBack里面处理
-	case 3:
-	// 在Impression里面已经处理
-	case 4:
-		cost := req.Cost()
+	if cost, ok := ca.VisitCost(req); ok {
 		TrackingCost(req, cost)
 	}
 
 	return nil
 }
 
-// TrackingCost 添加Cost统计信息
+// TrackingCost 添加Cost统计信息，同时记在request上面，TS事后更新cost时用来算差值
 func TrackingCost(req request.Request, cost float64) {
 	timestamp := tracking.Timestamp()
+	trackingCostAt(req, cost, timestamp)
+	req.AddTrackedCost(cost, timestamp)
+}
+
+func trackingCostAt(req request.Request, cost float64, timestamp int64) {
 	tracking.AddCost(req.AdStatisKey(timestamp), cost)
 	tracking.IP.AddCost(req.IPKey(timestamp), cost)
 	tracking.Domain.AddCost(req.DomainKey(timestamp), cost)
@@ -205,6 +199,9 @@ func TrackingRevenue(req request.Request, Revenue float64) {
 	tracking.IP.AddRevenue(req.IPKey(timestamp), Revenue)
 	tracking.Domain.AddRevenue(req.DomainKey(timestamp), Revenue)
 	tracking.Ref.AddRevenue(req.ReferrerKey(timestamp), Revenue)
+	if req.LanderId() > 0 && req.ClickTimeStamp() > 0 {
+		tracking.Slot.AddRevenue(req.SlotKey(timestamp), Revenue)
+	}
 }
 
 // TrackingConversion 添加Revenue统计信息
@@ -214,6 +211,9 @@ func TrackingConversion(req request.Request, count int) {
 	tracking.IP.AddConversion(req.IPKey(timestamp), count)
 	tracking.Domain.AddConversion(req.DomainKey(timestamp), count)
 	tracking.Ref.AddConversion(req.ReferrerKey(timestamp), count)
+	if req.LanderId() > 0 && req.ClickTimeStamp() > 0 {
+		tracking.Slot.AddConversion(req.SlotKey(timestamp), count)
+	}
 }
 
 func (u *User) OnLandingPageClick(w http.ResponseWriter, req request.Request) error {
@@ -252,19 +252,46 @@ func (u *User) OnS2SPostback(w http.ResponseWriter, req request.Request) error {
 		return err
 	}
 
-	if ca.CostModel == 2 {
-		cost := ca.CPAValue
+	if cost, ok := ca.ConversionCost(req); ok {
 		TrackingCost(req, cost)
 	}
 
 	return nil
 }
 
-func (u *User) OnConversionPixel(w http.ResponseWriter, req request.Request) error {
-	return nil
-}
 
-func (u *User) OnConversionScript(w http.ResponseWriter, req request.Request) error {
+
+// UpdateCost TS事后通知click的实际cost，只对Auto的campaign有效
+// 把和已经记过的cost的差值记到第一次记cost的统计时间点上
+func (u *User) UpdateCost(req request.Request, cost float64) error {
+	if !u.Active() {
+		return errors.New("User not active")
+	}
+	campaignId := req.CampaignId()
+	ca := campaign.GetCampaign(campaignId)
+	if ca == nil {
+		return fmt.Errorf("Invalid campaign id(%d) for %s", campaignId, req.Id())
+	}
+	if ca.UserId != u.Id {
+		return fmt.Errorf("Campaign with id(%d) does not belong to user %d for %s", campaignId, u.Id, req.Id())
+	}
+	if ca.CostModel != campaign.CostModelAuto {
+		return fmt.Errorf("Campaign(%d) cost model(%d) does not accept cost update for %s", campaignId, ca.CostModel, req.Id())
+	}
+	if cost < 0 {
+		return fmt.Errorf("Invalid cost(%f) for %s", cost, req.Id())
+	}
+
+	tracked, timestamp := req.TrackedCost()
+	delta := cost - tracked
+	if delta == 0 {
+		return nil
+	}
+	if timestamp == 0 {
+		timestamp = tracking.Timestamp()
+	}
+	trackingCostAt(req, delta, timestamp)
+	req.AddTrackedCost(delta, timestamp)
 	return nil
 }
 
@@ -452,6 +479,14 @@ func newUser(c UserConfig) (u *User) {
 	return
 }
 
+// Authorized 检查接口调用时带的token
+func (u *User) Authorized(token string) bool {
+	if u.ApiToken == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(u.ApiToken), []byte(token)) == 1
+}
+
 func (u *User) Active() bool {
 	// 0:New;1:运行中;2:已过期;3:Events已消耗完（包括透支）
 	switch u.Status {
@@ -0,0 +1,113 @@
+// Package ahocorasick 多模式的子串匹配，一次扫描找出文本中出现的所有模式串
+// 用于代替对每个模式逐个strings.Contains
+package ahocorasick
+
+type node struct {
+	next map[byte]int32
+	fail int32
+	out  []int32 // 以这个节点结尾的模式串
+	dict int32   // fail链上最近的有out的节点，没有为-1
+}
+
+// Matcher 构建之后只读，可以并发使用
+type Matcher struct {
+	nodes []node
+	empty []int32 // 空的模式串，任何文本都包含
+}
+
+// New 构建patterns的自动机，Match回调里的序号为patterns的下标
+func New(patterns []string) *Matcher {
+	m := &Matcher{nodes: []node{{dict: -1}}}
+	for i, p := range patterns {
+		if p == "" {
+			m.empty = append(m.empty, int32(i))
+			continue
+		}
+		cur := int32(0)
+		for j := 0; j < len(p); j++ {
+			n, ok := m.nodes[cur].next[p[j]]
+			if !ok {
+				n = int32(len(m.nodes))
+				m.nodes = append(m.nodes, node{dict: -1})
+				if m.nodes[cur].next == nil {
+					m.nodes[cur].next = make(map[byte]int32)
+				}
+				m.nodes[cur].next[p[j]] = n
+			}
+			cur = n
+		}
+		m.nodes[cur].out = append(m.nodes[cur].out, int32(i))
+	}
+	m.build()
+	return m
+}
+
+// build 按BFS顺序计算fail和dict
+func (m *Matcher) build() {
+	queue := make([]int32, 0, len(m.nodes))
+	for _, n := range m.nodes[0].next {
+		queue = append(queue, n)
+	}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for c, n := range m.nodes[cur].next {
+			f := m.nodes[cur].fail
+			for {
+				if t, ok := m.nodes[f].next[c]; ok {
+					m.nodes[n].fail = t
+					break
+				}
+				if f == 0 {
+					break
+				}
+				f = m.nodes[f].fail
+			}
+			if t := m.nodes[n].fail; len(m.nodes[t].out) > 0 {
+				m.nodes[n].dict = t
+			} else {
+				m.nodes[n].dict = m.nodes[t].dict
+			}
+			queue = append(queue, n)
+		}
+	}
+}
+
+// Match 对s中出现的每个模式串调用fn(同一个模式可能调用多次)，fn返回false时停止
+func (m *Matcher) Match(s string, fn func(pattern int) bool) {
+	for _, p := range m.empty {
+		if !fn(int(p)) {
+			return
+		}
+	}
+	cur := int32(0)
+	for i := 0; i < len(s); i++ {
+		for {
+			if n, ok := m.nodes[cur].next[s[i]]; ok {
+				cur = n
+				break
+			}
+			if cur == 0 {
+				break
+			}
+			cur = m.nodes[cur].fail
+		}
+		for n := cur; n > 0; n = m.nodes[n].dict {
+			for _, p := range m.nodes[n].out {
+				if !fn(int(p)) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Contains s是否包含任何一个模式串
+func (m *Matcher) Contains(s string) bool {
+	found := false
+	m.Match(s, func(int) bool {
+		found = true
+		return false
+	})
+	return found
+}
@@ -0,0 +1,104 @@
+package ahocorasick
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func matches(m *Matcher, s string) []int {
+	found := make(map[int]bool)
+	m.Match(s, func(p int) bool {
+		found[p] = true
+		return true
+	})
+	var ps []int
+	for p := range found {
+		ps = append(ps, p)
+	}
+	sort.Ints(ps)
+	return ps
+}
+
+func TestMatch(t *testing.T) {
+	patterns := []string{"he", "she", "his", "hers", "bot", "robot", ""}
+	m := New(patterns)
+	cases := map[string][]int{
+		"ushers":        {0, 1, 3, 6},
+		"Googlebot/2.1": {4, 6},
+		"a robot":       {4, 5, 6},
+		"":              {6},
+		"xyz":           {6},
+	}
+	for s, want := range cases {
+		got := matches(m, s)
+		if len(got) != len(want) {
+			t.Errorf("%s:got %v, expected %v", s, got, want)
+			continue
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("%s:got %v, expected %v", s, got, want)
+				break
+			}
+		}
+	}
+
+	if New([]string{"curl"}).Contains("Mozilla/5.0") {
+		t.Errorf("should not contain")
+	}
+	if New(nil).Contains("anything") {
+		t.Errorf("no pattern should not contain")
+	}
+}
+
+// TestMatchRandom 和逐个strings.Contains的结果比较
+func TestMatchRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	word := func(n int) string {
+		b := make([]byte, 1+r.Intn(n))
+		for i := range b {
+			b[i] = "abc"[r.Intn(3)]
+		}
+		return string(b)
+	}
+	for round := 0; round < 100; round++ {
+		patterns := make([]string, 1+r.Intn(20))
+		for i := range patterns {
+			patterns[i] = word(5)
+		}
+		m := New(patterns)
+		for k := 0; k < 50; k++ {
+			s := word(30)
+			got := matches(m, s)
+			var want []int
+			for i, p := range patterns {
+				if strings.Contains(s, p) {
+					want = append(want, i)
+				}
+			}
+			if len(got) != len(want) {
+				t.Fatalf("%q in %q:got %v, expected %v", patterns, s, got, want)
+			}
+			for i := range got {
+				if got[i] != want[i] {
+					t.Fatalf("%q in %q:got %v, expected %v", patterns, s, got, want)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkMatch(b *testing.B) {
+	patterns := make([]string, 1000)
+	for i := range patterns {
+		patterns[i] = strings.Repeat(string(rune('a'+i%26)), 1+i%7) + "bot"
+	}
+	m := New(patterns)
+	ua := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/58.0.3029.110 Safari/537.36"
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Contains(ua)
+	}
+}
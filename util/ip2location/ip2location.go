@@ -376,6 +376,11 @@ func Open(dbpath string) {
 	metaok = true
 }
 
+// check whether the database has been opened successfully
+func Opened() bool {
+	return metaok
+}
+
 // close database file handle
 func Close() {
 	//f.Close()
@@ -0,0 +1,152 @@
+package ipcmp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IP128 128位的IP地址，IPv4按照IPv4-mapped(::ffff:a.b.c.d)保存
+// 所以IPv4和IPv6可以放在同一个集合/范围里面比较，而且不会互相匹配
+type IP128 struct {
+	Hi, Lo uint64
+}
+
+// v4MappedLo IPv4-mapped地址低64位的前缀，高64位都是0
+const v4MappedLo = uint64(0xffff) << 32
+
+// FromIPInt 把IPv4的IP_INT转成IP128
+func FromIPInt(n IP_INT) IP128 {
+	return IP128{Lo: v4MappedLo | uint64(uint32(n))}
+}
+
+// FromNetIP 把net.IP转成IP128，ip为nil时返回false
+func FromNetIP(ip net.IP) (IP128, bool) {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return IP128{}, false
+	}
+	var a IP128
+	for i := 0; i < 8; i++ {
+		a.Hi = a.Hi<<8 | uint64(ip16[i])
+		a.Lo = a.Lo<<8 | uint64(ip16[i+8])
+	}
+	return a, true
+}
+
+// IsV4 是否是IPv4(IPv4-mapped)地址
+func (a IP128) IsV4() bool {
+	return a.Hi == 0 && a.Lo>>32 == 0xffff
+}
+
+// Compare a<b返回-1，a==b返回0，a>b返回1
+func (a IP128) Compare(b IP128) int {
+	switch {
+	case a.Hi < b.Hi || a.Hi == b.Hi && a.Lo < b.Lo:
+		return -1
+	case a == b:
+		return 0
+	}
+	return 1
+}
+
+// Next 下一个地址，a已经是最大的地址时ok为false
+func (a IP128) Next() (next IP128, ok bool) {
+	if a.Lo != ^uint64(0) {
+		return IP128{Hi: a.Hi, Lo: a.Lo + 1}, true
+	}
+	if a.Hi != ^uint64(0) {
+		return IP128{Hi: a.Hi + 1}, true
+	}
+	return a, false
+}
+
+// NetIP 转回net.IP
+func (a IP128) NetIP() net.IP {
+	ip := make(net.IP, net.IPv6len)
+	for i := 0; i < 8; i++ {
+		ip[i] = byte(a.Hi >> uint(56-8*i))
+		ip[i+8] = byte(a.Lo >> uint(56-8*i))
+	}
+	return ip
+}
+
+// String IPv4为1.2.3.4，IPv6为RFC 5952的格式
+func (a IP128) String() string {
+	return a.NetIP().String()
+}
+
+// mask 保留前bits位，其它清零；last为true时其它位置1
+func (a IP128) mask(bits uint, last bool) IP128 {
+	var hi, lo uint64 // 需要保留的位
+	switch {
+	case bits >= 128:
+		return a
+	case bits > 64:
+		hi, lo = ^uint64(0), ^uint64(0)<<(128-bits)
+	case bits == 64:
+		hi = ^uint64(0)
+	case bits > 0:
+		hi = ^uint64(0) << (64 - bits)
+	}
+	if last {
+		return IP128{Hi: a.Hi | ^hi, Lo: a.Lo | ^lo}
+	}
+	return IP128{Hi: a.Hi & hi, Lo: a.Lo & lo}
+}
+
+// ParseIP128 解析IPv4或者IPv6地址
+// 支持1.2.3.4:63323、[2001:db8::1]:63323这种带端口的格式
+func ParseIP128(s string) (IP128, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") {
+		// [IPv6]:port
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return IP128{}, ErrNotIPFormat
+		}
+		s = s[1:end]
+	}
+	if strings.Count(s, ":") <= 1 {
+		// IPv4，保持IPToInt64原来的宽松格式
+		n, err := IPToInt64(s)
+		if err != nil {
+			return IP128{}, err
+		}
+		return FromIPInt(n), nil
+	}
+	if i := strings.Index(s, "%"); i >= 0 {
+		s = s[:i] // fe80::1%eth0
+	}
+	a, ok := FromNetIP(net.ParseIP(s))
+	if !ok {
+		return IP128{}, ErrNotIPFormat
+	}
+	return a, nil
+}
+
+// Canonical 返回IP统一的写法，如2001:0db8::0001返回2001:db8::1，不是IP的返回空
+func Canonical(s string) string {
+	a, err := ParseIP128(s)
+	if err != nil {
+		return ""
+	}
+	return a.String()
+}
+
+// parseCIDR 1.2.3.0/24或者2001:db8::/32，返回范围的第一个和最后一个地址
+func parseCIDR(s string) (first, last IP128, err error) {
+	_, n, err := net.ParseCIDR(strings.TrimSpace(s))
+	if err != nil {
+		return first, last, fmt.Errorf("%v:%v", ErrNotIPFormat, err)
+	}
+	ones, bits := n.Mask.Size()
+	if bits == 8*net.IPv4len {
+		ones += 96 // IPv4-mapped
+	}
+	a, ok := FromNetIP(n.IP)
+	if !ok {
+		return first, last, ErrNotIPFormat
+	}
+	return a.mask(uint(ones), false), a.mask(uint(ones), true), nil
+}
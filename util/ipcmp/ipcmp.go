@@ -7,32 +7,56 @@ import (
 	"strings"
 )
 
+// IP_INT IPv4的整数形式，IPv6用IP128
 type IP_INT int64
 
-// IPCompare 用于ip的解析和对比
+// IPCompare 用于ip的解析和对比，IPv4和IPv6都支持
 type IPCompare struct {
-	ip1 IP_INT
-	ip2 IP_INT
+	ip1 IP128
+	ip2 IP128
 }
 
 // In 判断ip是不是在这个范围内
 func (cmp IPCompare) In(ip string) (bool, error) {
-	n, err := IPToInt64(ip)
+	n, err := ParseIP128(ip)
 	if err != nil {
 		return false, err
 	}
 
-	return n >= cmp.ip1 && n <= cmp.ip2, nil
+	return cmp.IP128In(n), nil
 }
 
 // IpIntIn 先转换成IP_INT再进行比较可以提高速度
 func (cmp IPCompare) IpIntIn(n IP_INT) bool {
-	return n >= cmp.ip1 && n <= cmp.ip2
+	return cmp.IP128In(FromIPInt(n))
 }
 
-// NewIPCompare 从123.45.6.7构建出一个IPCompare
+// IP128In 先转换成IP128再进行比较可以提高速度
+func (cmp IPCompare) IP128In(n IP128) bool {
+	return n.Compare(cmp.ip1) >= 0 && n.Compare(cmp.ip2) <= 0
+}
+
+// First 范围内的第一个地址
+func (cmp IPCompare) First() IP128 {
+	return cmp.ip1
+}
+
+// Last 范围内的最后一个地址
+func (cmp IPCompare) Last() IP128 {
+	return cmp.ip2
+}
+
+// NewIPCompare 从123.45.6.7、2001:db8::1或者CIDR(123.45.6.0/24、2001:db8::/32)构建出一个IPCompare
 func NewIPCompare(ip string) (IPCompare, error) {
-	n, err := IPToInt64(ip)
+	if strings.Contains(ip, "/") {
+		n1, n2, err := parseCIDR(ip)
+		if err != nil {
+			return IPCompare{}, err
+		}
+		return IPCompare{ip1: n1, ip2: n2}, nil
+	}
+
+	n, err := ParseIP128(ip)
 	if err != nil {
 		return IPCompare{}, err
 	}
@@ -43,19 +67,24 @@ func NewIPCompare(ip string) (IPCompare, error) {
 	}, nil
 }
 
-// NewIPCompareRange 123.45.6.7 - 123.45.6.10 构建出一个IPCompare
+// NewIPCompareRange 123.45.6.7 - 123.45.6.10 或者 2001:db8::1 - 2001:db8::ff 构建出一个IPCompare
+// 两端必须同是IPv4或者同是IPv6
 func NewIPCompareRange(ip1, ip2 string) (IPCompare, error) {
-	n1, err := IPToInt64(ip1)
+	n1, err := ParseIP128(ip1)
 	if err != nil {
 		return IPCompare{}, err
 	}
 
-	n2, err := IPToInt64(ip2)
+	n2, err := ParseIP128(ip2)
 	if err != nil {
 		return IPCompare{}, err
 	}
 
-	if n1 > n2 {
+	if n1.IsV4() != n2.IsV4() {
+		return IPCompare{}, fmt.Errorf("%v:%s-%s mixes IPv4 and IPv6", ErrNotIPFormat, ip1, ip2)
+	}
+
+	if n1.Compare(n2) > 0 {
 		n1, n2 = n2, n1
 	}
 
@@ -70,6 +99,7 @@ var ErrNotIPFormat = errors.New("Not IP Format")
 
 // IPToInt64 从192.168.0.1解析出一个整数
 // 支持从 192.168.0.1:63323解析出IP部分
+// 只支持IPv4，需要IPv6的用ParseIP128
 func IPToInt64(s string) (IP_INT, error) {
 	s = strings.TrimSpace(s)
 	nums := strings.Split(s, ".")
@@ -105,3 +105,111 @@ func TestMinMaxIP(t *testing.T) {
 	t.Log("minIP:", min)
 	t.Log("maxIP:", max)
 }
+
+func TestParseIP128(t *testing.T) {
+	cases := []struct {
+		s    string
+		want string
+		v4   bool
+	}{
+		{" 1.2.3.4:2322 ", "1.2.3.4", true},
+		{"2001:0db8:0000:0000:0000:0000:0000:0001", "2001:db8::1", false},
+		{"[2001:db8::1]:63323", "2001:db8::1", false},
+		{"::ffff:1.2.3.4", "1.2.3.4", true},
+		{"fe80::1%eth0", "fe80::1", false},
+	}
+	for _, c := range cases {
+		a, err := ParseIP128(c.s)
+		if err != nil {
+			t.Errorf("ParseIP128(%s) failed:%v", c.s, err)
+			continue
+		}
+		if a.String() != c.want || a.IsV4() != c.v4 {
+			t.Errorf("ParseIP128(%s) got %s v4:%v, expected %s v4:%v", c.s, a, a.IsV4(), c.want, c.v4)
+		}
+	}
+
+	for _, s := range []string{"", "1.2.3", "2001:db8::g", "[2001:db8::1", "1.2.3.256"} {
+		if _, err := ParseIP128(s); err == nil {
+			t.Errorf("ParseIP128(%s) should fail", s)
+		}
+	}
+
+	n, _ := IPToInt64("1.2.3.4")
+	a, _ := ParseIP128("1.2.3.4")
+	if FromIPInt(n) != a {
+		t.Errorf("FromIPInt(%v) got %v, expected %v", n, FromIPInt(n), a)
+	}
+}
+
+func TestCompareIPv6(t *testing.T) {
+	ranges := map[string]IPCompare{}
+	for _, s := range []string{"2001:db8::/32", "10.0.0.0/8", "2001:db9::1", "::/0"} {
+		r, err := NewIPCompare(s)
+		if err != nil {
+			t.Fatalf("NewIPCompare(%s) failed:%v", s, err)
+		}
+		ranges[s] = r
+	}
+	r, err := NewIPCompareRange("2001:db8::ff", "2001:db8::1")
+	if err != nil {
+		t.Fatalf("NewIPCompareRange failed:%v", err)
+	}
+	ranges["range"] = r
+
+	cases := []struct {
+		r, ip string
+		in    bool
+	}{
+		{"2001:db8::/32", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", true},
+		{"2001:db8::/32", "2001:db9::", false},
+		{"2001:db8::/32", "32.1.13.184", false}, // 和2001:db8::的前4个字节相同的IPv4
+		{"10.0.0.0/8", "10.255.255.255", true},
+		{"10.0.0.0/8", "11.0.0.0", false},
+		{"10.0.0.0/8", "a00::", false},
+		{"2001:db9::1", "[2001:db9:0::1]:80", true},
+		{"2001:db9::1", "2001:db9::2", false},
+		{"::/0", "2001:db8::1", true},
+		{"range", "2001:db8::80", true},
+		{"range", "2001:db8::100", false},
+	}
+	for _, c := range cases {
+		in, err := ranges[c.r].In(c.ip)
+		if err != nil {
+			t.Errorf("%s In(%s) failed:%v", c.r, c.ip, err)
+			continue
+		}
+		if in != c.in {
+			t.Errorf("%s In(%s) got %v, expected %v", c.r, c.ip, in, c.in)
+		}
+	}
+
+	if _, err := NewIPCompareRange("1.2.3.4", "2001:db8::1"); err == nil {
+		t.Errorf("range mixing IPv4 and IPv6 should fail")
+	}
+	if _, err := NewIPCompare("2001:db8::/129"); err == nil {
+		t.Errorf("invalid CIDR should fail")
+	}
+}
+
+func TestIPSetMixed(t *testing.T) {
+	s := NewIPSet()
+	n, _ := IPToInt64("1.2.3.4")
+	s.AddIP(n, "v4")
+	a, _ := ParseIP128("2001:db8::4")
+	s.AddIP128(a, "v6")
+
+	for addr, desc := range map[string]string{"1.2.3.4:80": "v4", "::ffff:1.2.3.4": "v4", "2001:DB8:0::4": "v6", "[2001:db8::4]:443": "v6"} {
+		if d, in := s.AddrIn(addr); !in || d != desc {
+			t.Errorf("AddrIn(%s) got %s %v, expected %s", addr, d, in, desc)
+		}
+	}
+	for _, addr := range []string{"::4", "1.2.3.5", "2001:db8::5", "bad"} {
+		if _, in := s.AddrIn(addr); in {
+			t.Errorf("AddrIn(%s) should not in", addr)
+		}
+	}
+	if _, in := s.IPIn(n); !in || s.Count() != 2 {
+		t.Errorf("IPIn(%v) should in, count:%d", n, s.Count())
+	}
+}
@@ -1,36 +1,46 @@
 package ipcmp
 
-// IPSet 保存所有的IP
+// IPSet 保存所有的IP，IPv4和IPv6都可以
 type IPSet struct {
-	m map[IP_INT]string
+	m map[IP128]string
 }
 
-// AddIP 添加一个IP和它对应的说明
+// AddIP 添加一个IPv4和它对应的说明
 func (s *IPSet) AddIP(ip IP_INT, desc string) {
+	s.m[FromIPInt(ip)] = desc
+}
+
+// AddIP128 添加一个IP和它对应的说明
+func (s *IPSet) AddIP128(ip IP128, desc string) {
 	s.m[ip] = desc
 }
 
-// IPIn 判断一个IP是否在集合中
+// IPIn 判断一个IPv4是否在集合中
 // 如果在，返回其desc和true
 // 如果不在，返回""和false
 func (s *IPSet) IPIn(ip IP_INT) (string, bool) {
+	return s.IP128In(FromIPInt(ip))
+}
+
+// IP128In 判断一个IP是否在集合中
+func (s *IPSet) IP128In(ip IP128) (string, bool) {
 	desc, ok := s.m[ip]
 	return desc, ok
 }
 
-// AddrIn 返回192.168.0.155:23234是否在IP列表中
+// AddrIn 返回192.168.0.155:23234或者[2001:db8::1]:23234是否在IP列表中
 func (s *IPSet) AddrIn(addr string) (string, bool) {
-	ip, err := IPToInt64(addr)
+	ip, err := ParseIP128(addr)
 	if err != nil {
 		return "", false
 	}
 
-	return s.IPIn(ip)
+	return s.IP128In(ip)
 }
 
 // NewIPSet make一个新的IPSet
 func NewIPSet() IPSet {
-	return IPSet{make(map[IP_INT]string)}
+	return IPSet{make(map[IP128]string)}
 }
 
 // Count 返回有多少个IP
@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	httpRequests = NewCounterVec("http_requests_total",
+		"Number of HTTP requests by handler and status code.", "handler", "code")
+	httpDuration = NewHistogramVec("http_request_duration_seconds",
+		"HTTP request latency by handler.", nil, "handler")
+)
+
+// statusWriter 记下handler写的状态码，没有调用WriteHeader时是200
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Instrument 统计handler的请求数(按状态码)和耗时，name是指标里面的handler名字
+func Instrument(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			code := sw.code
+			if code == 0 {
+				code = http.StatusOK
+			}
+			httpDuration.Observe(time.Since(start).Seconds(), name)
+			httpRequests.Inc(name, strconv.Itoa(code))
+		}()
+		h(sw, r)
+	}
+}
+
+// AllowOnly 只允许allow里面的IP或者网段(逗号分隔)访问h，allow为空时不限制
+// 用的是连接的地址，不看X-Forwarded-For，避免被伪造
+func AllowOnly(h http.Handler, allow string) (http.Handler, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(allow, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("[metrics][AllowOnly] invalid address %s:%v", s, err)
+		}
+		nets = append(nets, n)
+	}
+	if len(nets) == 0 {
+		return h, nil
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			for _, n := range nets {
+				if n.Contains(ip) {
+					h.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}), nil
+}
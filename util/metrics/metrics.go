@@ -0,0 +1,372 @@
+// Package metrics 以Prometheus的文本格式导出运行时指标
+// 只实现了用到的部分：带label的Counter、Histogram和取值函数的Gauge/Counter
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets 默认的耗时分布(秒)
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+var (
+	mu      sync.Mutex
+	metrics []metric
+	names   = make(map[string]bool)
+)
+
+// register 同一个名字只能注册一次，重复注册是代码错误，直接panic
+func register(m metric) {
+	mu.Lock()
+	defer mu.Unlock()
+	if names[m.name()] {
+		panic(fmt.Sprintf("[metrics] duplicate metric %s", m.name()))
+	}
+	names[m.name()] = true
+	metrics = append(metrics, m)
+}
+
+func registered() []metric {
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]metric(nil), metrics...)
+}
+
+// WriteTo 把所有注册的指标按注册顺序写到w
+func WriteTo(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, m := range registered() {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler /metrics的处理函数
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteTo(w)
+	})
+}
+
+// vec 按label的值区分的一组序列
+type vec struct {
+	mname  string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.RWMutex
+	series map[string]*series
+	newer  func() interface{}
+}
+
+type series struct {
+	values []string
+	v      interface{}
+}
+
+func newVec(name, help, typ string, labels []string, newer func() interface{}) *vec {
+	return &vec{
+		mname:  name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		series: make(map[string]*series),
+		newer:  newer,
+	}
+}
+
+func (v *vec) name() string { return v.mname }
+
+func (v *vec) get(values []string) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("[metrics] %s expects %d label values, got %d", v.mname, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	s, ok := v.series[key]
+	v.mu.RUnlock()
+	if ok {
+		return s.v
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok = v.series[key]; !ok {
+		s = &series{values: append([]string(nil), values...), v: v.newer()}
+		v.series[key] = s
+	}
+	return s.v
+}
+
+// sorted 按label的值排序，输出稳定
+func (v *vec) sorted() []*series {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ss := make([]*series, 0, len(keys))
+	for _, k := range keys {
+		ss = append(ss, v.series[k])
+	}
+	return ss
+}
+
+func (v *vec) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.mname, escapeHelp(v.help), v.mname, v.typ)
+}
+
+// value 可以原子加的float64
+type value struct {
+	bits uint64
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		n := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, n) {
+			return
+		}
+	}
+}
+
+func (v *value) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// CounterVec 只增不减的计数
+type CounterVec struct {
+	v *vec
+}
+
+// NewCounterVec 注册一个计数，labels是label的名字，可以没有
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, "counter", labels, func() interface{} { return new(value) })}
+	register(c)
+	return c
+}
+
+func (c *CounterVec) name() string { return c.v.mname }
+
+// Inc 加1，values按NewCounterVec时labels的顺序
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add 加delta，delta不能小于0
+func (c *CounterVec) Add(delta float64, values ...string) {
+	if delta < 0 {
+		return
+	}
+	c.v.get(values).(*value).add(delta)
+}
+
+// Value 当前的值，测试用
+func (c *CounterVec) Value(values ...string) float64 {
+	return c.v.get(values).(*value).get()
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.v.header(w)
+	for _, s := range c.v.sorted() {
+		writeSample(w, c.v.mname, c.v.labels, s.values, "", "", s.v.(*value).get())
+	}
+}
+
+// HistogramVec 数值的分布，一般用于耗时
+type HistogramVec struct {
+	v       *vec
+	buckets []float64
+}
+
+type histogram struct {
+	counts []uint64 // 每个bucket自己的计数，输出时再累加
+	count  uint64
+	sum    value
+}
+
+// NewHistogramVec 注册一个分布，buckets为空时用DefBuckets
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{buckets: buckets}
+	h.v = newVec(name, help, "histogram", labels, func() interface{} {
+		return &histogram{counts: make([]uint64, len(buckets))}
+	})
+	register(h)
+	return h
+}
+
+func (h *HistogramVec) name() string { return h.v.mname }
+
+// Observe 记录一个值
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	hg := h.v.get(values).(*histogram)
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		atomic.AddUint64(&hg.counts[i], 1)
+	}
+	atomic.AddUint64(&hg.count, 1)
+	hg.sum.add(v)
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.v.header(w)
+	for _, s := range h.v.sorted() {
+		hg := s.v.(*histogram)
+		var cum uint64
+		for i, le := range h.buckets {
+			cum += atomic.LoadUint64(&hg.counts[i])
+			writeSample(w, h.v.mname+"_bucket", h.v.labels, s.values, "le", formatFloat(le), float64(cum))
+		}
+		count := atomic.LoadUint64(&hg.count)
+		writeSample(w, h.v.mname+"_bucket", h.v.labels, s.values, "le", "+Inf", float64(count))
+		writeSample(w, h.v.mname+"_sum", h.v.labels, s.values, "", "", hg.sum.get())
+		writeSample(w, h.v.mname+"_count", h.v.labels, s.values, "", "", float64(count))
+	}
+}
+
+// GaugeFunc 抓取时调用fn取值，用于队列长度之类本来就有的数据
+type GaugeFunc struct {
+	mname string
+	help  string
+	typ   string // gauge或者counter
+	label string
+	fn    func() map[string]float64
+}
+
+// NewGaugeFunc 注册一个没有label的gauge
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	return NewGaugeVecFunc(name, help, "", func() map[string]float64 {
+		return map[string]float64{"": fn()}
+	})
+}
+
+// NewGaugeVecFunc 注册一个有一个label的gauge，fn返回label的值到gauge值的map
+func NewGaugeVecFunc(name, help, label string, fn func() map[string]float64) *GaugeFunc {
+	g := &GaugeFunc{mname: name, help: help, typ: "gauge", label: label, fn: fn}
+	register(g)
+	return g
+}
+
+// CounterFunc 抓取时调用fn取值的计数，用于别的包里面本来就有的只增不减的计数
+type CounterFunc struct {
+	*GaugeFunc
+}
+
+// NewCounterFunc 注册一个没有label的counter，fn的返回值不能减小
+func NewCounterFunc(name, help string, fn func() float64) *CounterFunc {
+	c := &CounterFunc{&GaugeFunc{mname: name, help: help, typ: "counter", fn: func() map[string]float64 {
+		return map[string]float64{"": fn()}
+	}}}
+	register(c)
+	return c
+}
+
+func (g *GaugeFunc) name() string { return g.mname }
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", g.mname, escapeHelp(g.help), g.mname, g.typ)
+	m := g.fn()
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if g.label == "" {
+			writeSample(w, g.mname, nil, nil, "", "", m[k])
+		} else {
+			writeSample(w, g.mname, []string{g.label}, []string{k}, "", "", m[k])
+		}
+	}
+}
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraLabel, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", l, escapeLabel(values[i]))
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraLabel, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+
+// runtimeStats 一次抓取只ReadMemStats一次
+type runtimeStats struct{}
+
+func (runtimeStats) name() string { return "go_" }
+
+func (runtimeStats) write(w *bufio.Writer) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	gauge := func(name, help string, v float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		writeSample(w, name, nil, nil, "", "", v)
+	}
+	gauge("go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	gauge("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", float64(ms.Alloc))
+	gauge("go_memstats_sys_bytes", "Number of bytes obtained from system.", float64(ms.Sys))
+	gauge("go_memstats_heap_objects", "Number of allocated objects.", float64(ms.HeapObjects))
+	fmt.Fprintf(w, "# HELP go_gc_count Number of completed GC cycles.\n# TYPE go_gc_count counter\n")
+	writeSample(w, "go_gc_count", nil, nil, "", "", float64(ms.NumGC))
+	fmt.Fprintf(w, "# HELP go_gc_pause_seconds_total Total GC pause time.\n# TYPE go_gc_pause_seconds_total counter\n")
+	writeSample(w, "go_gc_pause_seconds_total", nil, nil, "", "", float64(ms.PauseTotalNs)/1e9)
+}
+
+func init() {
+	register(runtimeStats{})
+}
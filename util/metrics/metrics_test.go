@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func exposition(t *testing.T) string {
+	var b bytes.Buffer
+	if err := WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func contains(t *testing.T, out string, lines ...string) {
+	for _, l := range lines {
+		if !strings.Contains(out, l+"\n") {
+			t.Errorf("missing %q in:\n%s", l, out)
+		}
+	}
+}
+
+func TestCounterVec(t *testing.T) {
+	c := NewCounterVec("test_counter_total", "A test counter.", "tier", "result")
+	c.Inc("local", "hit")
+	c.Inc("local", "hit")
+	c.Add(3, "remote", `mi"ss`)
+	c.Add(-1, "local", "hit")
+
+	if v := c.Value("local", "hit"); v != 2 {
+		t.Errorf("local hit = %v, want 2", v)
+	}
+	contains(t, exposition(t),
+		"# HELP test_counter_total A test counter.",
+		"# TYPE test_counter_total counter",
+		`test_counter_total{tier="local",result="hit"} 2`,
+		`test_counter_total{tier="remote",result="mi\"ss"} 3`)
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := NewHistogramVec("test_duration_seconds", "A test histogram.", []float64{1, 0.25}, "handler")
+	h.Observe(0.125, "a")
+	h.Observe(0.25, "a")
+	h.Observe(0.5, "a")
+	h.Observe(3, "a")
+
+	contains(t, exposition(t),
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{handler="a",le="0.25"} 2`,
+		`test_duration_seconds_bucket{handler="a",le="1"} 3`,
+		`test_duration_seconds_bucket{handler="a",le="+Inf"} 4`,
+		`test_duration_seconds_sum{handler="a"} 3.875`,
+		`test_duration_seconds_count{handler="a"} 4`)
+}
+
+func TestGaugeFunc(t *testing.T) {
+	NewGaugeFunc("test_gauge", "A test gauge.", func() float64 { return 7 })
+	NewGaugeVecFunc("test_queue_depth", "A test gauge vec.", "queue", func() map[string]float64 {
+		return map[string]float64{"b": 2, "a": 1}
+	})
+	out := exposition(t)
+	contains(t, out, "test_gauge 7", `test_queue_depth{queue="a"} 1`, `test_queue_depth{queue="b"} 2`, "# TYPE go_goroutines gauge")
+	if strings.Index(out, `queue="a"`) > strings.Index(out, `queue="b"`) {
+		t.Error("series should be sorted by label value")
+	}
+}
+
+func TestCounterFunc(t *testing.T) {
+	n := 3.0
+	NewCounterFunc("test_func_total", "A test counter func.", func() float64 { return n })
+	n++
+	contains(t, exposition(t), "# TYPE test_func_total counter", "test_func_total 4")
+}
+
+func TestDuplicate(t *testing.T) {
+	NewCounterVec("test_dup_total", "")
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a duplicate name should panic")
+		}
+	}()
+	NewCounterVec("test_dup_total", "")
+}
+
+func TestInstrument(t *testing.T) {
+	h := Instrument("TestHandler", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	for _, p := range []string{"/", "/bad", "/bad"} {
+		h(httptest.NewRecorder(), httptest.NewRequest("GET", p, nil))
+	}
+	if v := httpRequests.Value("TestHandler", "200"); v != 1 {
+		t.Errorf("200 = %v, want 1", v)
+	}
+	if v := httpRequests.Value("TestHandler", "400"); v != 2 {
+		t.Errorf("400 = %v, want 2", v)
+	}
+	contains(t, exposition(t), `http_request_duration_seconds_count{handler="TestHandler"} 3`)
+}
+
+func TestAllowOnly(t *testing.T) {
+	if _, err := AllowOnly(Handler(), "10.0.0.0/33"); err == nil {
+		t.Error("invalid cidr should fail")
+	}
+	h, err := AllowOnly(Handler(), "127.0.0.1, 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, code := range map[string]int{
+		"127.0.0.1:1234": http.StatusOK,
+		"10.1.2.3:80":    http.StatusOK,
+		"192.168.1.1:80": http.StatusForbidden,
+		"[::1]:80":       http.StatusForbidden,
+	} {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != code {
+			t.Errorf("%s got %d, want %d", addr, w.Code, code)
+		}
+	}
+}